@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"hdruk/federated-metadata/pkg/contenthash"
+	"hdruk/federated-metadata/pkg/deletion"
+	"hdruk/federated-metadata/pkg/outbox"
 	"hdruk/federated-metadata/pkg/pull"
 	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/testjob"
 	"hdruk/federated-metadata/pkg/utils"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -30,18 +37,92 @@ func main() {
 		slog.SetLogLoggerLevel(slog.LevelInfo)
 	}
 
+	openState()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	// Run the Push Service in it's own thread
 	go push.Run()
 
+	// Retry Gateway writes left in the outbox, including those from
+	// before a restart
+	go outbox.Default.Run(ctx)
+
 	// Spawn a Pull Service on a cron scheduler
 	scheduler := gocron.NewScheduler(time.UTC)
 	scheduler.SingletonModeAll()
 
 	// TODO - reinstate this once we have federations
 	// to begin running.
+	// Cycles aren't given ctx: on a signal the running federation is
+	// left to finish, and only cancelled by pull.Shutdown past the
+	// deadline
 	scheduler.Every(1).Minute().Do(func() {
-		pull.Run()
+		pull.Run(context.Background())
 	})
 
-	scheduler.StartBlocking()
+	scheduler.StartAsync()
+
+	<-ctx.Done()
+	shutdown(scheduler)
+}
+
+// openState Loads the stores kept on disk now the environment is read.
+// Without a path they are held in memory, so say so loudly: a restart
+// would lose every Gateway write still waiting to be delivered, every
+// content hash changes are detected against and every pending deletion
+func openState() {
+	outbox.Open()
+	contenthash.Open()
+	deletion.Open()
+
+	if outbox.Path() == "" {
+		customMsg := "neither GMI_STATE_DIR nor GMI_OUTBOX_PATH is set, so the outbox is held in memory and lost on restart"
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "CONFIG", "")
+	}
+	if contenthash.Path() == "" {
+		customMsg := "neither GMI_STATE_DIR nor GMI_CONTENT_HASH_PATH is set, so content hashes are held in memory and lost on restart"
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "CONFIG", "")
+	}
+	if deletion.Path() == "" {
+		customMsg := "neither GMI_STATE_DIR nor GMI_DELETIONS_PATH is set, so pending deletions are held in memory and counted again after a restart"
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "CONFIG", "")
+	}
+}
+
+// shutdown Stops the scheduler taking new pull cycles, then gives the
+// running cycle and in-flight push requests GMI_SHUTDOWN_TIMEOUT_SECONDS
+// to finish before the process exits
+func shutdown(scheduler *gocron.Scheduler) {
+	timeout := pull.ShutdownTimeout()
+	slog.Info("shutting down", "timeout", timeout.String())
+	utils.WriteGatewayAudit("shutting down", "SHUTDOWN", "")
+
+	// Stop waits for the running job, which pull.Shutdown bounds, so
+	// don't block on it here
+	pull.Drain()
+	go scheduler.Stop()
+	testjob.CancelAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan bool)
+	go func() {
+		done <- pull.Shutdown(ctx, 5*time.Second)
+	}()
+
+	if err := push.Shutdown(ctx); err != nil {
+		slog.Info("push service did not drain cleanly", "error", err.Error())
+	}
+
+	if !<-done {
+		slog.Info("pull cycle was still running at exit")
+		utils.WriteGatewayAudit("pull cycle was still running at exit", "SHUTDOWN", "")
+	}
+	slog.Info("shutdown complete")
 }
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// principalKey is the gin context key the authenticated caller is stored
+// under
+const principalKey = "gmi-principal"
+
+// Principal Defines the authenticated caller of a push API request
+type Principal struct {
+	Subject string
+	Service bool
+	Admin   bool
+	Teams   []int
+}
+
+// Claims Defines the claims we read from a Gateway-issued JWT
+type Claims struct {
+	jwt.RegisteredClaims
+	IsAdmin bool     `json:"is_admin"`
+	Roles   []string `json:"roles"`
+	Teams   []int    `json:"teams"`
+}
+
+// CanManageTeam Returns true if the principal is an admin or a member of
+// the given team
+func (p Principal) CanManageTeam(teamId int) bool {
+	if p.Admin {
+		return true
+	}
+
+	for _, t := range p.Teams {
+		if t == teamId {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDisabled Returns true when PUSH_API_AUTH_DISABLED is set. Only meant
+// for local development
+func IsDisabled() bool {
+	return os.Getenv("PUSH_API_AUTH_DISABLED") == "1"
+}
+
+// RequireAuth Returns middleware that rejects any request without a valid
+// service API key or Gateway-issued JWT, and stores the caller on the
+// context for handlers to authorise against
+func RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method_name := utils.MethodName(0)
+
+		if IsDisabled() {
+			c.Set(principalKey, Principal{Subject: "anonymous", Admin: true})
+			c.Next()
+			return
+		}
+
+		principal, err := authenticate(c.Request)
+		if err != nil {
+			slog.Debug(
+				fmt.Sprintf("rejected unauthenticated request: %s", err.Error()),
+				"x-request-session-id", c.GetHeader("x-request-session-id"),
+				"method_name", method_name,
+			)
+			utils.WriteGatewayAudit(fmt.Sprintf("rejected unauthenticated request to %s: %v", c.FullPath(), err), "RequireAuth", c.Request.Method)
+
+			c.AbortWithStatusJSON(http.StatusUnauthorized, utils.FormResponse(http.StatusUnauthorized,
+				false,
+				"unauthorised",
+				err.Error()))
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// GetPrincipal Returns the caller stored by RequireAuth
+func GetPrincipal(c *gin.Context) (Principal, bool) {
+	val, ok := c.Get(principalKey)
+	if !ok {
+		return Principal{}, false
+	}
+
+	principal, ok := val.(Principal)
+	return principal, ok
+}
+
+// AuthoriseTeam Aborts the request with a 403 unless the caller can manage
+// the given team. Returns false if the request was aborted
+func AuthoriseTeam(c *gin.Context, teamId int) bool {
+	principal, ok := GetPrincipal(c)
+	if ok && principal.CanManageTeam(teamId) {
+		return true
+	}
+
+	utils.WriteGatewayAudit(fmt.Sprintf("%s is not permitted to manage team %d", principal.Subject, teamId), "AuthoriseTeam", c.Request.Method)
+	c.AbortWithStatusJSON(http.StatusForbidden, utils.FormResponse(http.StatusForbidden,
+		false,
+		"forbidden",
+		fmt.Sprintf("not permitted to manage federations for team %d", teamId)))
+	return false
+}
+
+// AuthoriseAdmin Aborts the request with a 403 unless the caller is an
+// admin. Returns false if the request was aborted
+func AuthoriseAdmin(c *gin.Context) bool {
+	principal, ok := GetPrincipal(c)
+	if ok && principal.Admin {
+		return true
+	}
+
+	utils.WriteGatewayAudit(fmt.Sprintf("%s is not an admin", principal.Subject), "AuthoriseAdmin", c.Request.Method)
+	c.AbortWithStatusJSON(http.StatusForbidden, utils.FormResponse(http.StatusForbidden,
+		false,
+		"forbidden",
+		"admin access required"))
+	return false
+}
+
+// authenticate Resolves the caller from an x-api-key header or a bearer
+// token
+func authenticate(req *http.Request) (Principal, error) {
+	if key := req.Header.Get("x-api-key"); key != "" {
+		if validAPIKey(key) {
+			return Principal{Subject: "service", Service: true, Admin: true}, nil
+		}
+		return Principal{}, errors.New("invalid api key")
+	}
+
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return Principal{}, errors.New("missing credentials")
+	}
+
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || token == "" {
+		return Principal{}, errors.New("authorization header must be a bearer token")
+	}
+
+	claims, err := ParseToken(token)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{
+		Subject: claims.Subject,
+		Admin:   claims.IsAdmin || hasRole(claims.Roles, adminRole()),
+		Teams:   claims.Teams,
+	}, nil
+}
+
+// ParseToken Verifies a Gateway-issued JWT against JWT_SECRET (HMAC) or
+// the keys served at JWKS_URL, and checks JWT_ISSUER and JWT_AUDIENCE
+// when they are configured
+func ParseToken(token string) (*Claims, error) {
+	secret := os.Getenv("JWT_SECRET")
+	jwksUrl := os.Getenv("JWKS_URL")
+	if secret == "" && jwksUrl == "" {
+		return nil, errors.New("token verification is not configured")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if secret == "" {
+				return nil, errors.New("hmac signed tokens are not accepted")
+			}
+			return []byte(secret), nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS:
+			if jwksUrl == "" {
+				return nil, errors.New("asymmetric tokens are not accepted")
+			}
+			kid, _ := t.Header["kid"].(string)
+			return defaultKeySet.Key(jwksUrl, kid)
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	return claims, nil
+}
+
+func validAPIKey(key string) bool {
+	for _, candidate := range strings.Split(os.Getenv("PUSH_API_KEYS"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func adminRole() string {
+	if role := os.Getenv("JWT_ADMIN_ROLE"); role != "" {
+		return role
+	}
+	return "hdruk.superadmin"
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package conditional
+
+import (
+	"container/list"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxEntries   = 10000
+	defaultMaxBodyBytes = 200 << 20
+	defaultTTL          = 24 * time.Hour
+)
+
+// Validators Holds the ETag and Last-Modified a custodian sent with a
+// response. Body is kept for responses whose content we reuse when the
+// custodian answers 304 Not Modified
+type Validators struct {
+	ETag         string
+	LastModified string
+	Body         []byte
+}
+
+// Enabled Returns false when GMI_CONDITIONAL_REQUESTS turns conditional
+// requests off, for custodians whose validators can't be trusted
+func Enabled() bool {
+	value := os.Getenv("GMI_CONDITIONAL_REQUESTS")
+	return value != "0" && value != "false"
+}
+
+// FromResponse Returns the validators in a response's headers
+func FromResponse(res *http.Response) Validators {
+	return Validators{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+}
+
+// Empty Returns true when the custodian sent no validators
+func (v Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// Apply Makes req conditional on the validators. If-None-Match wins over
+// If-Modified-Since, but both are sent for custodians honouring only one
+func (v Validators) Apply(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// NotModified Returns true when a conditional request found the resource
+// unchanged
+func NotModified(res *http.Response) bool {
+	return res.StatusCode == http.StatusNotModified
+}
+
+// Limits Defines how much a Store holds. The least recently used
+// validators are evicted once either cap is reached, and any not used
+// within TTL are dropped
+type Limits struct {
+	Entries   int
+	BodyBytes int64
+	TTL       time.Duration
+}
+
+// LimitsFromEnv Returns the limits set by GMI_CONDITIONAL_MAX_ENTRIES
+// (default 10000), GMI_CONDITIONAL_MAX_BODY_BYTES (default 200MiB) and
+// GMI_CONDITIONAL_TTL_HOURS (default 24)
+func LimitsFromEnv() Limits {
+	limits := Limits{Entries: defaultMaxEntries, BodyBytes: defaultMaxBodyBytes, TTL: defaultTTL}
+
+	if entries, err := strconv.Atoi(os.Getenv("GMI_CONDITIONAL_MAX_ENTRIES")); err == nil && entries > 0 {
+		limits.Entries = entries
+	}
+	if bytes, err := strconv.ParseInt(os.Getenv("GMI_CONDITIONAL_MAX_BODY_BYTES"), 10, 64); err == nil && bytes > 0 {
+		limits.BodyBytes = bytes
+	}
+	if hours, err := strconv.Atoi(os.Getenv("GMI_CONDITIONAL_TTL_HOURS")); err == nil && hours > 0 {
+		limits.TTL = time.Duration(hours) * time.Hour
+	}
+	return limits
+}
+
+// record Holds a URL's validators in the recency list
+type record struct {
+	url        string
+	validators Validators
+	usedAt     time.Time
+}
+
+// Store Holds the validators last seen for each custodian URL, within
+// its limits
+type Store struct {
+	mu        sync.Mutex
+	limits    *Limits
+	records   map[string]*list.Element
+	recency   *list.List
+	bodyBytes int64
+}
+
+// NewStore Creates an empty Store with the limits LimitsFromEnv returns
+// when each record is stored
+func NewStore() *Store {
+	return &Store{records: map[string]*list.Element{}, recency: list.New()}
+}
+
+// NewLimitedStore Creates an empty Store with fixed limits
+func NewLimitedStore(limits Limits) *Store {
+	s := NewStore()
+	s.limits = &limits
+	return s
+}
+
+// Default The store pull cycles and targeted syncs record validators in.
+// It is held in memory, so after a restart every URL is fetched in full
+// once more
+var Default = NewStore()
+
+// Get Returns the validators recorded for a URL, if there are any that
+// haven't expired
+func (s *Store) Get(url string) (Validators, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.records[url]
+	if !ok {
+		return Validators{}, false
+	}
+
+	r := element.Value.(*record)
+	if time.Since(r.usedAt) > s.currentLimits().TTL {
+		s.remove(element)
+		return Validators{}, false
+	}
+
+	r.usedAt = time.Now()
+	s.recency.MoveToFront(element)
+	return r.validators, true
+}
+
+// Set Records the validators for a URL, evicting the least recently used
+// to stay within the limits. Empty validators are forgotten, as there's
+// nothing to send next time, as are bodies too large to keep at all
+func (s *Store) Set(url string, v Validators) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.records[url]; ok {
+		s.remove(element)
+	}
+
+	limits := s.currentLimits()
+	if v.Empty() || int64(len(v.Body)) > limits.BodyBytes {
+		return
+	}
+
+	s.records[url] = s.recency.PushFront(&record{url: url, validators: v, usedAt: time.Now()})
+	s.bodyBytes += int64(len(v.Body))
+
+	for s.recency.Len() > limits.Entries || s.bodyBytes > limits.BodyBytes {
+		s.remove(s.recency.Back())
+	}
+}
+
+// Forget Removes the validators for a URL
+func (s *Store) Forget(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.records[url]; ok {
+		s.remove(element)
+	}
+}
+
+// Len Returns how many URLs have validators recorded
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.recency.Len()
+}
+
+// currentLimits Returns the store's limits. Callers must hold mu
+func (s *Store) currentLimits() Limits {
+	if s.limits != nil {
+		return *s.limits
+	}
+	return LimitsFromEnv()
+}
+
+// remove Drops a record. Callers must hold mu
+func (s *Store) remove(element *list.Element) {
+	r := s.recency.Remove(element).(*record)
+	delete(s.records, r.url)
+	s.bodyBytes -= int64(len(r.validators.Body))
+}
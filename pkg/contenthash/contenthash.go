@@ -0,0 +1,166 @@
+package contenthash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hdruk/federated-metadata/pkg/journal"
+	"hdruk/federated-metadata/pkg/utils"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Hash Returns the SHA-256 of a JSON document in canonical form: object
+// keys sorted, insignificant whitespace removed and nothing HTML escaped.
+// The same content hashes the same whatever order a custodian sends it in
+func Hash(document []byte) (string, error) {
+	canonical, err := Canonical(document)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:])), nil
+}
+
+// Canonical Returns a JSON document in canonical form. Numbers are kept
+// exactly as written
+func Canonical(document []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("unable to decode document: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unable to decode document: unexpected data after the top level value")
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("unable to encode document: %v", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Store Holds the content hash last written to the gateway for each
+// dataset, keyed by team and persistentId
+type Store struct {
+	mu      sync.RWMutex
+	journal *journal.Journal
+	hashes  map[string]string
+}
+
+// NewStore Creates an empty Store held in memory
+func NewStore() *Store {
+	return &Store{hashes: map[string]string{}}
+}
+
+// OpenStore Creates a Store journaled to path, loading the hashes already
+// there. An empty path keeps the store in memory only
+func OpenStore(path string) (*Store, error) {
+	s := NewStore()
+
+	j, err := journal.Open(path, func(key string, value json.RawMessage) error {
+		var hash string
+		if err := json.Unmarshal(value, &hash); err != nil {
+			return err
+		}
+		s.hashes[key] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read content hashes: %v", err)
+	}
+	s.journal = j
+	return s, nil
+}
+
+// Path Returns the file content hashes are kept in, next to the outbox in
+// GMI_STATE_DIR. When unset they are only held in memory
+func Path() string {
+	if path := os.Getenv("GMI_CONTENT_HASH_PATH"); path != "" {
+		return path
+	}
+	return journal.Path("contenthash.log")
+}
+
+// Default The store pull cycles and targeted syncs record hashes in. Held
+// in memory until Open is called; without a path, the first hash seen for
+// each dataset after a restart becomes its baseline
+var Default = NewStore()
+
+// Open Replaces Default with the store kept in Path. Called once at
+// startup, after the environment is loaded. Hashes that can't be read are
+// left alone for an operator to recover, and the service carries on with
+// them held in memory
+func Open() {
+	s, err := OpenStore(Path())
+	if err != nil {
+		customMsg := fmt.Sprintf("%v, keeping content hashes in memory", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "ContentHash", "")
+		s = NewStore()
+	}
+	Default = s
+}
+
+// Get Returns the hash last recorded for a dataset, if there is one
+func (s *Store) Get(teamId int, pid string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash, ok := s.hashes[key(teamId, pid)]
+	return hash, ok
+}
+
+// Set Records the hash of a dataset's content
+func (s *Store) Set(teamId int, pid, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(teamId, pid)
+	if current, ok := s.hashes[k]; ok && current == hash {
+		return
+	}
+	s.hashes[k] = hash
+	s.saved(s.journal.Put(k, hash))
+}
+
+// Forget Removes a dataset's hash, once it's deleted from the gateway
+func (s *Store) Forget(teamId int, pid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(teamId, pid)
+	delete(s.hashes, k)
+	s.saved(s.journal.Delete(k))
+}
+
+// saved Reports a journal write that failed, and compacts the journal
+// once it has grown well past the hashes it holds. Callers hold s.mu
+func (s *Store) saved(err error) {
+	if err == nil && s.journal.NeedsCompaction() {
+		values := map[string]any{}
+		for k, hash := range s.hashes {
+			values[k] = hash
+		}
+		err = s.journal.Compact(values)
+	}
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to save content hashes: %v", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "ContentHash", "")
+	}
+}
+
+func key(teamId int, pid string) string {
+	return fmt.Sprintf("%d/%s", teamId, pid)
+}
@@ -0,0 +1,166 @@
+package pkg
+
+import "encoding/json"
+
+// The dataset model decodes custodian payloads that vary a lot in the
+// wild. Each type records unknown and present keys in its Extras field so
+// that re-encoding produces the same document the custodian sent, plus any
+// changes made through the typed fields.
+
+func (f *FederationDataset) UnmarshalJSON(data []byte) error {
+	type alias FederationDataset
+	return unmarshalKeepingExtras(data, (*alias)(f), &f.Extras)
+}
+
+func (f FederationDataset) MarshalJSON() ([]byte, error) {
+	type alias FederationDataset
+	return marshalKeepingExtras(alias(f), f.Extras)
+}
+
+func (r *Revisions) UnmarshalJSON(data []byte) error {
+	type alias Revisions
+	return unmarshalKeepingExtras(data, (*alias)(r), &r.Extras)
+}
+
+func (r Revisions) MarshalJSON() ([]byte, error) {
+	type alias Revisions
+	return marshalKeepingExtras(alias(r), r.Extras)
+}
+
+func (s *Summary) UnmarshalJSON(data []byte) error {
+	type alias Summary
+	return unmarshalKeepingExtras(data, (*alias)(s), &s.Extras)
+}
+
+func (s Summary) MarshalJSON() ([]byte, error) {
+	type alias Summary
+	return marshalKeepingExtras(alias(s), s.Extras)
+}
+
+func (p *Publisher) UnmarshalJSON(data []byte) error {
+	type alias Publisher
+	return unmarshalKeepingExtras(data, (*alias)(p), &p.Extras)
+}
+
+func (p Publisher) MarshalJSON() ([]byte, error) {
+	type alias Publisher
+	return marshalKeepingExtras(alias(p), p.Extras)
+}
+
+func (d *Documentation) UnmarshalJSON(data []byte) error {
+	type alias Documentation
+	return unmarshalKeepingExtras(data, (*alias)(d), &d.Extras)
+}
+
+func (d Documentation) MarshalJSON() ([]byte, error) {
+	type alias Documentation
+	return marshalKeepingExtras(alias(d), d.Extras)
+}
+
+func (c *Coverage) UnmarshalJSON(data []byte) error {
+	type alias Coverage
+	return unmarshalKeepingExtras(data, (*alias)(c), &c.Extras)
+}
+
+func (c Coverage) MarshalJSON() ([]byte, error) {
+	type alias Coverage
+	return marshalKeepingExtras(alias(c), c.Extras)
+}
+
+func (p *Provenance) UnmarshalJSON(data []byte) error {
+	type alias Provenance
+	return unmarshalKeepingExtras(data, (*alias)(p), &p.Extras)
+}
+
+func (p Provenance) MarshalJSON() ([]byte, error) {
+	type alias Provenance
+	return marshalKeepingExtras(alias(p), p.Extras)
+}
+
+func (t *Temporal) UnmarshalJSON(data []byte) error {
+	type alias Temporal
+	return unmarshalKeepingExtras(data, (*alias)(t), &t.Extras)
+}
+
+func (t Temporal) MarshalJSON() ([]byte, error) {
+	type alias Temporal
+	return marshalKeepingExtras(alias(t), t.Extras)
+}
+
+func (a *Accessibility) UnmarshalJSON(data []byte) error {
+	type alias Accessibility
+	return unmarshalKeepingExtras(data, (*alias)(a), &a.Extras)
+}
+
+func (a Accessibility) MarshalJSON() ([]byte, error) {
+	type alias Accessibility
+	return marshalKeepingExtras(alias(a), a.Extras)
+}
+
+func (a *Access) UnmarshalJSON(data []byte) error {
+	type alias Access
+	return unmarshalKeepingExtras(data, (*alias)(a), &a.Extras)
+}
+
+func (a Access) MarshalJSON() ([]byte, error) {
+	type alias Access
+	return marshalKeepingExtras(alias(a), a.Extras)
+}
+
+func (u *Usage) UnmarshalJSON(data []byte) error {
+	type alias Usage
+	return unmarshalKeepingExtras(data, (*alias)(u), &u.Extras)
+}
+
+func (u Usage) MarshalJSON() ([]byte, error) {
+	type alias Usage
+	return marshalKeepingExtras(alias(u), u.Extras)
+}
+
+func (f *FormatAndStandards) UnmarshalJSON(data []byte) error {
+	type alias FormatAndStandards
+	return unmarshalKeepingExtras(data, (*alias)(f), &f.Extras)
+}
+
+func (f FormatAndStandards) MarshalJSON() ([]byte, error) {
+	type alias FormatAndStandards
+	return marshalKeepingExtras(alias(f), f.Extras)
+}
+
+func (o *Observations) UnmarshalJSON(data []byte) error {
+	type alias Observations
+	return unmarshalKeepingExtras(data, (*alias)(o), &o.Extras)
+}
+
+func (o Observations) MarshalJSON() ([]byte, error) {
+	type alias Observations
+	return marshalKeepingExtras(alias(o), o.Extras)
+}
+
+func (s *StructuralMetadata) UnmarshalJSON(data []byte) error {
+	type alias StructuralMetadata
+	return unmarshalKeepingExtras(data, (*alias)(s), &s.Extras)
+}
+
+func (s StructuralMetadata) MarshalJSON() ([]byte, error) {
+	type alias StructuralMetadata
+	return marshalKeepingExtras(alias(s), s.Extras)
+}
+
+func (d *DataElement) UnmarshalJSON(data []byte) error {
+	type alias DataElement
+	return unmarshalKeepingExtras(data, (*alias)(d), &d.Extras)
+}
+
+func (d DataElement) MarshalJSON() ([]byte, error) {
+	type alias DataElement
+	return marshalKeepingExtras(alias(d), d.Extras)
+}
+
+// DecodeFederationDataset Decodes a custodian dataset document into the
+// typed model
+func DecodeFederationDataset(data []byte) (FederationDataset, error) {
+	var dataset FederationDataset
+	err := json.Unmarshal(data, &dataset)
+	return dataset, err
+}
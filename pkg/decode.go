@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Extras Holds the parts of a decoded JSON object that our typed model
+// doesn't know about, plus which known keys were actually present. It
+// lets custodian payloads round-trip through the typed model without
+// losing or inventing fields
+type Extras struct {
+	unknown map[string]json.RawMessage
+	present map[string]bool
+}
+
+// Unknown Returns the raw value of a key the typed model doesn't
+// declare, if the decoded document held one
+func (e Extras) Unknown(key string) (json.RawMessage, bool) {
+	raw, ok := e.unknown[key]
+	return raw, ok
+}
+
+// Present Returns true if key was present in the decoded document
+func (e Extras) Present(key string) bool {
+	return e.present[key] || e.unknown[key] != nil
+}
+
+// MultiString Holds a value custodians publish either as a single string
+// or as an array of strings. It remembers which form it was decoded from
+// so it's written back the same way
+type MultiString struct {
+	Values []string
+	Array  bool
+}
+
+// NewMultiString Creates a MultiString holding a single string value
+func NewMultiString(value string) MultiString {
+	return MultiString{Values: []string{value}}
+}
+
+// String Returns the values joined by a comma
+func (m MultiString) String() string {
+	return strings.Join(m.Values, ", ")
+}
+
+// IsEmpty Returns true if there are no non-blank values
+func (m MultiString) IsEmpty() bool {
+	for _, v := range m.Values {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalJSON Accepts null, a string, or an array of strings. Arrays
+// holding anything else are rejected rather than rewritten as strings
+func (m *MultiString) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+
+	switch {
+	case bytes.Equal(trimmed, []byte("null")):
+		*m = MultiString{}
+		return nil
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return err
+		}
+
+		values := make([]string, 0, len(raw))
+		for i, r := range raw {
+			var s string
+			if err := json.Unmarshal(r, &s); err != nil {
+				return fmt.Errorf("expected a string at index %d: %v", i, err)
+			}
+			values = append(values, s)
+		}
+		*m = MultiString{Values: values, Array: true}
+		return nil
+	default:
+		var s string
+		if err := json.Unmarshal(trimmed, &s); err != nil {
+			return fmt.Errorf("expected a string or an array of strings: %v", err)
+		}
+		*m = MultiString{Values: []string{s}}
+		return nil
+	}
+}
+
+// MarshalJSON Writes the value back in the form it was decoded from
+func (m MultiString) MarshalJSON() ([]byte, error) {
+	if m.Array {
+		if m.Values == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(m.Values)
+	}
+
+	if m.Values == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(m.String())
+}
+
+// unmarshalKeepingExtras Decodes data into v, a pointer to a struct with
+// no custom unmarshaller, and records unknown and present keys in extras
+func unmarshalKeepingExtras(data []byte, v interface{}, extras *Extras) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	known := jsonFieldNames(reflect.TypeOf(v).Elem())
+
+	extras.unknown = map[string]json.RawMessage{}
+	extras.present = map[string]bool{}
+	for key, val := range raw {
+		if _, ok := known[key]; ok {
+			extras.present[key] = true
+			continue
+		}
+		extras.unknown[key] = val
+	}
+
+	return nil
+}
+
+// marshalKeepingExtras Encodes v, a struct with no custom marshaller, then
+// drops zero-valued known keys that weren't in the original document and
+// restores the unknown keys recorded in extras
+func marshalKeepingExtras(v interface{}, extras Extras) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if extras.present == nil && len(extras.unknown) == 0 {
+		return data, nil
+	}
+
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+
+	rv := reflect.ValueOf(v)
+	for key, index := range jsonFieldNames(rv.Type()) {
+		if extras.present != nil && !extras.present[key] && rv.Field(index).IsZero() {
+			delete(out, key)
+		}
+	}
+
+	for key, val := range extras.unknown {
+		if _, ok := out[key]; !ok {
+			out[key] = val
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// jsonFieldNames Maps the json key of every encoded field in t to its
+// field index
+func jsonFieldNames(t reflect.Type) map[string]int {
+	names := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = i
+	}
+	return names
+}
@@ -0,0 +1,243 @@
+package deletion
+
+import (
+	"encoding/json"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/journal"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRuns is how many consecutive runs a dataset must be missing for
+// when neither the federation nor GMI_DELETE_AFTER_RUNS say
+const defaultRuns = 3
+
+// Pending Defines a dataset missing from its federation's list, waiting
+// to be deleted from a team
+type Pending struct {
+	FederationID int       `json:"federation_id"`
+	TeamID       int       `json:"team_id"`
+	PersistentID string    `json:"persistent_id"`
+	MissingRuns  int       `json:"missing_runs"`
+	FirstMissing time.Time `json:"first_missing_at"`
+	LastMissing  time.Time `json:"last_missing_at"`
+}
+
+// Policy Defines how long a dataset must be missing before it's deleted.
+// Both must have passed; a zero Window doesn't apply
+type Policy struct {
+	Runs   int
+	Window time.Duration
+}
+
+// PolicyFor Returns the federation's deletion policy, falling back to
+// GMI_DELETE_AFTER_RUNS (default 3) and GMI_DELETE_AFTER_HOURS (default
+// 0) for what it doesn't set
+func PolicyFor(fed *pkg.Federation) Policy {
+	runs := fed.DeleteAfterRuns
+	if runs <= 0 {
+		runs, _ = strconv.Atoi(os.Getenv("GMI_DELETE_AFTER_RUNS"))
+	}
+	if runs <= 0 {
+		runs = defaultRuns
+	}
+
+	hours := fed.DeleteAfterHours
+	if hours <= 0 {
+		hours, _ = strconv.Atoi(os.Getenv("GMI_DELETE_AFTER_HOURS"))
+	}
+	if hours < 0 {
+		hours = 0
+	}
+
+	return Policy{Runs: runs, Window: time.Duration(hours) * time.Hour}
+}
+
+// Due Returns true once a pending deletion has waited long enough
+func (p Policy) Due(pending Pending) bool {
+	return pending.MissingRuns >= p.Runs && pending.LastMissing.Sub(pending.FirstMissing) >= p.Window
+}
+
+// Describe Returns how far a pending deletion is through the policy, for
+// run reports
+func (p Policy) Describe(pending Pending) string {
+	message := fmt.Sprintf("missing for %d of %d runs", pending.MissingRuns, p.Runs)
+	if p.Window > 0 {
+		message = fmt.Sprintf("%s, since %s, deleted after %s", message, pending.FirstMissing.Format(time.RFC3339), p.Window)
+	}
+	return message
+}
+
+// Store Holds the pending deletions for every federation, keyed by
+// federation, team and persistentId
+type Store struct {
+	mu      sync.Mutex
+	journal *journal.Journal
+	pending map[string]*Pending
+}
+
+// NewStore Creates an empty Store held in memory
+func NewStore() *Store {
+	return &Store{pending: map[string]*Pending{}}
+}
+
+// OpenStore Creates a Store journaled to path, loading the pending
+// deletions already there with the counts and times they had. An empty
+// path keeps the store in memory only
+func OpenStore(path string) (*Store, error) {
+	s := NewStore()
+
+	j, err := journal.Open(path, func(k string, value json.RawMessage) error {
+		pending := &Pending{}
+		if err := json.Unmarshal(value, pending); err != nil {
+			return err
+		}
+		s.pending[k] = pending
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pending deletions: %v", err)
+	}
+	s.journal = j
+	return s, nil
+}
+
+// Path Returns the file pending deletions are kept in, next to the outbox
+// in GMI_STATE_DIR. When unset they are only held in memory
+func Path() string {
+	if path := os.Getenv("GMI_DELETIONS_PATH"); path != "" {
+		return path
+	}
+	return journal.Path("deletions.log")
+}
+
+// Default The store pull cycles track missing datasets in. Held in memory
+// until Open is called; without a path a restart starts every count and
+// window again, delaying rather than hastening deletions
+var Default = NewStore()
+
+// Open Replaces Default with the store kept in Path. Called once at
+// startup, after the environment is loaded. Pending deletions that can't
+// be read are left alone for an operator to recover, and the service
+// carries on with them held in memory
+func Open() {
+	s, err := OpenStore(Path())
+	if err != nil {
+		customMsg := fmt.Sprintf("%v, keeping pending deletions in memory", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "Deletion", "")
+		s = NewStore()
+	}
+	Default = s
+}
+
+// Miss Records that a team's dataset was missing from a run at now, and
+// returns its pending deletion
+func (s *Store) Miss(federationId, teamId int, pid string, now time.Time) Pending {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(federationId, teamId, pid)
+	pending, ok := s.pending[k]
+	if !ok {
+		pending = &Pending{
+			FederationID: federationId,
+			TeamID:       teamId,
+			PersistentID: pid,
+			FirstMissing: now,
+		}
+		s.pending[k] = pending
+	}
+	pending.MissingRuns++
+	pending.LastMissing = now
+	s.saved(s.journal.Put(k, pending))
+	return *pending
+}
+
+// Cancel Removes the pending deletions of pid from every team in the
+// federation, once it's listed again. Returns those removed
+func (s *Store) Cancel(federationId int, pid string) []Pending {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancelled := []Pending{}
+	for k, pending := range s.pending {
+		if pending.FederationID == federationId && pending.PersistentID == pid {
+			cancelled = append(cancelled, *pending)
+			delete(s.pending, k)
+			s.saved(s.journal.Delete(k))
+		}
+	}
+	return cancelled
+}
+
+// Forget Removes a single pending deletion, once it's carried out
+func (s *Store) Forget(federationId, teamId int, pid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(federationId, teamId, pid)
+	delete(s.pending, k)
+	s.saved(s.journal.Delete(k))
+}
+
+// Retain Removes the federation's pending deletions keep returns false
+// for, such as datasets the gateway no longer holds
+func (s *Store) Retain(federationId int, keep func(Pending) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, pending := range s.pending {
+		if pending.FederationID == federationId && !keep(*pending) {
+			delete(s.pending, k)
+			s.saved(s.journal.Delete(k))
+		}
+	}
+}
+
+// List Returns a federation's pending deletions, longest missing first
+func (s *Store) List(federationId int) []Pending {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := []Pending{}
+	for _, pending := range s.pending {
+		if pending.FederationID == federationId {
+			found = append(found, *pending)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].FirstMissing.Equal(found[j].FirstMissing) {
+			return found[i].FirstMissing.Before(found[j].FirstMissing)
+		}
+		return key(0, found[i].TeamID, found[i].PersistentID) < key(0, found[j].TeamID, found[j].PersistentID)
+	})
+	return found
+}
+
+// saved Reports a journal write that failed, and compacts the journal
+// once it has grown well past the deletions it holds. Callers hold s.mu
+func (s *Store) saved(err error) {
+	if err == nil && s.journal.NeedsCompaction() {
+		values := map[string]any{}
+		for k, pending := range s.pending {
+			values[k] = pending
+		}
+		err = s.journal.Compact(values)
+	}
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to save pending deletions: %v", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "Deletion", "")
+	}
+}
+
+func key(federationId, teamId int, pid string) string {
+	return fmt.Sprintf("%d/%d/%s", federationId, teamId, pid)
+}
@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrUnavailable Gateway API couldn't be reached or failed with a
+	// server error
+	ErrUnavailable = errors.New("gateway api unavailable")
+	// ErrUnauthorised The service user couldn't log in, or isn't allowed
+	// to make the call
+	ErrUnauthorised = errors.New("gateway api refused our credentials")
+	// ErrNotFound The resource doesn't exist
+	ErrNotFound = errors.New("gateway api resource not found")
+	// ErrConflict The write clashes with something already in the gateway
+	ErrConflict = errors.New("gateway api reported a conflict")
+	// ErrRejected Any other client error, usually a payload the gateway
+	// won't accept
+	ErrRejected = errors.New("gateway api rejected the request")
+	// ErrInvalidResponse The gateway answered with a body we can't decode
+	ErrInvalidResponse = errors.New("gateway api returned an invalid response")
+)
+
+// Error Defines a failed call to Gateway API. Use errors.Is with the
+// Err* values above to act on the kind of failure
+type Error struct {
+	Method     string
+	Endpoint   string
+	StatusCode int    // 0 when no response was received
+	Message    string // the start of the response body
+	Err        error  // the transport or decoding error, if any
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.StatusCode == 0:
+		return fmt.Sprintf("gateway api %s %s failed: %v", e.Method, e.Endpoint, e.Err)
+	case e.Err != nil:
+		return fmt.Sprintf("gateway api %s %s returned %d: %v", e.Method, e.Endpoint, e.StatusCode, e.Err)
+	case e.Message != "":
+		return fmt.Sprintf("gateway api %s %s returned %d: %s", e.Method, e.Endpoint, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("gateway api %s %s returned %d", e.Method, e.Endpoint, e.StatusCode)
+}
+
+// Unwrap Returns the underlying transport or decoding error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is Matches the Err* value for this error's status code
+func (e *Error) Is(target error) bool {
+	if errors.Is(e.Err, ErrInvalidResponse) {
+		return target == ErrInvalidResponse
+	}
+	return target == statusError(e.StatusCode)
+}
+
+// statusError Maps a response status to the Err* value it represents.
+// Returns nil for successful responses
+func statusError(status int) error {
+	switch {
+	case status == 0 || status >= http.StatusInternalServerError:
+		return ErrUnavailable
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrUnauthorised
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusConflict:
+		return ErrConflict
+	case status >= http.StatusBadRequest:
+		return ErrRejected
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Fake Implements API in memory for tests. Seed Federations and Datasets,
+// set Errors to make calls fail, then inspect what was written
+type Fake struct {
+	mu sync.Mutex
+
+	Federations []pkg.Federation
+	// Datasets holds the GMI datasets for each team, keyed by team id
+	// then persistentId
+	Datasets map[int]pkg.DatasetsVersions
+	// Errors makes the named API method, e.g. "CreateDataset", fail. Every
+	// method fails once its context is done, as the live client would
+	Errors map[string]error
+
+	Disabled []int
+	Created  []DatasetRequest
+	Updated  []DatasetRequest
+	Deleted  []string
+}
+
+// NewFake Creates an empty Fake
+func NewFake() *Fake {
+	return &Fake{
+		Datasets: map[int]pkg.DatasetsVersions{},
+		Errors:   map[string]error{},
+	}
+}
+
+// ListFederations Returns the seeded federations
+func (f *Fake) ListFederations(ctx context.Context, sessionId string) ([]pkg.Federation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "ListFederations"); err != nil {
+		return []pkg.Federation{}, err
+	}
+	return append([]pkg.Federation{}, f.Federations...), nil
+}
+
+// Ping Fails only when Errors says so
+func (f *Fake) Ping(ctx context.Context, sessionId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fail(ctx, "Ping")
+}
+
+// DisableFederation Records the federation as disabled
+func (f *Fake) DisableFederation(ctx context.Context, federationId int, sessionId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "DisableFederation"); err != nil {
+		return err
+	}
+	f.Disabled = append(f.Disabled, federationId)
+	return nil
+}
+
+// GetDataset Returns the seeded dataset with the given persistentId
+func (f *Fake) GetDataset(ctx context.Context, pid string, sessionId string) (pkg.Dataset, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "GetDataset"); err != nil {
+		return pkg.Dataset{}, err
+	}
+	for _, datasets := range f.Datasets {
+		if versions, ok := datasets[pid]; ok {
+			dataset := pkg.Dataset{Pid: pid}
+			if n := len(versions.Versions); n > 0 {
+				dataset.Version = versions.Versions[n-1]
+			}
+			return dataset, nil
+		}
+	}
+	return pkg.Dataset{}, &Error{Method: http.MethodGet, Endpoint: "datasets", StatusCode: http.StatusNotFound}
+}
+
+// ListTeamDatasets Returns the seeded datasets for a team
+func (f *Fake) ListTeamDatasets(ctx context.Context, teamId int, sessionId string) (pkg.DatasetsVersions, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "ListTeamDatasets"); err != nil {
+		return pkg.DatasetsVersions{}, err
+	}
+	found := pkg.DatasetsVersions{}
+	for pid, versions := range f.Datasets[teamId] {
+		found[pid] = versions
+	}
+	return found, nil
+}
+
+// CreateDataset Records the dataset and adds it to the team
+func (f *Fake) CreateDataset(ctx context.Context, req DatasetRequest, sessionId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "CreateDataset"); err != nil {
+		return err
+	}
+	f.Created = append(f.Created, req)
+	f.store(req)
+	return nil
+}
+
+// UpdateDataset Records the new version and adds it to the team
+func (f *Fake) UpdateDataset(ctx context.Context, req DatasetRequest, sessionId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "UpdateDataset"); err != nil {
+		return err
+	}
+	f.Updated = append(f.Updated, req)
+	f.store(req)
+	return nil
+}
+
+// DeleteDataset Records the deletion and removes it from the team
+func (f *Fake) DeleteDataset(ctx context.Context, teamId int, pid string, sessionId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(ctx, "DeleteDataset"); err != nil {
+		return err
+	}
+	f.Deleted = append(f.Deleted, pid)
+	delete(f.Datasets[teamId], pid)
+	return nil
+}
+
+// store Adds the stored dataset's version to its team. The version is
+// read from the metadata when it holds one
+func (f *Fake) store(req DatasetRequest) {
+	teamId, _ := strconv.Atoi(req.TeamID)
+
+	dataset, err := pkg.DecodeFederationDataset([]byte(req.Metadata))
+	version := ""
+	if err == nil {
+		version = dataset.Version
+	}
+
+	if f.Datasets[teamId] == nil {
+		f.Datasets[teamId] = pkg.DatasetsVersions{}
+	}
+	versions := f.Datasets[teamId][req.PersistentID]
+	versions.Versions = append(versions.Versions, version)
+	f.Datasets[teamId][req.PersistentID] = versions
+}
+
+// fail Returns the error a call should fail with, if any
+func (f *Fake) fail(ctx context.Context, method string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.Errors[method]
+}
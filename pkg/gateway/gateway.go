@@ -0,0 +1,434 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// maxErrorMessage is how much of an error response body we keep
+const maxErrorMessage = 512
+
+// HTTPClient Defines an HTTPClient object
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// API Defines every call we make to Gateway API. Client calls the live
+// API, Fake keeps everything in memory for tests
+type API interface {
+	// ListFederations Returns every active federation
+	ListFederations(ctx context.Context, sessionId string) ([]pkg.Federation, error)
+	// DisableFederation Marks a federation as disabled and untested
+	DisableFederation(ctx context.Context, federationId int, sessionId string) error
+	// GetDataset Returns a dataset by its persistentId
+	GetDataset(ctx context.Context, pid string, sessionId string) (pkg.Dataset, error)
+	// ListTeamDatasets Returns the versions of every dataset GMI created
+	// for a team
+	ListTeamDatasets(ctx context.Context, teamId int, sessionId string) (pkg.DatasetsVersions, error)
+	// CreateDataset Stores a new dataset for a team
+	CreateDataset(ctx context.Context, req DatasetRequest, sessionId string) error
+	// UpdateDataset Stores a new version of a dataset we created before
+	UpdateDataset(ctx context.Context, req DatasetRequest, sessionId string) error
+	// DeleteDataset Deletes a dataset GMI created for a team
+	DeleteDataset(ctx context.Context, teamId int, pid string, sessionId string) error
+	// Ping Returns nil when the API is serving requests
+	Ping(ctx context.Context, sessionId string) error
+}
+
+// DatasetRequest Defines the body sent to store a dataset. Gateway API
+// expects the ids as strings and the metadata JSON encoded
+type DatasetRequest struct {
+	TeamID       string `json:"team_id"`
+	UserID       string `json:"user_id"`
+	Metadata     string `json:"metadata"`
+	CreateOrigin string `json:"create_origin"`
+	Status       string `json:"status"`
+	PersistentID string `json:"pid"`
+}
+
+// NewDatasetRequest Creates the request storing metadata as pid for a
+// team, on behalf of GATEWAY_API_USER_ID
+func NewDatasetRequest(teamId int, pid string, metadata string) DatasetRequest {
+	return DatasetRequest{
+		TeamID:       strconv.Itoa(teamId),
+		UserID:       os.Getenv("GATEWAY_API_USER_ID"),
+		Metadata:     metadata,
+		CreateOrigin: "GMI",
+		Status:       "ACTIVE",
+		PersistentID: pid,
+	}
+}
+
+// disableRequest Defines the body sent to disable a federation
+type disableRequest struct {
+	Enabled int `json:"enabled"`
+	Tested  int `json:"tested"`
+}
+
+// deleteRequest Defines the body sent to delete a dataset
+type deleteRequest struct {
+	TeamID int `json:"team_id"`
+}
+
+// loginRequest Defines the body sent to log the service user in
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// loginResponse Defines the response to a service user login
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// Client Calls Gateway API. Empty fields fall back to GATEWAY_API_URL,
+// GATEWAY_API_AUTH_URL, SERVICE_EMAIL and SERVICE_PASSWORD, read on every
+// call. Writes are made as the service user, whose token is kept until
+// the gateway refuses it
+type Client struct {
+	BaseURL  string
+	AuthURL  string
+	Email    string
+	Password string
+	HTTP     HTTPClient
+
+	mu    sync.Mutex
+	token string
+}
+
+// Default The client used to reach Gateway API
+var Default API
+
+func init() {
+	_ = godotenv.Load()
+
+	timeoutSeconds, err := strconv.Atoi(os.Getenv("GMI_DEFAULT_TIMEOUT_SECONDS"))
+	if err != nil {
+		timeoutSeconds = 10
+	}
+
+	Default = &Client{
+		HTTP: &http.Client{Timeout: time.Duration(timeoutSeconds) * time.Second},
+	}
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey Returns a context whose writes are sent with key in
+// an Idempotency-Key header, so the gateway can recognise a retried write
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// FindFederation Returns the active federation with the given id. ok is
+// false when there is no such federation
+func FindFederation(ctx context.Context, api API, id int, sessionId string) (fed pkg.Federation, ok bool, err error) {
+	feds, err := api.ListFederations(ctx, sessionId)
+	if err != nil {
+		return pkg.Federation{}, false, err
+	}
+
+	for _, fed := range feds {
+		if fed.ID == id {
+			return fed, true, nil
+		}
+	}
+	return pkg.Federation{}, false, nil
+}
+
+// ListFederations Returns every active federation
+func (c *Client) ListFederations(ctx context.Context, sessionId string) ([]pkg.Federation, error) {
+	feds := []pkg.Federation{}
+	err := c.do(ctx, http.MethodGet, "federations", nil, false, sessionId, &feds)
+	return feds, err
+}
+
+// DisableFederation Marks a federation as disabled and untested, so the
+// team can see something is wrong before testing again
+func (c *Client) DisableFederation(ctx context.Context, federationId int, sessionId string) error {
+	return c.do(ctx, http.MethodPatch, fmt.Sprintf("federations/%d", federationId), disableRequest{}, false, sessionId, nil)
+}
+
+// GetDataset Returns a dataset by its persistentId
+func (c *Client) GetDataset(ctx context.Context, pid string, sessionId string) (pkg.Dataset, error) {
+	var dataset pkg.Dataset
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("datasets/%s", url.PathEscape(pid)), nil, false, sessionId, &dataset)
+	return dataset, err
+}
+
+// ListTeamDatasets Returns the versions of every dataset GMI created for
+// a team, keyed by persistentId
+func (c *Client) ListTeamDatasets(ctx context.Context, teamId int, sessionId string) (pkg.DatasetsVersions, error) {
+	query := url.Values{}
+	query.Set("team_id", strconv.Itoa(teamId))
+	query.Set("create_origin", "GMI")
+	query.Set("onlyDatasets", "true")
+
+	// Gateway API answers with an empty list, rather than an empty
+	// object, when the team has no GMI datasets
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "datasets?"+query.Encode(), nil, false, sessionId, &raw); err != nil {
+		return pkg.DatasetsVersions{}, err
+	}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("[]")) || bytes.Equal(trimmed, []byte("null")) {
+		return pkg.DatasetsVersions{}, nil
+	}
+
+	versions := pkg.DatasetsVersions{}
+	if err := json.Unmarshal(raw, &versions); err != nil {
+		return pkg.DatasetsVersions{}, &Error{
+			Method:     http.MethodGet,
+			Endpoint:   "datasets",
+			StatusCode: http.StatusOK,
+			Err:        fmt.Errorf("%w: %v", ErrInvalidResponse, err),
+		}
+	}
+	return versions, nil
+}
+
+// CreateDataset Stores a new dataset for a team
+func (c *Client) CreateDataset(ctx context.Context, req DatasetRequest, sessionId string) error {
+	return c.do(ctx, http.MethodPost, "federations", req, true, sessionId, nil)
+}
+
+// UpdateDataset Stores a new version of a dataset we created before
+func (c *Client) UpdateDataset(ctx context.Context, req DatasetRequest, sessionId string) error {
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("federations/update/%s", url.PathEscape(req.PersistentID)), req, true, sessionId, nil)
+}
+
+// DeleteDataset Deletes a dataset GMI created for a team
+func (c *Client) DeleteDataset(ctx context.Context, teamId int, pid string, sessionId string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("federations/delete/%s", url.PathEscape(pid)), deleteRequest{TeamID: teamId}, true, sessionId, nil)
+}
+
+// Ping Returns nil when the API is serving requests. Any response short
+// of a server error counts, as readiness doesn't need the service user
+func (c *Client) Ping(ctx context.Context, sessionId string) error {
+	if c.baseURL() == "" {
+		return &Error{Method: http.MethodGet, Endpoint: "federations", Err: errors.New("GATEWAY_API_URL is not set")}
+	}
+
+	err := c.send(ctx, http.MethodGet, "federations", nil, false, sessionId, nil)
+	var gatewayErr *Error
+	if errors.As(err, &gatewayErr) && gatewayErr.StatusCode != 0 && gatewayErr.StatusCode < http.StatusInternalServerError {
+		return nil
+	}
+	return err
+}
+
+// do Sends a request to endpoint, below the base url, and decodes a
+// successful response into out when it isn't nil. authed calls are made
+// as the service user, logging in again once if the gateway refuses the
+// token we hold
+func (c *Client) do(ctx context.Context, method, endpoint string, body any, authed bool, sessionId string, out any) error {
+	method_name := utils.MethodName(1)
+
+	err := c.send(ctx, method, endpoint, body, authed, sessionId, out)
+	if authed && isStatus(err, http.StatusUnauthorized) {
+		c.clearToken()
+		err = c.send(ctx, method, endpoint, body, authed, sessionId, out)
+	}
+
+	if err != nil {
+		slog.Debug(
+			err.Error(),
+			"x-request-session-id", sessionId,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, err.Error(), "GatewayAPI", method)
+	}
+	return err
+}
+
+// send Makes a single attempt at a call
+func (c *Client) send(ctx context.Context, method, endpoint string, body any, authed bool, sessionId string, out any) error {
+	base := c.baseURL()
+	target := fmt.Sprintf("%s/%s", base, endpoint)
+	path := strings.SplitN(endpoint, "?", 2)[0]
+
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return &Error{Method: method, Endpoint: path, Err: err}
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, payload)
+	if err != nil {
+		return &Error{Method: method, Endpoint: path, Err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("x-request-session-id", sessionId)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key, ok := ctx.Value(idempotencyKey{}).(string); ok && key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	if authed {
+		token, err := c.serviceToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		c.observe(method, base, target, 0, err)
+		return &Error{Method: method, Endpoint: path, Err: err}
+	}
+	defer res.Body.Close()
+
+	responseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.observe(method, base, target, res.StatusCode, err)
+		return &Error{Method: method, Endpoint: path, StatusCode: res.StatusCode, Err: err}
+	}
+
+	if !utils.IsSuccessfulStatusCode(res.StatusCode) {
+		c.observe(method, base, target, res.StatusCode, nil)
+		return &Error{Method: method, Endpoint: path, StatusCode: res.StatusCode, Message: excerpt(responseBody)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(responseBody, out); err != nil {
+		return &Error{
+			Method:     method,
+			Endpoint:   path,
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("%w: %v", ErrInvalidResponse, err),
+		}
+	}
+	return nil
+}
+
+// serviceToken Returns the service user's token, logging in when we
+// don't hold one
+func (c *Client) serviceToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	authURL := c.AuthURL
+	if authURL == "" {
+		authURL = os.Getenv("GATEWAY_API_AUTH_URL")
+	}
+	credentials := loginRequest{Email: c.Email, Password: c.Password}
+	if credentials.Email == "" {
+		credentials.Email = os.Getenv("SERVICE_EMAIL")
+	}
+	if credentials.Password == "" {
+		credentials.Password = os.Getenv("SERVICE_PASSWORD")
+	}
+	if authURL == "" || credentials.Email == "" || credentials.Password == "" {
+		return "", &Error{
+			Method:     http.MethodPost,
+			Endpoint:   "login",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "GATEWAY_API_AUTH_URL, SERVICE_EMAIL and SERVICE_PASSWORD must be set",
+		}
+	}
+
+	encoded, _ := json.Marshal(credentials)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, authURL, bytes.NewReader(encoded))
+	if err != nil {
+		return "", &Error{Method: http.MethodPost, Endpoint: "login", Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", &Error{Method: http.MethodPost, Endpoint: "login", Err: err}
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", &Error{Method: http.MethodPost, Endpoint: "login", StatusCode: res.StatusCode, Message: excerpt(body)}
+	}
+
+	var login loginResponse
+	if err := json.Unmarshal(body, &login); err != nil || login.AccessToken == "" {
+		return "", &Error{
+			Method:     http.MethodPost,
+			Endpoint:   "login",
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("%w: token not found in login response", ErrInvalidResponse),
+		}
+	}
+
+	c.token = login.AccessToken
+	return c.token, nil
+}
+
+// clearToken Forgets the service user's token, so the next call logs in
+func (c *Client) clearToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+func (c *Client) baseURL() string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return os.Getenv("GATEWAY_API_URL")
+}
+
+func (c *Client) httpClient() HTTPClient {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// observe Counts a failed call
+func (c *Client) observe(method, base, target string, code int, err error) {
+	metrics.GatewayAPIErrors.WithLabelValues(
+		method,
+		metrics.GatewayEndpoint(base, target),
+		metrics.StatusLabel(code, err),
+	).Inc()
+}
+
+// isStatus Returns true when err is a Gateway API error with the given
+// status code
+func isStatus(err error, status int) bool {
+	gatewayErr, ok := err.(*Error)
+	return ok && gatewayErr.StatusCode == status
+}
+
+// excerpt Returns the start of a response body for error messages
+func excerpt(body []byte) string {
+	message := strings.TrimSpace(string(body))
+	if len(message) > maxErrorMessage {
+		message = message[:maxErrorMessage] + "..."
+	}
+	return message
+}
@@ -0,0 +1,195 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/validator"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	StatusUp      = "UP"
+	StatusDown    = "DOWN"
+	StatusSkipped = "SKIPPED"
+)
+
+// Version Is the build version, set at build time with
+// -ldflags "-X hdruk/federated-metadata/pkg/health.Version=..."
+var Version = "dev"
+
+// errSkipped Is returned by checks for dependencies that aren't
+// configured, and so can't affect readiness
+var errSkipped = errors.New("not configured")
+
+// Check Defines a single dependency checked for readiness
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// DependencyStatus Defines the outcome of checking a single dependency
+type DependencyStatus struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Checks The dependencies /readyz checks
+var Checks = DefaultChecks()
+
+// DefaultChecks Returns checks for the Gateway API, Secret Manager,
+// Pub/Sub (when audit logging is enabled) and the list schema url
+func DefaultChecks() []Check {
+	return []Check{
+		{Name: "gateway-api", Check: checkGatewayAPI},
+		{Name: "secret-manager", Check: checkSecretManager},
+		{Name: "pubsub", Check: checkPubSub},
+		{Name: "schema-url", Check: checkSchemaUrl},
+	}
+}
+
+// Timeout Returns how long each dependency has to respond, from
+// GMI_READINESS_TIMEOUT_SECONDS. Defaults to 3 seconds
+func Timeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("GMI_READINESS_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 3
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Ready Runs every check concurrently, each bounded by Timeout, and
+// returns true only if none of them are down
+func Ready(ctx context.Context, checks []Check) (bool, []DependencyStatus) {
+	statuses := make([]DependencyStatus, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			statuses[i] = run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, status := range statuses {
+		if status.Status == StatusDown {
+			ready = false
+		}
+	}
+	return ready, statuses
+}
+
+func run(ctx context.Context, check Check) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, Timeout())
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() { errs <- check.Check(ctx) }()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", Timeout())
+	}
+
+	status := DependencyStatus{
+		Name:      check.Name,
+		Status:    StatusUp,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+
+	switch {
+	case errors.Is(err, errSkipped):
+		status.Status = StatusSkipped
+		status.Error = err.Error()
+	case err != nil:
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func checkGatewayAPI(ctx context.Context) error {
+	return gateway.Default.Ping(ctx, "")
+}
+
+func checkSchemaUrl(ctx context.Context) error {
+	return checkUrl(ctx, validator.ListSchemaUrl(), func(status int) bool {
+		return status >= 200 && status < 300
+	})
+}
+
+func checkUrl(ctx context.Context, url string, ok func(status int) bool) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if !ok(res.StatusCode) {
+		return fmt.Errorf("%s returned HTTP %d", url, res.StatusCode)
+	}
+	return nil
+}
+
+func checkSecretManager(ctx context.Context) error {
+	parent := os.Getenv("GOOGLE_APPLICATION_PROJECT_PATH")
+	if parent == "" {
+		return errSkipped
+	}
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	it := client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: parent, PageSize: 1})
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return err
+	}
+	return nil
+}
+
+func checkPubSub(ctx context.Context) error {
+	if os.Getenv("AUDIT_LOG_ENABLED") != "1" {
+		return errSkipped
+	}
+
+	client, err := pubsub.NewClient(ctx, os.Getenv("PUBSUB_PROJECT_ID"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	exists, err := client.Topic(os.Getenv("PUBSUB_TOPIC_NAME")).Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("topic %s does not exist", os.Getenv("PUBSUB_TOPIC_NAME"))
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// compactSlack is how many superseded lines a journal can hold beyond
+// its live records before it's worth rewriting
+const compactSlack = 1000
+
+// record Defines a single line of a journal: the latest value for key, or
+// its removal
+type record struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Journal Keeps a store's records in a file by appending each change as
+// a line of JSON, rather than rewriting everything on every change. The
+// file is compacted to just the live records when it's opened and once
+// superseded lines outnumber them. A nil Journal keeps nothing, for
+// stores held in memory only
+type Journal struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	keys  map[string]bool
+	lines int
+}
+
+// Path Returns the file a store called name is kept in, in the directory
+// given by GMI_STATE_DIR. Returns an empty string when it is unset
+func Path(name string) string {
+	dir := os.Getenv("GMI_STATE_DIR")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// Open Replays the journal at path, calling load with the latest value of
+// every live record, then compacts it and opens it for appending. A
+// partial last line, left by a crash mid-write, is dropped. An empty path
+// returns a nil Journal
+func Open(path string, load func(key string, value json.RawMessage) error) (*Journal, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	values, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		if err := load(key, value); err != nil {
+			return nil, fmt.Errorf("unable to load %s from %s: %v", key, path, err)
+		}
+	}
+
+	j := &Journal{path: path}
+	if err := j.rewrite(values); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay Reads every record in the file at path and returns the latest
+// value of each live key
+func replay(path string) (map[string]json.RawMessage, error) {
+	values := map[string]json.RawMessage{}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Anything after the last newline wasn't finished
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", path, err)
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("unable to decode %s line %d: %v", path, number, err)
+		}
+		if r.Deleted {
+			delete(values, r.Key)
+		} else {
+			values[r.Key] = r.Value
+		}
+	}
+}
+
+// Put Records the latest value for key
+func (j *Journal) Put(key string, value any) error {
+	if j == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %v", key, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.append(record{Key: key, Value: encoded}); err != nil {
+		return err
+	}
+	j.keys[key] = true
+	return nil
+}
+
+// Delete Records that key has been removed. Keys the journal doesn't
+// hold are ignored
+func (j *Journal) Delete(key string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.keys[key] {
+		return nil
+	}
+	if err := j.append(record{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	delete(j.keys, key)
+	return nil
+}
+
+// NeedsCompaction Returns true once superseded lines outnumber the live
+// records by more than compactSlack
+func (j *Journal) NeedsCompaction() bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.lines > 2*len(j.keys)+compactSlack
+}
+
+// Compact Rewrites the journal to hold just values, the store's live
+// records, replacing the file in one step
+func (j *Journal) Compact(values map[string]any) error {
+	if j == nil {
+		return nil
+	}
+
+	encoded := map[string]json.RawMessage{}
+	for key, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %v", key, err)
+		}
+		encoded[key] = raw
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.rewrite(encoded)
+}
+
+// Close Closes the journal's file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// append Writes a record to the end of the file and syncs it. Callers
+// hold j.mu
+func (j *Journal) append(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %v", r.Key, err)
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to write to %s: %v", j.path, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("unable to write to %s: %v", j.path, err)
+	}
+	j.lines++
+	return nil
+}
+
+// rewrite Replaces the file with one holding values, so a crash can't
+// leave half a journal, and reopens it for appending. Callers hold j.mu,
+// or have the only reference to j
+func (j *Journal) rewrite(values map[string]json.RawMessage) error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to compact %s: %v", j.path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	keys := map[string]bool{}
+	for key, value := range values {
+		line, err := json.Marshal(record{Key: key, Value: value})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("unable to compact %s: %v", j.path, err)
+		}
+		keys[key] = true
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to compact %s: %v", j.path, err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", j.path, err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.keys = keys
+	j.lines = len(keys)
+	return nil
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DecodeFederationResponse Decodes a custodian list document one item at
+// a time, so a long list is never held as a second, generic copy. Keys
+// other than items are read past without being kept
+func DecodeFederationResponse(r io.Reader) (FederationResponse, error) {
+	var list FederationResponse
+	decoder := json.NewDecoder(r)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return list, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return list, err
+		}
+
+		if key, _ := token.(string); key != "items" {
+			if err := skipValue(decoder); err != nil {
+				return list, err
+			}
+			continue
+		}
+
+		items, err := decodeItems(decoder)
+		if err != nil {
+			return list, err
+		}
+		list.Items = items
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return list, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return list, fmt.Errorf("unexpected data after the list")
+	}
+
+	return list, nil
+}
+
+// decodeItems Decodes the items array, or null, the decoder is at
+func decodeItems(decoder *json.Decoder) ([]FederationItem, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("items must be an array")
+	}
+
+	items := []FederationItem{}
+	for decoder.More() {
+		var item FederationItem
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("item %d: %v", len(items), err)
+		}
+		items = append(items, item)
+	}
+
+	return items, expectDelim(decoder, ']')
+}
+
+// skipValue Reads past the next value without decoding it
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(decoder *json.Decoder, want json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %q in list document", want)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg/report"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "gmi"
+
+var (
+	CycleDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pull_cycle_duration_seconds",
+		Help:      "How long each pull cycle took.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	})
+	Cycles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pull_cycles_total",
+		Help:      "Pull cycles run, by outcome.",
+	}, []string{"status"})
+	LastCycleSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pull_cycle_last_success",
+		Help:      "1 if the last pull cycle succeeded, 0 otherwise.",
+	})
+	LastCycleTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pull_cycle_last_finished_timestamp_seconds",
+		Help:      "When the last pull cycle finished.",
+	})
+
+	FederationSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "federation_syncs_total",
+		Help:      "Federation syncs, by federation and outcome.",
+	}, []string{"federation", "status"})
+	Datasets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "datasets_total",
+		Help:      "Datasets processed, by federation and action taken.",
+	}, []string{"federation", "action"})
+	ValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validation_failures_total",
+		Help:      "Custodian payloads that failed validation, by federation and document type.",
+	}, []string{"federation", "document"})
+	SameVersionEdits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "same_version_edits_total",
+		Help:      "Datasets whose content changed without a version bump, by federation.",
+	}, []string{"federation"})
+
+	CustodianRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "custodian_request_duration_seconds",
+		Help:      "Latency of calls to custodian endpoints, by federation and response status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"federation", "code"})
+	GatewayAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gateway_api_errors_total",
+		Help:      "Failed Gateway API calls, by method, endpoint and response status.",
+	}, []string{"method", "endpoint", "code"})
+	OutboxEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbox_entries",
+		Help:      "Gateway writes waiting in the outbox, by status.",
+	}, []string{"status"})
+	SecretFetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "secret_fetch_failures_total",
+		Help:      "Failures reading federation credentials from secret manager.",
+	}, []string{"federation"})
+)
+
+type federationKey struct{}
+
+// WithFederation Returns a context that labels custodian calls made with
+// it as belonging to the given federation
+func WithFederation(ctx context.Context, federationId int) context.Context {
+	return context.WithValue(ctx, federationKey{}, FederationLabel(federationId))
+}
+
+// FederationFrom Returns the federation label carried by ctx, or
+// "unknown"
+func FederationFrom(ctx context.Context) string {
+	if id, ok := ctx.Value(federationKey{}).(string); ok {
+		return id
+	}
+	return "unknown"
+}
+
+// FederationLabel Returns the label used for a federation id
+func FederationLabel(federationId int) string {
+	return strconv.Itoa(federationId)
+}
+
+// StatusLabel Returns the label for a response status, or "error" when
+// no response was received
+func StatusLabel(code int, err error) string {
+	if err != nil || code == 0 {
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+// GatewayEndpoint Returns the first path segment of a Gateway API url
+// below base, e.g. "datasets", to keep label cardinality bounded
+func GatewayEndpoint(base, url string) string {
+	path := strings.TrimPrefix(url, base)
+	path = strings.SplitN(path, "?", 2)[0]
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			return segment
+		}
+	}
+	return "/"
+}
+
+// ObserveCycle Records a finished pull cycle along with every federation
+// run and dataset outcome within it
+func ObserveCycle(cycle report.Cycle, runs []report.FederationRun) {
+	CycleDuration.Observe(cycle.FinishedAt.Sub(cycle.StartedAt).Seconds())
+	Cycles.WithLabelValues(cycle.Status).Inc()
+	LastCycleTimestamp.Set(float64(cycle.FinishedAt.Unix()))
+
+	if cycle.Status == report.StatusSucceeded {
+		LastCycleSuccess.Set(1)
+	} else {
+		LastCycleSuccess.Set(0)
+	}
+
+	for _, run := range runs {
+		federation := FederationLabel(run.FederationID)
+		FederationSyncs.WithLabelValues(federation, run.Status).Inc()
+
+		for _, outcome := range run.Datasets {
+			Datasets.WithLabelValues(federation, strings.ToLower(outcome.Action)).Inc()
+			if outcome.Action == report.ActionInvalid {
+				ValidationFailures.WithLabelValues(federation, "dataset").Inc()
+			}
+		}
+	}
+}
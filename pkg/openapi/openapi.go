@@ -0,0 +1,291 @@
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// document Defines the parts of the OpenAPI document we validate against
+type document struct {
+	Components struct {
+		Parameters map[string]parameter `json:"parameters"`
+	} `json:"components"`
+	Paths map[string]map[string]operation `json:"paths"`
+}
+
+type operation struct {
+	Parameters  []parameter  `json:"parameters"`
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type parameter struct {
+	Ref      string          `json:"$ref"`
+	Name     string          `json:"name"`
+	In       string          `json:"in"`
+	Required bool            `json:"required"`
+	Schema   json.RawMessage `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema json.RawMessage `json:"schema"`
+	} `json:"content"`
+}
+
+// defaultMaxBodyBytes is the largest request body read when
+// GMI_MAX_REQUEST_BYTES isn't set
+const defaultMaxBodyBytes = 1 << 20
+
+// MaxBodyBytes Returns the most we'll read of a request body, from
+// GMI_MAX_REQUEST_BYTES. Handlers reading a body themselves use it too
+func MaxBodyBytes() int64 {
+	limit, err := strconv.ParseInt(os.Getenv("GMI_MAX_REQUEST_BYTES"), 10, 64)
+	if err != nil || limit <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return limit
+}
+
+var (
+	loadOnce sync.Once
+	loaded   document
+	root     map[string]interface{}
+	loadErr  error
+
+	pathParam = regexp.MustCompile(`:(\w+)`)
+)
+
+// Spec Returns the raw OpenAPI document describing the push API
+func Spec() []byte {
+	return spec
+}
+
+// SpecHandler Serves the OpenAPI document
+func SpecHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", spec)
+}
+
+// HasOperation Returns true if the document describes the given method on
+// a gin route template, e.g. GET /federation/:id/quality
+func HasOperation(method, route string) bool {
+	if err := load(); err != nil {
+		return false
+	}
+
+	_, ok := loaded.Paths[specPath(route)][strings.ToLower(method)]
+	return ok
+}
+
+// ValidateRequest Returns middleware that checks path and query parameters
+// and JSON bodies against the operation the document defines for the
+// matched route. Requests that don't match are rejected with a 400 listing
+// every problem found. Routes the document doesn't describe pass through
+func ValidateRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method_name := utils.MethodName(0)
+
+		if err := load(); err != nil {
+			slog.Debug(
+				fmt.Sprintf("unable to load openapi document: %s", err.Error()),
+				"x-request-session-id", c.GetHeader("x-request-session-id"),
+				"method_name", method_name,
+			)
+			c.Next()
+			return
+		}
+
+		op, ok := loaded.Paths[specPath(c.FullPath())][strings.ToLower(c.Request.Method)]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		problems := validateParameters(c, op.Parameters)
+
+		if op.RequestBody != nil {
+			bodyProblems, err := validateBody(c, op.RequestBody)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, utils.FormResponse(http.StatusRequestEntityTooLarge,
+					false,
+					"request body too large",
+					fmt.Sprintf("request bodies are limited to %d bytes", tooLarge.Limit)))
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+					false,
+					"unable to decode request body",
+					err.Error()))
+				return
+			}
+			problems = append(problems, bodyProblems...)
+		}
+
+		if len(problems) > 0 {
+			slog.Debug(
+				fmt.Sprintf("request does not match the api specification: %s", strings.Join(problems, "; ")),
+				"x-request-session-id", c.GetHeader("x-request-session-id"),
+				"method_name", method_name,
+			)
+			c.AbortWithStatusJSON(http.StatusBadRequest, utils.FormValidationResponse(http.StatusBadRequest,
+				"request does not match the api specification",
+				problems))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func load() error {
+	loadOnce.Do(func() {
+		if loadErr = json.Unmarshal(spec, &loaded); loadErr != nil {
+			return
+		}
+		loadErr = json.Unmarshal(spec, &root)
+	})
+	return loadErr
+}
+
+// specPath Converts a gin route template into an OpenAPI path
+func specPath(route string) string {
+	return pathParam.ReplaceAllString(route, "{$1}")
+}
+
+func validateParameters(c *gin.Context, params []parameter) []string {
+	problems := []string{}
+
+	for _, p := range params {
+		if p.Ref != "" {
+			p = loaded.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+		}
+
+		var value string
+		var found bool
+		switch p.In {
+		case "query":
+			value, found = c.GetQuery(p.Name)
+		case "path":
+			value = c.Param(p.Name)
+			found = value != ""
+		default:
+			continue
+		}
+
+		if !found {
+			if p.Required {
+				problems = append(problems, fmt.Sprintf("%s: %s parameter is required", p.Name, p.In))
+			}
+			continue
+		}
+
+		for _, problem := range validateAgainst(p.Schema, coerce(p.Schema, value)) {
+			problems = append(problems, fmt.Sprintf("%s: %s", p.Name, problem))
+		}
+	}
+
+	return problems
+}
+
+func validateBody(c *gin.Context, body *requestBody) ([]string, error) {
+	media, ok := body.Content["application/json"]
+	if !ok {
+		return nil, nil
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxBodyBytes()))
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+
+	if len(bytes.TrimSpace(raw)) == 0 {
+		if body.Required {
+			return []string{"request body is required"}, nil
+		}
+		return nil, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+
+	return validateAgainst(media.Schema, value), nil
+}
+
+// validateAgainst Validates value against a schema from the document.
+// The schema is wrapped alongside the document's components so any $ref
+// into #/components resolves
+func validateAgainst(schema json.RawMessage, value interface{}) []string {
+	var s interface{}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return []string{fmt.Sprintf("invalid schema: %v", err)}
+	}
+
+	wrapped := map[string]interface{}{
+		"allOf":      []interface{}{s},
+		"components": root["components"],
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(wrapped), gojsonschema.NewGoLoader(value))
+	if err != nil {
+		return []string{fmt.Sprintf("unable to validate: %v", err)}
+	}
+
+	problems := []string{}
+	for _, e := range result.Errors() {
+		// allOf failures only repeat the errors already listed
+		if e.Type() == "number_all_of" {
+			continue
+		}
+		problems = append(problems, e.String())
+	}
+	return problems
+}
+
+// coerce Converts a parameter value to the type its schema expects, so
+// it's validated as that type. Values that don't convert are left as
+// strings for the schema to reject
+func coerce(schema json.RawMessage, value string) interface{} {
+	var s struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(schema, &s)
+
+	switch s.Type {
+	case "integer":
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
@@ -0,0 +1,483 @@
+package outbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/contenthash"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/journal"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	OpCreate = "CREATE"
+	OpUpdate = "UPDATE"
+	OpDelete = "DELETE"
+
+	StatusPending   = "PENDING"
+	StatusDead      = "DEAD"
+	StatusDelivered = "DELIVERED"
+
+	defaultBackoff     = 30 * time.Second
+	defaultMaxAttempts = 8
+	maxBackoff         = time.Hour
+	pollInterval       = 10 * time.Second
+)
+
+var (
+	// ErrNotFound Is returned for an entry the outbox doesn't hold
+	ErrNotFound = errors.New("outbox entry not found")
+	// ErrNotDead Is returned when replaying an entry that is still being
+	// retried
+	ErrNotDead = errors.New("outbox entry is not a dead letter")
+)
+
+// Entry Defines a Gateway write or delete waiting to be delivered. ID is
+// its idempotency key, sent to the gateway with every attempt
+type Entry struct {
+	ID           string                  `json:"id"`
+	Op           string                  `json:"op"`
+	FederationID int                     `json:"federation_id"`
+	TeamID       int                     `json:"team_id"`
+	PersistentID string                  `json:"persistent_id"`
+	ContentHash  string                  `json:"content_hash,omitempty"`
+	Request      *gateway.DatasetRequest `json:"request,omitempty"`
+	Status       string                  `json:"status"`
+	Attempts     int                     `json:"attempts"`
+	LastError    string                  `json:"last_error,omitempty"`
+	CreatedAt    time.Time               `json:"created_at"`
+	UpdatedAt    time.Time               `json:"updated_at"`
+	NextAttempt  time.Time               `json:"next_attempt_at"`
+}
+
+// NewWrite Creates the entry storing req in the gateway. op is OpCreate
+// or OpUpdate, and hash the content hash of req's metadata
+func NewWrite(op string, federationId int, req gateway.DatasetRequest, hash string) Entry {
+	teamId, _ := strconv.Atoi(req.TeamID)
+	return Entry{
+		ID:           Key(op, teamId, req.PersistentID, hash),
+		Op:           op,
+		FederationID: federationId,
+		TeamID:       teamId,
+		PersistentID: req.PersistentID,
+		ContentHash:  hash,
+		Request:      &req,
+	}
+}
+
+// NewDelete Creates the entry deleting pid from a team
+func NewDelete(federationId, teamId int, pid string) Entry {
+	return Entry{
+		ID:           Key(OpDelete, teamId, pid, ""),
+		Op:           OpDelete,
+		FederationID: federationId,
+		TeamID:       teamId,
+		PersistentID: pid,
+	}
+}
+
+// Key Returns the idempotency key for an operation. The same write of
+// the same content to the same team always has the same key
+func Key(op string, teamId int, pid, hash string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s\n%s", op, teamId, pid, hash)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Path Returns the file the outbox is kept in. Read from GMI_OUTBOX_PATH,
+// falling back to outbox.log in GMI_STATE_DIR; when neither is set the
+// outbox is only held in memory
+func Path() string {
+	if path := os.Getenv("GMI_OUTBOX_PATH"); path != "" {
+		return path
+	}
+	return journal.Path("outbox.log")
+}
+
+// MaxAttempts Returns how many times an entry is tried before it becomes
+// a dead letter. Read from GMI_OUTBOX_MAX_ATTEMPTS
+func MaxAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("GMI_OUTBOX_MAX_ATTEMPTS"))
+	if err != nil || attempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return attempts
+}
+
+// Backoff Returns how long to wait before the next try of an entry that
+// has failed attempts times. The wait starts at GMI_OUTBOX_BACKOFF_SECONDS
+// and doubles with each failure, up to an hour
+func Backoff(attempts int) time.Duration {
+	base := defaultBackoff
+	if seconds, err := strconv.Atoi(os.Getenv("GMI_OUTBOX_BACKOFF_SECONDS")); err == nil && seconds >= 0 {
+		base = time.Duration(seconds) * time.Second
+	}
+
+	wait := base
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// Store Holds undelivered entries, one per team and dataset, journaling
+// every change so they survive a restart
+type Store struct {
+	mu      sync.Mutex
+	journal *journal.Journal
+	entries map[string]*Entry
+
+	// deliver is held for each attempt, so writes to the gateway go out
+	// in the order they were made
+	deliver sync.Mutex
+}
+
+// NewStore Creates a store kept in path, loading the entries already
+// there. An empty path keeps the store in memory only
+func NewStore(path string) (*Store, error) {
+	s := &Store{entries: map[string]*Entry{}}
+
+	j, err := journal.Open(path, func(id string, value json.RawMessage) error {
+		e := &Entry{}
+		if err := json.Unmarshal(value, e); err != nil {
+			return err
+		}
+		s.entries[id] = e
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read outbox: %v", err)
+	}
+	s.journal = j
+	s.observe()
+	return s, nil
+}
+
+// Default The outbox every Gateway write and delete goes through. Held
+// in memory until Open is called
+var Default, _ = NewStore("")
+
+// Open Replaces Default with the outbox kept in Path. Called once at
+// startup, after the environment is loaded and before anything is
+// written
+func Open() {
+	Default = open(Path())
+}
+
+// open Creates the store kept in path. An outbox that can't be read is
+// left alone for an operator to recover, and the service carries on
+// with one held in memory
+func open(path string) *Store {
+	s, err := NewStore(path)
+	if err != nil {
+		customMsg := fmt.Sprintf("%v, keeping the outbox in memory", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "Outbox", "")
+		s, _ = NewStore("")
+	}
+	return s
+}
+
+// Deliver Records e, replacing any undelivered entry for the same team
+// and dataset, then tries it straight away. Returns nil once the gateway
+// has it; otherwise e is left for Run to retry, or as a dead letter when
+// retrying can't help
+func (s *Store) Deliver(ctx context.Context, e Entry, sessionId string) error {
+	now := time.Now().UTC()
+	e.Status = StatusPending
+	e.Attempts = 0
+	e.LastError = ""
+	e.CreatedAt = now
+	e.UpdatedAt = now
+	e.NextAttempt = now
+
+	s.mu.Lock()
+	for id, other := range s.entries {
+		if other.TeamID == e.TeamID && other.PersistentID == e.PersistentID {
+			delete(s.entries, id)
+			s.remove(id)
+		}
+	}
+	s.entries[e.ID] = &e
+	s.put(&e)
+	s.mu.Unlock()
+
+	return s.attempt(ctx, e.ID, sessionId)
+}
+
+// RetryDue Tries every pending entry whose backoff has passed. Returns
+// how many were delivered
+func (s *Store) RetryDue(ctx context.Context, sessionId string) int {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	due := []*Entry{}
+	for _, e := range s.entries {
+		if e.Status == StatusPending && !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	s.mu.Unlock()
+	sortEntries(due)
+
+	delivered := 0
+	for _, e := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if s.attempt(ctx, e.ID, sessionId) == nil {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// Run Retries due entries until ctx is done
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.RetryDue(ctx, "")
+		}
+	}
+}
+
+// List Returns the entries with the given status, or every entry when
+// status is empty, oldest first. Requests are left out to keep the list
+// small; Get returns an entry in full
+func (s *Store) List(status string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := []*Entry{}
+	for _, e := range s.entries {
+		if status == "" || e.Status == status {
+			found = append(found, e)
+		}
+	}
+	sortEntries(found)
+
+	entries := make([]Entry, 0, len(found))
+	for _, e := range found {
+		summary := *e
+		summary.Request = nil
+		entries = append(entries, summary)
+	}
+	return entries
+}
+
+// Get Returns the entry with the given id
+func (s *Store) Get(id string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Replay Gives a dead letter a fresh set of attempts and tries it
+// straight away. Returns the entry as it stands afterwards, with status
+// StatusDelivered once the gateway has it
+func (s *Store) Replay(ctx context.Context, id string, sessionId string) (Entry, error) {
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	if !ok {
+		s.mu.Unlock()
+		return Entry{}, ErrNotFound
+	}
+	if e.Status != StatusDead {
+		s.mu.Unlock()
+		return Entry{}, ErrNotDead
+	}
+	e.Status = StatusPending
+	e.Attempts = 0
+	e.NextAttempt = time.Now().UTC()
+	replayed := *e
+	s.put(e)
+	s.mu.Unlock()
+
+	if err := s.attempt(ctx, id, sessionId); err != nil {
+		current, _ := s.Get(id)
+		return current, nil
+	}
+
+	replayed.Status = StatusDelivered
+	replayed.Attempts++
+	replayed.LastError = ""
+	replayed.UpdatedAt = time.Now().UTC()
+	return replayed, nil
+}
+
+// attempt Sends the entry with the given id to the gateway once, then
+// removes it or records the failure. An entry replaced while waiting to
+// be sent is left alone
+func (s *Store) attempt(ctx context.Context, id string, sessionId string) error {
+	method_name := utils.MethodName(0)
+
+	s.deliver.Lock()
+	defer s.deliver.Unlock()
+
+	s.mu.Lock()
+	current, ok := s.entries[id]
+	if !ok || current.Status != StatusPending {
+		s.mu.Unlock()
+		return nil
+	}
+	e := *current
+	s.mu.Unlock()
+
+	err := send(ctx, e, sessionId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok = s.entries[id]; !ok {
+		return err
+	}
+
+	if err == nil {
+		delete(s.entries, id)
+		s.remove(id)
+		if e.Op == OpDelete {
+			contenthash.Default.Forget(e.TeamID, e.PersistentID)
+		} else {
+			contenthash.Default.Set(e.TeamID, e.PersistentID, e.ContentHash)
+		}
+		return nil
+	}
+
+	// Cut short by shutdown rather than refused, so it isn't counted
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s pid=%s interrupted: %w", e.Op, e.PersistentID, err)
+	}
+
+	now := time.Now().UTC()
+	current.Attempts++
+	current.LastError = err.Error()
+	current.UpdatedAt = now
+
+	var customMsg string
+	if retryable(err) && current.Attempts < MaxAttempts() {
+		current.NextAttempt = now.Add(Backoff(current.Attempts))
+		customMsg = fmt.Sprintf("%s pid=%s for team %d queued for retry after attempt %d", e.Op, e.PersistentID, e.TeamID, current.Attempts)
+	} else {
+		current.Status = StatusDead
+		customMsg = fmt.Sprintf("%s pid=%s for team %d moved to dead letters after attempt %d", e.Op, e.PersistentID, e.TeamID, current.Attempts)
+	}
+	s.put(current)
+
+	slog.Debug(
+		fmt.Sprintf("%s: %v", customMsg, err.Error()),
+		"x-request-session-id", sessionId,
+		"method_name", method_name,
+	)
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), "Outbox", "")
+
+	return fmt.Errorf("%s: %w", customMsg, err)
+}
+
+// send Makes the call an entry stands for. A create the gateway already
+// has becomes an update, an update of a dataset it no longer has becomes
+// a create, and deleting a dataset that is already gone succeeds, so an
+// attempt that landed before its response was lost is safe to repeat
+func send(ctx context.Context, e Entry, sessionId string) error {
+	ctx = gateway.WithIdempotencyKey(ctx, e.ID)
+
+	switch e.Op {
+	case OpCreate:
+		err := gateway.Default.CreateDataset(ctx, *e.Request, sessionId)
+		if errors.Is(err, gateway.ErrConflict) {
+			return gateway.Default.UpdateDataset(ctx, *e.Request, sessionId)
+		}
+		return err
+	case OpUpdate:
+		err := gateway.Default.UpdateDataset(ctx, *e.Request, sessionId)
+		if errors.Is(err, gateway.ErrNotFound) {
+			return gateway.Default.CreateDataset(ctx, *e.Request, sessionId)
+		}
+		return err
+	case OpDelete:
+		err := gateway.Default.DeleteDataset(ctx, e.TeamID, e.PersistentID, sessionId)
+		if errors.Is(err, gateway.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unknown outbox operation %q", e.Op)
+}
+
+// retryable Returns true for failures that may clear up on their own:
+// the gateway being down or our service user failing to log in
+func retryable(err error) bool {
+	return errors.Is(err, gateway.ErrUnavailable) ||
+		errors.Is(err, gateway.ErrUnauthorised) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// put Journals the latest state of e. Callers hold s.mu
+func (s *Store) put(e *Entry) {
+	s.saved(s.journal.Put(e.ID, e))
+}
+
+// remove Journals that the entry with the given id has gone. Callers
+// hold s.mu
+func (s *Store) remove(id string) {
+	s.saved(s.journal.Delete(id))
+}
+
+// saved Reports a journal write that failed, and compacts the journal
+// once it has grown well past the entries it holds. Callers hold s.mu
+func (s *Store) saved(err error) {
+	s.observe()
+
+	if err == nil && s.journal.NeedsCompaction() {
+		values := map[string]any{}
+		for id, e := range s.entries {
+			values[id] = e
+		}
+		err = s.journal.Compact(values)
+	}
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to save outbox: %v", err)
+		slog.Error(customMsg)
+		utils.WriteGatewayAudit(customMsg, "Outbox", "")
+	}
+}
+
+// observe Updates the outbox gauges. Callers hold s.mu
+func (s *Store) observe() {
+	counts := map[string]int{StatusPending: 0, StatusDead: 0}
+	for _, e := range s.entries {
+		counts[e.Status]++
+	}
+	for status, count := range counts {
+		metrics.OutboxEntries.WithLabelValues(status).Set(float64(count))
+	}
+}
+
+func sortEntries(entries []*Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+}
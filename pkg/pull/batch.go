@@ -0,0 +1,185 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultBatchSize is how many datasets a batch call asks for when the
+// federation doesn't say
+const DefaultBatchSize = 50
+
+// checkDatasetMode Returns an error for a dataset mode we don't know, or
+// a batch mode without a batch endpoint
+func checkDatasetMode(fed *pkg.Federation) error {
+	switch strings.ToUpper(fed.DatasetMode) {
+	case "", pkg.DatasetModeItem, pkg.DatasetModeEmbedded:
+		return nil
+	case pkg.DatasetModeBatch:
+		if fed.EndpointBatch == "" {
+			return fmt.Errorf("dataset_mode %s needs endpoint_batch", pkg.DatasetModeBatch)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown dataset_mode %q", fed.DatasetMode)
+	}
+}
+
+// CallForBatch Fetches several datasets in one call to the federation's
+// batch endpoint, with {ids} replaced by the comma separated, escaped
+// persistentIds. The custodian answers with an object keyed by
+// persistentId, and may leave some out
+func (p *Pull) CallForBatch(ctx context.Context, pids []string) (map[string][]byte, error) {
+	method_name := utils.MethodName(0)
+
+	escaped := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		escaped = append(escaped, url.QueryEscape(pid))
+	}
+	uri := strings.ReplaceAll(p.BatchUri, "{ids}", strings.Join(escaped, ","))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to form new request: %v", err)
+	}
+
+	p.GenerateHeaders(req)
+
+	result, err := Client.Do(req)
+	if err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to call %s: %v", uri, err.Error()),
+			"x-request-session-id", p.Logging,
+			"method_name", method_name,
+		)
+		return nil, fmt.Errorf("unable to call batch endpoint: %w", err)
+	}
+	defer result.Body.Close()
+
+	if !utils.IsSuccessfulStatusCode(result.StatusCode) {
+		return nil, fmt.Errorf("batch endpoint returned HTTP %d", result.StatusCode)
+	}
+
+	body, err := limitBody(result, MaxListBytes())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body of batch response: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.NewDecoder(body).Decode(&raw)
+	if body.Err() != nil {
+		return nil, fmt.Errorf("unable to read body of batch response: %w", body.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode batch response: %v", err)
+	}
+
+	bodies := map[string][]byte{}
+	for pid, dataset := range raw {
+		if len(dataset) > 0 && !bytes.Equal(dataset, []byte("null")) {
+			bodies[pid] = dataset
+		}
+	}
+	return bodies, nil
+}
+
+// prefetcher Supplies dataset bodies that came inline with the list or
+// from batch calls, so they needn't be fetched one at a time
+type prefetcher struct {
+	p      *Pull
+	pids   []string
+	index  map[string]int
+	asked  map[string]bool
+	bodies map[string][]byte
+}
+
+// newPrefetcher Creates the prefetcher for a list's items. Embedded
+// bodies are moved out of items, so each is only held once
+func (p *Pull) newPrefetcher(items []pkg.FederationItem) *prefetcher {
+	f := &prefetcher{
+		p:      p,
+		index:  map[string]int{},
+		asked:  map[string]bool{},
+		bodies: map[string][]byte{},
+	}
+
+	embedded := strings.ToUpper(p.DatasetMode) == pkg.DatasetModeEmbedded
+	for i := range items {
+		pid := items[i].PersistentID
+		f.index[pid] = len(f.pids)
+		f.pids = append(f.pids, pid)
+
+		dataset := items[i].Dataset
+		items[i].Dataset = nil
+		if embedded && len(dataset) > 0 && !bytes.Equal(dataset, []byte("null")) {
+			f.bodies[pid] = dataset
+		}
+	}
+
+	return f
+}
+
+// take Returns and forgets the prefetched body for pid. In batch mode the
+// batch starting at pid is fetched first, unless it was already asked
+// for. ok is false when the dataset must be fetched on its own
+func (f *prefetcher) take(ctx context.Context, pid string) ([]byte, bool) {
+	if strings.ToUpper(f.p.DatasetMode) == pkg.DatasetModeBatch && !f.asked[pid] {
+		f.fetchBatch(ctx, pid)
+	}
+
+	body, ok := f.bodies[pid]
+	delete(f.bodies, pid)
+	return body, ok
+}
+
+// fetchBatch Asks for pid and the datasets after it that haven't been
+// asked for yet. A failed batch is logged, leaving its datasets to be
+// fetched one at a time
+func (f *prefetcher) fetchBatch(ctx context.Context, pid string) {
+	method_name := utils.MethodName(0)
+
+	size := f.p.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	batch := []string{pid}
+	f.asked[pid] = true
+	if start, ok := f.index[pid]; ok {
+		for _, next := range f.pids[start+1:] {
+			if len(batch) == size {
+				break
+			}
+			if !f.asked[next] {
+				batch = append(batch, next)
+				f.asked[next] = true
+			}
+		}
+	}
+
+	bodies, err := f.p.CallForBatch(ctx, batch)
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to fetch batch of %d datasets, fetching them one at a time", len(batch))
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", f.p.Logging,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), "CallForBatch", "GET")
+		return
+	}
+
+	for _, id := range batch {
+		if body, ok := bodies[id]; ok {
+			f.bodies[id] = body
+		}
+	}
+}
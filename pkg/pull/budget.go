@@ -0,0 +1,50 @@
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/report"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultFederationTimeout bounds everything done for one federation in a
+// cycle: fetching its secret, its list and every dataset, and writing
+// them to the gateway
+const defaultFederationTimeout = 10 * time.Minute
+
+// ErrFederationTimeout A federation used up its time budget before it
+// finished syncing
+var ErrFederationTimeout = errors.New("federation exceeded its time budget")
+
+// FederationTimeout Returns the time budget each federation gets per
+// sync or test, so one stuck custodian can't hold up the rest. Read from
+// GMI_FEDERATION_TIMEOUT_SECONDS
+func FederationTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("GMI_FEDERATION_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return defaultFederationTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// WithFederationBudget Returns a child of ctx that expires once a
+// federation's time budget is spent
+func WithFederationBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, FederationTimeout())
+}
+
+// stopReason Returns why work on a federation has to stop, or nil while
+// ctx is live. A spent budget is ErrFederationTimeout, anything else
+// means the cycle was cancelled and is report.ErrInterrupted
+func stopReason(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w of %s", ErrFederationTimeout, FederationTimeout())
+	}
+	return report.ErrInterrupted
+}
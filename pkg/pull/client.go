@@ -0,0 +1,37 @@
+package pull
+
+import (
+	"hdruk/federated-metadata/pkg/metrics"
+	"net/http"
+	"time"
+)
+
+// instrumentedClient Wraps an HTTPClient and times every custodian call
+// per federation. Gateway API calls are counted by pkg/gateway
+type instrumentedClient struct {
+	next HTTPClient
+}
+
+// InstrumentClient Returns next wrapped with metrics instrumentation
+func InstrumentClient(next HTTPClient) HTTPClient {
+	return &instrumentedClient{next: next}
+}
+
+// Do Issues the request through the wrapped client
+func (c *instrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := c.next.Do(req)
+	elapsed := time.Since(start)
+
+	code := 0
+	if res != nil {
+		code = res.StatusCode
+	}
+
+	metrics.CustodianRequests.WithLabelValues(
+		metrics.FederationFrom(req.Context()),
+		metrics.StatusLabel(code, err),
+	).Observe(elapsed.Seconds())
+
+	return res, err
+}
@@ -0,0 +1,465 @@
+package pull
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/utils"
+	"hdruk/federated-metadata/pkg/validator"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	StepPassed  = "PASSED"
+	StepWarning = "WARNING"
+	StepFailed  = "FAILED"
+	StepSkipped = "SKIPPED"
+
+	// certificateWarningDays is how close to expiry a custodian's
+	// certificate can get before we warn about it
+	certificateWarningDays = 30
+)
+
+// DiagnosticStep Defines the outcome of a single step of a federation test
+type DiagnosticStep struct {
+	Name         string      `json:"name"`
+	PersistentID string      `json:"persistent_id,omitempty"`
+	Status       string      `json:"status"`
+	DurationMs   int64       `json:"duration_ms"`
+	Message      string      `json:"message,omitempty"`
+	Detail       interface{} `json:"detail,omitempty"`
+}
+
+// DiagnosticReport Defines the ordered outcome of testing a federation
+// configuration. Status, Success, Title and Errors keep the shape of the
+// original one-line test result, so existing callers keep working
+type DiagnosticReport struct {
+	Status     int              `json:"status"`
+	Success    bool             `json:"success"`
+	Title      string           `json:"title"`
+	Errors     string           `json:"errors"`
+	FailedStep string           `json:"failed_step,omitempty"`
+	DurationMs int64            `json:"duration_ms"`
+	Steps      []DiagnosticStep `json:"steps"`
+}
+
+// CertificateDetail Defines what we report about a custodian's TLS
+// certificate
+type CertificateDetail struct {
+	Subject       string    `json:"subject"`
+	Issuer        string    `json:"issuer"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+}
+
+// DiagnosticProgress Is called as each step of a diagnosis is recorded,
+// with the number of datasets listed once the list has been read
+type DiagnosticProgress func(step DiagnosticStep, datasets int)
+
+// diagnosis Accumulates steps while a federation is being tested
+type diagnosis struct {
+	ctx         context.Context
+	report      DiagnosticReport
+	status      int
+	datasets    int
+	progress    DiagnosticProgress
+	interrupted bool
+}
+
+// record Appends a step and reports it to any progress callback
+func (d *diagnosis) record(step DiagnosticStep) {
+	d.report.Steps = append(d.report.Steps, step)
+	if d.progress != nil {
+		d.progress(step, d.datasets)
+	}
+}
+
+// run Times fn and records its outcome as a step. fn returns the status,
+// message and detail for the step. fn isn't run once the test has been
+// stopped
+func (d *diagnosis) run(name, persistentId string, fn func() (string, string, interface{})) bool {
+	if d.stopped() {
+		return false
+	}
+
+	start := time.Now()
+	status, message, detail := fn()
+
+	if status == StepFailed && d.report.FailedStep == "" {
+		d.report.FailedStep = name
+		d.report.Errors = message
+	}
+
+	d.record(DiagnosticStep{
+		Name:         name,
+		PersistentID: persistentId,
+		Status:       status,
+		DurationMs:   time.Since(start).Milliseconds(),
+		Message:      message,
+		Detail:       detail,
+	})
+	return status != StepFailed
+}
+
+// stopped Returns true once the test has been cancelled or has run out
+// of time, recording why the first time it's noticed
+func (d *diagnosis) stopped() bool {
+	err := d.ctx.Err()
+	if err == nil {
+		return false
+	}
+	if d.interrupted {
+		return true
+	}
+	d.interrupted = true
+
+	message := "test was cancelled"
+	if errors.Is(err, context.DeadlineExceeded) {
+		d.status = http.StatusGatewayTimeout
+		message = "test ran out of time"
+	}
+	if d.report.FailedStep == "" {
+		d.report.FailedStep = "interrupted"
+		d.report.Errors = message
+	}
+	d.record(DiagnosticStep{Name: "interrupted", Status: StepFailed, Message: message})
+	return true
+}
+
+// skip Records every remaining step as skipped, noting first if the
+// test was stopped
+func (d *diagnosis) skip(names ...string) {
+	d.stopped()
+	for _, name := range names {
+		d.record(DiagnosticStep{
+			Name:    name,
+			Status:  StepSkipped,
+			Message: fmt.Sprintf("skipped after %s failed", d.report.FailedStep),
+		})
+	}
+}
+
+// Diagnose Tests every part of a federation configuration in order: URL
+// parsing, DNS, TCP and TLS, auth, the list endpoint's status, latency
+// and schema, then each dataset's fetch, version and validity. Each step
+// is timed. Connection level failures stop the test, dataset level
+// failures don't, so custodians see every broken dataset at once. The
+// test stops, failing, once ctx is done
+func (p *Pull) Diagnose(ctx context.Context) DiagnosticReport {
+	return p.DiagnoseWithProgress(ctx, nil)
+}
+
+// DiagnoseWithProgress Runs Diagnose, calling progress as each step is
+// recorded
+func (p *Pull) DiagnoseWithProgress(ctx context.Context, progress DiagnosticProgress) DiagnosticReport {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Diagnose",
+		"x-request-session-id", p.Logging,
+		"method_name", method_name,
+	)
+
+	start := time.Now()
+	d := &diagnosis{
+		ctx:      ctx,
+		report:   DiagnosticReport{Steps: []DiagnosticStep{}},
+		status:   http.StatusBadRequest,
+		progress: progress,
+	}
+
+	p.diagnose(d)
+
+	d.report.DurationMs = time.Since(start).Milliseconds()
+	d.report.Success = d.report.FailedStep == ""
+	if d.report.Success {
+		d.report.Status = http.StatusOK
+		d.report.Title = "Test Successful"
+	} else {
+		d.report.Status = d.status
+		d.report.Title = "Test Unsuccessful"
+	}
+
+	return d.report
+}
+
+func (p *Pull) diagnose(d *diagnosis) {
+	var listUrl *url.URL
+
+	ok := d.run("url-parse", "", func() (string, string, interface{}) {
+		var err error
+		listUrl, err = parseEndpoint(p.DatasetsUri)
+		if err != nil {
+			return StepFailed, fmt.Sprintf("datasets endpoint is invalid: %v", err), nil
+		}
+		template, err := ParseDatasetTemplate(p.DatasetUri)
+		if err != nil {
+			return StepFailed, fmt.Sprintf("dataset endpoint is invalid: %v", err), nil
+		}
+		sample := template.Expand(map[string]string{"id": "id", "version": "1.0.0", "self": p.DatasetsUri})
+		if _, err := parseEndpoint(sample); err != nil {
+			return StepFailed, fmt.Sprintf("dataset endpoint is invalid: %v", err), nil
+		}
+		if !template.Uses("id") && !template.Uses("self") {
+			return StepWarning, "dataset endpoint has no {id} or {self} placeholder, so every dataset will be fetched from the same url", nil
+		}
+		return StepPassed, "", map[string]string{"datasets": p.DatasetsUri, "dataset": p.DatasetUri}
+	})
+	if !ok {
+		d.skip("dns", "tcp-connect", "tls-handshake", "auth", "list-status", "list-schema")
+		return
+	}
+
+	host := listUrl.Hostname()
+	port := listUrl.Port()
+	if port == "" {
+		port = "80"
+		if listUrl.Scheme == "https" {
+			port = "443"
+		}
+	}
+	address := net.JoinHostPort(host, port)
+
+	ok = d.run("dns", "", func() (string, string, interface{}) {
+		addrs, err := net.DefaultResolver.LookupHost(d.ctx, host)
+		if err != nil {
+			return StepFailed, fmt.Sprintf("unable to resolve %s: %v", host, err), nil
+		}
+		return StepPassed, "", addrs
+	})
+	if !ok {
+		d.skip("tcp-connect", "tls-handshake", "auth", "list-status", "list-schema")
+		return
+	}
+
+	ok = d.run("tcp-connect", "", func() (string, string, interface{}) {
+		dialer := &net.Dialer{Timeout: defaultTimeout}
+		conn, err := dialer.DialContext(d.ctx, "tcp", address)
+		if err != nil {
+			return StepFailed, fmt.Sprintf("unable to connect to %s: %v", address, err), nil
+		}
+		conn.Close()
+		return StepPassed, "", address
+	})
+	if !ok {
+		d.skip("tls-handshake", "auth", "list-status", "list-schema")
+		return
+	}
+
+	ok = d.run("tls-handshake", "", func() (string, string, interface{}) {
+		if listUrl.Scheme != "https" {
+			return StepWarning, "endpoint does not use TLS, credentials will be sent in plain text", nil
+		}
+		return checkTLS(d.ctx, address, host)
+	})
+	if !ok {
+		d.skip("auth", "list-status", "list-schema")
+		return
+	}
+
+	// The list is fetched once; auth, status and latency are all read
+	// from the same response
+	var body []byte
+	var statusCode int
+	var latency time.Duration
+	var fetchErr error
+
+	ok = d.run("auth", "", func() (string, string, interface{}) {
+		switch strings.ToUpper(p.Method) {
+		case "BEARER", "API_KEY", "NO_AUTH":
+		default:
+			return StepFailed, fmt.Sprintf("unknown auth type %s", p.Method), nil
+		}
+
+		started := time.Now()
+		body, statusCode, fetchErr = p.fetchWithStatus(d.ctx, p.DatasetsUri)
+		latency = time.Since(started)
+
+		if fetchErr != nil {
+			return StepFailed, fetchErr.Error(), nil
+		}
+		if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+			d.status = statusCode
+			return StepFailed, statusMessage(statusCode), map[string]string{"auth_type": strings.ToUpper(p.Method)}
+		}
+		return StepPassed, "", map[string]string{"auth_type": strings.ToUpper(p.Method)}
+	})
+	if !ok {
+		d.skip("list-status", "list-schema")
+		return
+	}
+
+	ok = d.run("list-status", "", func() (string, string, interface{}) {
+		detail := map[string]interface{}{
+			"status_code": statusCode,
+			"latency_ms":  latency.Milliseconds(),
+		}
+		if !utils.IsSuccessfulStatusCode(statusCode) {
+			d.status = statusCode
+			return StepFailed, statusMessage(statusCode), detail
+		}
+		return StepPassed, "", detail
+	})
+	if !ok {
+		d.skip("list-schema")
+		return
+	}
+
+	var list pkg.FederationResponse
+	ok = d.run("list-schema", "", func() (string, string, interface{}) {
+		var report validator.ValidationReport
+		report, list = validator.ValidateListDocument(body, p.DatasetUri, p.Logging)
+		d.datasets = len(list.Items)
+		if !report.Valid {
+			return StepFailed, "list response failed to validate against the schema", report
+		}
+		if len(list.Items) == 0 {
+			return StepFailed, "There are no datasets listed in your federation endpoint!", report
+		}
+		return StepPassed, fmt.Sprintf("%d datasets listed", len(list.Items)), report
+	})
+	if !ok {
+		return
+	}
+
+	for _, item := range list.Items {
+		if d.stopped() {
+			return
+		}
+		p.diagnoseDataset(d, item)
+	}
+}
+
+// diagnoseDataset Records the fetch, version and validity steps for a
+// single listed dataset
+func (p *Pull) diagnoseDataset(d *diagnosis, item pkg.FederationItem) {
+	var body []byte
+	ok := d.run("dataset-fetch", item.PersistentID, func() (string, string, interface{}) {
+		datasetUri, err := p.datasetURL(item)
+		if err != nil {
+			return StepFailed, err.Error(), nil
+		}
+
+		started := time.Now()
+		var statusCode int
+		body, statusCode, err = p.fetchWithStatus(d.ctx, datasetUri)
+
+		detail := map[string]interface{}{
+			"url":         datasetUri,
+			"status_code": statusCode,
+			"latency_ms":  time.Since(started).Milliseconds(),
+		}
+		if err != nil {
+			return StepFailed, err.Error(), detail
+		}
+		if !utils.IsSuccessfulStatusCode(statusCode) {
+			return StepFailed, statusMessage(statusCode), detail
+		}
+		return StepPassed, "", detail
+	})
+	if !ok {
+		return
+	}
+
+	report := validator.ValidateTransformedDatasetDocument(body, p.Transformations, &item, p.DatasetUri, p.Logging)
+
+	d.run("dataset-version", item.PersistentID, func() (string, string, interface{}) {
+		if report.Error != "" {
+			return StepFailed, report.Error, nil
+		}
+		if report.Version != item.Version {
+			return StepFailed, fmt.Sprintf("version mismatch: expected %s, but got %s", item.Version, report.Version), nil
+		}
+		return StepPassed, "", nil
+	})
+
+	d.run("dataset-valid", item.PersistentID, func() (string, string, interface{}) {
+		if !report.Valid {
+			return StepFailed, "dataset failed schema or semantic validation", report
+		}
+		return StepPassed, "", report
+	})
+}
+
+// fetchWithStatus Issues an authenticated GET and returns the body and
+// status code whatever the status
+func (p *Pull) fetchWithStatus(ctx context.Context, uri string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to form new request: %v", err)
+	}
+
+	p.GenerateHeaders(req)
+
+	result, err := Client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to call %s: %v", uri, err)
+	}
+	defer result.Body.Close()
+
+	body, err := readLimited(result, p.limitFor(uri))
+	if err != nil {
+		return nil, result.StatusCode, fmt.Errorf("unable to read body of response: %w", err)
+	}
+
+	return body, result.StatusCode, nil
+}
+
+// checkTLS Completes a TLS handshake with address and reports on the
+// certificate presented
+func checkTLS(ctx context.Context, address, host string) (string, string, interface{}) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: defaultTimeout},
+		Config:    &tls.Config{ServerName: host},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return StepFailed, fmt.Sprintf("TLS handshake with %s failed: %v", address, err), nil
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return StepFailed, "server presented no certificate", nil
+	}
+
+	cert := certs[0]
+	detail := CertificateDetail{
+		Subject:       cert.Subject.String(),
+		Issuer:        cert.Issuer.String(),
+		NotAfter:      cert.NotAfter,
+		DaysRemaining: int(time.Until(cert.NotAfter).Hours() / 24),
+	}
+
+	if detail.DaysRemaining < certificateWarningDays {
+		return StepWarning, fmt.Sprintf("certificate expires in %d days", detail.DaysRemaining), detail
+	}
+	return StepPassed, "", detail
+}
+
+// parseEndpoint Parses a custodian endpoint, requiring an absolute http
+// or https url
+func parseEndpoint(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q must use http or https", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%q has no host", raw)
+	}
+	return u, nil
+}
+
+// statusMessage Describes an HTTP status received from a custodian
+func statusMessage(statusCode int) string {
+	return fmt.Sprintf("request received HTTP %d (%s)", statusCode, http.StatusText(statusCode))
+}
@@ -0,0 +1,98 @@
+package pull
+
+import (
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/urltemplate"
+	"net/url"
+	"strings"
+)
+
+// ErrMissingValue is returned for a dataset whose endpoint needs a value
+// its list item doesn't have
+var ErrMissingValue = errors.New("dataset endpoint needs a missing value")
+
+// ErrUntrustedSelf is returned for a dataset whose self link points
+// somewhere other than its federation, which we won't send the
+// federation's credentials to
+var ErrUntrustedSelf = errors.New("dataset self link is not on the federation's host")
+
+// DatasetVariables are the item values a dataset endpoint template can
+// use
+var DatasetVariables = []string{"id", "version", "self"}
+
+// EndpointURL Joins a federation's base url and one of its endpoints.
+// Absolute endpoints, and those starting from an item's self link, are
+// used as they are
+func EndpointURL(base, endpoint string) string {
+	if strings.HasPrefix(endpoint, "{+self}") || strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return endpoint
+	}
+	return fmt.Sprintf("%s%s", base, endpoint)
+}
+
+// ParseDatasetTemplate Parses a dataset endpoint as an RFC 6570 URL
+// template over DatasetVariables
+func ParseDatasetTemplate(uri string) (*urltemplate.Template, error) {
+	t, err := urltemplate.Parse(uri, DatasetVariables...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dataset endpoint template: %w", err)
+	}
+	return t, nil
+}
+
+// datasetURL Returns the endpoint for a listed dataset. Errors when the
+// template needs a value the item doesn't have, such as the version of a
+// dataset named only by a webhook, or when a self link leaves the
+// federation's scheme and host. A relative result, e.g. from a relative
+// self link, is resolved against the list endpoint
+func (p *Pull) datasetURL(item pkg.FederationItem) (string, error) {
+	t, err := ParseDatasetTemplate(p.DatasetUri)
+	if err != nil {
+		return "", err
+	}
+
+	values := map[string]string{
+		"id":      item.PersistentID,
+		"version": item.Version,
+		"self":    item.Self,
+	}
+	for _, name := range t.Required() {
+		if values[name] == "" {
+			return "", fmt.Errorf("%w: {%s} for pid=%s", ErrMissingValue, name, item.PersistentID)
+		}
+	}
+
+	base, err := url.Parse(p.DatasetsUri)
+	if err != nil {
+		return "", fmt.Errorf("invalid list endpoint: %v", err)
+	}
+
+	if t.Uses("self") && item.Self != "" {
+		self, err := url.Parse(item.Self)
+		if err != nil || !sameOrigin(base.ResolveReference(self), base) {
+			return "", fmt.Errorf("%w: %s for pid=%s", ErrUntrustedSelf, item.Self, item.PersistentID)
+		}
+	}
+
+	uri := t.Expand(values)
+	if ref, err := url.Parse(uri); err == nil && !ref.IsAbs() {
+		uri = base.ResolveReference(ref).String()
+	}
+
+	return uri, nil
+}
+
+// NeedsListValues Returns true when the dataset endpoint uses values only
+// a list item has, so a dataset named by its persistentId alone must be
+// looked up in the list first
+func (p *Pull) NeedsListValues() bool {
+	t, err := ParseDatasetTemplate(p.DatasetUri)
+	return err == nil && (t.Uses("version") || t.Uses("self"))
+}
+
+// sameOrigin Returns true when a and b have the same scheme and host
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
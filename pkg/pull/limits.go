@@ -0,0 +1,98 @@
+package pull
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultMaxListBytes    = 50 << 20
+	defaultMaxDatasetBytes = 20 << 20
+)
+
+// ErrBodyTooLarge is returned when a custodian sends more than we're
+// prepared to read for a call
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// MaxListBytes Returns the most we'll read of a list response, from
+// GMI_MAX_LIST_BYTES
+func MaxListBytes() int64 {
+	return byteLimit("GMI_MAX_LIST_BYTES", defaultMaxListBytes)
+}
+
+// MaxDatasetBytes Returns the most we'll read of a dataset response, from
+// GMI_MAX_DATASET_BYTES
+func MaxDatasetBytes() int64 {
+	return byteLimit("GMI_MAX_DATASET_BYTES", defaultMaxDatasetBytes)
+}
+
+func byteLimit(name string, fallback int64) int64 {
+	limit, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil || limit <= 0 {
+		return fallback
+	}
+	return limit
+}
+
+// limitFor Returns the byte limit for a call to uri, which is the list
+// limit for the federation's list endpoint and the dataset limit otherwise
+func (p *Pull) limitFor(uri string) int64 {
+	if uri == p.DatasetsUri {
+		return MaxListBytes()
+	}
+	return MaxDatasetBytes()
+}
+
+// cappedBody Reads a response body until it runs past its limit. Once it
+// does, every read fails with ErrBodyTooLarge, so decoding straight from
+// it stops there
+type cappedBody struct {
+	r     io.Reader
+	read  int64
+	limit int64
+	err   error
+}
+
+// limitBody Returns a reader for a response body of at most limit bytes.
+// A declared length over the limit is refused before anything is read
+func limitBody(res *http.Response, limit int64) (*cappedBody, error) {
+	if res.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes declared, limit is %d", ErrBodyTooLarge, res.ContentLength, limit)
+	}
+	return &cappedBody{r: io.LimitReader(res.Body, limit+1), limit: limit}, nil
+}
+
+func (b *cappedBody) Read(buf []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.r.Read(buf)
+	b.read += int64(n)
+	if b.read > b.limit {
+		b.err = fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, b.limit)
+		return n - int(b.read-b.limit), b.err
+	}
+	return n, err
+}
+
+// Err Returns ErrBodyTooLarge once the body has run past its limit. Check
+// it after decoding, as decoders don't always pass read errors on
+// unwrapped
+func (b *cappedBody) Err() error {
+	return b.err
+}
+
+// readLimited Reads a response body of at most limit bytes. A body that
+// runs past it is abandoned at limit+1 bytes
+func readLimited(res *http.Response, limit int64) ([]byte, error) {
+	body, err := limitBody(res, limit)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(body)
+}
@@ -2,22 +2,26 @@ package pull
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"hdruk/federated-metadata/pkg"
-	"hdruk/federated-metadata/pkg/secrets"
+	"hdruk/federated-metadata/pkg/conditional"
+	"hdruk/federated-metadata/pkg/deletion"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/report"
 	"hdruk/federated-metadata/pkg/utils"
 	"hdruk/federated-metadata/pkg/validator"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
@@ -29,6 +33,13 @@ type HTTPClient interface {
 
 var (
 	Client HTTPClient
+
+	// ErrNotModified is returned when a custodian answers a conditional
+	// request with 304 Not Modified
+	ErrNotModified = errors.New("not modified")
+
+	// defaultTimeout bounds every call we make to a custodian
+	defaultTimeout time.Duration
 )
 
 // Pull Defines a Pull object
@@ -43,6 +54,26 @@ type Pull struct {
 	Verbose     bool
 	Dataset     string
 	Logging     string
+
+	// Transformations are applied to every dataset body before it is
+	// decoded, validated and written to the gateway
+	Transformations []pkg.TransformRule
+	// DryRun skips every gateway write and delete
+	DryRun bool
+	// SameVersionEdits is the federation's choice of whether to warn
+	// about datasets edited without a version bump
+	SameVersionEdits string
+	// Conditional sends the validators from earlier responses, so
+	// custodians can answer 304 Not Modified rather than send everything
+	Conditional bool
+	// DatasetMode, BatchUri and BatchSize say where dataset bodies come
+	// from when the custodian can send more than one per call
+	DatasetMode string
+	BatchUri    string
+	BatchSize   int
+	// DatasetSchemaUrl is the schema the federation pins its datasets
+	// to, if any
+	DatasetSchemaUrl string
 }
 
 // NewPull Creates a new instance of Pull
@@ -71,85 +102,17 @@ func init() {
 		timeoutSeconds = 10
 	}
 
-	Client = &http.Client{
-		Timeout: time.Duration(timeoutSeconds) * time.Second,
-	}
-}
-
-// GetFederations Retrieves a list of active federations from the gateway-api
-// to run against during this pull cycle
-func GetGatewayFederations(sessionId string) ([]pkg.Federation, error) {
-	method_name := utils.MethodName(0)
-
-	var customMsg string
-	customAction := "GetGatewayFederations"
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", os.Getenv("GATEWAY_API_URL"), "federations"), nil)
-
-	slog.Debug(
-		fmt.Sprintf(" --> pulling from %s \n", fmt.Sprintf("%s/%s", os.Getenv("GATEWAY_API_URL"), "federations")),
-		"x-request-session-id", sessionId,
-		"method_name", method_name,
-	)
-	if err != nil {
-		customMsg = "unable to create new request for gateway api pull"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return []pkg.Federation{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
-
-	req.Header.Add("x-request-session-id", sessionId)
-
-	res, err := Client.Do(req)
-	if os.IsTimeout(err) {
-		customMsg = "http call timed out"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s %v", customMsg, err.Error()), customAction, "GET")
-		return []pkg.Federation{}, fmt.Errorf("%s %v", customMsg, err)
-	}
-	if err != nil {
-		customMsg = "unable to pull active federations from gateway api"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return []pkg.Federation{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		customMsg = "unable to read body of response from gateway api"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return []pkg.Federation{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
-
-	var feds []pkg.Federation
-	json.Unmarshal(body, &feds)
-
-	return feds, nil
+	defaultTimeout = time.Duration(timeoutSeconds) * time.Second
+	Client = InstrumentClient(&http.Client{
+		Timeout: defaultTimeout,
+	})
 }
 
 // InvalidateFederationDueToFailure Attempts to invalidate the federation object
 // held within gateway api, due to a failure in processing. Sets enabled, tested
 // to false - so that it's updated in gateway frontend and the user can determine
 // the cause of the issue before testing again
-func InvalidateFederationDueToFailure(fed int, sessionId string) bool {
+func InvalidateFederationDueToFailure(ctx context.Context, fed int, sessionId string) bool {
 	method_name := utils.MethodName(0)
 
 	slog.Debug(
@@ -158,9 +121,6 @@ func InvalidateFederationDueToFailure(fed int, sessionId string) bool {
 		"method_name", method_name,
 	)
 
-	var customMsg string
-	customAction := "InvalidateFederationDueToFailure"
-
 	enabled, err := strconv.Atoi(os.Getenv("MARK_DISABLED_ON_ERROR"))
 	if err != nil {
 		enabled = 0
@@ -170,57 +130,17 @@ func InvalidateFederationDueToFailure(fed int, sessionId string) bool {
 		return true
 	}
 
-	body := []byte(`{
-		"enabled": 0,
-		"tested": 0
-	}`)
-
-	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/%s/%d", os.Getenv("GATEWAY_API_URL"), "federations", fed),
-		bytes.NewBuffer(body))
-	if err != nil {
-		customMsg = "unable to create new request for gateway api update %v"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("x-request-session-id", sessionId)
-
-	res, err := Client.Do(req)
-	if err != nil {
-		customMsg = "unable to update federation via gateway api %v"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
-	}
-	defer res.Body.Close()
-
-	_, err = io.ReadAll(res.Body)
-	if err != nil {
-		customMsg = "unable to read body of response from gateway api %v"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", sessionId,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
-	}
-
-	return true
+	return gateway.Default.DisableFederation(ctx, fed, sessionId) == nil
 }
 
 // GenerateHeaders Returns headers primed on the Request pointer ready
-// for authentication
+// for authentication. Also labels the request with this federation for
+// metrics
 func (p *Pull) GenerateHeaders(req *http.Request) {
 	method_name := utils.MethodName(0)
 
+	*req = *req.WithContext(metrics.WithFederation(req.Context(), p.ID))
+
 	var customMsg string
 	customAction := "GenerateHeaders"
 
@@ -238,7 +158,7 @@ func (p *Pull) GenerateHeaders(req *http.Request) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(customMsg, customAction, "")
+		utils.WriteGatewayAuditContext(req.Context(), customMsg, customAction, "")
 
 		if p.Verbose {
 			fmt.Printf("%s", customMsg)
@@ -246,155 +166,15 @@ func (p *Pull) GenerateHeaders(req *http.Request) {
 	}
 }
 
-// TestCredentials Tests that we can access an external site given
-// the provided details. Returns true if the returned status code
-// is 200. False otherwise.
-func (p *Pull) TestCredentials() gin.H {
-	method_name := utils.MethodName(0)
-
-	req, err := http.NewRequest("GET", p.DatasetsUri, nil)
-	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("Credentials Test: %v", err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return utils.FormResponse(pkg.ERROR_INVALID_HTTP_REQUEST, false, "Credentials Test", err.Error())
-	}
-
-	p.GenerateHeaders(req)
-
-	if p.Verbose {
-		fmt.Printf("%v", req)
-	}
-	result, err := Client.Do(req)
-	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("Credentials Test: %v", err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return utils.FormResponse(http.StatusBadRequest, false, "Credentials Test", err.Error())
-	}
-	defer result.Body.Close()
-
-	return checkStatus(result.StatusCode)
-}
-
-// TestDatasetsEndpoint Tests that we can access an external
-// datasets collection given the provided details. Returns true
-// if the returned status code is 200. False otherwise.
-func (p *Pull) TestDatasetsEndpoint() gin.H {
-	method_name := utils.MethodName(0)
-
-	req, err := http.NewRequest("GET", p.DatasetsUri, nil)
-
-	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("Endpoints Test: %v", err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return utils.FormResponse(pkg.ERROR_INVALID_HTTP_REQUEST, false, "Endpoints Test", err.Error())
-	}
-
-	p.GenerateHeaders(req)
-
-	result, err := Client.Do(req)
-	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("Endpoints Test: %v", err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return utils.FormResponse(http.StatusBadRequest, false, "Endpoints Tests", err.Error())
-	}
-	defer result.Body.Close()
-
-	list, err := p.CallForList()
-	if err != nil {
-		return returnFailedValidation()
-	}
-
-	if result.StatusCode != 200 {
-		return checkStatus(result.StatusCode)
-	}
-
-	if len(list.Items) == 0 {
-		customMsg := "There are no datasets listed in your federation endpoint!"
-
-		slog.Debug(
-			customMsg,
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-
-		return utils.FormResponse(500,
-			false,
-			"Federation error",
-			customMsg)
-	}
-
-	for _, item := range list.Items {
-		pid := item.PersistentID
-		version := item.Version
-
-		dataset, err := p.CallForDataset(pid)
-		if err != nil {
-			customMsg := fmt.Sprintf("failed to retrieve dataset for pid %s: %v", pid, err)
-
-			slog.Debug(
-				customMsg,
-				"x-request-session-id", p.Logging,
-				"method_name", method_name,
-			)
-
-			return utils.FormResponse(500,
-				false,
-				"Internal Server Error",
-				customMsg)
-		}
-
-		if version != dataset["version"] {
-			slog.Debug(
-				fmt.Sprintf("version mismatch: expected %s, but got %s", version, dataset["version"]),
-				"x-request-session-id", p.Logging,
-				"method_name", method_name,
-			)
-
-			return utils.FormResponse(400,
-				false,
-				"Test Unsuccessful",
-				fmt.Errorf("version mismatch: expected %s, but got %s", version, dataset["version"]).Error())
-		}
-
-		_, err = json.Marshal(dataset)
-		if err != nil {
-			slog.Debug(
-				fmt.Sprintf("failed to marshal dataset to JSON: %v", err.Error()),
-				"x-request-session-id", p.Logging,
-				"method_name", method_name,
-			)
-
-			return utils.FormResponse(500,
-				false,
-				"Internal Server Error",
-				fmt.Errorf("failed to marshal dataset to JSON: %v", err).Error())
-		}
-
-	}
-	return checkStatus(result.StatusCode)
-}
-
 // CallForList Attempts to authenticate against an external source and call
-// recorded endpoints for data
-func (p *Pull) CallForList() (pkg.FederationResponse, error) {
+// recorded endpoints for data. The call is abandoned if ctx is done first
+func (p *Pull) CallForList(ctx context.Context) (pkg.FederationResponse, error) {
 	method_name := utils.MethodName(0)
 
 	var customMsg string
 	customAction := "CallForList"
 
-	req, err := http.NewRequest("GET", p.DatasetsUri, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.DatasetsUri, nil)
 	if err != nil {
 		customMsg = "unable to form new request: %v"
 
@@ -404,7 +184,7 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 			"method_name", method_name,
 		)
 
-		utils.WriteGatewayAudit(fmt.Sprintf(customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf(customMsg, err.Error()), customAction, "GET")
 
 		if p.Verbose {
 			fmt.Println(fmt.Sprintf(customMsg, err.Error()))
@@ -414,6 +194,15 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 
 	p.GenerateHeaders(req)
 
+	// Only ask for a 304 when we have the list it would tell us to reuse
+	var previous conditional.Validators
+	if p.Conditional {
+		if validators, ok := conditional.Default.Get(p.DatasetsUri); ok && validators.Body != nil {
+			previous = validators
+			previous.Apply(req)
+		}
+	}
+
 	result, err := Client.Do(req)
 	if err != nil {
 		customMsg = "auth call failed"
@@ -430,7 +219,7 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		if p.Verbose {
 			fmt.Printf("%s: %v\n", customMsg, err)
@@ -439,8 +228,28 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 	}
 	defer result.Body.Close()
 
+	// The list we validated last time is still current
+	if previous.Body != nil && conditional.NotModified(result) {
+		if p.Verbose {
+			fmt.Printf("list at %s not modified\n", p.DatasetsUri)
+		}
+		fedList, err := pkg.DecodeFederationResponse(bytes.NewReader(previous.Body))
+		if err == nil {
+			return fedList, nil
+		}
+
+		// The list we kept is no use, so ask for it in full. With its
+		// validators forgotten the call isn't conditional, so this
+		// happens at most once
+		customMsg = "unable to reuse unmodified list, fetching it again"
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		conditional.Default.Forget(p.DatasetsUri)
+		result.Body.Close()
+		return p.CallForList(ctx)
+	}
+
 	if !utils.IsSuccessfulStatusCode(result.StatusCode) {
-		InvalidateFederationDueToFailure(p.ID, p.Logging)
+		InvalidateFederationDueToFailure(ctx, p.ID, p.Logging)
 
 		customMsg = "non-200 status returned %d - flagging federation as invalid"
 		slog.Debug(
@@ -448,7 +257,7 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf(customMsg, result.StatusCode), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf(customMsg, result.StatusCode), customAction, "GET")
 
 		if p.Verbose {
 			fmt.Printf("non-200 status returned %d, flagging federation as invalid.\n", result.StatusCode)
@@ -465,41 +274,38 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 		fmt.Printf("Running call against %s\n", p.DatasetsUri)
 	}
 
-	body, err := io.ReadAll(result.Body)
+	capped, err := limitBody(result, MaxListBytes())
 	if err != nil {
-		customMsg = "unable to read body of response"
-		slog.Debug(
-			customMsg,
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		return pkg.FederationResponse{}, p.listReadFailed(ctx, err)
+	}
 
-		if p.Verbose {
-			fmt.Printf("%s: %v\n", customMsg, err)
-		}
-		return pkg.FederationResponse{}, err
+	// Items are decoded one at a time as the body arrives. The bytes are
+	// kept to validate against the schema, which needs the whole document
+	var body bytes.Buffer
+	fedList, err := pkg.DecodeFederationResponse(io.TeeReader(capped, &body))
+	if capped.Err() != nil {
+		return pkg.FederationResponse{}, p.listReadFailed(ctx, capped.Err())
 	}
 
 	// Ensure the returned payload from http call can be validated against our schema
-	res, err := validator.ValidateSchema(string(body), p.Logging)
-	if !res || err != nil {
+	res, schemaErr := validator.ValidateSchema(body.Bytes(), p.Logging)
+	if !res || schemaErr != nil {
+		metrics.ValidationFailures.WithLabelValues(metrics.FederationLabel(p.ID), "list").Inc()
+
 		customMsg = "unable to validate incoming data against schema"
 		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err),
+			fmt.Sprintf("%s: %v", customMsg, schemaErr),
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, schemaErr), customAction, "GET")
 
 		if p.Verbose {
-			fmt.Printf("%s: %v\n", customMsg, err)
+			fmt.Printf("%s: %v\n", customMsg, schemaErr)
 		}
-		return pkg.FederationResponse{}, fmt.Errorf("schema validation failed: %v", err)
+		return pkg.FederationResponse{}, fmt.Errorf("schema validation failed: %v", schemaErr)
 	}
 
-	var fedList pkg.FederationResponse
-	err = json.Unmarshal(body, &fedList)
 	if err != nil {
 		customMsg = "unable to unmarshal response body"
 		slog.Debug(
@@ -507,7 +313,7 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		if p.Verbose {
 			fmt.Printf("%s: %v\n", customMsg, err)
@@ -515,12 +321,58 @@ func (p *Pull) CallForList() (pkg.FederationResponse, error) {
 		return pkg.FederationResponse{}, err
 	}
 
+	if p.Conditional {
+		validators := conditional.FromResponse(result)
+		validators.Body = body.Bytes()
+		conditional.Default.Set(p.DatasetsUri, validators)
+	}
+
 	return fedList, nil
 }
 
+// listReadFailed Records that a list body couldn't be read, and returns
+// the error to fail the call with
+func (p *Pull) listReadFailed(ctx context.Context, err error) error {
+	method_name := utils.MethodName(0)
+
+	customMsg := "unable to read body of response"
+	slog.Debug(
+		fmt.Sprintf("%s: %v", customMsg, err.Error()),
+		"x-request-session-id", p.Logging,
+		"method_name", method_name,
+	)
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), "CallForList", "GET")
+
+	if p.Verbose {
+		fmt.Printf("%s: %v\n", customMsg, err)
+	}
+	return err
+}
+
 // CallForDataset Is a subsequent step in the data pulling process. Issues
-// an HTTP request against an individual endpoint to probe for data
-func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
+// an HTTP request against an individual endpoint to probe for data, and
+// decodes the result into the typed dataset model
+func (p *Pull) CallForDataset(ctx context.Context, id string) (pkg.FederationDataset, error) {
+	body, err := p.CallForDatasetRaw(ctx, id)
+	if err != nil {
+		return pkg.FederationDataset{}, err
+	}
+
+	return p.decodeDataset(body)
+}
+
+// CallForDatasetRaw Issues an HTTP request against an individual dataset
+// endpoint and returns the body exactly as the custodian sent it
+func (p *Pull) CallForDatasetRaw(ctx context.Context, id string) ([]byte, error) {
+	body, _, err := p.callForDataset(ctx, pkg.FederationItem{PersistentID: id}, conditional.Validators{})
+	return body, err
+}
+
+// callForDataset Fetches a listed dataset, conditional on previous when
+// it holds validators. Returns ErrNotModified if the custodian says the
+// dataset hasn't changed, otherwise the body and the validators that came
+// with it
+func (p *Pull) callForDataset(ctx context.Context, item pkg.FederationItem, previous conditional.Validators) ([]byte, conditional.Validators, error) {
 	method_name := utils.MethodName(0)
 
 	slog.Debug(
@@ -532,9 +384,13 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 	var customMsg string
 	customAction := "CallForDataset"
 
-	datasetUriWithId := strings.ReplaceAll(p.DatasetUri, "{id}", id)
+	datasetUriWithId, err := p.datasetURL(item)
+	if err != nil {
+		utils.WriteGatewayAuditContext(ctx, err.Error(), customAction, "GET")
+		return nil, conditional.Validators{}, err
+	}
 
-	req, err := http.NewRequest("GET", datasetUriWithId, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", datasetUriWithId, nil)
 	if err != nil {
 		customMsg = "unable to form new request with following error"
 		slog.Debug(
@@ -542,12 +398,13 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
-		return map[string]interface{}{}, fmt.Errorf("%s %v", customMsg, err)
+		return nil, conditional.Validators{}, fmt.Errorf("%s %v", customMsg, err)
 	}
 
 	p.GenerateHeaders(req)
+	previous.Apply(req)
 
 	result, err := Client.Do(req)
 	if os.IsTimeout(err) {
@@ -557,13 +414,13 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		if p.Verbose {
 			fmt.Printf("http call timedout %v", err.Error())
 		}
 
-		return map[string]interface{}{}, fmt.Errorf(customMsg)
+		return nil, conditional.Validators{}, fmt.Errorf(customMsg)
 	}
 
 	if err != nil {
@@ -573,14 +430,18 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
-		return map[string]interface{}{}, fmt.Errorf("%s %v", customMsg, err)
+		return nil, conditional.Validators{}, fmt.Errorf("%s %v", customMsg, err)
 	}
 	defer result.Body.Close()
 
+	if !previous.Empty() && conditional.NotModified(result) {
+		return nil, conditional.Validators{}, ErrNotModified
+	}
+
 	if !utils.IsSuccessfulStatusCode(result.StatusCode) {
-		InvalidateFederationDueToFailure(p.ID, p.Logging)
+		InvalidateFederationDueToFailure(ctx, p.ID, p.Logging)
 
 		customMsg = fmt.Sprintf("non-200 status returned: %d. Flagging federation as invalid.", result.StatusCode)
 		slog.Debug(
@@ -588,25 +449,25 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(customMsg, customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, customMsg, customAction, "GET")
 
 		if p.Verbose {
 			fmt.Printf("%s\n", customMsg)
 		}
 
-		return map[string]interface{}{}, fmt.Errorf(customMsg)
+		return nil, conditional.Validators{}, fmt.Errorf(customMsg)
 	}
 
 	if p.Verbose {
 		slog.Debug(
-			fmt.Sprintf("running call against %s\n", p.DatasetUri),
+			fmt.Sprintf("running call against %s\n", datasetUriWithId),
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		fmt.Printf("running call against %s\n", p.DatasetUri)
+		fmt.Printf("running call against %s\n", datasetUriWithId)
 	}
 
-	body, err := io.ReadAll(result.Body)
+	body, err := readLimited(result, MaxDatasetBytes())
 	if err != nil {
 		customMsg = "unable to read body of call"
 		slog.Debug(
@@ -614,589 +475,363 @@ func (p *Pull) CallForDataset(id string) (map[string]interface{}, error) {
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
-		return map[string]interface{}{}, fmt.Errorf("%s: %v", customMsg, err)
+		return nil, conditional.Validators{}, fmt.Errorf("%s: %w", customMsg, err)
 	}
 
-	var dataset map[string]interface{}
-	if err := json.Unmarshal(body, &dataset); err != nil {
-		return map[string]interface{}{}, err
-	}
-	return dataset, nil
+	return body, conditional.FromResponse(result), nil
 }
 
-func (p *Pull) FindDataset(pid string) (pkg.Dataset, error) {
+// decodeDataset Decodes a dataset body into the typed dataset model
+func (p *Pull) decodeDataset(body []byte) (pkg.FederationDataset, error) {
 	method_name := utils.MethodName(0)
 
-	slog.Debug(
-		"GetDatasetStatus",
-		"x-request-session-id", p.Logging,
-		"method_name", method_name,
-	)
-
-	var customMsg string
-	customAction := "GetDatasetStatus"
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", os.Getenv("GATEWAY_API_URL"), "datasets", pid), nil)
-
+	dataset, err := pkg.DecodeFederationDataset(body)
 	if err != nil {
-		customMsg = "unable to create new request for gateway api pull"
+		customMsg := "unable to decode dataset body"
 		slog.Debug(
 			fmt.Sprintf("%s: %v", customMsg, err.Error()),
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.Dataset{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
+		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), "CallForDataset", "GET")
 
-	req.Header.Add("x-request-session-id", p.Logging)
-
-	res, err := Client.Do(req)
-	if os.IsTimeout(err) {
-		customMsg = "http call timed out"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.Dataset{}, fmt.Errorf("%s %v", customMsg, err)
+		return pkg.FederationDataset{}, fmt.Errorf("%s: %v", customMsg, err)
 	}
-	if err != nil {
-		customMsg = "unable to pull active federations from gateway api"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.Dataset{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-
-	var dataset pkg.Dataset
-	json.Unmarshal(body, &dataset)
-
 	return dataset, nil
 }
 
-func (p *Pull) GetTeamDatasetsGMI(teamId int) (pkg.DatasetsVersions, error) {
+// Run Runs the functionality of this process. Each federation is synced
+// within its own time budget, and the whole cycle stops if ctx is
+// cancelled or the cycle is aborted
+func Run(ctx context.Context) {
 	method_name := utils.MethodName(0)
-
-	slog.Debug(
-		"GetTeamDatasetsGMI",
-		"x-request-session-id", p.Logging,
-		"method_name", method_name,
-	)
+	sessionId := uuid.New().String()
 
 	var customMsg string
-	customAction := "GetTeamDatasetsGMI"
-
-	url := fmt.Sprintf("%s/%s?team_id=%d&create_origin=%s&onlyDatasets=true", os.Getenv("GATEWAY_API_URL"), "datasets", teamId, "GMI")
+	customAction := "Run"
 
-	req, err := http.NewRequest("GET", url, nil)
+	cycleLock.Lock()
+	defer cycleLock.Unlock()
 
-	if err != nil {
-		customMsg = "unable to create new request for gateway api pull"
+	if draining.Load() {
 		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
+			"service is shutting down, skipping pull cycle",
+			"x-request-session-id", sessionId,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.DatasetsVersions{}, fmt.Errorf("%s: %v", customMsg, err)
+		return
 	}
 
-	req.Header.Add("x-request-session-id", p.Logging)
-
-	res, err := Client.Do(req)
-	if os.IsTimeout(err) {
-		customMsg = "http call timed out"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.DatasetsVersions{}, fmt.Errorf("%s %v", customMsg, err)
-	}
-	if err != nil {
-		customMsg = "unable to pull datasets for a team from the gateway api"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-		return pkg.DatasetsVersions{}, fmt.Errorf("%s: %v", customMsg, err)
-	}
-	defer res.Body.Close()
-
-	body, _ := io.ReadAll(res.Body)
-	var datasetsVersions pkg.DatasetsVersions
-	err = json.Unmarshal(body, &datasetsVersions)
-	if err != nil {
-
-		if string(body) == "[]" {
-			customMsg = "problem with datasetVersions body"
-			slog.Debug(
-				fmt.Sprintf("%s: %v", customMsg, err.Error()),
-				"x-request-session-id", p.Logging,
-				"method_name", method_name,
-			)
-			utils.WriteGatewayAudit("No existing GMI datasets found for this team", customAction, "GET")
-			return pkg.DatasetsVersions{}, nil
-		}
-
-		customMsg = "unable to unmarshal body response of call"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-
-		if p.Verbose {
-			fmt.Printf("unable to unmarshal body response of call %v\n", err)
-		}
-	}
-
-	return datasetsVersions, nil
-}
-
-func (p *Pull) DeleteTeamDataset(teamId int, pid string) error {
-	method_name := utils.MethodName(0)
+	ctx, cancel := abortable(ctx)
+	defer cancel()
 
+	fmt.Println("Pulling data...")
 	slog.Debug(
-		"DeleteTeamDataset",
-		"x-request-session-id", p.Logging,
+		"Running the pull service",
+		"x-request-session-id", sessionId,
 		"method_name", method_name,
 	)
+	utils.WriteGatewayAuditContext(ctx, "Running the pull service", customAction, "GET")
 
-	var customMsg string
-	customAction := "DeleteTeamDataset"
-
-	body := map[string]int{
-		"team_id": teamId,
-	}
-
-	jsonPayload, _ := json.Marshal(body)
-
-	token, err := utils.GetServiceUserJWT()
-
-	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("failed to marshal login payload: %v", err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return fmt.Errorf("failed to marshal login payload: %v", err)
-	}
-
-	req, err := http.NewRequest("DELETE",
-		fmt.Sprintf("%s/%s/%s/%s",
-			os.Getenv("GATEWAY_API_URL"),
-			"federations",
-			"delete",
-			pid,
-		), bytes.NewBuffer(jsonPayload))
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("x-request-session-id", p.Logging)
-
-	if err != nil {
-		customMsg = "unable to create new request for gateway api pull"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
-		return fmt.Errorf("%s: %v", customMsg, err)
-	}
+	cycle := report.NewCycle(sessionId)
+	var cycleErr error
+	defer func() {
+		cycle.Finish(cycleErr)
+		metrics.ObserveCycle(*cycle, report.FederationRuns(sessionId))
+	}()
 
-	res, err := Client.Do(req)
-	if os.IsTimeout(err) {
-		customMsg = "http call timed out"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s %v", customMsg, err.Error()), customAction, "DELETE")
-		return fmt.Errorf("%s %v", customMsg, err)
-	}
+	// Firstly grab a list of all active federations in the api
+	feds, err := gateway.Default.ListFederations(ctx, sessionId)
 	if err != nil {
-		customMsg = "unable to pull datasets for a team from the gateway api"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
-		return fmt.Errorf("%s: %v", customMsg, err)
+		fmt.Printf("%v\n", err.Error())
+		cycleErr = err
 	}
-	defer res.Body.Close()
-	return nil
-}
-
-func (p *Pull) CreateOrUpdateTeamDataset(teamId string, pid string, metadata string, update bool) error {
-	method_name := utils.MethodName(0)
 
 	slog.Debug(
-		"CreateTeamDataset",
-		"x-request-session-id", p.Logging,
+		fmt.Sprintf("collected %d federations", len(feds)),
+		"x-request-session-id", sessionId,
 		"method_name", method_name,
 	)
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("collected %d federations", len(feds)), customAction, "GET")
+	fmt.Printf("Found %d federations \n", len(feds))
+	for _, fed := range feds {
 
-	var customMsg string
-	customAction := "CreateTeamDataset"
-
-	// Send the dataset to Gateway API for processing
-	body := map[string]string{
-		"team_id":       teamId,
-		"user_id":       os.Getenv("GATEWAY_API_USER_ID"),
-		"metadata":      metadata,
-		"create_origin": "GMI",
-		"status":        "ACTIVE",
-		"pid":           pid,
-	}
+		// Let the federation in progress finish, but don't start another
+		// once we've been asked to stop
+		if draining.Load() || ctx.Err() != nil {
+			customMsg = "service is shutting down, leaving remaining federations for the next cycle"
+			slog.Info(customMsg, "x-request-session-id", sessionId, "method_name", method_name)
+			utils.WriteGatewayAudit(customMsg, customAction, "")
+			cycleErr = report.ErrInterrupted
+			break
+		}
 
-	jsonPayload, _ := json.Marshal(body)
+		fmt.Printf("Working on federation= %d \n", fed.ID)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("Working on federation= %d ", fed.ID), customAction, "GET")
 
-	url := fmt.Sprintf("%s/%s", os.Getenv("GATEWAY_API_URL"), "federations")
-	method := "POST"
-	if update {
-		url = fmt.Sprintf("%s/%s/%s/%s", os.Getenv("GATEWAY_API_URL"), "federations", "update", pid)
-		method = "PUT"
-		fmt.Printf("---> UPDATING existing dataset %s \n", pid)
-	} else {
-		fmt.Printf("---> creating a new dataset! \n")
-	}
+		// Determine if it is time to run this federation
+		if !isTimeToRun(&fed) {
+			fmt.Println("it is not time to run this federation..")
+			continue
+		}
 
-	req, err := http.NewRequest(method, url,
-		bytes.NewBuffer(jsonPayload),
-	)
+		run := report.NewFederationRun(fed.ID, sessionId)
 
-	if os.IsTimeout(err) {
-		customMsg = "http call timed out"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, method)
+		fedCtx, cancelFed := WithFederationBudget(ctx)
+		stop := pullFederation(fedCtx, &fed, run, sessionId)
+		cancelFed()
 
-		if p.Verbose {
-			fmt.Printf("http call timedout %v", err.Error())
+		if ctx.Err() != nil {
+			cycleErr = report.ErrInterrupted
+			return
 		}
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("x-request-session-id", p.Logging)
+		if stop {
+			return
+		}
+	} //loop over feds
+}
+
+// pullFederation Syncs every dataset a federation lists to the team it
+// belongs to in the gateway, deleting from each team those it no longer
+// lists, and records how it went on run. Returns true when the error met
+// means the whole cycle should stop
+func pullFederation(ctx context.Context, fed *pkg.Federation, run *report.FederationRun, sessionId string) bool {
+	method_name := utils.MethodName(0)
 
-	token, err := utils.GetServiceUserJWT()
+	var customMsg string
+	customAction := "Run"
 
+	// A federation we can't map to teams is misconfigured, not failing,
+	// so it's reported without being invalidated
+	teamIds, err := TeamIDs(fed)
 	if err != nil {
-		slog.Debug(
-			fmt.Sprintf("failed to marshal login payload: %v", err),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		return fmt.Errorf("failed to marshal login payload: %v", err)
+		customMsg = "invalid federation config"
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s %d: %v", customMsg, fed.ID, err.Error()), customAction, "GET")
+		run.Finish(fmt.Errorf("%s: %w", customMsg, err))
+		return false
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-
+	// Gather the gcloud secrets for this federation and create a new
+	// Pull object to action the request
+	p, err := NewFederationPull(ctx, fed, sessionId)
 	if err != nil {
-		customMsg = "unable to prepare gateway api call with processed dataset"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, method)
-
-		if p.Verbose {
-			fmt.Printf("%v\n", fmt.Errorf("unable to prepare gateway api call with processed dataset: %v", err))
+		if reason := stopReason(ctx); reason != nil {
+			stopRun(run, reason, sessionId)
+			return false
 		}
+		run.Finish(err)
+		return false
 	}
-	result, err := Client.Do(req)
-	if result.StatusCode > 400 {
-		fmt.Printf("%v\n", fmt.Errorf("unable to call gateway api with processed dataset: %v", result))
-	}
-	if err != nil {
-		customMsg = "unable to call gateway api with processed dataset"
-		slog.Debug(
-			fmt.Sprintf("%s: %v", customMsg, err.Error()),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, method)
 
-		if p.Verbose {
-			fmt.Printf("%v\n", fmt.Errorf("unable to call gateway api with processed dataset: %v", err))
+	list, err := p.CallForList(ctx)
+	if err != nil {
+		// Our own cancellation isn't the custodian's fault
+		if reason := stopReason(ctx); reason != nil {
+			stopRun(run, reason, sessionId)
+			return false
 		}
-	}
-	defer result.Body.Close()
 
-	bodyResponse, err := io.ReadAll(result.Body)
-	if err != nil {
-		customMsg = "unable to parse body of gateway api dataset store call"
+		fmt.Printf("errors: %s\n", err)
+		// Invalidate this federation as it has received an error
+		InvalidateFederationDueToFailure(ctx, fed.ID, p.Logging)
+
+		customMsg = "unable to validate provided payload against our schema"
 		slog.Debug(
 			fmt.Sprintf("%s: %v", customMsg, err.Error()),
 			"x-request-session-id", p.Logging,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, method)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		if p.Verbose {
-			fmt.Printf("%v\n", fmt.Errorf("unable to parse body of gateway api dataset store call: %v", err))
+			fmt.Printf("%v\n", fmt.Errorf("unable to validate provided payload against our schema: %v", err))
 		}
-	}
-
-	var out bytes.Buffer
-	json.Indent(&out, bodyResponse, "", "  ")
-	fmt.Printf("%s", out.Bytes())
+		run.Finish(err)
+		return true // stop actually doing things?!?!?
 
-	return nil
-}
-
-// Run Runs the functionality of this process
-func Run() {
-	method_name := utils.MethodName(0)
-	sessionId := uuid.New().String()
-
-	var customMsg string
-	customAction := "Run"
+	}
 
-	fmt.Println("Pulling data...")
+	if p.Verbose {
+		fmt.Printf("Number of datasets: %d\n", len(list.Items))
+	}
 	slog.Debug(
-		"Running the pull service",
-		"x-request-session-id", sessionId,
+		fmt.Sprintf("Number of datasets: %d\n", len(list.Items)),
+		"x-request-session-id", p.Logging,
 		"method_name", method_name,
 	)
-	utils.WriteGatewayAudit("Running the pull service", customAction, "GET")
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("Number of datasets: %d\n", len(list.Items)), customAction, "GET")
 
-	// Firstly grab a list of all active federations in the api
-	feds, err := GetGatewayFederations(sessionId)
+	//find all the pids of datasets in the GMI payload
+	var fedPids []string
+	for _, item := range list.Items {
+		pid := string(item.PersistentID)
+		fmt.Printf("federation: %s, pid: %s, version: %s\n", strconv.Itoa(fed.ID), pid, string(item.Version))
+		fedPids = append(fedPids, pid)
+	}
+
+	//retrieve the pids already in the gateway for each team, that have been created via GMI (create_origin="GMI")
+	// Without them we can't tell a create from an update, or what to
+	// delete, so leave this federation for the next cycle
+	existing, err := listTeamDatasets(ctx, teamIds, sessionId)
 	if err != nil {
-		fmt.Printf("%v\n", err.Error())
+		if reason := stopReason(ctx); reason != nil {
+			stopRun(run, reason, sessionId)
+			return false
+		}
+		customMsg = "unable to retrieve existing GMI datasets"
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		run.Finish(fmt.Errorf("%s: %w", customMsg, err))
+		return false
 	}
 
-	slog.Debug(
-		fmt.Sprintf("collected %d federations", len(feds)),
-		"x-request-session-id", sessionId,
-		"method_name", method_name,
-	)
-	utils.WriteGatewayAudit(fmt.Sprintf("collected %d federations", len(feds)), customAction, "GET")
-	fmt.Printf("Found %d federations \n", len(feds))
-	for _, fed := range feds {
+	// Datasets listed again are no longer up for deletion, and those the
+	// gateway no longer holds needn't be
+	if !p.DryRun {
+		for _, pid := range fedPids {
+			for _, cancelled := range deletion.Default.Cancel(fed.ID, pid) {
+				customMsg = fmt.Sprintf("cancelled deletion of pid=%s from team_id=%d, listed again after %d missed runs", pid, cancelled.TeamID, cancelled.MissingRuns)
+				utils.WriteGatewayAuditContext(ctx, customMsg, customAction, "DELETE")
+				if p.Verbose {
+					fmt.Printf("%s\n", customMsg)
+				}
+			}
+		}
+		deletion.Default.Retain(fed.ID, func(pending deletion.Pending) bool {
+			return existing.has(pending.TeamID, pending.PersistentID)
+		})
+	}
 
-		teamId := fed.Team[0].ID
-		fmt.Printf("Working on teamId= %d \n", teamId)
-		utils.WriteGatewayAudit(fmt.Sprintf("Working on teamId= %d ", teamId), customAction, "GET")
+	policy := deletion.PolicyFor(fed)
+	now := time.Now().UTC()
 
-		// Determine if it is time to run this federation
-		if !isTimeToRun(&fed) {
-			fmt.Println("it is not time to run this federation..")
+	for _, teamId := range teamIds {
+		var existingGatewayDatasetPids []string
+		for key := range existing.datasets[teamId] {
+			existingGatewayDatasetPids = append(existingGatewayDatasetPids, key)
+		}
+
+		if len(existingGatewayDatasetPids) == 0 {
 			continue
 		}
-		// Next gather the gcloud secrets for this federation
-		var accessToken string = ""
-
-		// only need to do this when there is some AUTH
-		if fed.AuthType != "NO_AUTH" {
-			sec := secrets.NewSecrets(fed.PID, "")
-			ret, err := sec.GetSecret(fed.AuthType)
-			if err != nil {
-				customMsg = "unable to retrieve secrets from gcloud"
-				fmt.Printf(" --> %s: %v \n", customMsg, err.Error())
-				utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		if p.Verbose {
+			fmt.Printf("Existing pids for team_id=%d %v\n", teamId, existingGatewayDatasetPids)
+		}
+		// find if there are any existing pids created with GMI previously that are no longer in the payload
+		existingPidForDeletion := utils.FindMissingElements(existingGatewayDatasetPids, fedPids)
+		sort.Strings(existingPidForDeletion)
+		if len(existingPidForDeletion) > 0 && p.Verbose {
+			fmt.Printf("Up for deletion... %v\n", existingPidForDeletion)
+		}
+		for _, pid := range existingPidForDeletion {
+			if reason := stopReason(ctx); reason != nil {
+				stopRun(run, reason, sessionId)
+				return false
+			}
+			if p.DryRun {
+				if p.Verbose {
+					fmt.Printf("--> dry run: would delete pid=%s from team_id=%d\n", pid, teamId)
+				}
+				run.AddDataset(report.DatasetOutcome{PersistentID: pid, TeamID: teamId, Action: report.ActionSkipped, Message: "dry run: would delete"})
+				continue
+			}
 
+			// A dataset is only deleted once it has been missing long
+			// enough that it isn't a custodian hiccup
+			pending := deletion.Default.Miss(fed.ID, teamId, pid, now)
+			if !policy.Due(pending) {
+				run.AddDataset(report.DatasetOutcome{
+					PersistentID: pid,
+					TeamID:       teamId,
+					Action:       report.ActionPendingDeletion,
+					Message:      policy.Describe(pending),
+				})
 				continue
 			}
 
-			if reflect.TypeOf(ret).String() == "secrets.BearerTokenResponse" {
-				accessToken = ret.(secrets.BearerTokenResponse).BearerToken
-			} else if reflect.TypeOf(ret).String() == "secrets.APIKeyResponse" {
-				accessToken = ret.(secrets.APIKeyResponse).APIKey
+			//delete any existing GMI created datasets that are no longer in the GMI payload
+			outcome := p.deleteDataset(ctx, teamId, pid, policy.Describe(pending))
+			if outcome.Action == report.ActionDeleted {
+				deletion.Default.Forget(fed.ID, teamId, pid)
 			}
+			run.AddDataset(outcome)
 		}
+	}
 
-		// Create a new Pull object to action the request
-		p := NewPull(
-			fed.ID,
-			fmt.Sprintf("%s%s", fed.EndpointBaseURL, fed.EndpointDatasets),
-			fmt.Sprintf("%s%s", fed.EndpointBaseURL, fed.EndpointDataset),
-			"",
-			"",
-			accessToken,
-			fed.AuthType,
-			true,
-			sessionId,
-		)
+	prefetched := p.newPrefetcher(list.Items)
+
+	for _, item := range list.Items {
 
-		list, err := p.CallForList()
+		if reason := stopReason(ctx); reason != nil {
+			stopRun(run, reason, sessionId)
+			return false
+		}
+
+		pid := item.PersistentID
+
+		body, validators, err := p.fetchDataset(ctx, item, existing, prefetched)
+		if errors.Is(err, ErrNotModified) {
+			run.AddDataset(notModifiedOutcome(item))
+			continue
+		}
+		// One oversized or unaddressable dataset is the custodian's
+		// problem, not a reason to stop syncing the rest
+		if errors.Is(err, ErrBodyTooLarge) || errors.Is(err, ErrMissingValue) || errors.Is(err, ErrUntrustedSelf) {
+			run.AddDataset(report.DatasetOutcome{
+				PersistentID: pid,
+				Version:      item.Version,
+				Action:       report.ActionInvalid,
+				Message:      err.Error(),
+			})
+			continue
+		}
 		if err != nil {
+			if reason := stopReason(ctx); reason != nil {
+				stopRun(run, reason, sessionId)
+				return false
+			}
+
 			fmt.Printf("errors: %s\n", err)
-			// Invalidate this federation as it has received an error
-			InvalidateFederationDueToFailure(fed.ID, p.Logging)
+			InvalidateFederationDueToFailure(ctx, fed.ID, p.Logging)
 
-			customMsg = "unable to validate provided payload against our schema"
+			customMsg = "unable to pull invidual dataset"
 			slog.Debug(
 				fmt.Sprintf("%s: %v", customMsg, err.Error()),
 				"x-request-session-id", p.Logging,
 				"method_name", method_name,
 			)
-			utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+			utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 			if p.Verbose {
-				fmt.Printf("%v\n", fmt.Errorf("unable to validate provided payload against our schema: %v", err))
+				fmt.Printf("%v\n", fmt.Errorf("unable to pull individual dataset: %v", err))
 			}
-			return // stop actually doing things?!?!?
-
-		}
-
-		if p.Verbose {
-			fmt.Printf("Number of datasets: %d\n", len(list.Items))
-		}
-		slog.Debug(
-			fmt.Sprintf("Number of datasets: %d\n", len(list.Items)),
-			"x-request-session-id", p.Logging,
-			"method_name", method_name,
-		)
-		utils.WriteGatewayAudit(fmt.Sprintf("Number of datasets: %d\n", len(list.Items)), customAction, "GET")
-
-		//find all the pids of datasets in the GMI payload
-		var fedPids []string
-		for _, item := range list.Items {
-			pid := string(item.PersistentID)
-			fmt.Printf("teamId: %s, pid: %s, version: %s\n", strconv.Itoa(fed.Team[0].ID), pid, string(item.Version))
-			fedPids = append(fedPids, pid)
+			run.Finish(err)
+			return true // stop doing things plz
 		}
 
-		//retrieve the pids already in the gateway for this team, that have been created via GMI (create_origin="GMI")
-		existingPidsAndVersions, _ := p.GetTeamDatasetsGMI(teamId)
+		outcome, err := p.syncDataset(ctx, fed, item, body, existing)
+		if err != nil {
+			fmt.Printf("errors: %s\n", err)
+			InvalidateFederationDueToFailure(ctx, fed.ID, p.Logging)
 
-		var existingGatewayDatasetPids []string
-		for key := range existingPidsAndVersions {
-			existingGatewayDatasetPids = append(existingGatewayDatasetPids, key)
-		}
+			utils.WriteGatewayAuditContext(ctx, err.Error(), customAction, "GET")
 
-		if len(existingGatewayDatasetPids) > 0 {
 			if p.Verbose {
-				fmt.Printf("Existing pids for team_id=%d %v\n", teamId, existingGatewayDatasetPids)
-			}
-			// find if there are any existing pids created with GMI previously that are no longer in the payload
-			existingPidForDeletion := utils.FindMissingElements(existingGatewayDatasetPids, fedPids)
-			if len(existingPidForDeletion) > 0 {
-				if p.Verbose {
-					fmt.Printf("Up for deletion... %v\n", existingPidForDeletion)
-				}
-				for _, pid := range existingPidForDeletion {
-					//delete any existing GMI created datasets that are no longer in the GMI payload
-					p.DeleteTeamDataset(teamId, pid)
-				}
+				fmt.Printf("%v\n", err)
 			}
+			run.Finish(err)
+			return true // stop doing things plz
 		}
+		run.AddDataset(outcome)
+		for _, moved := range p.removeFromOtherTeams(ctx, outcome, existing) {
+			run.AddDataset(moved)
+		}
+		p.rememberValidators(item, outcome, validators)
+	} //loop over datasets
 
-		for _, item := range list.Items {
-
-			pid := item.PersistentID
-			version := item.Version
-
-			dataset, err := p.CallForDataset(pid)
-			if err != nil {
-				fmt.Printf("errors: %s\n", err)
-				InvalidateFederationDueToFailure(fed.ID, p.Logging)
-
-				customMsg = "unable to pull invidual dataset"
-				slog.Debug(
-					fmt.Sprintf("%s: %v", customMsg, err.Error()),
-					"x-request-session-id", p.Logging,
-					"method_name", method_name,
-				)
-				utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-
-				if p.Verbose {
-					fmt.Printf("%v\n", fmt.Errorf("unable to pull individual dataset: %v", err))
-				}
-				return // stop doing things plz
-			}
-
-			if version != dataset["version"] {
-
-				msg := fmt.Errorf("version mis-match... %s != %s ... skipping", version, dataset["version"])
-				customMsg = "Version in /datasets does not match this version"
-				slog.Debug(
-					fmt.Sprintf("%s: %v", customMsg, msg),
-					"x-request-session-id", p.Logging,
-					"method_name", method_name,
-				)
-				utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, msg), customAction, "GET")
-				if p.Verbose {
-					fmt.Printf("%v\n", msg)
-				}
-				continue
-			}
-
-			jsonString, err := json.Marshal(dataset)
-			if err != nil {
-				fmt.Printf("errors: %s\n", err)
-				InvalidateFederationDueToFailure(fed.ID, p.Logging)
-
-				customMsg = "unable to marshal dataset response to json"
-				slog.Debug(
-					fmt.Sprintf("%s: %v", customMsg, err.Error()),
-					"x-request-session-id", p.Logging,
-					"method_name", method_name,
-				)
-				utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
-
-				if p.Verbose {
-					fmt.Printf("%v\n", fmt.Errorf("unable to marshal dataset to json: %v", err))
-				}
-				return // stop doing things plz
-			}
-
-			//check if the dataset is already in the gateway
-			existsInGateway := utils.StringInSlice(pid, existingGatewayDatasetPids)
-
-			//check if the version number is already in the gateway
-			versionAlreadyInGateway := false
-			if existsInGateway {
-				versions := existingPidsAndVersions[pid].Versions
-				versionAlreadyInGateway = utils.StringInSlice(version, versions)
-			}
-
-			fmt.Printf("existsInGateway=%t, version_in_gateway=%t \n", existsInGateway, versionAlreadyInGateway)
-			fmt.Printf("--> version=%s \n ", version)
-			fmt.Printf("--> versions=%v \n ", existingPidsAndVersions[pid].Versions)
-
-			if existsInGateway {
-				if versionAlreadyInGateway {
-					if p.Verbose {
-						fmt.Printf("Skipping pid=%s version=%s as dataset is already in the gateway\n", pid, string(item.Version))
-					}
-					continue
-				} else {
-					if p.Verbose {
-						fmt.Printf("Updating dataset pid=%s", pid)
-					}
-					p.CreateOrUpdateTeamDataset(strconv.Itoa(fed.Team[0].ID), pid, string(jsonString), true)
-				}
-			} else {
-				if p.Verbose {
-					fmt.Printf("Create a new dataset pid=%s", pid)
-				}
-				p.CreateOrUpdateTeamDataset(strconv.Itoa(fed.Team[0].ID), pid, string(jsonString), false)
-			}
-		} //loop over datasets
-	} //loop over feds
+	run.Finish(nil)
+	return false
 }
 
 func determineOperationRequired(fed *pkg.Federation, dataset *pkg.FederationDataset) {
@@ -1256,33 +891,3 @@ func isTimeToRun(fed *pkg.Federation) bool {
 
 	return false
 }
-
-func returnFailedValidation() gin.H {
-	return utils.FormResponse(http.StatusOK, false, "Schema Validation Failed",
-		fmt.Errorf("%s", "test request failed to validate response against schema definition").Error())
-}
-
-// checkStatus Returns based upon the received HTTP status code
-// from external server request
-func checkStatus(statusCode int) gin.H {
-	switch statusCode {
-	case 200:
-		return utils.FormResponse(statusCode, true, "Test Successful", "")
-	case 400:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request received HTTP 400 (Bad Request)").Error())
-	case 401:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request received HTTP 401 (Unauthorized)").Error())
-	case 403:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request received HTTP 403 (Forbidden)").Error())
-	case 404:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request received HTTP 404 (Not Found)").Error())
-	case 500:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request received HTTP 500 (Internal Server Error)").Error())
-	case 501:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request receveid HTTP 501 (Not Implemented)").Error())
-	case 503:
-		return utils.FormResponse(statusCode, false, "Test Unsuccessful", fmt.Errorf("%s", "request receveid HTTP 503 (Gateway Timeout)").Error())
-	}
-
-	return utils.FormResponse(pkg.ERROR_UNKNOWN, false, "Test Unsuccessful", fmt.Errorf("%s", "unknown error received").Error())
-}
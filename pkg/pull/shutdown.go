@@ -0,0 +1,143 @@
+package pull
+
+import (
+	"context"
+	"fmt"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownTimeout Leaves headroom inside Kubernetes' default 30
+// second termination grace period
+const defaultShutdownTimeout = 25 * time.Second
+
+var (
+	// cycleLock is held for the whole of a pull cycle, so Wait can tell
+	// when the running cycle has returned
+	cycleLock sync.Mutex
+
+	draining atomic.Bool
+	aborting atomic.Bool
+
+	// cancelCycle cancels the context of the running cycle or targeted
+	// sync, so Abort can stop calls already in flight
+	cancelMu    sync.Mutex
+	cancelCycle context.CancelFunc
+)
+
+// ShutdownTimeout Returns how long a running pull cycle is given to finish
+// its current federation once the service is asked to stop. Read from
+// GMI_SHUTDOWN_TIMEOUT_SECONDS
+func ShutdownTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("GMI_SHUTDOWN_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Drain Stops pull cycles from starting, and a running cycle from moving
+// on to its next federation. The federation in progress carries on
+func Drain() {
+	draining.Store(true)
+}
+
+// Abort Stops a running cycle, cancelling any custodian, gateway or
+// secret manager call in flight. The federation in progress is recorded
+// as interrupted
+func Abort() {
+	aborting.Store(true)
+
+	cancelMu.Lock()
+	defer cancelMu.Unlock()
+	if cancelCycle != nil {
+		cancelCycle()
+	}
+}
+
+// Resume Clears Drain and Abort, letting pull cycles run again
+func Resume() {
+	draining.Store(false)
+	aborting.Store(false)
+}
+
+// Wait Blocks until any running pull cycle has returned. Returns false if
+// ctx is done first
+func Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		cycleLock.Lock()
+		cycleLock.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown Drains the pull service, giving the running cycle until ctx's
+// deadline to finish its current federation. Past the deadline the cycle
+// is aborted and given grace to record where it stopped. Returns false if
+// the cycle still hadn't returned
+func Shutdown(ctx context.Context, grace time.Duration) bool {
+	Drain()
+	if Wait(ctx) {
+		return true
+	}
+
+	method_name := utils.MethodName(0)
+	customMsg := "pull cycle did not finish before the shutdown deadline, aborting"
+	slog.Info(customMsg, "method_name", method_name)
+	utils.WriteGatewayAudit(customMsg, "Shutdown", "")
+
+	Abort()
+	graceCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return Wait(graceCtx)
+}
+
+// abortable Returns a child of ctx that Abort cancels. Callers must hold
+// cycleLock, and call the returned func once they're done
+func abortable(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cancelMu.Lock()
+	cancelCycle = cancel
+	cancelMu.Unlock()
+
+	// Abort may have been called before we were registered
+	if aborting.Load() {
+		cancel()
+	}
+
+	return ctx, func() {
+		cancelMu.Lock()
+		cancelCycle = nil
+		cancelMu.Unlock()
+		cancel()
+	}
+}
+
+// stopRun Records a federation run as cut short, either by shutdown or by
+// running out of time. The run's context is done by now, so the audit is
+// written without it
+func stopRun(run *report.FederationRun, reason error, sessionId string) {
+	customMsg := fmt.Sprintf("federation %d stopped after %d datasets: %v", run.FederationID, len(run.Datasets), reason)
+	slog.Info(
+		customMsg,
+		"x-request-session-id", sessionId,
+		"method_name", utils.MethodName(1),
+	)
+	utils.WriteGatewayAudit(customMsg, "Run", "")
+	run.Finish(reason)
+}
@@ -0,0 +1,504 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/conditional"
+	"hdruk/federated-metadata/pkg/contenthash"
+	"hdruk/federated-metadata/pkg/deletion"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/outbox"
+	"hdruk/federated-metadata/pkg/quality"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/secrets"
+	"hdruk/federated-metadata/pkg/utils"
+	"hdruk/federated-metadata/pkg/validator"
+	"log/slog"
+	"strings"
+)
+
+// NewFederationPull Creates the Pull used to sync a federation, fetching
+// its credentials from secret manager when it needs some
+func NewFederationPull(ctx context.Context, fed *pkg.Federation, sessionId string) (*Pull, error) {
+	var accessToken string = ""
+
+	if err := checkDatasetMode(fed); err != nil {
+		return nil, fmt.Errorf("invalid federation config: %w", err)
+	}
+	if _, err := ParseDatasetTemplate(EndpointURL(fed.EndpointBaseURL, fed.EndpointDataset)); err != nil {
+		return nil, fmt.Errorf("invalid federation config: %w", err)
+	}
+
+	// only need to do this when there is some AUTH
+	if fed.AuthType != "NO_AUTH" {
+		sec := secrets.NewSecrets(fed.PID, "")
+		ret, err := sec.GetSecret(ctx, fed.AuthType)
+		if err != nil {
+			metrics.SecretFetchFailures.WithLabelValues(metrics.FederationLabel(fed.ID)).Inc()
+			customMsg := "unable to retrieve secrets from gcloud"
+			fmt.Printf(" --> %s: %v \n", customMsg, err.Error())
+			utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), "NewFederationPull", "GET")
+
+			return nil, fmt.Errorf("%s: %v", customMsg, err)
+		}
+
+		accessToken = secrets.AccessToken(ret)
+	}
+
+	p := NewPull(
+		fed.ID,
+		fmt.Sprintf("%s%s", fed.EndpointBaseURL, fed.EndpointDatasets),
+		EndpointURL(fed.EndpointBaseURL, fed.EndpointDataset),
+		"",
+		"",
+		accessToken,
+		fed.AuthType,
+		true,
+		sessionId,
+	)
+	p.Transformations = fed.Transformations
+	p.DryRun = isDryRun()
+	p.SameVersionEdits = fed.SameVersionEdits
+	p.Conditional = conditional.Enabled()
+	p.DatasetMode = fed.DatasetMode
+	p.BatchUri = fmt.Sprintf("%s%s", fed.EndpointBaseURL, fed.EndpointBatch)
+	p.BatchSize = fed.BatchSize
+	p.DatasetSchemaUrl = fed.DatasetSchemaURL
+
+	return p, nil
+}
+
+// SyncDatasets Syncs just the given persistentIds of a federation to the
+// gateway, rather than everything in its list. Withdrawn datasets are
+// deleted from the gateway if we created them and the custodian's list no
+// longer holds them. Datasets not reached before ctx is done, or the sync
+// is aborted, are skipped
+func SyncDatasets(ctx context.Context, p *Pull, fed *pkg.Federation, pids []string, withdrawn bool) []report.DatasetOutcome {
+	method_name := utils.MethodName(0)
+	customAction := "SyncDatasets"
+
+	slog.Debug(
+		fmt.Sprintf("syncing %d datasets for federation %d (withdrawn=%t)", len(pids), fed.ID, withdrawn),
+		"x-request-session-id", p.Logging,
+		"method_name", method_name,
+	)
+
+	// Never write alongside a pull cycle, which may be syncing the same
+	// datasets
+	cycleLock.Lock()
+	defer cycleLock.Unlock()
+
+	if draining.Load() {
+		return skippedOutcomes(pids, "service is shutting down")
+	}
+	teamIds, err := TeamIDs(fed)
+	if err != nil {
+		return skippedOutcomes(pids, fmt.Sprintf("invalid federation config: %v", err))
+	}
+
+	ctx, cancel := abortable(ctx)
+	defer cancel()
+
+	outcomes := []report.DatasetOutcome{}
+
+	existing, err := listTeamDatasets(ctx, teamIds, p.Logging)
+	if err != nil {
+		return skippedOutcomes(pids, fmt.Sprintf("unable to read existing gateway datasets: %v", err))
+	}
+
+	items := []pkg.FederationItem{}
+	for _, pid := range pids {
+		items = append(items, pkg.FederationItem{PersistentID: pid})
+	}
+	listed := map[string]bool{}
+	if withdrawn {
+		if listed, err = p.lookupItems(ctx, items); err != nil {
+			return skippedOutcomes(pids, fmt.Sprintf("unable to confirm the withdrawal against the custodian's list: %v", err))
+		}
+	} else if p.NeedsListValues() {
+		if listed, err = p.lookupItems(ctx, items); err != nil {
+			return skippedOutcomes(pids, fmt.Sprintf("unable to read the list the dataset endpoint needs: %v", err))
+		}
+	}
+	prefetched := p.newPrefetcher(items)
+
+	for i, pid := range pids {
+		if reason := stopReason(ctx); reason != nil {
+			return append(outcomes, skippedOutcomes(pids[i:], reason.Error())...)
+		}
+
+		// A dataset the custodian names isn't missing: a withdrawal
+		// the list confirms deletes it straight away, and anything else
+		// means it's back
+		if !p.DryRun {
+			deletion.Default.Cancel(fed.ID, pid)
+		}
+
+		if withdrawn && listed[pid] {
+			// Only the list is trusted to say a dataset is gone, so a
+			// replayed or mistaken withdrawal can't delete it
+			outcomes = append(outcomes, report.DatasetOutcome{PersistentID: pid, Action: report.ActionSkipped, Message: "withdrawn, but still in the custodian's list"})
+			continue
+		}
+		if withdrawn {
+			outcomes = append(outcomes, p.withdrawDataset(ctx, pid, existing)...)
+			continue
+		}
+
+		item := items[i]
+		body, validators, err := p.fetchDataset(ctx, item, existing, prefetched)
+		if errors.Is(err, ErrNotModified) {
+			outcomes = append(outcomes, notModifiedOutcome(item))
+			continue
+		}
+		if errors.Is(err, ErrMissingValue) && p.NeedsListValues() && !listed[pid] {
+			err = fmt.Errorf("%w, as it isn't in the custodian's list", err)
+		}
+		if err != nil {
+			utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("unable to pull individual dataset pid=%s: %v", pid, err.Error()), customAction, "GET")
+			outcomes = append(outcomes, report.DatasetOutcome{
+				PersistentID: pid,
+				Action:       report.ActionInvalid,
+				Message:      err.Error(),
+			})
+			continue
+		}
+
+		outcome, err := p.syncDataset(ctx, fed, item, body, existing)
+		if err != nil {
+			outcome = report.DatasetOutcome{PersistentID: pid, Action: report.ActionInvalid, Message: err.Error()}
+		}
+		outcomes = append(outcomes, outcome)
+		outcomes = append(outcomes, p.removeFromOtherTeams(ctx, outcome, existing)...)
+		p.rememberValidators(item, outcome, validators)
+	}
+
+	return outcomes
+}
+
+// lookupItems Fills in items, named only by persistentId, from the
+// custodian's list, for dataset endpoints that use its other values.
+// Returns the persistentIds the list holds
+func (p *Pull) lookupItems(ctx context.Context, items []pkg.FederationItem) (map[string]bool, error) {
+	list, err := p.CallForList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byPid := map[string]pkg.FederationItem{}
+	for _, item := range list.Items {
+		byPid[item.PersistentID] = item
+	}
+
+	listed := map[string]bool{}
+	for i, item := range items {
+		if found, ok := byPid[item.PersistentID]; ok {
+			items[i] = found
+			listed[item.PersistentID] = true
+		}
+	}
+	return listed, nil
+}
+
+// withdrawDataset Deletes a withdrawn dataset from every team GMI synced
+// it to
+func (p *Pull) withdrawDataset(ctx context.Context, pid string, existing *teamDatasets) []report.DatasetOutcome {
+	outcomes := []report.DatasetOutcome{}
+
+	for _, teamId := range existing.ids {
+		if !existing.has(teamId, pid) {
+			continue
+		}
+		if p.DryRun {
+			outcomes = append(outcomes, report.DatasetOutcome{PersistentID: pid, TeamID: teamId, Action: report.ActionSkipped, Message: "dry run"})
+			continue
+		}
+		outcomes = append(outcomes, p.deleteDataset(ctx, teamId, pid, ""))
+	}
+
+	if len(outcomes) == 0 {
+		outcomes = append(outcomes, report.DatasetOutcome{PersistentID: pid, Action: report.ActionSkipped, Message: "not a GMI dataset in the gateway"})
+	}
+	return outcomes
+}
+
+// fetchDataset Fetches a dataset to sync, unless it came with the list or
+// in a batch. The fetch is conditional only when one of the federation's
+// teams already holds the dataset, so one missing from the gateway is
+// always fetched and written in full
+func (p *Pull) fetchDataset(ctx context.Context, item pkg.FederationItem, existing *teamDatasets, prefetched *prefetcher) ([]byte, conditional.Validators, error) {
+	if body, ok := prefetched.take(ctx, item.PersistentID); ok {
+		return body, conditional.Validators{}, nil
+	}
+
+	var previous conditional.Validators
+	if p.Conditional && existing.holds(item.PersistentID) {
+		if uri, err := p.datasetURL(item); err == nil {
+			previous, _ = conditional.Default.Get(uri)
+		}
+	}
+	return p.callForDataset(ctx, item, previous)
+}
+
+// rememberValidators Records the validators a dataset came with once the
+// gateway holds it, so the next fetch can be conditional
+func (p *Pull) rememberValidators(item pkg.FederationItem, outcome report.DatasetOutcome, validators conditional.Validators) {
+	if !p.Conditional || !p.synced(outcome) {
+		return
+	}
+	if uri, err := p.datasetURL(item); err == nil {
+		conditional.Default.Set(uri, validators)
+	}
+}
+
+// synced Returns true when the team a dataset belongs to holds the
+// content its outcome records, whether just written or already there
+func (p *Pull) synced(outcome report.DatasetOutcome) bool {
+	if p.DryRun || outcome.TeamID == 0 {
+		return false
+	}
+	hash, ok := contenthash.Default.Get(outcome.TeamID, outcome.PersistentID)
+	return ok && hash == outcome.ContentHash
+}
+
+// notModifiedOutcome Records a dataset the custodian says is unchanged
+// since we last synced it
+func notModifiedOutcome(item pkg.FederationItem) report.DatasetOutcome {
+	return report.DatasetOutcome{
+		PersistentID: item.PersistentID,
+		Version:      item.Version,
+		Action:       report.ActionSkipped,
+		Message:      "not modified",
+	}
+}
+
+// skippedOutcomes Records every one of pids as skipped for the same
+// reason
+func skippedOutcomes(pids []string, message string) []report.DatasetOutcome {
+	outcomes := []report.DatasetOutcome{}
+	for _, pid := range pids {
+		outcomes = append(outcomes, report.DatasetOutcome{
+			PersistentID: pid,
+			Action:       report.ActionSkipped,
+			Message:      message,
+		})
+	}
+	return outcomes
+}
+
+// syncDataset Transforms, checks and writes a single dataset fetched from
+// a custodian to the team it belongs to, given the GMI datasets the
+// federation's teams already have in the gateway. When the list didn't
+// give us a version, the dataset's own is used. A version already in the
+// gateway is rewritten only if its content hash changed. Returns an error
+// only when the dataset couldn't be prepared for the gateway at all
+func (p *Pull) syncDataset(ctx context.Context, fed *pkg.Federation, item pkg.FederationItem, body []byte, existing *teamDatasets) (report.DatasetOutcome, error) {
+	method_name := utils.MethodName(0)
+
+	var customMsg string
+	customAction := "Run"
+
+	pid := item.PersistentID
+
+	// Map almost-compliant metadata onto our model using the
+	// federation's declared rules, then validate the result
+	result, dataset, err := p.TransformDataset(body)
+	if err != nil {
+		customMsg = "unable to transform dataset"
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s pid=%s: %v", customMsg, pid, err.Error()), customAction, "GET")
+		if p.Verbose {
+			fmt.Printf("%s pid=%s: %v\n", customMsg, pid, err)
+		}
+		return report.DatasetOutcome{
+			PersistentID: pid,
+			Version:      item.Version,
+			Action:       report.ActionInvalid,
+			Message:      err.Error(),
+		}, nil
+	}
+
+	if item.Version == "" {
+		item.Version = dataset.Version
+	}
+	version := item.Version
+
+	score := quality.ScoreDataset(&dataset)
+	outcome := report.DatasetOutcome{
+		PersistentID: pid,
+		Version:      version,
+		Quality:      &score,
+	}
+
+	// Cross-field and list-versus-dataset checks that JSON Schema can't
+	// express. Any ERROR finding means we skip this dataset
+	findings := validator.ValidateSemantics(&validator.SemanticInput{
+		Item:       item,
+		Dataset:    &dataset,
+		DatasetUri: p.DatasetUri,
+	}, p.Logging)
+
+	for _, finding := range findings {
+		customMsg = fmt.Sprintf("semantic check %s (%s) failed for pid=%s", finding.Rule, finding.Severity, pid)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %s", customMsg, finding.Message), customAction, "GET")
+		if p.Verbose {
+			fmt.Printf("%s: %s\n", customMsg, finding.Message)
+		}
+	}
+
+	if validator.HasSemanticErrors(findings) {
+		if p.Verbose {
+			fmt.Printf("skipping pid=%s due to semantic errors\n", pid)
+		}
+		outcome.Action = report.ActionInvalid
+		outcome.Message = "failed semantic checks"
+		return outcome, nil
+	}
+
+	// What we write must meet the schema after transformation, not just
+	// decode into our model
+	if message := p.checkDatasetSchema(ctx, pid, result.After); message != "" {
+		outcome.Action = report.ActionInvalid
+		outcome.Message = message
+		return outcome, nil
+	}
+
+	jsonString, err := json.Marshal(dataset)
+	if err != nil {
+		customMsg = "unable to marshal dataset response to json"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", p.Logging,
+			"method_name", method_name,
+		)
+		return outcome, fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	teamId := resolveTeam(fed, pid, &dataset)
+	outcome.TeamID = teamId
+
+	hash, err := contenthash.Hash(jsonString)
+	if err != nil {
+		customMsg = "unable to hash dataset"
+		return outcome, fmt.Errorf("%s: %v", customMsg, err)
+	}
+	outcome.ContentHash = hash
+
+	//check if the dataset is already in the gateway for its team
+	existingVersions, existsInGateway := existing.datasets[teamId][pid]
+
+	//check if the version number is already in the gateway
+	versionAlreadyInGateway := existsInGateway && utils.StringInSlice(version, existingVersions.Versions)
+
+	// Without a hash from an earlier sync, the content in the gateway is
+	// taken to be this content
+	previousHash, hashKnown := contenthash.Default.Get(teamId, pid)
+	contentChanged := hashKnown && previousHash != hash
+
+	fmt.Printf("existsInGateway=%t, version_in_gateway=%t, content_changed=%t \n", existsInGateway, versionAlreadyInGateway, contentChanged)
+	fmt.Printf("--> version=%s \n ", version)
+	fmt.Printf("--> versions=%v \n ", existingVersions.Versions)
+
+	if p.DryRun {
+		fmt.Printf("--> dry run: would write pid=%s (exists=%t, version_in_gateway=%t, content_changed=%t)\n", pid, existsInGateway, versionAlreadyInGateway, contentChanged)
+		outcome.Action = report.ActionSkipped
+		outcome.Message = "dry run"
+		return outcome, nil
+	}
+
+	if existsInGateway {
+		if versionAlreadyInGateway && !contentChanged {
+			if p.Verbose {
+				fmt.Printf("Skipping pid=%s version=%s as dataset is already in the gateway\n", pid, version)
+			}
+			contenthash.Default.Set(teamId, pid, hash)
+			outcome.Action = report.ActionSkipped
+			return outcome, nil
+		}
+		if versionAlreadyInGateway {
+			outcome.Message = p.sameVersionEdit(ctx, fed, pid, version)
+		}
+		if p.Verbose {
+			fmt.Printf("Updating dataset pid=%s", pid)
+		}
+		outcome.Action = report.ActionUpdated
+	} else {
+		if p.Verbose {
+			fmt.Printf("Create a new dataset pid=%s", pid)
+		}
+		outcome.Action = report.ActionCreated
+	}
+
+	// The outbox records the content hash once the gateway has it
+	op := outbox.OpCreate
+	if existsInGateway {
+		op = outbox.OpUpdate
+	}
+	req := gateway.NewDatasetRequest(teamId, pid, string(jsonString))
+	if err := outbox.Default.Deliver(ctx, outbox.NewWrite(op, fed.ID, req, hash), p.Logging); err != nil {
+		outcome.Action = report.ActionQueued
+		outcome.Message = err.Error()
+	}
+	return outcome, nil
+}
+
+// checkDatasetSchema Validates a transformed dataset document against the
+// schema the federation pins, or the configured one, never the url the
+// document names. Returns why it can't be synced, or an empty string when
+// it can or there is no schema to check it against
+func (p *Pull) checkDatasetSchema(ctx context.Context, pid string, document []byte) string {
+	customAction := "Run"
+
+	schemaUrl, err := validator.SyncSchemaUrl(p.DatasetSchemaUrl)
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to validate pid=%s", pid)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		return fmt.Sprintf("%s: %v", customMsg, err)
+	}
+	if schemaUrl == "" {
+		return ""
+	}
+
+	schema, err := validator.ValidateSchemaReport(schemaUrl, document, p.Logging)
+	if err != nil {
+		customMsg := fmt.Sprintf("unable to validate pid=%s against %s", pid, schemaUrl)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		return fmt.Sprintf("%s: %v", customMsg, err)
+	}
+	if schema.Valid {
+		return ""
+	}
+
+	customMsg := fmt.Sprintf("pid=%s failed schema validation", pid)
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %s", customMsg, strings.Join(schema.Errors, "; ")), customAction, "GET")
+	if p.Verbose {
+		fmt.Printf("skipping %s\n", customMsg)
+	}
+	return fmt.Sprintf("failed schema validation: %s", strings.Join(schema.Errors, "; "))
+}
+
+// sameVersionEdit Handles a dataset whose content changed while its
+// version stayed the same, warning about it unless the federation
+// accepts such edits. Returns the message to record on its outcome
+func (p *Pull) sameVersionEdit(ctx context.Context, fed *pkg.Federation, pid, version string) string {
+	method_name := utils.MethodName(0)
+
+	metrics.SameVersionEdits.WithLabelValues(metrics.FederationLabel(fed.ID)).Inc()
+
+	if strings.ToUpper(p.SameVersionEdits) == pkg.SameVersionEditsAccept {
+		return fmt.Sprintf("content changed within version %s", version)
+	}
+
+	customMsg := fmt.Sprintf("content of pid=%s changed without a version bump from %s", pid, version)
+	slog.Warn(
+		fmt.Sprintf("federation %d: %s", fed.ID, customMsg),
+		"x-request-session-id", p.Logging,
+		"method_name", method_name,
+	)
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("federation %d: %s", fed.ID, customMsg), "Run", "PUT")
+
+	return fmt.Sprintf("warning: %s", customMsg)
+}
@@ -0,0 +1,166 @@
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/outbox"
+	"hdruk/federated-metadata/pkg/report"
+	"strings"
+)
+
+var (
+	// ErrNoTeams is returned for a federation without any team to sync
+	// its datasets to
+	ErrNoTeams = errors.New("federation has no team")
+
+	// ErrInvalidTeamRules is returned for team rules that can't be used
+	ErrInvalidTeamRules = errors.New("invalid team rules")
+)
+
+// TeamIDs Returns the ids of the teams a federation syncs to, its first
+// team first. Errors when it has no team, or one of its team rules names
+// a team it doesn't have or matches nothing
+func TeamIDs(fed *pkg.Federation) ([]int, error) {
+	if len(fed.Team) == 0 {
+		return nil, ErrNoTeams
+	}
+
+	ids := []int{}
+	known := map[int]bool{}
+	for _, team := range fed.Team {
+		ids = append(ids, team.ID)
+		known[team.ID] = true
+	}
+
+	for i, rule := range fed.TeamRules {
+		if !known[rule.TeamID] {
+			return nil, fmt.Errorf("%w: rule %d: team %d is not one of the federation's teams", ErrInvalidTeamRules, i, rule.TeamID)
+		}
+		byPayload := rule.Publisher != "" || rule.MemberOf != ""
+		if len(rule.PersistentIDs) == 0 && !byPayload {
+			return nil, fmt.Errorf("%w: rule %d: needs persistent_ids, publisher or member_of", ErrInvalidTeamRules, i)
+		}
+		if len(rule.PersistentIDs) > 0 && byPayload {
+			return nil, fmt.Errorf("%w: rule %d: persistent_ids can't be combined with publisher or member_of", ErrInvalidTeamRules, i)
+		}
+	}
+
+	return ids, nil
+}
+
+// resolveTeam Returns the team a dataset belongs to: the first rule
+// naming its persistent id, then the first whose publisher and memberOf
+// match its payload, otherwise the federation's first team. Names are
+// compared ignoring case and surrounding space
+func resolveTeam(fed *pkg.Federation, pid string, dataset *pkg.FederationDataset) int {
+	for _, rule := range fed.TeamRules {
+		for _, rulePid := range rule.PersistentIDs {
+			if rulePid == pid {
+				return rule.TeamID
+			}
+		}
+	}
+
+	publisher := dataset.Summary.Publisher
+	for _, rule := range fed.TeamRules {
+		if len(rule.PersistentIDs) > 0 {
+			continue
+		}
+		if rule.Publisher != "" && !sameName(rule.Publisher, publisher.Name) {
+			continue
+		}
+		if rule.MemberOf != "" && !sameName(rule.MemberOf, publisher.MemberOf) {
+			continue
+		}
+		return rule.TeamID
+	}
+
+	return fed.Team[0].ID
+}
+
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// teamDatasets Holds the GMI datasets each of a federation's teams has in
+// the gateway, keeping the federation's team order
+type teamDatasets struct {
+	ids      []int
+	datasets map[int]pkg.DatasetsVersions
+}
+
+// listTeamDatasets Returns the GMI datasets every one of teamIds has in
+// the gateway. Errors if any team's can't be read, as then we can't tell
+// a create from an update, or what to delete
+func listTeamDatasets(ctx context.Context, teamIds []int, sessionId string) (*teamDatasets, error) {
+	existing := &teamDatasets{ids: teamIds, datasets: map[int]pkg.DatasetsVersions{}}
+
+	for _, teamId := range teamIds {
+		datasets, err := gateway.Default.ListTeamDatasets(ctx, teamId, sessionId)
+		if err != nil {
+			return nil, fmt.Errorf("team %d: %w", teamId, err)
+		}
+		existing.datasets[teamId] = datasets
+	}
+
+	return existing, nil
+}
+
+// holds Returns true when any of the teams already has a GMI dataset
+// with pid
+func (t *teamDatasets) holds(pid string) bool {
+	for _, teamId := range t.ids {
+		if t.has(teamId, pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// has Returns true when the team already has a GMI dataset with pid
+func (t *teamDatasets) has(teamId int, pid string) bool {
+	_, ok := t.datasets[teamId][pid]
+	return ok
+}
+
+// deleteDataset Deletes a GMI dataset from a team through the outbox,
+// which forgets the content we last sent for it
+func (p *Pull) deleteDataset(ctx context.Context, teamId int, pid, message string) report.DatasetOutcome {
+	outcome := report.DatasetOutcome{
+		PersistentID: pid,
+		TeamID:       teamId,
+		Action:       report.ActionDeleted,
+		Message:      message,
+	}
+
+	if err := outbox.Default.Deliver(ctx, outbox.NewDelete(p.ID, teamId, pid), p.Logging); err != nil {
+		outcome.Action = report.ActionQueued
+		outcome.Message = err.Error()
+	}
+	return outcome
+}
+
+// removeFromOtherTeams Deletes a dataset from the other teams GMI synced
+// it to before, once the team it now belongs to holds the current
+// content. Datasets move between teams when their publisher or the
+// federation's rules change
+func (p *Pull) removeFromOtherTeams(ctx context.Context, outcome report.DatasetOutcome, existing *teamDatasets) []report.DatasetOutcome {
+	outcomes := []report.DatasetOutcome{}
+
+	// Only a team that holds what we just sent can take over the dataset
+	if !p.synced(outcome) {
+		return outcomes
+	}
+
+	for _, teamId := range existing.ids {
+		if teamId == outcome.TeamID || !existing.has(teamId, outcome.PersistentID) {
+			continue
+		}
+		outcomes = append(outcomes, p.deleteDataset(ctx, teamId, outcome.PersistentID, fmt.Sprintf("moved to team %d", outcome.TeamID)))
+	}
+
+	return outcomes
+}
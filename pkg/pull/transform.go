@@ -0,0 +1,60 @@
+package pull
+
+import (
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/transform"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"os"
+)
+
+// isDryRun Returns true when GMI_DRY_RUN is enabled. In a dry run the
+// pull cycle fetches, transforms and validates as normal but never writes
+// to or deletes from the gateway
+func isDryRun() bool {
+	return os.Getenv("GMI_DRY_RUN") == "1" || os.Getenv("GMI_DRY_RUN") == "true"
+}
+
+// TransformDataset Applies this federation's transformation rules to a
+// raw dataset body, then decodes the result into the typed model. With no
+// rules configured the body passes through untouched
+func (p *Pull) TransformDataset(body []byte) (transform.Result, pkg.FederationDataset, error) {
+	method_name := utils.MethodName(0)
+
+	var customMsg string
+	customAction := "TransformDataset"
+
+	result, err := transform.Apply(body, p.Transformations)
+	if err != nil {
+		customMsg = "unable to apply federation transformations"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", p.Logging,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "")
+
+		return result, pkg.FederationDataset{}, fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	for _, change := range result.Changes {
+		slog.Debug(
+			fmt.Sprintf("transformation %d (%s) on %s applied=%t %s", change.Rule, change.Op, change.Path, change.Applied, change.Reason),
+			"x-request-session-id", p.Logging,
+			"method_name", method_name,
+		)
+	}
+
+	dataset, err := p.decodeDataset(result.After)
+	if err != nil {
+		return result, pkg.FederationDataset{}, err
+	}
+
+	if p.DryRun && len(p.Transformations) > 0 {
+		fmt.Printf("--> dry run: before transformation\n%s\n", result.Before)
+		fmt.Printf("--> dry run: after transformation\n%s\n", result.After)
+	}
+
+	return result, dataset, nil
+}
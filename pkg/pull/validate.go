@@ -0,0 +1,104 @@
+package pull
+
+import (
+	"context"
+	"fmt"
+	"hdruk/federated-metadata/pkg/utils"
+	"hdruk/federated-metadata/pkg/validator"
+	"log/slog"
+	"net/http"
+)
+
+// Fetch Issues an authenticated GET against uri and returns the raw body.
+// Unlike CallForList and CallForDataset it never validates the payload or
+// invalidates the federation, so it's safe to use for custodian-facing
+// checks
+func (p *Pull) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	method_name := utils.MethodName(0)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to form new request: %v", err)
+	}
+
+	p.GenerateHeaders(req)
+
+	result, err := Client.Do(req)
+	if err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to call %s: %v", uri, err.Error()),
+			"x-request-session-id", p.Logging,
+			"method_name", method_name,
+		)
+		return nil, fmt.Errorf("unable to call %s: %v", uri, err)
+	}
+	defer result.Body.Close()
+
+	if !utils.IsSuccessfulStatusCode(result.StatusCode) {
+		return nil, fmt.Errorf("%s returned HTTP %d", uri, result.StatusCode)
+	}
+
+	body, err := readLimited(result, p.limitFor(uri))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body of response: %w", err)
+	}
+
+	return body, nil
+}
+
+// ValidateFederation Fetches the list endpoint and every dataset it
+// references, applies any transformations, and returns a full schema and
+// semantic validation report. Nothing is written to the gateway. Datasets
+// not reached before ctx is done are reported as not fetched
+func (p *Pull) ValidateFederation(ctx context.Context) validator.ValidationReport {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"ValidateFederation",
+		"x-request-session-id", p.Logging,
+		"method_name", method_name,
+	)
+
+	body, err := p.Fetch(ctx, p.DatasetsUri)
+	if err != nil {
+		return validator.ValidationReport{
+			DocumentType: validator.DocumentTypeList,
+			Schema: validator.SchemaReport{
+				SchemaUrl: validator.ListSchemaUrl(),
+				Errors:    []string{err.Error()},
+			},
+			Semantic: []validator.SemanticFinding{},
+		}
+	}
+
+	report, list := validator.ValidateListDocument(body, p.DatasetUri, p.Logging)
+
+	for _, item := range list.Items {
+		item := item
+		datasetUri, err := p.datasetURL(item)
+		var datasetBody []byte
+		if err == nil {
+			datasetBody, err = p.Fetch(ctx, datasetUri)
+		}
+		if err != nil {
+			report.Datasets = append(report.Datasets, validator.DatasetReport{
+				PersistentID: item.PersistentID,
+				Version:      item.Version,
+				Url:          datasetUri,
+				Error:        err.Error(),
+				Schema:       validator.SchemaReport{Errors: []string{}},
+				Semantic:     []validator.SemanticFinding{},
+			})
+			report.Valid = false
+			continue
+		}
+
+		datasetReport := validator.ValidateTransformedDatasetDocument(datasetBody, p.Transformations, &item, p.DatasetUri, p.Logging)
+		datasetReport.Url = datasetUri
+		if !datasetReport.Valid {
+			report.Valid = false
+		}
+		report.Datasets = append(report.Datasets, datasetReport)
+	}
+
+	return report
+}
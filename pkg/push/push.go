@@ -1,44 +1,142 @@
 package push
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hdruk/federated-metadata/pkg/auth"
+	"hdruk/federated-metadata/pkg/openapi"
 	"hdruk/federated-metadata/pkg/routes"
+	"hdruk/federated-metadata/pkg/utils"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Run Runs our Push API service
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// Run Runs our Push API service until Shutdown is called. Returns false
+// if the server stopped for any other reason
 func Run() bool {
-	router := gin.Default()
+	router := NewRouter()
 
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "DELETE"},
-		AllowHeaders:     []string{"Origin"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	// Requests are cancelled once shutdown begins, so long-lived streams
+	// such as test job events end rather than hold up the drain
+	baseCtx, cancel := context.WithCancel(context.Background())
 
-	server := &http.Server{
+	serverMu.Lock()
+	server = &http.Server{
 		Addr:           fmt.Sprintf(":%s", os.Getenv("GMI_PORT")),
 		Handler:        router,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+	server.RegisterOnShutdown(cancel)
+	s := server
+	serverMu.Unlock()
+
+	err := s.ListenAndServe()
+	return errors.Is(err, http.ErrServerClosed)
+}
+
+// Shutdown Stops the Push API accepting connections and waits for
+// in-flight requests to finish, up to ctx's deadline
+func Shutdown(ctx context.Context) error {
+	serverMu.Lock()
+	s := server
+	serverMu.Unlock()
+
+	if s == nil {
+		return nil
 	}
+	return s.Shutdown(ctx)
+}
+
+// NewRouter Builds the push API router. Every route registered here must
+// be described in pkg/openapi/openapi.json
+func NewRouter() *gin.Engine {
+	router := gin.Default()
+
+	router.Use(cors.New(corsConfig()))
+
+	router.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"not found",
+			fmt.Sprintf("no route for %s %s", c.Request.Method, c.Request.URL.Path)))
+	})
 
 	// Defines routes and handlers for REST interface
 	router.GET("/ping", routes.PingHandler)
-	router.POST("/test", routes.TestFederationHandler)
-	router.POST("/federation", routes.CreateFederationHandler)
-	router.PATCH("/federation", routes.UpdateFederationHandler)
-	router.DELETE("/federation", routes.DeleteFederationHandler)
+	router.GET("/healthz", routes.HealthzHandler)
+	router.GET("/readyz", routes.ReadyzHandler)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/openapi.json", openapi.SpecHandler)
+
+	// Custodians authenticate with their federation's webhook secret
+	// rather than a Gateway JWT
+	router.POST("/federation/:id/webhook", openapi.ValidateRequest(), routes.FederationWebhookHandler)
+
+	// Everything else requires a Gateway-issued JWT or a service API key,
+	// and must match the OpenAPI document
+	authed := router.Group("/", auth.RequireAuth(), openapi.ValidateRequest())
+	authed.POST("/test", routes.TestFederationHandler)
+	authed.GET("/test/:id", routes.GetTestJobHandler)
+	authed.DELETE("/test/:id", routes.CancelTestJobHandler)
+	authed.GET("/test/:id/events", routes.TestJobEventsHandler)
+	authed.POST("/validate", routes.ValidateHandler)
+	authed.POST("/federation", routes.CreateFederationHandler)
+	authed.PATCH("/federation", routes.UpdateFederationHandler)
+	authed.DELETE("/federation", routes.DeleteFederationHandler)
+	authed.GET("/federation/secrets", routes.ListFederationSecretsHandler)
+	authed.GET("/federation/secrets/:secret_id", routes.GetFederationSecretHandler)
+	authed.GET("/federation/:id/quality", routes.FederationQualityHandler)
+	authed.GET("/federation/:id/deletions", routes.FederationDeletionsHandler)
+	authed.GET("/outbox", routes.ListOutboxHandler)
+	authed.GET("/outbox/:id", routes.GetOutboxEntryHandler)
+	authed.POST("/outbox/:id/replay", routes.ReplayOutboxEntryHandler)
+
+	return router
+}
+
+// corsConfig Builds the CORS policy from PUSH_API_ALLOWED_ORIGINS. Without
+// a configured list any origin may call the API, but never with
+// credentials
+func corsConfig() cors.Config {
+	config := cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PATCH", "DELETE"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Authorization", "x-api-key", "x-request-session-id"},
+		ExposeHeaders: []string{"Content-Length"},
+		MaxAge:        12 * time.Hour,
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("PUSH_API_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	if len(origins) == 0 {
+		config.AllowAllOrigins = true
+		return config
+	}
 
-	server.ListenAndServe()
-	return true
+	config.AllowOrigins = origins
+	config.AllowCredentials = true
+	return config
 }
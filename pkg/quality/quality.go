@@ -0,0 +1,242 @@
+package quality
+
+import (
+	"hdruk/federated-metadata/pkg"
+	"math"
+	"strings"
+)
+
+const (
+	CategoryCompleteness = "completeness"
+	CategoryRichness     = "richness"
+
+	// minAbstractLength is the abstract length we consider rich enough to
+	// be useful to researchers browsing the gateway
+	minAbstractLength = 250
+	// minKeywords is the number of keywords that earns full credit
+	minKeywords = 5
+)
+
+// Criterion Defines a single scored aspect of a dataset. Score returns a
+// value between 0 (absent) and 1 (fully met)
+type Criterion struct {
+	Name     string
+	Field    string
+	Category string
+	Weight   float64
+	Score    func(d *pkg.FederationDataset) float64
+}
+
+// CriterionResult Defines the outcome of scoring a single criterion
+type CriterionResult struct {
+	Name     string  `json:"name"`
+	Field    string  `json:"field"`
+	Category string  `json:"category"`
+	Score    float64 `json:"score"`
+}
+
+// Score Defines the quality scores for a single dataset. Completeness,
+// Richness and Overall are percentages
+type Score struct {
+	PersistentID string            `json:"persistent_id"`
+	Version      string            `json:"version"`
+	Completeness float64           `json:"completeness"`
+	Richness     float64           `json:"richness"`
+	Overall      float64           `json:"overall"`
+	Missing      []string          `json:"missing"`
+	Criteria     []CriterionResult `json:"criteria"`
+}
+
+// DefaultCriteria The criteria every ingested dataset is scored against
+var DefaultCriteria = []Criterion{
+	{
+		Name: "title", Field: "summary.title", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Summary.Title) },
+	},
+	{
+		Name: "abstract", Field: "summary.abstract", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Summary.Abstract) },
+	},
+	{
+		Name: "contact-point", Field: "summary.contactPoint", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return presentMulti(d.Summary.ContactPoint) },
+	},
+	{
+		Name: "publisher", Field: "summary.publisher.name", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Summary.Publisher.Name) },
+	},
+	{
+		Name: "keywords", Field: "summary.keywords", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return presentMulti(d.Summary.Keywords) },
+	},
+	{
+		Name: "spatial-coverage", Field: "coverage.spatial", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return presentMulti(d.Coverage.Spatial) },
+	},
+	{
+		Name: "temporal-coverage", Field: "provenance.temporal.startDate", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Provenance.Temporal.StartDate) },
+	},
+	{
+		Name: "accrual-periodicity", Field: "provenance.temporal.accrualPeriodicity", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Provenance.Temporal.AccrualPeriodicity) },
+	},
+	{
+		Name: "access-rights", Field: "accessibility.access.accessRights", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return presentMulti(d.Accessibility.Access.AccessRights) },
+	},
+	{
+		Name: "jurisdiction", Field: "accessibility.access.jurisdiction", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return presentMulti(d.Accessibility.Access.Jurisdiction) },
+	},
+	{
+		Name: "data-controller", Field: "accessibility.access.dataController", Category: CategoryCompleteness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Accessibility.Access.DataController) },
+	},
+	{
+		Name: "abstract-length", Field: "summary.abstract", Category: CategoryRichness, Weight: 2,
+		Score: func(d *pkg.FederationDataset) float64 {
+			return ratio(len(strings.TrimSpace(d.Summary.Abstract)), minAbstractLength)
+		},
+	},
+	{
+		Name: "keyword-count", Field: "summary.keywords", Category: CategoryRichness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 {
+			return ratio(countNonBlank(d.Summary.Keywords.Values), minKeywords)
+		},
+	},
+	{
+		Name: "temporal-range", Field: "provenance.temporal.endDate", Category: CategoryRichness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 {
+			if d.Provenance.Temporal.EndDate == nil {
+				return 0
+			}
+			return present(*d.Provenance.Temporal.EndDate)
+		},
+	},
+	{
+		Name: "documentation", Field: "documentation.description", Category: CategoryRichness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return present(d.Documentation.Description) },
+	},
+	{
+		Name: "structural-metadata", Field: "structuralMetadata", Category: CategoryRichness, Weight: 2,
+		Score: scoreStructuralMetadata,
+	},
+	{
+		Name: "observations", Field: "observations", Category: CategoryRichness, Weight: 1,
+		Score: func(d *pkg.FederationDataset) float64 { return ratio(len(d.Observations), 1) },
+	},
+}
+
+// ScoreDataset Scores a dataset against DefaultCriteria
+func ScoreDataset(d *pkg.FederationDataset) Score {
+	return ScoreDatasetWithCriteria(d, DefaultCriteria)
+}
+
+// ScoreDatasetWithCriteria Scores a dataset against the given criteria.
+// Fields that score nothing at all are listed in Missing
+func ScoreDatasetWithCriteria(d *pkg.FederationDataset, criteria []Criterion) Score {
+	score := Score{
+		PersistentID: d.Identifier,
+		Version:      d.Version,
+		Missing:      []string{},
+		Criteria:     []CriterionResult{},
+	}
+
+	totals := map[string]float64{}
+	weights := map[string]float64{}
+	missing := map[string]bool{}
+
+	for _, c := range criteria {
+		value := c.Score(d)
+
+		score.Criteria = append(score.Criteria, CriterionResult{
+			Name:     c.Name,
+			Field:    c.Field,
+			Category: c.Category,
+			Score:    round(value),
+		})
+
+		totals[c.Category] += value * c.Weight
+		weights[c.Category] += c.Weight
+
+		if value == 0 && !missing[c.Field] {
+			missing[c.Field] = true
+			score.Missing = append(score.Missing, c.Field)
+		}
+	}
+
+	score.Completeness = percentage(totals[CategoryCompleteness], weights[CategoryCompleteness])
+	score.Richness = percentage(totals[CategoryRichness], weights[CategoryRichness])
+	score.Overall = percentage(
+		totals[CategoryCompleteness]+totals[CategoryRichness],
+		weights[CategoryCompleteness]+weights[CategoryRichness],
+	)
+
+	return score
+}
+
+// scoreStructuralMetadata Gives half credit for declaring any tables, and
+// the rest for the proportion of elements that carry a description
+func scoreStructuralMetadata(d *pkg.FederationDataset) float64 {
+	if len(d.StructuralMetadata) == 0 {
+		return 0
+	}
+
+	elements, described := 0, 0
+	for _, table := range d.StructuralMetadata {
+		for _, element := range table.Elements {
+			elements++
+			if element.Description != nil && strings.TrimSpace(*element.Description) != "" {
+				described++
+			}
+		}
+	}
+
+	if elements == 0 {
+		return 0.5
+	}
+	return 0.5 + 0.5*float64(described)/float64(elements)
+}
+
+func present(value string) float64 {
+	if strings.TrimSpace(value) == "" {
+		return 0
+	}
+	return 1
+}
+
+func presentMulti(value pkg.MultiString) float64 {
+	if value.IsEmpty() {
+		return 0
+	}
+	return 1
+}
+
+func countNonBlank(values []string) int {
+	n := 0
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func ratio(have, want int) float64 {
+	if want <= 0 || have >= want {
+		return 1
+	}
+	return float64(have) / float64(want)
+}
+
+func percentage(total, weight float64) float64 {
+	if weight == 0 {
+		return 0
+	}
+	return round(100 * total / weight)
+}
+
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
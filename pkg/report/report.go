@@ -0,0 +1,196 @@
+package report
+
+import (
+	"errors"
+	"hdruk/federated-metadata/pkg/quality"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRunning   = "RUNNING"
+	StatusSucceeded = "SUCCEEDED"
+	StatusFailed    = "FAILED"
+
+	// StatusInterrupted marks a run or cycle cut short by the service
+	// shutting down
+	StatusInterrupted = "INTERRUPTED"
+
+	ActionCreated = "CREATED"
+	ActionUpdated = "UPDATED"
+	ActionDeleted = "DELETED"
+	ActionSkipped = "SKIPPED"
+	ActionInvalid = "INVALID"
+	// ActionQueued marks a write or delete the gateway didn't take, left
+	// in the outbox to retry
+	ActionQueued = "QUEUED"
+	// ActionPendingDeletion marks a dataset missing from its federation's
+	// list that hasn't been missing long enough to delete
+	ActionPendingDeletion = "PENDING_DELETION"
+)
+
+// ErrInterrupted Is passed to Finish when a run or cycle is cut short by
+// the service shutting down
+var ErrInterrupted = errors.New("interrupted by service shutdown")
+
+// DatasetOutcome Defines what a pull cycle did with a single dataset
+type DatasetOutcome struct {
+	PersistentID string         `json:"persistent_id"`
+	Version      string         `json:"version"`
+	TeamID       int            `json:"team_id,omitempty"`
+	Action       string         `json:"action"`
+	Message      string         `json:"message,omitempty"`
+	Quality      *quality.Score `json:"quality,omitempty"`
+	// ContentHash is the canonical JSON hash of what we sent, or would
+	// have sent, to the gateway
+	ContentHash string `json:"content_hash,omitempty"`
+}
+
+// FederationRun Defines the report for a single federation within a pull
+// cycle
+type FederationRun struct {
+	FederationID int              `json:"federation_id"`
+	SessionID    string           `json:"session_id"`
+	StartedAt    time.Time        `json:"started_at"`
+	FinishedAt   time.Time        `json:"finished_at"`
+	Status       string           `json:"status"`
+	Error        string           `json:"error,omitempty"`
+	Datasets     []DatasetOutcome `json:"datasets"`
+}
+
+// Cycle Defines the outcome of a whole pull cycle across every federation
+// that was due to run
+type Cycle struct {
+	SessionID   string    `json:"session_id"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Federations int       `json:"federations"`
+	Failed      int       `json:"failed"`
+}
+
+var (
+	mu        sync.RWMutex
+	runs      = map[int]FederationRun{}
+	lastCycle *Cycle
+)
+
+// NewFederationRun Creates a running report for a federation
+func NewFederationRun(federationId int, sessionId string) *FederationRun {
+	return &FederationRun{
+		FederationID: federationId,
+		SessionID:    sessionId,
+		StartedAt:    time.Now().UTC(),
+		Status:       StatusRunning,
+		Datasets:     []DatasetOutcome{},
+	}
+}
+
+// AddDataset Records the outcome for a single dataset
+func (r *FederationRun) AddDataset(outcome DatasetOutcome) {
+	r.Datasets = append(r.Datasets, outcome)
+}
+
+// Finish Marks the run as finished and stores it as the latest run for
+// its federation. A nil err marks the run as succeeded, ErrInterrupted
+// as interrupted
+func (r *FederationRun) Finish(err error) {
+	r.FinishedAt = time.Now().UTC()
+	r.Status = finishedStatus(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	runs[r.FederationID] = *r
+}
+
+// LatestFederationRun Returns the most recently finished run for a
+// federation, if there is one
+func LatestFederationRun(federationId int) (FederationRun, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	run, ok := runs[federationId]
+	return run, ok
+}
+
+// NewCycle Creates a running report for a pull cycle
+func NewCycle(sessionId string) *Cycle {
+	return &Cycle{
+		SessionID: sessionId,
+		StartedAt: time.Now().UTC(),
+		Status:    StatusRunning,
+	}
+}
+
+// Finish Marks the cycle as finished, counting the federation runs it
+// recorded, and stores it as the latest cycle. The cycle fails if err is
+// set or any federation failed, and is interrupted if err is
+// ErrInterrupted
+func (c *Cycle) Finish(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.FinishedAt = time.Now().UTC()
+	for _, run := range runs {
+		if run.SessionID != c.SessionID {
+			continue
+		}
+		c.Federations++
+		if run.Status != StatusSucceeded {
+			c.Failed++
+		}
+	}
+
+	c.Status = finishedStatus(err)
+	if err != nil {
+		c.Error = err.Error()
+	} else if c.Failed > 0 {
+		c.Status = StatusFailed
+	}
+
+	finished := *c
+	lastCycle = &finished
+}
+
+// LatestCycle Returns the most recently finished pull cycle, if there is
+// one
+func LatestCycle() (Cycle, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if lastCycle == nil {
+		return Cycle{}, false
+	}
+	return *lastCycle, true
+}
+
+// FederationRuns Returns every federation run recorded for a pull cycle
+func FederationRuns(sessionId string) []FederationRun {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	found := []FederationRun{}
+	for _, run := range runs {
+		if run.SessionID == sessionId {
+			found = append(found, run)
+		}
+	}
+	return found
+}
+
+// finishedStatus Returns the status a run or cycle finishing with err ends
+// up in
+func finishedStatus(err error) string {
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case errors.Is(err, ErrInterrupted):
+		return StatusInterrupted
+	default:
+		return StatusFailed
+	}
+}
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"hdruk/federated-metadata/pkg/deletion"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FederationDeletionsHandler Returns the datasets missing from a
+// federation's list that are waiting to be deleted from the gateway, to
+// admins and members of the federation's teams
+func FederationDeletionsHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Federation pending deletions",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"invalid federation id",
+			err.Error()))
+		return
+	}
+
+	if !authoriseFederation(c, id) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"federation_id": id,
+		"pending":       deletion.Default.List(id),
+	})
+}
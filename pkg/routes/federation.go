@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/auth"
 	"hdruk/federated-metadata/pkg/secrets"
 	"hdruk/federated-metadata/pkg/utils"
 	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,28 +33,41 @@ func CreateFederationHandler(c *gin.Context) {
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "unable to decode request body",
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to decode request body",
+			err.Error()))
 		return
 	}
 
+	if cs.TeamID == 0 {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to create new secret instance",
+			"team_id is required"))
+		return
+	}
+
+	if !auth.AuthoriseTeam(c, cs.TeamID) {
+		return
+	}
+
+	// Record the owning team on the secret itself, so later updates and
+	// deletes can be authorised against it
 	secretCtx := secrets.NewSecrets("", "")
-	resp, err := secretCtx.CreateSecret(cs.Path, cs.SecretID, cs.Payload)
-	fmt.Printf("%v\n",cs)
+	resp, err := secretCtx.CreateSecret(c.Request.Context(), cs.Path, cs.SecretID, cs.Payload, map[string]string{
+		"team_id": strconv.Itoa(cs.TeamID),
+	})
 	if err != nil {
 		slog.Debug(
 			fmt.Sprintf("unable to create new secret instance: %s", err.Error()),
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "unable to create new secret instance",
-			"test": cs.Path,
-			"ID": cs.SecretID,
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+			false,
+			"unable to create new secret instance",
+			err.Error()))
 		return
 	}
 
@@ -81,28 +96,29 @@ func UpdateFederationHandler(c *gin.Context) {
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "unable to decode request body",
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to decode request body",
+			err.Error()))
 		return
 	}
 
 	secretCtx := secrets.NewSecrets("", "")
-	resp, err := secretCtx.UpdateSecret(cs.Path, cs.SecretID, cs.Payload)
-	fmt.Printf("%v\n",cs)
+	if !authoriseSecretOwner(c, secretCtx, cs.SecretID, cs.TeamID) {
+		return
+	}
+
+	resp, err := secretCtx.UpdateSecret(c.Request.Context(), cs.Path, cs.SecretID, cs.Payload)
 	if err != nil {
 		slog.Debug(
 			fmt.Sprintf("unable to create new secret instance: %s", err.Error()), 
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "unable to create new secret instance",
-			"test": cs.Path,
-			"ID": cs.SecretID,
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+			false,
+			"unable to create new secret instance",
+			err.Error()))
 		return
 	}
 
@@ -134,24 +150,29 @@ func DeleteFederationHandler(c *gin.Context) {
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "unable to decode request body",
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to decode request body",
+			err.Error()))
+		return
 	}
 
 	secretCtx := secrets.NewSecrets("", "")
-	err = secretCtx.DeleteSecret(ds.SecretID)
+	if !authoriseSecretOwner(c, secretCtx, ds.SecretID, ds.TeamID) {
+		return
+	}
+
+	err = secretCtx.DeleteSecret(c.Request.Context(), ds.SecretID)
 	if err != nil {
 		slog.Debug(
 			fmt.Sprintf("unable to create new secret instance: %s", err.Error()),
 			"x-request-session-id", c.GetHeader("x-request-session-id"),
 			"method_name", method_name,
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "unable to delete secret instance",
-			"error":   err.Error(),
-		})
+		c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+			false,
+			"unable to delete secret instance",
+			err.Error()))
 		return
 	}
 
@@ -159,3 +180,33 @@ func DeleteFederationHandler(c *gin.Context) {
 		"message": "OK",
 	})
 }
+
+// authoriseSecretOwner Checks the caller can manage the team recorded on
+// the secret when it was created. Secrets created before ownership was
+// recorded can only be managed by an admin. Returns false if the request
+// was aborted
+func authoriseSecretOwner(c *gin.Context, secretCtx *secrets.Secrets, secretID string, teamID int) bool {
+	labels, err := secretCtx.GetSecretLabels(c.Request.Context(), secretID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"unable to find secret instance",
+			err.Error()))
+		return false
+	}
+
+	owner, err := strconv.Atoi(labels["team_id"])
+	if err != nil {
+		return auth.AuthoriseAdmin(c)
+	}
+
+	if teamID != 0 && teamID != owner {
+		c.AbortWithStatusJSON(http.StatusForbidden, utils.FormResponse(http.StatusForbidden,
+			false,
+			"secret belongs to another team",
+			fmt.Sprintf("secret %s is not owned by team %d", secretID, teamID)))
+		return false
+	}
+
+	return auth.AuthoriseTeam(c, owner)
+}
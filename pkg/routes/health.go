@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"fmt"
+	"hdruk/federated-metadata/pkg/health"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/utils"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthzHandler Reports that the process is alive. It never checks
+// dependencies, so a flaky dependency can't get the pod restarted
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"version": health.Version,
+	})
+}
+
+// ReadyzHandler Checks every dependency and returns 503 if any are down,
+// alongside per-dependency status, the build version and the outcome of
+// the last pull cycle
+func ReadyzHandler(c *gin.Context) {
+	ready, dependencies := health.Ready(c.Request.Context(), health.Checks)
+
+	status := http.StatusOK
+	title := "ready"
+	problems := []string{}
+	for _, dep := range dependencies {
+		if dep.Status == health.StatusDown {
+			problems = append(problems, fmt.Sprintf("%s: %s", dep.Name, dep.Error))
+		}
+	}
+	if !ready {
+		status = http.StatusServiceUnavailable
+		title = "not ready"
+	}
+
+	response := utils.FormResponse(status, ready, title, strings.Join(problems, "; "))
+	response["version"] = health.Version
+	response["dependencies"] = dependencies
+	response["last_cycle"] = nil
+	if cycle, ok := report.LatestCycle(); ok {
+		response["last_cycle"] = cycle
+	}
+
+	c.JSON(status, response)
+}
@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/auth"
+	"hdruk/federated-metadata/pkg/outbox"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListOutboxHandler Returns the Gateway writes and deletes waiting in the
+// outbox, optionally only those with the status given in the query
+func ListOutboxHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Listing outbox",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	if !auth.AuthoriseAdmin(c) {
+		return
+	}
+
+	status := strings.ToUpper(c.Query("status"))
+	c.JSON(http.StatusOK, gin.H{
+		"entries": outbox.Default.List(status),
+	})
+}
+
+// GetOutboxEntryHandler Returns a single outbox entry, including the
+// request it will send
+func GetOutboxEntryHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Getting outbox entry",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	if !auth.AuthoriseAdmin(c) {
+		return
+	}
+
+	entry, ok := outbox.Default.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"outbox entry not found",
+			fmt.Sprintf("no outbox entry exists with id %s", c.Param("id"))))
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// ReplayOutboxEntryHandler Sends a dead letter to the gateway again. It
+// goes back to being retried if the gateway still doesn't take it
+func ReplayOutboxEntryHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Replaying outbox entry",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	if !auth.AuthoriseAdmin(c) {
+		return
+	}
+
+	id := c.Param("id")
+	entry, err := outbox.Default.Replay(c.Request.Context(), id, c.GetHeader("x-request-session-id"))
+	switch {
+	case errors.Is(err, outbox.ErrNotFound):
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"outbox entry not found",
+			fmt.Sprintf("no outbox entry exists with id %s", id)))
+		return
+	case errors.Is(err, outbox.ErrNotDead):
+		c.JSON(http.StatusConflict, utils.FormResponse(http.StatusConflict,
+			false,
+			"unable to replay outbox entry",
+			fmt.Sprintf("outbox entry %s is still being retried", id)))
+		return
+	}
+
+	utils.WriteGatewayAudit(fmt.Sprintf("replayed outbox entry %s: %s", id, entry.Status), "Outbox", c.Request.Method)
+	entry.Request = nil
+	c.JSON(http.StatusOK, entry)
+}
@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"fmt"
+	"hdruk/federated-metadata/pkg/auth"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/quality"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FederationQualityHandler Returns the quality scores recorded for every
+// dataset in a federation's most recent pull cycle, to admins and members
+// of the federation's teams
+func FederationQualityHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Federation quality",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"invalid federation id",
+			err.Error()))
+		return
+	}
+
+	if !authoriseFederation(c, id) {
+		return
+	}
+
+	run, ok := report.LatestFederationRun(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"no pull cycle recorded for this federation",
+			fmt.Sprintf("federation %d has not run since the service started", id)))
+		return
+	}
+
+	scores := []quality.Score{}
+	total := 0.0
+	for _, outcome := range run.Datasets {
+		if outcome.Quality == nil {
+			continue
+		}
+		scores = append(scores, *outcome.Quality)
+		total += outcome.Quality.Overall
+	}
+
+	average := 0.0
+	if len(scores) > 0 {
+		average = math.Round(100*total/float64(len(scores))) / 100
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"federation_id": run.FederationID,
+		"session_id":    run.SessionID,
+		"finished_at":   run.FinishedAt,
+		"average":       average,
+		"datasets":      scores,
+	})
+}
+
+// authoriseFederation Aborts the request with a 403 unless the caller is
+// an admin or can manage one of the federation's teams. Federations that
+// don't exist are refused the same way, so callers can't probe for them.
+// Returns false if the request was aborted
+func authoriseFederation(c *gin.Context, id int) bool {
+	principal, _ := auth.GetPrincipal(c)
+	if principal.Admin {
+		return true
+	}
+
+	fed, ok, err := gateway.FindFederation(c.Request.Context(), gateway.Default, id, c.GetHeader("x-request-session-id"))
+	if err != nil {
+		customMsg := "unable to look up federation"
+		utils.WriteGatewayAudit(fmt.Sprintf("%s %d: %v", customMsg, id, err.Error()), "AuthoriseFederation", c.Request.Method)
+		c.AbortWithStatusJSON(http.StatusBadGateway, utils.FormResponse(http.StatusBadGateway,
+			false,
+			customMsg,
+			err.Error()))
+		return false
+	}
+
+	if ok {
+		for _, team := range fed.Team {
+			if principal.CanManageTeam(team.ID) {
+				return true
+			}
+		}
+	}
+
+	utils.WriteGatewayAudit(fmt.Sprintf("%s is not permitted to view federation %d", principal.Subject, id), "AuthoriseFederation", c.Request.Method)
+	c.AbortWithStatusJSON(http.StatusForbidden, utils.FormResponse(http.StatusForbidden,
+		false,
+		"forbidden",
+		fmt.Sprintf("not permitted to view federation %d", id)))
+	return false
+}
@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"hdruk/federated-metadata/pkg/auth"
+	"hdruk/federated-metadata/pkg/secrets"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LookupSecretMetadata Returns the metadata held for a secret
+var LookupSecretMetadata = func(ctx context.Context, secretID string) (secrets.SecretMetadata, error) {
+	return secrets.NewSecrets("", "").GetSecretMetadata(ctx, secretID)
+}
+
+// GetFederationSecretHandler Returns the metadata held for a single
+// federation secret. Secret values are never returned. Callers who can't
+// manage the secret's team get the same 404 as for a secret that doesn't
+// exist, so they can't learn which ids are in use
+func GetFederationSecretHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Getting federation secret metadata",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	secretID := c.Param("secret_id")
+	principal, _ := auth.GetPrincipal(c)
+
+	meta, err := LookupSecretMetadata(c.Request.Context(), secretID)
+	if err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to get secret metadata: %s", err.Error()),
+			"x-request-session-id", c.GetHeader("x-request-session-id"),
+			"method_name", method_name,
+		)
+		if principal.Admin {
+			c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+				false,
+				"unable to get secret metadata",
+				err.Error()))
+			return
+		}
+	}
+
+	// Secrets created before ownership was recorded are admin only
+	permitted := principal.Admin
+	if owner, ownerErr := strconv.Atoi(meta.TeamID); ownerErr == nil {
+		permitted = principal.CanManageTeam(owner)
+	}
+
+	if err != nil || !meta.Exists || !permitted {
+		if err == nil && meta.Exists {
+			utils.WriteGatewayAudit(fmt.Sprintf("%s is not permitted to read secret %s", principal.Subject, secretID), "GetFederationSecret", c.Request.Method)
+		}
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"secret not found",
+			"no secret exists with this id"))
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
+
+// ListFederationSecretsHandler Returns the metadata for every federation
+// secret owned by the team given in the team_id query parameter. Secrets
+// whose metadata can't be read are listed with the error instead
+func ListFederationSecretsHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Listing federation secret metadata",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	teamID, err := strconv.Atoi(c.Query("team_id"))
+	if err != nil || teamID == 0 {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to list secrets",
+			"team_id query parameter is required"))
+		return
+	}
+
+	if !auth.AuthoriseTeam(c, teamID) {
+		return
+	}
+
+	secretCtx := secrets.NewSecrets("", "")
+	ids, err := secretCtx.ListTeamSecretIDs(c.Request.Context(), teamID)
+	if err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to list secrets: %s", err.Error()),
+			"x-request-session-id", c.GetHeader("x-request-session-id"),
+			"method_name", method_name,
+		)
+		c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+			false,
+			"unable to list secrets",
+			err.Error()))
+		return
+	}
+
+	// One secret we can't read doesn't hide the rest
+	results := []secrets.SecretMetadata{}
+	for _, id := range ids {
+		meta, err := secretCtx.GetSecretMetadata(c.Request.Context(), id)
+		if err != nil {
+			utils.WriteGatewayAudit(fmt.Sprintf("unable to get secret metadata for %s: %v", id, err.Error()), "ListFederationSecrets", c.Request.Method)
+			meta = secrets.SecretMetadata{SecretID: id, Fields: []string{}, Error: err.Error()}
+		}
+		results = append(results, meta)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"team_id": teamID,
+		"secrets": results,
+	})
+}
@@ -4,16 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/auth"
 	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/secrets"
+	"hdruk/federated-metadata/pkg/testjob"
 	"hdruk/federated-metadata/pkg/utils"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// TestFederationHandler will single handidly test each part of operation to
-// determine a successful federation configuration.
+// TestFederationHandler Tests each part of a federation configuration in
+// turn and returns an ordered, timed diagnostic report showing exactly
+// where an integration breaks. With ?async=true the test runs in the
+// background and a job is returned to poll or subscribe to instead
 func TestFederationHandler(c *gin.Context) {
 	method_name := utils.MethodName(0)
 	slog.Debug(
@@ -22,12 +31,10 @@ func TestFederationHandler(c *gin.Context) {
 		"method_name", method_name,
 	)
 
-	var response interface{}
-
 	decoder := json.NewDecoder(c.Request.Body)
-	var fed pkg.Federation
+	var tr pkg.TestFederationRequest
 
-	err := decoder.Decode(&fed)
+	err := decoder.Decode(&tr)
 	if err != nil {
 		slog.Debug(
 			fmt.Sprintf("unable to decode request body: %s", err.Error()), 
@@ -40,34 +47,207 @@ func TestFederationHandler(c *gin.Context) {
 			err.Error()))
 		return
 	}
+	fed := tr.Federation
+
+	accessToken, ok := resolveTestCredentials(c, &tr)
+	if !ok {
+		return
+	}
 
 	// Create a new Pull Object to test this integration
 	p := pull.NewPull(
 		fed.ID,
 		fmt.Sprintf("%s%s", fed.EndpointBaseURL,
 			fed.EndpointDatasets),
-		fmt.Sprintf("%s%s", fed.EndpointBaseURL,
-			fed.EndpointDataset),
+		pull.EndpointURL(fed.EndpointBaseURL, fed.EndpointDataset),
 		"",
 		"",
-		fed.PID,
+		accessToken,
 		fed.AuthType,
 		false,
 		c.GetHeader("x-request-session-id"),
 	)
+	p.Transformations = fed.Transformations
+
+	if async, _ := strconv.ParseBool(c.Query("async")); async {
+		principal, _ := auth.GetPrincipal(c)
+		job, err := testjob.Start(p, principal.Subject)
+		if err != nil {
+			c.JSON(http.StatusTooManyRequests, utils.FormResponse(http.StatusTooManyRequests,
+				false,
+				"unable to start test job",
+				fmt.Sprintf("%s: at most %d may run at once", err.Error(), testjob.MaxRunning())))
+			return
+		}
+		c.Header("Location", fmt.Sprintf("/test/%s", job.ID))
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
+	// Stop testing if the caller goes away or the endpoint is too slow
+	ctx, cancel := pull.WithFederationBudget(c.Request.Context())
+	defer cancel()
+
+	c.JSON(http.StatusOK, p.Diagnose(ctx))
+}
+
+// GetTestJobHandler Returns the progress, steps so far and, once finished,
+// the result of a background test job
+func GetTestJobHandler(c *gin.Context) {
+	job, ok := testjob.Get(c.Param("id"))
+	if !ok || !canViewTestJob(c, job) {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"test job not found",
+			fmt.Sprintf("no test job exists with id %s", c.Param("id"))))
+		return
+	}
 
-	response = p.TestCredentials()
-	if val, ok := response.(gin.H)["errors"]; ok && val != "" {
-		c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, job)
+}
+
+// CancelTestJobHandler Stops a background test job. The job finishes with
+// an interrupted step shortly after, which pollers and subscribers see as
+// usual
+func CancelTestJobHandler(c *gin.Context) {
+	job, ok := testjob.Get(c.Param("id"))
+	if !ok || !canViewTestJob(c, job) {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"test job not found",
+			fmt.Sprintf("no test job exists with id %s", c.Param("id"))))
+		return
+	}
+
+	if job.Status == testjob.StatusFinished {
+		c.JSON(http.StatusConflict, utils.FormResponse(http.StatusConflict,
+			false,
+			"test job has already finished",
+			fmt.Sprintf("test job %s finished at %s", job.ID, job.FinishedAt.Format(time.RFC3339))))
+		return
+	}
+
+	job, _ = testjob.Cancel(job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// TestJobEventsHandler Streams a background test job as server-sent
+// events. Steps already recorded are replayed first, then each new step is
+// sent as it happens, and the stream ends with the finished job
+func TestJobEventsHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+
+	job, events, cancel, ok := testjob.Subscribe(c.Param("id"))
+	if !ok || !canViewTestJob(c, job) {
+		cancel()
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"test job not found",
+			fmt.Sprintf("no test job exists with id %s", c.Param("id"))))
 		return
 	}
+	defer cancel()
 
-	response = p.TestDatasetsEndpoint()
+	// A test can run well past the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to lift write deadline for event stream: %v", err),
+			"x-request-session-id", c.GetHeader("x-request-session-id"),
+			"method_name", method_name,
+		)
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
 
-	if val, ok := response.(gin.H)["errors"]; ok && val != "" {
-		c.JSON(http.StatusOK, response)
+	for _, step := range job.Steps {
+		c.SSEvent(testjob.EventStep, step)
+	}
+	if events == nil {
+		c.SSEvent(testjob.EventResult, job)
+		c.Writer.Flush()
 		return
 	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, open := <-events:
+			if !open {
+				return false
+			}
+			c.SSEvent(event.Type, event.Data)
+			return event.Type != testjob.EventResult
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// canViewTestJob Returns true if the caller started the job or is an
+// admin
+func canViewTestJob(c *gin.Context, job testjob.Job) bool {
+	principal, ok := auth.GetPrincipal(c)
+	return ok && (principal.Admin || principal.Subject == job.Owner)
+}
+
+// resolveTestCredentials Returns the access token to test with. Inline
+// credentials win, otherwise the secret stored for the federation is read,
+// once the caller is confirmed to own it. Inline credentials are never
+// stored or logged. Returns false if the request was aborted
+func resolveTestCredentials(c *gin.Context, tr *pkg.TestFederationRequest) (string, bool) {
+	authType := strings.ToUpper(tr.AuthType)
+	if authType == "" || authType == "NO_AUTH" {
+		return "", true
+	}
+
+	if len(tr.Credentials) > 0 && string(tr.Credentials) != "null" {
+		payload := []byte(tr.Credentials)
+
+		// Accept the payload as a JSON encoded string too, as it's sent
+		// when creating the secret
+		var encoded string
+		if json.Unmarshal(tr.Credentials, &encoded) == nil {
+			payload = []byte(encoded)
+		}
+
+		secret, err := secrets.DecodeSecretPayload(authType, payload)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+				false,
+				"invalid credentials",
+				err.Error()))
+			return "", false
+		}
+		return secrets.AccessToken(secret), true
+	}
+
+	if tr.PID == "" {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"missing credentials",
+			fmt.Sprintf("provide credentials or the pid of a stored secret to test %s auth", authType)))
+		return "", false
+	}
+
+	teamID := 0
+	if len(tr.Team) > 0 {
+		teamID = tr.Team[0].ID
+	}
+
+	secretCtx := secrets.NewSecrets(tr.PID, "")
+	if !authoriseSecretOwner(c, secretCtx, tr.PID, teamID) {
+		return "", false
+	}
+
+	secret, err := secretCtx.GetSecret(c.Request.Context(), authType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, utils.FormResponse(http.StatusInternalServerError,
+			false,
+			"unable to read stored credentials",
+			err.Error()))
+		return "", false
+	}
 
-	c.JSON(http.StatusOK, utils.FormResponse(http.StatusOK, true, "Test Successful", ""))
+	return secrets.AccessToken(secret), true
 }
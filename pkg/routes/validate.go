@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/utils"
+	"hdruk/federated-metadata/pkg/validator"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidateHandler Validates a custodian payload without configuring a
+// federation. Accepts either a list or dataset document in the body, or a
+// live endpoint plus auth, and returns the full schema and semantic report.
+// Any transformations supplied are applied first, and the report shows
+// each dataset before and after
+func ValidateHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"Validating payload",
+		"x-request-session-id", c.GetHeader("x-request-session-id"),
+		"method_name", method_name,
+	)
+
+	decoder := json.NewDecoder(c.Request.Body)
+	var vr pkg.ValidateRequest
+
+	err := decoder.Decode(&vr)
+	if err != nil {
+		slog.Debug(
+			fmt.Sprintf("unable to decode request body: %s", err.Error()),
+			"x-request-session-id", c.GetHeader("x-request-session-id"),
+			"method_name", method_name,
+		)
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to decode request body",
+			err.Error()))
+		return
+	}
+
+	datasetUri := ""
+	if vr.EndpointDataset != "" {
+		datasetUri = pull.EndpointURL(vr.EndpointBaseURL, vr.EndpointDataset)
+		if _, err := pull.ParseDatasetTemplate(datasetUri); err != nil {
+			c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+				false,
+				"invalid endpoint_dataset",
+				err.Error()))
+			return
+		}
+	}
+
+	if len(vr.Document) > 0 && string(vr.Document) != "null" {
+		docType, err := validator.DetectDocumentType(vr.Document)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+				false,
+				"unable to read document",
+				err.Error()))
+			return
+		}
+
+		if docType == validator.DocumentTypeList {
+			report, _ := validator.ValidateListDocument(vr.Document, datasetUri, c.GetHeader("x-request-session-id"))
+			c.JSON(http.StatusOK, report)
+			return
+		}
+
+		datasetReport := validator.ValidateTransformedDatasetDocument(vr.Document, vr.Transformations, vr.Item, datasetUri, c.GetHeader("x-request-session-id"))
+		c.JSON(http.StatusOK, validator.ValidationReport{
+			Valid:        datasetReport.Valid,
+			DocumentType: validator.DocumentTypeDataset,
+			Schema:       datasetReport.Schema,
+			Semantic:     datasetReport.Semantic,
+			Datasets:     []validator.DatasetReport{datasetReport},
+		})
+		return
+	}
+
+	if vr.EndpointBaseURL == "" || vr.EndpointDatasets == "" || vr.EndpointDataset == "" {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"nothing to validate",
+			"provide either a document or endpoint_baseurl, endpoint_datasets and endpoint_dataset"))
+		return
+	}
+
+	authType := vr.AuthType
+	if authType == "" {
+		authType = "NO_AUTH"
+	}
+
+	p := pull.NewPull(
+		0,
+		fmt.Sprintf("%s%s", vr.EndpointBaseURL, vr.EndpointDatasets),
+		datasetUri,
+		"",
+		"",
+		vr.AccessToken,
+		authType,
+		false,
+		c.GetHeader("x-request-session-id"),
+	)
+	p.Transformations = vr.Transformations
+
+	// Stop fetching if the caller goes away or the endpoint is too slow
+	ctx, cancel := pull.WithFederationBudget(c.Request.Context())
+	defer cancel()
+
+	c.JSON(http.StatusOK, p.ValidateFederation(ctx))
+}
@@ -0,0 +1,158 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/openapi"
+	"hdruk/federated-metadata/pkg/utils"
+	"hdruk/federated-metadata/pkg/webhook"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FederationWebhookHandler Accepts a change notification from a
+// federation's custodian and queues a sync of just the datasets it names.
+// Custodians authenticate with the federation's webhook secret, either
+// signing the timestamp and body or sending the secret itself. Callers
+// are rate limited before anything is looked up
+func FederationWebhookHandler(c *gin.Context) {
+	method_name := utils.MethodName(0)
+	sessionId := c.GetHeader("x-request-session-id")
+	slog.Debug(
+		"Federation webhook",
+		"x-request-session-id", sessionId,
+		"method_name", method_name,
+	)
+
+	var customMsg string
+	customAction := "FederationWebhook"
+
+	federationId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"invalid federation id",
+			err.Error()))
+		return
+	}
+
+	var limited *webhook.RateLimitError
+	if err := webhook.Limits.Allow(federationId, c.ClientIP()); errors.As(err, &limited) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, utils.FormResponse(http.StatusTooManyRequests,
+			false,
+			"rate limited",
+			err.Error()))
+		return
+	}
+
+	timestamp := c.GetHeader(webhook.TimestampHeader)
+	if err := webhook.CheckTimestamp(timestamp, time.Now()); err != nil {
+		c.JSON(http.StatusUnauthorized, utils.FormResponse(http.StatusUnauthorized,
+			false,
+			"unauthorised",
+			err.Error()))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, openapi.MaxBodyBytes()))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, utils.FormResponse(http.StatusRequestEntityTooLarge,
+			false,
+			"unable to read request body",
+			err.Error()))
+		return
+	}
+
+	fed, ok, err := webhook.LookupFederation(c.Request.Context(), federationId, sessionId)
+	if err != nil {
+		customMsg = "unable to look up federation"
+		utils.WriteGatewayAudit(fmt.Sprintf("%s %d: %v", customMsg, federationId, err.Error()), customAction, "POST")
+		c.JSON(http.StatusBadGateway, utils.FormResponse(http.StatusBadGateway,
+			false,
+			customMsg,
+			err.Error()))
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, utils.FormResponse(http.StatusNotFound,
+			false,
+			"federation not found",
+			fmt.Sprintf("no active federation with id %d", federationId)))
+		return
+	}
+
+	secret, err := webhook.LookupSecret(c.Request.Context(), fed)
+	if err != nil {
+		customMsg = "webhook is not configured for this federation"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", sessionId,
+			"method_name", method_name,
+		)
+		c.JSON(http.StatusUnauthorized, utils.FormResponse(http.StatusUnauthorized,
+			false,
+			"unauthorised",
+			customMsg))
+		return
+	}
+
+	if !webhook.Verify(secret, body, timestamp, c.GetHeader(webhook.SignatureHeader), c.GetHeader(webhook.SecretHeader)) {
+		customMsg = fmt.Sprintf("rejected webhook for federation %d with an invalid signature", federationId)
+		utils.WriteGatewayAudit(customMsg, customAction, "POST")
+		c.JSON(http.StatusUnauthorized, utils.FormResponse(http.StatusUnauthorized,
+			false,
+			"unauthorised",
+			fmt.Sprintf("missing or invalid %s or %s header", webhook.SignatureHeader, webhook.SecretHeader)))
+		return
+	}
+
+	if err := webhook.Remember(federationId, timestamp, body, time.Now()); err != nil {
+		customMsg = fmt.Sprintf("rejected a replayed webhook for federation %d", federationId)
+		utils.WriteGatewayAudit(customMsg, customAction, "POST")
+		c.JSON(http.StatusConflict, utils.FormResponse(http.StatusConflict,
+			false,
+			"duplicate notification",
+			err.Error()))
+		return
+	}
+
+	var n webhook.Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		c.JSON(http.StatusBadRequest, utils.FormResponse(http.StatusBadRequest,
+			false,
+			"unable to decode request body",
+			err.Error()))
+		return
+	}
+	if problems := n.Validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, utils.FormValidationResponse(http.StatusBadRequest,
+			"invalid notification",
+			problems))
+		return
+	}
+
+	enqueued, err := webhook.Default.Enqueue(fed, n, sessionId)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, utils.FormResponse(http.StatusServiceUnavailable,
+			false,
+			"unable to queue sync",
+			err.Error()))
+		return
+	}
+
+	customMsg = fmt.Sprintf("queued %s sync of %d datasets for federation %d", n.Event, len(enqueued.Queued), federationId)
+	utils.WriteGatewayAudit(customMsg, customAction, "POST")
+
+	response := utils.FormResponse(http.StatusAccepted, true, "sync queued", "")
+	response["queued"] = enqueued.Queued
+	response["duplicates"] = enqueued.Duplicates
+	c.JSON(http.StatusAccepted, response)
+}
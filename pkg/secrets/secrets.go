@@ -7,10 +7,25 @@ import (
 	"hdruk/federated-metadata/pkg/utils"
 	"log/slog"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	// annotationAuthType and annotationFields record what a secret's
+	// payload holds when it's written, so its metadata can be read
+	// without accessing the payload
+	annotationAuthType = "gmi-auth-type"
+	annotationFields   = "gmi-fields"
 )
 
 // Secrets Defines the shape of a gcloud secrets object
@@ -41,7 +56,7 @@ func NewSecrets(parent, version string) *Secrets {
 
 // GetSecret Returns the current secret version for this secrets
 // object version reference
-func (s *Secrets) GetSecret(authType string) (any, error) {
+func (s *Secrets) GetSecret(ctx context.Context, authType string) (any, error) {
 	method_name := utils.MethodName(0)
 	slog.Debug(
 		"GetSecret", 
@@ -52,7 +67,6 @@ func (s *Secrets) GetSecret(authType string) (any, error) {
 	var customMsg string
 	customAction := "GetSecret"
 
-	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		customMsg = "failed to create secretmanager client"
@@ -61,7 +75,7 @@ func (s *Secrets) GetSecret(authType string) (any, error) {
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		return nil, fmt.Errorf("failed to create secretmanager client: %v", err)
 	}
@@ -80,7 +94,7 @@ func (s *Secrets) GetSecret(authType string) (any, error) {
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
 
 		return nil, fmt.Errorf("failed to access secret version: %v", err)
 	}
@@ -104,15 +118,121 @@ func (s *Secrets) GetSecret(authType string) (any, error) {
 		"x-request-session-id", nil,
 		"method_name", method_name,
 	)
-	utils.WriteGatewayAudit(fmt.Sprintf(customMsg, authType), customAction, "GET")
+	utils.WriteGatewayAuditContext(ctx, fmt.Sprintf(customMsg, authType), customAction, "GET")
+
+	return nil, fmt.Errorf("unable to determine auth type")
+}
+
+// DecodeSecretPayload Decodes a payload in the shape we store in secret
+// manager into the response type for authType. NO_AUTH needs no payload
+// and returns nil. Errors if the payload doesn't hold the token authType
+// needs
+func DecodeSecretPayload(authType string, payload []byte) (any, error) {
+	switch strings.ToUpper(authType) {
+	case "BEARER":
+		var token BearerTokenResponse
+		if err := json.Unmarshal(payload, &token); err != nil {
+			return nil, fmt.Errorf("unable to decode credentials: %v", err)
+		}
+		if token.BearerToken == "" {
+			return nil, fmt.Errorf("credentials must include a bearer_token")
+		}
+		return token, nil
+	case "API_KEY":
+		var token APIKeyResponse
+		if err := json.Unmarshal(payload, &token); err != nil {
+			return nil, fmt.Errorf("unable to decode credentials: %v", err)
+		}
+		if token.APIKey == "" {
+			return nil, fmt.Errorf("credentials must include an api_key")
+		}
+		return token, nil
+	case "NO_AUTH":
+		return nil, nil
+	}
 
 	return nil, fmt.Errorf("unable to determine auth type")
 }
 
+// AccessToken Returns the token sent to a custodian from a secret
+// returned by GetSecret or DecodeSecretPayload
+func AccessToken(secret any) string {
+	switch token := secret.(type) {
+	case BearerTokenResponse:
+		return token.BearerToken
+	case APIKeyResponse:
+		return token.APIKey
+	}
+	return ""
+}
+
+// WebhookSecretResponse Defines the shape of the secret a custodian's
+// webhook notifications are authenticated with
+type WebhookSecretResponse struct {
+	WebhookSecret string `json:"webhook_secret"`
+}
+
+// WebhookSecretID Returns the id of the secret holding a federation's
+// webhook secret, stored alongside its credentials
+func WebhookSecretID(pid string) string {
+	return fmt.Sprintf("%s-webhook", pid)
+}
+
+// GetWebhookSecret Returns the webhook secret stored in this secrets
+// object's parent. Errors if the secret doesn't exist or is empty
+func (s *Secrets) GetWebhookSecret(ctx context.Context) (string, error) {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"GetWebhookSecret",
+		"x-request-session-id", nil,
+		"method_name", method_name,
+	)
+
+	var customMsg string
+	customAction := "GetWebhookSecret"
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		customMsg = "failed to create secretmanager client"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return "", fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	defer client.Close()
+
+	res, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("%s/secrets/%s/versions/latest", os.Getenv("GOOGLE_APPLICATION_PROJECT_PATH"), s.Parent),
+	})
+	if err != nil {
+		customMsg = "failed to access secret version"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return "", fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	var secret WebhookSecretResponse
+	if err := json.Unmarshal(res.Payload.Data, &secret); err != nil || secret.WebhookSecret == "" {
+		return "", fmt.Errorf("secret must include a webhook_secret")
+	}
+	return secret.WebhookSecret, nil
+}
+
 // CreateSecret Attempts to create a new secret on the given `path`,
-// determined by `secretID` within gcloud. Returns the path on success
-// or an error otherwise.
-func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error) {
+// determined by `secretID` within gcloud, tagged with `labels` and
+// annotated with what its payload holds. Returns the path on success or
+// an error otherwise.
+func (s *Secrets) CreateSecret(ctx context.Context, parent, secretID, payload string, labels map[string]string) (string, error) {
 	method_name := utils.MethodName(0)
 	slog.Debug(
 		"CreateSecret", 
@@ -123,7 +243,6 @@ func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error)
 	var customMsg string
 	customAction := "CreateSecret"
 
-	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		// The most likely causes of the error are:
@@ -135,18 +254,18 @@ func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
 	defer client.Close()
 
-	fmt.Printf("%s %s", parent, secretID)
-
 	secretReq := &secretmanagerpb.CreateSecretRequest{
 		Parent:   parent,
 		SecretId: secretID,
 		Secret: &secretmanagerpb.Secret{
+			Labels:      labels,
+			Annotations: PayloadAnnotations([]byte(payload)),
 			Replication: &secretmanagerpb.Replication{
 				Replication: &secretmanagerpb.Replication_Automatic_{
 					Automatic: &secretmanagerpb.Replication_Automatic{},
@@ -163,7 +282,7 @@ func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -184,7 +303,7 @@ func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "POST")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -192,10 +311,52 @@ func (s *Secrets) CreateSecret(parent, secretID, payload string) (string, error)
 	return secretName, nil
 }
 
+// GetSecretLabels Returns the labels held on a secret, without reading
+// any of its versions
+func (s *Secrets) GetSecretLabels(ctx context.Context, secretID string) (map[string]string, error) {
+	method_name := utils.MethodName(0)
+
+	var customMsg string
+	customAction := "GetSecretLabels"
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		customMsg = "failed to create secretmanager client"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return nil, fmt.Errorf("%s: %v", customMsg, err)
+	}
+	defer client.Close()
+
+	req := &secretmanagerpb.GetSecretRequest{
+		Name: fmt.Sprintf("%s/secrets/%s", os.Getenv("GOOGLE_APPLICATION_PROJECT_PATH"), secretID),
+	}
+
+	secret, err := client.GetSecret(ctx, req)
+	if err != nil {
+		customMsg = "failed to get secret"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return nil, fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	return secret.Labels, nil
+}
+
 // UpdateSecret Attempts to update an existing secret on the given `path`,
-// determined by `secretID` within gcloud. Returns the path on success
-// or an error otherwise.
-func (s *Secrets) UpdateSecret(parent, secretID, payload string) (string, error) {
+// determined by `secretID` within gcloud, and its annotations to match
+// the new payload. Returns the path on success or an error otherwise.
+func (s *Secrets) UpdateSecret(ctx context.Context, parent, secretID, payload string) (string, error) {
 	method_name := utils.MethodName(0)
 	slog.Debug(
 		"UpdateSecret", 
@@ -206,7 +367,6 @@ func (s *Secrets) UpdateSecret(parent, secretID, payload string) (string, error)
 	var customMsg string
 	customAction := "UpdateSecret"
 
-	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		customMsg = "failed to create secretmanager client"
@@ -215,7 +375,7 @@ func (s *Secrets) UpdateSecret(parent, secretID, payload string) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
 	defer client.Close()
@@ -236,7 +396,26 @@ func (s *Secrets) UpdateSecret(parent, secretID, payload string) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
+
+		return "", fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	_, err = client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:        secretName,
+			Annotations: PayloadAnnotations([]byte(payload)),
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"annotations"}},
+	})
+	if err != nil {
+		customMsg = "failed to update secret annotations"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -247,13 +426,12 @@ func (s *Secrets) UpdateSecret(parent, secretID, payload string) (string, error)
 // AddSecretVersion Updates a secret to the new `payload` incrementing
 // the gcloud secret version. Returns the secret path on success, error
 // otherwise.
-func (s *Secrets) AddSecretVersion(path string, payload []byte) (string, error) {
+func (s *Secrets) AddSecretVersion(ctx context.Context, path string, payload []byte) (string, error) {
 	method_name := utils.MethodName(0)
 
 	var customMsg string
 	customAction := ""
 
-	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		customMsg = "failed to create secret"
@@ -262,7 +440,7 @@ func (s *Secrets) AddSecretVersion(path string, payload []byte) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -283,7 +461,7 @@ func (s *Secrets) AddSecretVersion(path string, payload []byte) (string, error)
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "PATCH")
 
 		return "", fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -293,13 +471,12 @@ func (s *Secrets) AddSecretVersion(path string, payload []byte) (string, error)
 
 // DeleteSecret Attempts to delete a secret from within gcloud
 // secrets manager. Returns nil on success, error otherwise
-func (s *Secrets) DeleteSecret(secretID string) error {
+func (s *Secrets) DeleteSecret(ctx context.Context, secretID string) error {
 	method_name := utils.MethodName(0)
 
 	var customMsg string
 	customAction := ""
 
-	ctx := context.Background()
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		customMsg = "failed to create secretmanager client"
@@ -308,7 +485,7 @@ func (s *Secrets) DeleteSecret(secretID string) error {
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
 
 		return fmt.Errorf("%s: %v", customMsg, err)
 	}
@@ -325,10 +502,220 @@ func (s *Secrets) DeleteSecret(secretID string) error {
 			"x-request-session-id", nil,
 			"method_name", method_name,
 		)
-		utils.WriteGatewayAudit(fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "DELETE")
 
 		return fmt.Errorf("%s: %v", customMsg, err)
 	}
 
 	return nil
 }
+
+// SecretMetadata Defines what we're willing to reveal about a secret.
+// Payload values are never included, only which fields are set
+type SecretMetadata struct {
+	SecretID     string     `json:"secret_id"`
+	Exists       bool       `json:"exists"`
+	TeamID       string     `json:"team_id,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	VersionCount int        `json:"version_count"`
+	AuthType     string     `json:"auth_type,omitempty"`
+	Fields       []string   `json:"fields"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// GetSecretMetadata Returns the metadata for a secret. A secret that
+// doesn't exist is returned with Exists set to false rather than an error
+func (s *Secrets) GetSecretMetadata(ctx context.Context, secretID string) (SecretMetadata, error) {
+	method_name := utils.MethodName(0)
+
+	var customMsg string
+	customAction := "GetSecretMetadata"
+
+	meta := SecretMetadata{SecretID: secretID, Fields: []string{}}
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		customMsg = "failed to create secretmanager client"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return meta, fmt.Errorf("%s: %v", customMsg, err)
+	}
+	defer client.Close()
+
+	name := fmt.Sprintf("%s/secrets/%s", os.Getenv("GOOGLE_APPLICATION_PROJECT_PATH"), secretID)
+
+	secret, err := client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: name})
+	if status.Code(err) == codes.NotFound {
+		return meta, nil
+	}
+	if err != nil {
+		customMsg = "failed to get secret"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return meta, fmt.Errorf("%s: %v", customMsg, err)
+	}
+
+	meta.Exists = true
+	meta.TeamID = secret.Labels["team_id"]
+	if secret.CreateTime != nil {
+		created := secret.CreateTime.AsTime()
+		meta.CreatedAt = &created
+	}
+
+	versions := client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: name})
+	for {
+		version, err := versions.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			customMsg = "failed to list secret versions"
+			slog.Debug(
+				fmt.Sprintf("%s: %v", customMsg, err.Error()),
+				"x-request-session-id", nil,
+				"method_name", method_name,
+			)
+			utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+			return meta, fmt.Errorf("%s: %v", customMsg, err)
+		}
+
+		if version.State == secretmanagerpb.SecretVersion_DESTROYED {
+			continue
+		}
+		meta.VersionCount++
+
+		if version.CreateTime != nil {
+			updated := version.CreateTime.AsTime()
+			if meta.UpdatedAt == nil || updated.After(*meta.UpdatedAt) {
+				meta.UpdatedAt = &updated
+			}
+		}
+	}
+
+	// What the payload holds was recorded when it was written. Secrets
+	// written before that report no fields until they're next updated
+	if meta.VersionCount > 0 {
+		meta.AuthType = secret.Annotations[annotationAuthType]
+		if fields := secret.Annotations[annotationFields]; fields != "" {
+			meta.Fields = strings.Split(fields, ",")
+		}
+	}
+
+	return meta, nil
+}
+
+// ListTeamSecretIDs Returns the ids of every secret labelled as owned by
+// the given team
+func (s *Secrets) ListTeamSecretIDs(ctx context.Context, teamID int) ([]string, error) {
+	method_name := utils.MethodName(0)
+
+	var customMsg string
+	customAction := "ListTeamSecretIDs"
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		customMsg = "failed to create secretmanager client"
+		slog.Debug(
+			fmt.Sprintf("%s: %v", customMsg, err.Error()),
+			"x-request-session-id", nil,
+			"method_name", method_name,
+		)
+		utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+		return nil, fmt.Errorf("%s: %v", customMsg, err)
+	}
+	defer client.Close()
+
+	it := client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{
+		Parent: os.Getenv("GOOGLE_APPLICATION_PROJECT_PATH"),
+		Filter: fmt.Sprintf("labels.team_id=%d", teamID),
+	})
+
+	ids := []string{}
+	for {
+		secret, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			customMsg = "failed to list secrets"
+			slog.Debug(
+				fmt.Sprintf("%s: %v", customMsg, err.Error()),
+				"x-request-session-id", nil,
+				"method_name", method_name,
+			)
+			utils.WriteGatewayAuditContext(ctx, fmt.Sprintf("%s: %v", customMsg, err.Error()), customAction, "GET")
+
+			return nil, fmt.Errorf("%s: %v", customMsg, err)
+		}
+
+		ids = append(ids, path.Base(secret.Name))
+	}
+
+	return ids, nil
+}
+
+// PayloadFields Returns the sorted names of the fields set to a non-empty
+// value in a secret payload
+func PayloadFields(payload []byte) []string {
+	fields := []string{}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return fields
+	}
+
+	for key, value := range values {
+		if value == nil {
+			continue
+		}
+		if str, ok := value.(string); ok && strings.TrimSpace(str) == "" {
+			continue
+		}
+		fields = append(fields, key)
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+// PayloadAnnotations Returns the annotations recording which fields a
+// secret payload sets and the auth type they make up
+func PayloadAnnotations(payload []byte) map[string]string {
+	fields := PayloadFields(payload)
+	return map[string]string{
+		annotationAuthType: InferAuthType(fields),
+		annotationFields:   strings.Join(fields, ","),
+	}
+}
+
+// InferAuthType Works out which auth type a payload holds from the fields
+// it sets, matching the shapes GetSecret decodes
+func InferAuthType(fields []string) string {
+	has := map[string]bool{}
+	for _, f := range fields {
+		has[f] = true
+	}
+
+	switch {
+	case has["bearer_token"]:
+		return "BEARER"
+	case has["api_key"], has["client_id"], has["client_secret"]:
+		return "API_KEY"
+	case len(fields) == 0:
+		return "NO_AUTH"
+	}
+	return "UNKNOWN"
+}
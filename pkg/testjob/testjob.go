@@ -0,0 +1,261 @@
+package testjob
+
+import (
+	"context"
+	"errors"
+	"hdruk/federated-metadata/pkg/pull"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	StatusRunning  = "RUNNING"
+	StatusFinished = "FINISHED"
+
+	EventStep   = "step"
+	EventResult = "result"
+
+	// retention is how long a finished job can still be polled
+	retention = time.Hour
+
+	// defaultMaxRunning is how many jobs one principal can have running
+	// when GMI_TEST_JOBS_PER_PRINCIPAL doesn't say
+	defaultMaxRunning = 3
+)
+
+// ErrTooManyJobs is returned by Start when the owner already has as many
+// jobs running as they're allowed
+var ErrTooManyJobs = errors.New("too many test jobs running")
+
+// MaxRunning Returns how many jobs a single principal may have running at
+// once, from GMI_TEST_JOBS_PER_PRINCIPAL
+func MaxRunning() int {
+	max, err := strconv.Atoi(os.Getenv("GMI_TEST_JOBS_PER_PRINCIPAL"))
+	if err != nil || max <= 0 {
+		return defaultMaxRunning
+	}
+	return max
+}
+
+// Progress Defines how far through the listed datasets a job is
+type Progress struct {
+	DatasetsTotal int `json:"datasets_total"`
+	DatasetsDone  int `json:"datasets_done"`
+}
+
+// Job Defines a federation test running in the background
+type Job struct {
+	ID         string                 `json:"id"`
+	Owner      string                 `json:"-"`
+	Status     string                 `json:"status"`
+	CreatedAt  time.Time              `json:"created_at"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+	Progress   Progress               `json:"progress"`
+	Steps      []pull.DiagnosticStep  `json:"steps"`
+	Result     *pull.DiagnosticReport `json:"result,omitempty"`
+}
+
+// Event Defines a single message sent to job subscribers. Data holds a
+// pull.DiagnosticStep for step events and the finished Job for result
+// events
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// entry Holds a job alongside its subscribers
+type entry struct {
+	job         Job
+	subscribers map[chan Event]bool
+	cancel      context.CancelFunc
+}
+
+var (
+	mu   sync.Mutex
+	jobs = map[string]*entry{}
+)
+
+// Start Runs a diagnosis of p in the background on behalf of owner and
+// returns the new job. The job gets a federation's time budget, and can
+// be stopped early with Cancel. Returns ErrTooManyJobs when owner already
+// has MaxRunning jobs running
+func Start(p *pull.Pull, owner string) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	purge()
+
+	running := 0
+	for _, e := range jobs {
+		if e.job.Owner == owner && e.job.Status == StatusRunning {
+			running++
+		}
+	}
+	if running >= MaxRunning() {
+		return Job{}, ErrTooManyJobs
+	}
+
+	e := &entry{
+		job: Job{
+			ID:        uuid.NewString(),
+			Owner:     owner,
+			Status:    StatusRunning,
+			CreatedAt: time.Now().UTC(),
+			Steps:     []pull.DiagnosticStep{},
+		},
+		subscribers: map[chan Event]bool{},
+	}
+	jobs[e.job.ID] = e
+
+	ctx, cancel := pull.WithFederationBudget(context.Background())
+	e.cancel = cancel
+
+	go run(ctx, e, p)
+
+	return snapshot(e), nil
+}
+
+// Get Returns a copy of the job with the given id, if it exists
+func Get(id string) (Job, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return snapshot(e), true
+}
+
+// Subscribe Returns the job as it stands plus a channel carrying every
+// event after it. The channel is closed once the result is sent, or when
+// the returned cancel func is called. A finished job returns a nil channel
+func Subscribe(id string) (Job, <-chan Event, func(), bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := jobs[id]
+	if !ok {
+		return Job{}, nil, func() {}, false
+	}
+
+	if e.job.Status == StatusFinished {
+		return snapshot(e), nil, func() {}, true
+	}
+
+	ch := make(chan Event, 64)
+	e.subscribers[ch] = true
+
+	cancel := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if e.subscribers[ch] {
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return snapshot(e), ch, cancel, true
+}
+
+// Cancel Stops a running job, abandoning any call it has in flight. The
+// job finishes with an interrupted step shortly after. ok is false if
+// there's no such job
+func Cancel(id string) (job Job, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	e.cancel()
+	return snapshot(e), true
+}
+
+// CancelAll Stops every running job, as the service shuts down
+func CancelAll() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, e := range jobs {
+		e.cancel()
+	}
+}
+
+func run(ctx context.Context, e *entry, p *pull.Pull) {
+	defer e.cancel()
+
+	result := p.DiagnoseWithProgress(ctx, func(step pull.DiagnosticStep, datasets int) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		e.job.Steps = append(e.job.Steps, step)
+		e.job.Progress.DatasetsTotal = datasets
+		// Every dataset finishes with its last recorded step, whichever
+		// step failed
+		if step.PersistentID != "" && (step.Name == "dataset-valid" || (step.Name == "dataset-fetch" && step.Status == pull.StepFailed)) {
+			e.job.Progress.DatasetsDone++
+		}
+
+		publish(e, Event{Type: EventStep, Data: step})
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	finished := time.Now().UTC()
+	e.job.Status = StatusFinished
+	e.job.FinishedAt = &finished
+	e.job.Result = &result
+
+	publish(e, Event{Type: EventResult, Data: snapshot(e)})
+	for ch := range e.subscribers {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+
+	// Finished jobs go once they can no longer be polled, whether or not
+	// another job is started to purge them
+	time.AfterFunc(retention, func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delete(jobs, e.job.ID)
+	})
+}
+
+// publish Sends an event to every subscriber. Subscribers too slow to
+// keep up are dropped rather than blocking the test. Callers must hold mu
+func publish(e *entry, event Event) {
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// snapshot Returns a copy of the job that's safe to use without holding
+// mu. Callers must hold mu
+func snapshot(e *entry) Job {
+	job := e.job
+	job.Steps = append([]pull.DiagnosticStep{}, e.job.Steps...)
+	return job
+}
+
+// purge Forgets finished jobs past their retention. Callers must hold mu
+func purge() {
+	for id, e := range jobs {
+		if e.job.FinishedAt != nil && time.Since(*e.job.FinishedAt) > retention {
+			delete(jobs, id)
+		}
+	}
+}
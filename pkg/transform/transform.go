@@ -0,0 +1,288 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpRename   = "rename"
+	OpMove     = "move"
+	OpSplit    = "split"
+	OpDefault  = "default"
+	OpConstant = "constant"
+)
+
+// Change Records what a single rule did to a document
+type Change struct {
+	Rule    int    `json:"rule"`
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Applied bool   `json:"applied"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Result Holds a document before and after a set of rules were applied
+type Result struct {
+	Before  json.RawMessage `json:"before"`
+	After   json.RawMessage `json:"after"`
+	Changes []Change        `json:"changes"`
+}
+
+// ValidateRules Checks every rule has a known op and the fields that op
+// needs. Returns the first problem found
+func ValidateRules(rules []pkg.TransformRule) error {
+	for i, rule := range rules {
+		switch rule.Op {
+		case OpRename:
+			if rule.From == "" || rule.To == "" {
+				return fmt.Errorf("rule %d: rename needs from and to", i)
+			}
+			if strings.Contains(rule.To, ".") {
+				return fmt.Errorf("rule %d: rename target must be a key, use move for paths", i)
+			}
+		case OpMove:
+			if rule.From == "" || rule.To == "" {
+				return fmt.Errorf("rule %d: move needs from and to", i)
+			}
+		case OpSplit:
+			if rule.From == "" {
+				return fmt.Errorf("rule %d: split needs from", i)
+			}
+		case OpDefault, OpConstant:
+			if rule.To == "" {
+				return fmt.Errorf("rule %d: %s needs to", i, rule.Op)
+			}
+			if rule.Value == nil {
+				return fmt.Errorf("rule %d: %s needs a value", i, rule.Op)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown op %q", i, rule.Op)
+		}
+	}
+	return nil
+}
+
+// Apply Runs rules in order against a JSON object document and returns the
+// transformed document. Rules whose source path doesn't exist are skipped
+// and recorded as not applied
+func Apply(document []byte, rules []pkg.TransformRule) (Result, error) {
+	result := Result{
+		Before:  document,
+		After:   document,
+		Changes: []Change{},
+	}
+
+	if len(rules) == 0 {
+		return result, nil
+	}
+
+	if err := ValidateRules(rules); err != nil {
+		return result, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return result, fmt.Errorf("document is not a JSON object: %v", err)
+	}
+
+	for i, rule := range rules {
+		change := Change{Rule: i, Op: rule.Op}
+
+		switch rule.Op {
+		case OpRename:
+			parent, _ := splitPath(rule.From)
+			change.Path = rule.From
+			change.Applied, change.Reason = move(doc, rule.From, joinPath(parent, rule.To))
+		case OpMove:
+			change.Path = rule.From
+			change.Applied, change.Reason = move(doc, rule.From, rule.To)
+		case OpSplit:
+			change.Path = rule.From
+			change.Applied, change.Reason = split(doc, rule)
+		case OpDefault:
+			change.Path = rule.To
+			if current, ok := get(doc, rule.To); ok && !isEmpty(current) {
+				change.Reason = "value already set"
+				break
+			}
+			change.Applied, change.Reason = set(doc, rule.To, rule.Value)
+		case OpConstant:
+			change.Path = rule.To
+			change.Applied, change.Reason = set(doc, rule.To, rule.Value)
+		}
+
+		result.Changes = append(result.Changes, change)
+	}
+
+	after, err := json.Marshal(doc)
+	if err != nil {
+		return result, fmt.Errorf("unable to encode transformed document: %v", err)
+	}
+	result.After = after
+
+	return result, nil
+}
+
+func move(doc map[string]interface{}, from, to string) (bool, string) {
+	value, ok := get(doc, from)
+	if !ok {
+		return false, fmt.Sprintf("%s not found", from)
+	}
+
+	// Remove first so a value can be moved beneath its own path, e.g. a
+	// publisher string into summary.publisher.name
+	remove(doc, from)
+	if applied, reason := set(doc, to, value); !applied {
+		set(doc, from, value)
+		return false, reason
+	}
+	return true, ""
+}
+
+func split(doc map[string]interface{}, rule pkg.TransformRule) (bool, string) {
+	value, ok := get(doc, rule.From)
+	if !ok {
+		return false, fmt.Sprintf("%s not found", rule.From)
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return false, fmt.Sprintf("%s is not a string", rule.From)
+	}
+
+	separator := rule.Separator
+	if separator == "" {
+		separator = ","
+	}
+
+	parts := []interface{}{}
+	for _, part := range strings.Split(str, separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	to := rule.To
+	if to == "" {
+		to = rule.From
+	}
+	if applied, reason := set(doc, to, parts); !applied {
+		return false, reason
+	}
+	if to != rule.From {
+		remove(doc, rule.From)
+	}
+	return true, ""
+}
+
+// get Returns the value at a dot separated path. Numeric segments index
+// into arrays
+func get(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			next, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// set Writes value at a dot separated path, creating any missing objects
+// along the way
+func set(doc map[string]interface{}, path string, value interface{}) (bool, string) {
+	segments := strings.Split(path, ".")
+
+	var current interface{} = doc
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if last {
+				node[segment] = value
+				return true, ""
+			}
+			next, ok := node[segment]
+			if !ok || next == nil {
+				next = map[string]interface{}{}
+				node[segment] = next
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return false, fmt.Sprintf("%s: no array element %s", path, segment)
+			}
+			if last {
+				node[index] = value
+				return true, ""
+			}
+			current = node[index]
+		default:
+			return false, fmt.Sprintf("%s: cannot descend into %s", path, strings.Join(segments[:i], "."))
+		}
+	}
+	return false, fmt.Sprintf("%s: empty path", path)
+}
+
+func remove(doc map[string]interface{}, path string) {
+	parentPath, key := splitPath(path)
+
+	var parent interface{} = doc
+	if parentPath != "" {
+		var ok bool
+		if parent, ok = get(doc, parentPath); !ok {
+			return
+		}
+	}
+
+	if node, ok := parent.(map[string]interface{}); ok {
+		delete(node, key)
+	}
+}
+
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
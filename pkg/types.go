@@ -1,5 +1,7 @@
 package pkg
 
+import "encoding/json"
+
 // Federation Defines the shape of a Federation object being returned
 // from Gateway API
 type Federation struct {
@@ -13,6 +15,80 @@ type Federation struct {
 	RunTimeMinute    string `json:"run_time_minute"`
 	Enabled          bool   `json:"enabled"`
 	Team             []Team `json:"team"`
+
+	// Transformations are applied in order to every dataset document
+	// before it is validated and sent to the gateway
+	Transformations []TransformRule `json:"transformations"`
+
+	// SameVersionEdits Is how to treat a dataset whose content changed
+	// without its version being bumped. Either way it's updated
+	SameVersionEdits string `json:"same_version_edits"`
+
+	// TeamRules map datasets to the federation's teams, for custodians
+	// publishing on behalf of several. Datasets no rule matches belong
+	// to the first team
+	TeamRules []TeamRule `json:"team_rules"`
+
+	// DatasetMode Is how dataset bodies are fetched: one call per
+	// dataset, inline in the list, or several at a time from
+	// EndpointBatch. Datasets the custodian leaves out are fetched one at
+	// a time either way
+	DatasetMode   string `json:"dataset_mode"`
+	EndpointBatch string `json:"endpoint_batch"`
+	BatchSize     int    `json:"batch_size"`
+
+	// DeleteAfterRuns and DeleteAfterHours Are how long a dataset must be
+	// missing from the list before it's deleted from the gateway. Zero
+	// falls back to GMI_DELETE_AFTER_RUNS and GMI_DELETE_AFTER_HOURS
+	DeleteAfterRuns  int `json:"delete_after_runs"`
+	DeleteAfterHours int `json:"delete_after_hours"`
+
+	// DatasetSchemaURL Pins the schema the federation's datasets are
+	// checked against before they're synced. It must be under one of
+	// GMI_SCHEMA_ALLOWED_PREFIXES. Empty falls back to
+	// GMI_DATASET_SCHEMA_VALIDATION_URL
+	DatasetSchemaURL string `json:"dataset_schema_url"`
+}
+
+const (
+	// DatasetModeItem Fetches each dataset from EndpointDataset. The
+	// default
+	DatasetModeItem = "ITEM"
+	// DatasetModeEmbedded Takes dataset bodies from the dataset key of
+	// each list item
+	DatasetModeEmbedded = "EMBEDDED"
+	// DatasetModeBatch Fetches datasets BatchSize at a time from
+	// EndpointBatch, which answers with an object keyed by persistentId
+	DatasetModeBatch = "BATCH"
+)
+
+// TeamRule Maps datasets to one of a federation's teams, either by
+// persistent id or by the publisher named in their payload. Rules naming
+// persistent ids are checked before those matching the payload
+type TeamRule struct {
+	TeamID        int      `json:"team_id"`
+	PersistentIDs []string `json:"persistent_ids,omitempty"`
+	Publisher     string   `json:"publisher,omitempty"`
+	MemberOf      string   `json:"member_of,omitempty"`
+}
+
+const (
+	// SameVersionEditsWarn Updates the dataset and warns that its version
+	// wasn't bumped. The default
+	SameVersionEditsWarn = "WARN"
+	// SameVersionEditsAccept Updates the dataset without a warning
+	SameVersionEditsAccept = "ACCEPT"
+)
+
+// TransformRule Defines a single declarative mapping applied to a
+// custodian's dataset document. Paths are dot separated, e.g.
+// summary.publisher.name
+type TransformRule struct {
+	Op        string      `json:"op"`
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Separator string      `json:"separator,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
 }
 
 // Team Defines the shape of a Team object being returned from Gateway
@@ -55,24 +131,35 @@ type FederationItem struct {
 	Issued       string `json:"issued"`
 	Modified     string `json:"modified"`
 	Source       string `json:"source"`
+
+	// Dataset holds the full dataset body, for custodians that embed it
+	// in the list
+	Dataset json.RawMessage `json:"dataset,omitempty"`
 }
 
 type CreateSecretRequest struct {
 	Path     string `json:"path"`
 	SecretID string `json:"secret_id"`
 	Payload  string `json:"payload"`
+	TeamID   int    `json:"team_id"`
 }
 
 type DeleteSecretRequest struct {
 	SecretID string `json:"secret_id"`
+	TeamID   int    `json:"team_id"`
 }
 
 type Revisions struct {
 	Version *string `json:"version"`
 	Url     *string `json:"url"`
+	Extras  Extras  `json:"-"`
 }
 
+// FederationDataset Defines the shape of a dataset document returned by a
+// custodian's dataset endpoint. Fields the model doesn't declare are kept
+// in Extras so the document can be re-encoded without loss
 type FederationDataset struct {
+	Schema             string               `json:"@schema,omitempty"`
 	Identifier         string               `json:"identifier"`
 	Version            string               `json:"version"`
 	Issued             string               `json:"issued"`
@@ -85,6 +172,7 @@ type FederationDataset struct {
 	Accessibility      Accessibility        `json:"accessibility"`
 	Observations       []Observations       `json:"observations"`
 	StructuralMetadata []StructuralMetadata `json:"structuralMetadata"`
+	Extras             Extras               `json:"-"`
 }
 
 type Dataset struct {
@@ -100,74 +188,87 @@ type DatasetVersions struct {
 type DatasetsVersions map[string]DatasetVersions
 
 type Summary struct {
-	Title        string    `json:"title"`
-	Abstract     string    `json:"abstract"`
-	ContactPoint string    `json:"contactPoint"`
-	Keywords     []string  `json:"keywords"`
-	Publisher    Publisher `json:"publisher"`
+	Title        string      `json:"title"`
+	Abstract     string      `json:"abstract"`
+	ContactPoint MultiString `json:"contactPoint"`
+	Keywords     MultiString `json:"keywords"`
+	Publisher    Publisher   `json:"publisher"`
+	Extras       Extras      `json:"-"`
 }
 
 type Publisher struct {
-	Name         string `json:"name"`
-	Logo         string `json:"logo"`
-	Description  string `json:"description"`
-	ContactPoint string `json:"contactPoint"`
-	MemberOf     string `json:"memberOf"`
+	Name         string      `json:"name"`
+	Logo         string      `json:"logo"`
+	Description  string      `json:"description"`
+	ContactPoint MultiString `json:"contactPoint"`
+	MemberOf     string      `json:"memberOf"`
+	Extras       Extras      `json:"-"`
 }
 
 type Documentation struct {
 	Description string `json:"description"`
+	Extras      Extras `json:"-"`
 }
 
 type Coverage struct {
-	Spatial string `json:"spatial"`
+	Spatial MultiString `json:"spatial"`
+	Extras  Extras      `json:"-"`
 }
 
 type Provenance struct {
 	Temporal Temporal `json:"temporal"`
+	Extras   Extras   `json:"-"`
 }
 
 type Temporal struct {
 	AccrualPeriodicity string  `json:"accrualPeriodicity"`
 	StartDate          string  `json:"startDate"`
+	EndDate            *string `json:"endDate"`
 	TimeLag            *string `json:"timeLag"`
+	Extras             Extras  `json:"-"`
 }
 
 type Accessibility struct {
 	Access             Access             `json:"access"`
 	Usage              Usage              `json:"usage"`
 	FormatAndStandards FormatAndStandards `json:"formatAndStandards"`
+	Extras             Extras             `json:"-"`
 }
 
 type Access struct {
-	AccessRights   string `json:"accessRights"`
-	Jurisdiction   string `json:"jurisdiction"`
-	DataController string `json:"dataController"`
+	AccessRights   MultiString `json:"accessRights"`
+	Jurisdiction   MultiString `json:"jurisdiction"`
+	DataController string      `json:"dataController"`
+	Extras         Extras      `json:"-"`
 }
 
 type Usage struct {
-	DataUseLimitation string `json:"dataUseLimitation"`
+	DataUseLimitation MultiString `json:"dataUseLimitation"`
+	Extras            Extras      `json:"-"`
 }
 
 type FormatAndStandards struct {
-	VocabularyEncodingScheme string `json:"vocabularyEncodingScheme"`
-	ConformsTo               string `json:"conformsTo"`
-	Language                 string `json:"language"`
-	Format                   string `json:"format"`
+	VocabularyEncodingScheme MultiString `json:"vocabularyEncodingScheme"`
+	ConformsTo               MultiString `json:"conformsTo"`
+	Language                 MultiString `json:"language"`
+	Format                   MultiString `json:"format"`
+	Extras                   Extras      `json:"-"`
 }
 
 type Observations struct {
-	ObservedNode              string `json:"observedNode"`
-	MeasuredValue             int    `json:"measuredValue"`
-	DisambiguatingDescription string `json:"disambiguatingDescription"`
-	ObservationDate           string `json:"observationDate"`
-	MeasuredProperty          string `json:"measuredProperty"`
+	ObservedNode              string  `json:"observedNode"`
+	MeasuredValue             float64 `json:"measuredValue"`
+	DisambiguatingDescription string  `json:"disambiguatingDescription"`
+	ObservationDate           string  `json:"observationDate"`
+	MeasuredProperty          string  `json:"measuredProperty"`
+	Extras                    Extras  `json:"-"`
 }
 
 type StructuralMetadata struct {
 	Name        string        `json:"name"`
 	Description *string       `json:"description"`
 	Elements    []DataElement `json:"elements"`
+	Extras      Extras        `json:"-"`
 }
 
 type DataElement struct {
@@ -175,4 +276,27 @@ type DataElement struct {
 	Description *string `json:"description"`
 	DataType    string  `json:"dataType"`
 	Sensitive   bool    `json:"sensitive"`
+	Extras      Extras  `json:"-"`
+}
+
+// TestFederationRequest Defines the body of a /test request. Credentials
+// take the same shape as the payload stored in secret manager, either as
+// an object or a JSON encoded string, and are only ever used for the test
+type TestFederationRequest struct {
+	Federation
+	Credentials json.RawMessage `json:"credentials"`
+}
+
+// ValidateRequest Defines the body accepted by the validate endpoint.
+// Either Document holds a list or dataset payload to check directly, or
+// EndpointBaseURL and friends point at a live custodian endpoint
+type ValidateRequest struct {
+	Document         json.RawMessage `json:"document"`
+	Item             *FederationItem `json:"item"`
+	AuthType         string          `json:"auth_type"`
+	AccessToken      string          `json:"access_token"`
+	EndpointBaseURL  string          `json:"endpoint_baseurl"`
+	EndpointDatasets string          `json:"endpoint_datasets"`
+	EndpointDataset  string          `json:"endpoint_dataset"`
+	Transformations  []TransformRule `json:"transformations"`
 }
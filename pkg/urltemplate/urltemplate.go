@@ -0,0 +1,223 @@
+package urltemplate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template Is a parsed RFC 6570 URL template. Level 3 expressions are
+// supported: simple {var}, reserved {+var}, fragment {#var}, label
+// {.var}, path {/var}, path parameter {;var}, query {?var} and query
+// continuation {&var}, each with one or more comma separated variables.
+// Level 4 prefix and explode modifiers are not
+type Template struct {
+	raw   string
+	parts []part
+}
+
+type part struct {
+	literal    string
+	expression *expression
+}
+
+type expression struct {
+	op   operator
+	vars []string
+}
+
+// operator Describes how an expression's variables are expanded, as in
+// the table in RFC 6570 appendix A
+type operator struct {
+	first    string
+	sep      string
+	named    bool
+	ifEmpty  string
+	reserved bool
+}
+
+var operators = map[byte]operator{
+	0:   {first: "", sep: ","},
+	'+': {first: "", sep: ",", reserved: true},
+	'#': {first: "#", sep: ",", reserved: true},
+	'.': {first: ".", sep: "."},
+	'/': {first: "/", sep: "/"},
+	';': {first: ";", sep: ";", named: true},
+	'?': {first: "?", sep: "&", named: true, ifEmpty: "="},
+	'&': {first: "&", sep: "&", named: true, ifEmpty: "="},
+}
+
+// Parse Parses a URL template whose expressions may only use the given
+// variable names. Returns the first problem found
+func Parse(raw string, variables ...string) (*Template, error) {
+	known := map[string]bool{}
+	for _, name := range variables {
+		known[name] = true
+	}
+
+	t := &Template{raw: raw}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open == -1 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected } at %d", len(raw)-len(rest)+open)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end == -1 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed expression at %d", len(raw)-len(rest)+open)
+		}
+
+		expr, err := parseExpression(rest[open+1:open+1+end], known)
+		if err != nil {
+			return nil, fmt.Errorf("expression {%s}: %v", rest[open+1:open+1+end], err)
+		}
+		t.parts = append(t.parts, part{expression: expr})
+		rest = rest[open+end+2:]
+	}
+
+	return t, nil
+}
+
+func parseExpression(body string, known map[string]bool) (*expression, error) {
+	if body == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	var key byte
+	if _, ok := operators[body[0]]; ok && body[0] != 0 {
+		key = body[0]
+		body = body[1:]
+	} else if strings.ContainsRune("=,!@|", rune(body[0])) {
+		return nil, fmt.Errorf("operator %c is reserved", body[0])
+	}
+
+	expr := &expression{op: operators[key]}
+	for _, name := range strings.Split(body, ",") {
+		if strings.ContainsAny(name, ":*") {
+			return nil, fmt.Errorf("prefix and explode modifiers are not supported")
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown variable %q", name)
+		}
+		expr.vars = append(expr.vars, name)
+	}
+
+	return expr, nil
+}
+
+// String Returns the template as written
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Uses Returns true when any expression uses the variable
+func (t *Template) Uses(name string) bool {
+	for _, p := range t.parts {
+		if p.expression == nil {
+			continue
+		}
+		for _, v := range p.expression.vars {
+			if v == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Required Returns the variables the URL can't be formed without: those
+// in expressions other than the query, which are dropped when empty
+func (t *Template) Required() []string {
+	required := []string{}
+	seen := map[string]bool{}
+	for _, p := range t.parts {
+		if p.expression == nil || p.expression.op.named {
+			continue
+		}
+		for _, v := range p.expression.vars {
+			if !seen[v] {
+				seen[v] = true
+				required = append(required, v)
+			}
+		}
+	}
+	return required
+}
+
+// Expand Returns the URL with every expression expanded from values.
+// Empty or missing values are undefined, and left out as RFC 6570 says
+func (t *Template) Expand(values map[string]string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.expression == nil {
+			b.WriteString(p.literal)
+			continue
+		}
+		p.expression.expand(&b, values)
+	}
+	return b.String()
+}
+
+func (e *expression) expand(b *strings.Builder, values map[string]string) {
+	first := true
+	for _, name := range e.vars {
+		value, ok := values[name]
+		if !ok || value == "" {
+			continue
+		}
+
+		if first {
+			b.WriteString(e.op.first)
+			first = false
+		} else {
+			b.WriteString(e.op.sep)
+		}
+
+		if e.op.named {
+			b.WriteString(name)
+			b.WriteString("=")
+		}
+		b.WriteString(escape(value, e.op.reserved))
+	}
+}
+
+// escape Percent-encodes value, keeping unreserved characters and, for
+// reserved expansion, reserved characters and existing percent-encoded
+// triplets
+func escape(value string, reserved bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case isUnreserved(c):
+			b.WriteByte(c)
+		case reserved && isReserved(c):
+			b.WriteByte(c)
+		case reserved && c == '%' && i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]):
+			b.WriteString(value[i : i+3])
+			i += 2
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0
+}
+
+func isReserved(c byte) bool {
+	return strings.IndexByte(":/?#[]@!$&'()*+,;=", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
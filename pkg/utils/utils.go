@@ -1,25 +1,19 @@
 package utils
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/gin-gonic/gin"
 )
 
-type loginResponse struct {
-	AccessToken string `json:"access_token"`
-}
-
 // HandleError Global error handler utility function
 func HandleError(message string, returnVal any) (any, error) {
 	return returnVal, fmt.Errorf("%s", message)
@@ -36,6 +30,14 @@ func FormResponse(status int, ret bool, title string, err string) gin.H {
 	}
 }
 
+// FormValidationResponse Forms the same envelope as FormResponse, adding
+// each individual problem found with a request under details
+func FormValidationResponse(status int, title string, details []string) gin.H {
+	response := FormResponse(status, false, title, strings.Join(details, "; "))
+	response["details"] = details
+	return response
+}
+
 // IsSuccessfulStatusCode Helper function to determine successful http call
 // responses
 func IsSuccessfulStatusCode(status int) bool {
@@ -70,60 +72,19 @@ func FindMissingElements(list1, list2 []string) []string {
 	return missingElements
 }
 
-func GetServiceUserJWT() (string, error) {
-
-	email, okEmail := os.LookupEnv("SERVICE_EMAIL")
-	if !okEmail || email == "" {
-		fmt.Println("SERVICE_EMAIL is missing or empty")
-	}
-
-	password, okPassword := os.LookupEnv("SERVICE_PASSWORD")
-	if !okPassword || password == "" {
-		fmt.Println("SERVICE_PASSWORD is missing or empty")
-	}
-
-	authURL, okAuthUrl := os.LookupEnv("GATEWAY_API_AUTH_URL")
-	if !okAuthUrl || authURL == "" {
-		fmt.Println("GATEWAY_API_AUTH_URL is missing or empty")
-	}
-
-	payload := map[string]string{
-		"email":    email,
-		"password": password,
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal login payload: %v", err)
-	}
-
-	resp, err := http.Post(authURL, "application/json", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return "", fmt.Errorf("failed to make login request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("login request failed with status: %s", resp.Status)
-	}
-
-	var result loginResponse
-	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to parse login response: %v", err)
-	}
-
-	token := result.AccessToken
-	if token == "" {
-		return "", fmt.Errorf("token not found in login response")
-	}
-	fmt.Printf("Access token: %s\n", token)
-
-	return token, nil
-}
+// auditTimeout bounds how long publishing a single audit entry can take,
+// so a slow Pub/Sub can't hold up the work being audited
+const auditTimeout = 5 * time.Second
 
 // WriteGatewayAudit Helper function to write logs to the gateway api audit
 // log
 func WriteGatewayAudit(message, actionType string, actionName string) {
+	WriteGatewayAuditContext(context.Background(), message, actionType, actionName)
+}
+
+// WriteGatewayAuditContext Writes to the gateway api audit log as part of
+// the work ctx belongs to. Nothing is published once ctx is done
+func WriteGatewayAuditContext(ctx context.Context, message, actionType string, actionName string) {
 	enabled, err := strconv.Atoi(os.Getenv("AUDIT_LOG_ENABLED"))
 	if err != nil {
 		enabled = 0 // couldn't read config, so avoid spamming the API
@@ -133,13 +94,16 @@ func WriteGatewayAudit(message, actionType string, actionName string) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, auditTimeout)
+	defer cancel()
+
 	projectId := os.Getenv("PUBSUB_PROJECT_ID")
 	topicName := os.Getenv("PUBSUB_TOPIC_NAME")
 
 	client, err := pubsub.NewClient(ctx, projectId)
 	if err != nil {
 		slog.Info(fmt.Sprintf("Failed to create client: %s", err.Error()))
+		return
 	}
 	defer client.Close()
 
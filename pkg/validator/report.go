@@ -0,0 +1,245 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/quality"
+	"hdruk/federated-metadata/pkg/transform"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	DocumentTypeList    = "list"
+	DocumentTypeDataset = "dataset"
+)
+
+// ValidationReport Defines the full outcome of validating a custodian
+// payload. For list documents fetched from a live endpoint, Datasets holds
+// a report for every item in the list
+type ValidationReport struct {
+	Valid        bool              `json:"valid"`
+	DocumentType string            `json:"document_type"`
+	Schema       SchemaReport      `json:"schema"`
+	Semantic     []SemanticFinding `json:"semantic"`
+	Datasets     []DatasetReport   `json:"datasets,omitempty"`
+}
+
+// DatasetReport Defines the outcome of validating a single dataset
+// document
+type DatasetReport struct {
+	PersistentID string            `json:"persistent_id"`
+	Version      string            `json:"version"`
+	Url          string            `json:"url,omitempty"`
+	Valid        bool              `json:"valid"`
+	Error        string            `json:"error,omitempty"`
+	Schema       SchemaReport      `json:"schema"`
+	Semantic     []SemanticFinding `json:"semantic"`
+	Transform    *transform.Result `json:"transform,omitempty"`
+	Quality      *quality.Score    `json:"quality,omitempty"`
+}
+
+// defaultSchemaPrefixes is where HDR UK publishes its schemata
+const defaultSchemaPrefixes = "https://raw.githubusercontent.com/HDRUK/"
+
+// ErrSchemaNotAllowed Is returned for a schema url a document names that
+// isn't under one of the allowed prefixes. Such schemas are never fetched
+var ErrSchemaNotAllowed = errors.New("schema url is not allowed")
+
+// SchemaUrlAllowed Returns ErrSchemaNotAllowed unless schemaUrl is an
+// https url under one of the prefixes in GMI_SCHEMA_ALLOWED_PREFIXES, a
+// comma separated list defaulting to defaultSchemaPrefixes. Paths that
+// step out of a prefix with ".." are refused
+func SchemaUrlAllowed(schemaUrl string) error {
+	u, err := url.Parse(schemaUrl)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Host == "" || strings.Contains(u.Path, "..") {
+		return fmt.Errorf("%w: %s", ErrSchemaNotAllowed, schemaUrl)
+	}
+
+	prefixes := os.Getenv("GMI_SCHEMA_ALLOWED_PREFIXES")
+	if prefixes == "" {
+		prefixes = defaultSchemaPrefixes
+	}
+	for _, prefix := range strings.Split(prefixes, ",") {
+		allowed, err := url.Parse(strings.TrimSpace(prefix))
+		if err != nil || allowed.Scheme != "https" {
+			continue
+		}
+		if strings.EqualFold(u.Host, allowed.Host) && strings.HasPrefix(u.Path, allowed.Path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSchemaNotAllowed, schemaUrl)
+}
+
+// DatasetSchemaUrl Returns the schema url used to validate a dataset
+// document. GMI_DATASET_SCHEMA_VALIDATION_URL takes precedence, otherwise
+// the document's own @schema is used if SchemaUrlAllowed accepts it.
+// Returns an empty string when neither is available
+func DatasetSchemaUrl(dataset *pkg.FederationDataset) (string, error) {
+	if schemaUrl := os.Getenv("GMI_DATASET_SCHEMA_VALIDATION_URL"); schemaUrl != "" {
+		return schemaUrl, nil
+	}
+	if dataset.Schema == "" {
+		return "", nil
+	}
+	if err := SchemaUrlAllowed(dataset.Schema); err != nil {
+		return "", err
+	}
+	return dataset.Schema, nil
+}
+
+// SyncSchemaUrl Returns the schema url datasets are checked against
+// before they're synced: pinned, the federation's own choice, if
+// SchemaUrlAllowed accepts it, otherwise GMI_DATASET_SCHEMA_VALIDATION_URL.
+// A dataset's own @schema is never used. Returns an empty string when
+// neither is set
+func SyncSchemaUrl(pinned string) (string, error) {
+	if pinned != "" {
+		if err := SchemaUrlAllowed(pinned); err != nil {
+			return "", err
+		}
+		return pinned, nil
+	}
+	return os.Getenv("GMI_DATASET_SCHEMA_VALIDATION_URL"), nil
+}
+
+// DetectDocumentType Returns DocumentTypeList when the document has an
+// `items` array, DocumentTypeDataset otherwise
+func DetectDocumentType(document []byte) (string, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(document, &probe); err != nil {
+		return "", fmt.Errorf("document is not a JSON object: %v", err)
+	}
+
+	if _, ok := probe["items"]; ok {
+		return DocumentTypeList, nil
+	}
+	return DocumentTypeDataset, nil
+}
+
+// ValidateListDocument Validates a list document against the GMI schema
+// and runs the list-level semantic checks against each item
+func ValidateListDocument(document []byte, datasetUri string, logging string) (ValidationReport, pkg.FederationResponse) {
+	report := ValidationReport{
+		DocumentType: DocumentTypeList,
+		Semantic:     []SemanticFinding{},
+	}
+
+	schema, err := ValidateSchemaReport(ListSchemaUrl(), document, logging)
+	report.Schema = schema
+	if err != nil {
+		return report, pkg.FederationResponse{}
+	}
+
+	list, err := pkg.DecodeFederationResponse(bytes.NewReader(document))
+	if err != nil {
+		report.Schema.Valid = false
+		report.Schema.Errors = append(report.Schema.Errors, fmt.Sprintf("unable to decode list: %v", err))
+		return report, pkg.FederationResponse{}
+	}
+
+	report.Semantic = append(report.Semantic, checkDuplicatePersistentIds(list)...)
+	for _, item := range list.Items {
+		report.Semantic = append(report.Semantic, ValidateSemantics(&SemanticInput{
+			Item:       item,
+			DatasetUri: datasetUri,
+		}, logging)...)
+	}
+
+	report.Valid = report.Schema.Valid && !HasSemanticErrors(report.Semantic)
+	return report, list
+}
+
+// ValidateTransformedDatasetDocument Applies rules to a dataset document and
+// validates the result. The report carries the document before and after
+// transformation
+func ValidateTransformedDatasetDocument(document []byte, rules []pkg.TransformRule, item *pkg.FederationItem, datasetUri string, logging string) DatasetReport {
+	result, err := transform.Apply(document, rules)
+	if err != nil {
+		return DatasetReport{
+			Error:     fmt.Sprintf("unable to apply transformations: %v", err),
+			Schema:    SchemaReport{Errors: []string{}},
+			Semantic:  []SemanticFinding{},
+			Transform: &result,
+		}
+	}
+
+	report := ValidateDatasetDocument(result.After, item, datasetUri, logging)
+	if len(rules) > 0 {
+		report.Transform = &result
+	}
+	return report
+}
+
+// ValidateDatasetDocument Validates a dataset document against its schema
+// and runs the semantic checks. item may be nil when the dataset is
+// validated on its own, in which case the list comparison rules are
+// skipped
+func ValidateDatasetDocument(document []byte, item *pkg.FederationItem, datasetUri string, logging string) DatasetReport {
+	report := DatasetReport{
+		Semantic: []SemanticFinding{},
+		Schema:   SchemaReport{Errors: []string{}},
+	}
+
+	dataset, err := pkg.DecodeFederationDataset(document)
+	if err != nil {
+		report.Error = fmt.Sprintf("unable to decode dataset: %v", err)
+		return report
+	}
+
+	report.PersistentID = dataset.Identifier
+	report.Version = dataset.Version
+
+	schemaUrl, err := DatasetSchemaUrl(&dataset)
+	if err != nil {
+		report.Schema.SchemaUrl = dataset.Schema
+		report.Schema.Errors = append(report.Schema.Errors, err.Error())
+	} else if schemaUrl == "" {
+		report.Schema.Skipped = true
+		report.Schema.Valid = true
+	} else {
+		report.Schema, _ = ValidateSchemaReport(schemaUrl, document, logging)
+	}
+
+	in := &SemanticInput{
+		Dataset:    &dataset,
+		DatasetUri: datasetUri,
+	}
+	if item != nil {
+		in.Item = *item
+		report.PersistentID = item.PersistentID
+	}
+	report.Semantic = ValidateSemantics(in, logging)
+
+	score := quality.ScoreDataset(&dataset)
+	report.Quality = &score
+
+	report.Valid = report.Schema.Valid && !HasSemanticErrors(report.Semantic)
+	return report
+}
+
+// checkDuplicatePersistentIds Reports every persistentId that appears in
+// the list more than once
+func checkDuplicatePersistentIds(list pkg.FederationResponse) []SemanticFinding {
+	findings := []SemanticFinding{}
+	seen := map[string]int{}
+
+	for _, item := range list.Items {
+		seen[item.PersistentID]++
+		if seen[item.PersistentID] == 2 {
+			findings = append(findings, SemanticFinding{
+				Rule:     "unique-persistent-ids",
+				Severity: SeverityError,
+				Field:    "persistentId",
+				Message:  fmt.Sprintf("persistentId %s appears more than once in the list", item.PersistentID),
+			})
+		}
+	}
+
+	return findings
+}
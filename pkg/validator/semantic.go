@@ -0,0 +1,324 @@
+package validator
+
+import (
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/urltemplate"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severity Defines how serious a semantic finding is. Only ERROR findings
+// stop a dataset from being synced
+type Severity string
+
+const (
+	SeverityError   Severity = "ERROR"
+	SeverityWarning Severity = "WARNING"
+	SeverityInfo    Severity = "INFO"
+)
+
+// SemanticInput Defines everything a semantic rule can look at: the list
+// entry, the dataset document it points to and the endpoint it was
+// fetched from
+type SemanticInput struct {
+	Item       pkg.FederationItem
+	Dataset    *pkg.FederationDataset
+	DatasetUri string
+}
+
+// SemanticFinding Defines the shape of a single failed semantic check
+type SemanticFinding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Field    string   `json:"field"`
+	Message  string   `json:"message"`
+}
+
+// SemanticRule Defines a single named check. Check returns one message per
+// problem found, or nothing when the input passes. Rules that compare the
+// list entry with the dataset are skipped when either side is missing
+type SemanticRule struct {
+	Name            string
+	Field           string
+	Severity        Severity
+	RequiresItem    bool
+	RequiresDataset bool
+	Check           func(in *SemanticInput) []string
+}
+
+// DefaultSemanticRules The checks we run against every dataset, on top of
+// JSON Schema validation
+var DefaultSemanticRules = []SemanticRule{
+	{
+		Name:            "identifier-matches-list",
+		Field:           "identifier",
+		Severity:        SeverityError,
+		RequiresItem:    true,
+		RequiresDataset: true,
+		Check:           checkIdentifierMatchesList,
+	},
+	{
+		Name:            "version-is-semver",
+		Field:           "version",
+		Severity:        SeverityWarning,
+		RequiresDataset: true,
+		Check:           checkVersionIsSemver,
+	},
+	{
+		Name:            "version-matches-list",
+		Field:           "version",
+		Severity:        SeverityError,
+		RequiresItem:    true,
+		RequiresDataset: true,
+		Check:           checkVersionMatchesList,
+	},
+	{
+		Name:     "modified-after-issued",
+		Field:    "modified",
+		Severity: SeverityWarning,
+		Check:    checkModifiedAfterIssued,
+	},
+	{
+		Name:            "revisions-known-versions",
+		Field:           "revisions",
+		Severity:        SeverityWarning,
+		RequiresDataset: true,
+		Check:           checkRevisionsKnownVersions,
+	},
+	{
+		Name:         "self-resolves-to-dataset",
+		Field:        "self",
+		Severity:     SeverityWarning,
+		RequiresItem: true,
+		Check:        checkSelfResolvesToDataset,
+	},
+}
+
+// ValidateSemantics Runs every rule in DefaultSemanticRules against the
+// given input and returns the findings in rule order
+func ValidateSemantics(in *SemanticInput, logging string) []SemanticFinding {
+	return ValidateSemanticsWithRules(in, DefaultSemanticRules, logging)
+}
+
+// ValidateSemanticsWithRules Runs the given rules against the input and
+// returns the findings in rule order
+func ValidateSemanticsWithRules(in *SemanticInput, rules []SemanticRule, logging string) []SemanticFinding {
+	method_name := utils.MethodName(0)
+	slog.Debug(
+		"ValidateSemantics",
+		"x-request-session-id", logging,
+		"method_name", method_name,
+	)
+
+	findings := []SemanticFinding{}
+	for _, rule := range rules {
+		if rule.RequiresItem && in.Item.PersistentID == "" {
+			continue
+		}
+		if rule.RequiresDataset && in.Dataset == nil {
+			continue
+		}
+
+		for _, msg := range rule.Check(in) {
+			slog.Debug(
+				fmt.Sprintf("%s %s: %s", rule.Severity, rule.Name, msg),
+				"x-request-session-id", logging,
+				"method_name", method_name,
+			)
+			findings = append(findings, SemanticFinding{
+				Rule:     rule.Name,
+				Severity: rule.Severity,
+				Field:    rule.Field,
+				Message:  msg,
+			})
+		}
+	}
+
+	return findings
+}
+
+// HasSemanticErrors Returns true if any finding is of ERROR severity
+func HasSemanticErrors(findings []SemanticFinding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func checkIdentifierMatchesList(in *SemanticInput) []string {
+	identifier := in.Dataset.Identifier
+	if identifier == "" {
+		return []string{"dataset has no identifier"}
+	}
+
+	if identifier != in.Item.PersistentID {
+		return []string{fmt.Sprintf("dataset identifier %s does not match list persistentId %s",
+			identifier, in.Item.PersistentID)}
+	}
+	return nil
+}
+
+func checkVersionIsSemver(in *SemanticInput) []string {
+	version := in.Dataset.Version
+	if _, ok := parseSemver(version); !ok {
+		return []string{fmt.Sprintf("dataset version %q is not a valid semantic version", version)}
+	}
+	return nil
+}
+
+func checkVersionMatchesList(in *SemanticInput) []string {
+	version := in.Dataset.Version
+	if version != in.Item.Version {
+		return []string{fmt.Sprintf("version mismatch: expected %s, but got %s", in.Item.Version, version)}
+	}
+	return nil
+}
+
+func checkModifiedAfterIssued(in *SemanticInput) []string {
+	var msgs []string
+
+	type datePair struct {
+		source   string
+		issued   string
+		modified string
+	}
+
+	pairs := []datePair{{"list entry", in.Item.Issued, in.Item.Modified}}
+	if in.Dataset != nil {
+		pairs = append(pairs, datePair{"dataset", in.Dataset.Issued, in.Dataset.Modified})
+	}
+
+	for _, pair := range pairs {
+		if pair.issued == "" || pair.modified == "" {
+			continue
+		}
+
+		issued, err := time.Parse(time.RFC3339, pair.issued)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s issued %q is not an RFC 3339 timestamp", pair.source, pair.issued))
+			continue
+		}
+		modified, err := time.Parse(time.RFC3339, pair.modified)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s modified %q is not an RFC 3339 timestamp", pair.source, pair.modified))
+			continue
+		}
+
+		if modified.Before(issued) {
+			msgs = append(msgs, fmt.Sprintf("%s modified %s is before issued %s", pair.source, pair.modified, pair.issued))
+		}
+	}
+
+	return msgs
+}
+
+func checkRevisionsKnownVersions(in *SemanticInput) []string {
+	current, currentOk := parseSemver(in.Dataset.Version)
+
+	var msgs []string
+	for i, revision := range in.Dataset.Revisions {
+		version := ""
+		if revision.Version != nil {
+			version = *revision.Version
+		}
+
+		parsed, ok := parseSemver(version)
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("revision %d references unknown version %q", i, version))
+			continue
+		}
+
+		if currentOk && compareSemver(parsed, current) > 0 {
+			msgs = append(msgs, fmt.Sprintf("revision %d references version %s which is newer than the dataset version %s",
+				i, version, in.Dataset.Version))
+		}
+	}
+
+	return msgs
+}
+
+func checkSelfResolvesToDataset(in *SemanticInput) []string {
+	if in.Item.Self == "" || in.DatasetUri == "" {
+		return nil
+	}
+
+	// A template built from self always resolves to it
+	template, err := urltemplate.Parse(in.DatasetUri, "id", "version", "self")
+	if err != nil || template.Uses("self") {
+		return nil
+	}
+	expected := template.Expand(map[string]string{"id": in.Item.PersistentID, "version": in.Item.Version})
+
+	selfUrl, err := url.Parse(in.Item.Self)
+	if err != nil || selfUrl.Host == "" {
+		return []string{fmt.Sprintf("self %q is not an absolute URL", in.Item.Self)}
+	}
+	expectedUrl, err := url.Parse(expected)
+	if err != nil {
+		return nil
+	}
+
+	if !strings.EqualFold(selfUrl.Host, expectedUrl.Host) ||
+		strings.TrimSuffix(selfUrl.Path, "/") != strings.TrimSuffix(expectedUrl.Path, "/") {
+		return []string{fmt.Sprintf("self %s does not resolve to the dataset endpoint %s", in.Item.Self, expected)}
+	}
+	return nil
+}
+
+// semver Holds the numeric parts of a semantic version. Pre-release and
+// build metadata are accepted but ignored for ordering
+type semver [3]int
+
+// parseSemver Parses MAJOR.MINOR.PATCH with optional pre-release and
+// build metadata suffixes. Returns false if the string is not a valid
+// version
+func parseSemver(version string) (semver, bool) {
+	var v semver
+
+	core := version
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		if i == len(core)-1 {
+			return v, false
+		}
+		core = core[:i]
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+
+	for i, part := range parts {
+		if part == "" || (len(part) > 1 && part[0] == '0') {
+			return v, false
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+
+	return v, true
+}
+
+// compareSemver Returns -1, 0 or 1 depending on whether a is lower than,
+// equal to or higher than b
+func compareSemver(a, b semver) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
@@ -1,49 +1,160 @@
 package validator
 
 import (
+	"container/list"
 	"fmt"
 	"hdruk/federated-metadata/pkg/utils"
 	"log/slog"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
+// SchemaReport Defines the outcome of validating a document against a
+// single JSON schema
+type SchemaReport struct {
+	SchemaUrl string   `json:"schema_url"`
+	Skipped   bool     `json:"skipped"`
+	Valid     bool     `json:"valid"`
+	Errors    []string `json:"errors"`
+}
+
+// schemaTTL is how long a fetched schema is reused before it's fetched
+// again, so every dataset in a run doesn't refetch it
+const schemaTTL = 10 * time.Minute
+
+// maxSchemas is how many compiled schemas are kept. The least recently
+// used is evicted to make room for another
+const maxSchemas = 16
+
+type cachedSchema struct {
+	url       string
+	schema    *gojsonschema.Schema
+	fetchedAt time.Time
+}
+
+var (
+	schemasMu sync.Mutex
+	schemas   = map[string]*list.Element{}
+	recency   = list.New()
+)
+
+// schemaConfigured Returns true for the schema urls set in the
+// environment, which are trusted as they are
+func schemaConfigured(schemaUrl string) bool {
+	return schemaUrl == ListSchemaUrl() || schemaUrl == os.Getenv("GMI_DATASET_SCHEMA_VALIDATION_URL")
+}
+
+// loadSchema Returns the compiled schema held at schemaUrl, fetching it
+// when it isn't cached or has expired. Only configured schemas and those
+// SchemaUrlAllowed accepts are fetched. Schemas that fail to load aren't
+// cached
+func loadSchema(schemaUrl string) (*gojsonschema.Schema, error) {
+	if !schemaConfigured(schemaUrl) {
+		if err := SchemaUrlAllowed(schemaUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	schemasMu.Lock()
+	if element, ok := schemas[schemaUrl]; ok {
+		cached := element.Value.(*cachedSchema)
+		if time.Since(cached.fetchedAt) < schemaTTL {
+			recency.MoveToFront(element)
+			schemasMu.Unlock()
+			return cached.schema, nil
+		}
+		recency.Remove(element)
+		delete(schemas, schemaUrl)
+	}
+	schemasMu.Unlock()
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(schemaUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	if element, ok := schemas[schemaUrl]; ok {
+		recency.Remove(element)
+	}
+	schemas[schemaUrl] = recency.PushFront(&cachedSchema{url: schemaUrl, schema: schema, fetchedAt: time.Now()})
+	for recency.Len() > maxSchemas {
+		oldest := recency.Remove(recency.Back()).(*cachedSchema)
+		delete(schemas, oldest.url)
+	}
+	return schema, nil
+}
+
+// ListSchemaUrl Returns the schema url used to validate GMI list payloads
+func ListSchemaUrl() string {
+	var schemaUrl = os.Getenv("GMI_DEFAULT_SCHEMA_VALIDATION_URL")
+	if schemaUrl == "" {
+		schemaUrl = "https://raw.githubusercontent.com/HDRUK/schemata-2/master/hdr_schemata/models/GMI/gmi.schema.json"
+	}
+	return schemaUrl
+}
+
 // ValidateSchema Attempts to validate a returned json object against
 // our json schema for federation services. Returns true on success,
 // false otherwise. Upon error, errors are output to stdout
-func ValidateSchema(document string, logging string) (bool, error) {
+func ValidateSchema(document []byte, logging string) (bool, error) {
+	report, err := ValidateSchemaReport(ListSchemaUrl(), document, logging)
+	if err != nil {
+		return false, err
+	}
+
+	if report.Valid {
+		return true, nil
+	}
+
+	for _, desc := range report.Errors {
+		fmt.Printf("- %s\n", desc)
+	}
+
+	return false, err
+}
+
+// ValidateSchemaReport Validates document against the schema held at
+// schemaUrl and returns every validation error found. An error is only
+// returned when validation could not be run at all. The document is read
+// in place rather than copied
+func ValidateSchemaReport(schemaUrl string, document []byte, logging string) (SchemaReport, error) {
 	method_name := utils.MethodName(0)
 	slog.Debug(
-		"ValidateSchema", 
+		"ValidateSchema",
 		"x-request-session-id", logging,
 		"method_name", method_name,
 	)
 
-	var schemaUrl = os.Getenv("GMI_DEFAULT_SCHEMA_VALIDATION_URL")
-	if schemaUrl == "" {
-		schemaUrl = "https://raw.githubusercontent.com/HDRUK/schemata-2/master/hdr_schemata/models/GMI/gmi.schema.json"
+	report := SchemaReport{
+		SchemaUrl: schemaUrl,
+		Errors:    []string{},
 	}
 
-	schemaLoader := gojsonschema.NewReferenceLoader(schemaUrl)
-	documentLoader := gojsonschema.NewStringLoader(document)
-	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+	schema, err := loadSchema(schemaUrl)
+	var result *gojsonschema.Result
+	if err == nil {
+		result, err = schema.Validate(gojsonschema.NewBytesLoader(document))
+	}
 	if err != nil {
 		slog.Debug(
-			fmt.Sprintf("Error validating schema: %v", err.Error()), 
+			fmt.Sprintf("Error validating schema: %v", err.Error()),
 			"x-request-session-id", logging,
 			"method_name", method_name,
 		)
-		return false, err
-	}
-
-	if result.Valid() {
-		return true, nil
+		report.Errors = append(report.Errors, err.Error())
+		return report, err
 	}
 
+	report.Valid = result.Valid()
 	for _, desc := range result.Errors() {
-		fmt.Printf("- %s\n", desc)
+		report.Errors = append(report.Errors, desc.String())
 	}
 
-	return false, err
+	return report, nil
 }
@@ -0,0 +1,232 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/utils"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimit = 30
+	defaultQueueSize = 1000
+	rateWindow       = time.Minute
+)
+
+// ErrQueueFull Is returned when there is no room left to queue a sync
+var ErrQueueFull = errors.New("webhook queue is full")
+
+// RateLimitError Is returned when a caller has sent more notifications
+// for a federation than it is allowed in the current window
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many notifications for this federation, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// Task Defines a targeted sync of some of a federation's datasets
+type Task struct {
+	Federation    pkg.Federation
+	Withdrawn     bool
+	PersistentIDs []string
+	SessionID     string
+}
+
+// Enqueued Defines which datasets a notification queued, and which were
+// already waiting to sync
+type Enqueued struct {
+	Queued     []string `json:"queued"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// Sync Runs a queued task through the pull service within the
+// federation's time budget, returning what happened to each dataset
+func Sync(ctx context.Context, task Task) []report.DatasetOutcome {
+	ctx, cancel := pull.WithFederationBudget(ctx)
+	defer cancel()
+
+	p, err := pull.NewFederationPull(ctx, &task.Federation, task.SessionID)
+	if err != nil {
+		outcomes := []report.DatasetOutcome{}
+		for _, pid := range task.PersistentIDs {
+			outcomes = append(outcomes, report.DatasetOutcome{PersistentID: pid, Action: report.ActionSkipped, Message: err.Error()})
+		}
+		return outcomes
+	}
+	return pull.SyncDatasets(ctx, p, &task.Federation, task.PersistentIDs, task.Withdrawn)
+}
+
+// window Counts the notifications a caller sent since start
+type window struct {
+	start time.Time
+	count int
+}
+
+// Limiter Allows each caller limit notifications a minute. It's checked
+// before a notification is authenticated, so traffic without a valid
+// signature is limited too and can't make us look up federations and
+// secrets as fast as it likes
+type Limiter struct {
+	mu      sync.Mutex
+	windows map[string]*window
+	limit   int
+	swept   time.Time
+}
+
+// NewLimiter Creates a limiter allowing limit notifications a minute
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{windows: map[string]*window{}, limit: limit}
+}
+
+// Limits The limiter webhook notifications are checked against, keyed by
+// federation and client IP
+var Limits = NewLimiter(RateLimit())
+
+// Allow Counts a notification for a federation from clientIp. Returns a
+// *RateLimitError once the caller has sent too many this minute
+func (l *Limiter) Allow(federationId int, clientIp string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= rateWindow {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= rateWindow {
+				delete(l.windows, k)
+			}
+		}
+		l.swept = now
+	}
+
+	k := fmt.Sprintf("%d/%s", federationId, clientIp)
+	w, ok := l.windows[k]
+	if !ok || now.Sub(w.start) >= rateWindow {
+		w = &window{start: now}
+		l.windows[k] = w
+	}
+	if w.count >= l.limit {
+		return &RateLimitError{RetryAfter: w.start.Add(rateWindow).Sub(now)}
+	}
+	w.count++
+	return nil
+}
+
+// Queue Holds targeted syncs waiting to run. Datasets already waiting are
+// not queued twice
+type Queue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	tasks   chan Task
+	run     func(context.Context, Task) []report.DatasetOutcome
+	once    sync.Once
+}
+
+// NewQueue Creates a queue holding up to size tasks, each run with run
+func NewQueue(size int, run func(context.Context, Task) []report.DatasetOutcome) *Queue {
+	return &Queue{
+		pending: map[string]bool{},
+		tasks:   make(chan Task, size),
+		run:     run,
+	}
+}
+
+// Default The queue webhook notifications are added to
+var Default = NewQueue(defaultQueueSize, Sync)
+
+// RateLimit Returns how many notifications each caller may send a
+// federation a minute. Read from GMI_WEBHOOK_RATE_LIMIT
+func RateLimit() int {
+	limit, err := strconv.Atoi(os.Getenv("GMI_WEBHOOK_RATE_LIMIT"))
+	if err != nil || limit <= 0 {
+		return defaultRateLimit
+	}
+	return limit
+}
+
+// Enqueue Queues a sync of the datasets named in n. Returns
+// ErrQueueFull when there is no room for it
+func (q *Queue) Enqueue(fed pkg.Federation, n Notification, sessionId string) (Enqueued, error) {
+	q.once.Do(func() {
+		go q.work()
+	})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	withdrawn := n.Event == EventWithdrawn
+	result := Enqueued{Queued: []string{}, Duplicates: []string{}}
+	for _, pid := range n.PersistentIDs {
+		if q.pending[key(fed.ID, pid, withdrawn)] || utils.StringInSlice(pid, result.Queued) {
+			result.Duplicates = append(result.Duplicates, pid)
+			continue
+		}
+		result.Queued = append(result.Queued, pid)
+	}
+
+	if len(result.Queued) == 0 {
+		return result, nil
+	}
+
+	task := Task{Federation: fed, Withdrawn: withdrawn, PersistentIDs: result.Queued, SessionID: sessionId}
+	select {
+	case q.tasks <- task:
+	default:
+		return Enqueued{}, ErrQueueFull
+	}
+
+	for _, pid := range result.Queued {
+		q.pending[key(fed.ID, pid, withdrawn)] = true
+	}
+	return result, nil
+}
+
+// work Runs queued tasks one at a time
+func (q *Queue) work() {
+	method_name := utils.MethodName(0)
+	customAction := "Webhook"
+
+	for task := range q.tasks {
+		// Released before syncing, so a change made while we sync is
+		// picked up by another
+		q.mu.Lock()
+		for _, pid := range task.PersistentIDs {
+			delete(q.pending, key(task.Federation.ID, pid, task.Withdrawn))
+		}
+		q.mu.Unlock()
+
+		outcomes := q.run(context.Background(), task)
+
+		federation := metrics.FederationLabel(task.Federation.ID)
+		for _, outcome := range outcomes {
+			metrics.Datasets.WithLabelValues(federation, strings.ToLower(outcome.Action)).Inc()
+
+			customMsg := fmt.Sprintf("webhook sync for federation %d: pid=%s %s", task.Federation.ID, outcome.PersistentID, outcome.Action)
+			if outcome.Message != "" {
+				customMsg = fmt.Sprintf("%s: %s", customMsg, outcome.Message)
+			}
+			slog.Debug(
+				customMsg,
+				"x-request-session-id", task.SessionID,
+				"method_name", method_name,
+			)
+			utils.WriteGatewayAudit(customMsg, customAction, "POST")
+		}
+	}
+}
+
+// key Identifies a dataset waiting to sync
+func key(federationId int, pid string, withdrawn bool) string {
+	return fmt.Sprintf("%d/%s/%t", federationId, pid, withdrawn)
+}
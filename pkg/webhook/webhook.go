@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/secrets"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventCreated   = "created"
+	EventUpdated   = "updated"
+	EventWithdrawn = "withdrawn"
+
+	// SignatureHeader carries sha256=<hex HMAC-SHA256 of the timestamp, a
+	// "." and the body>, keyed with the federation's webhook secret
+	SignatureHeader = "X-GMI-Signature"
+
+	// TimestampHeader carries the Unix time, in seconds, a notification
+	// was sent at
+	TimestampHeader = "X-GMI-Timestamp"
+
+	// SecretHeader carries the webhook secret itself, for custodians that
+	// can't sign requests
+	SecretHeader = "X-GMI-Webhook-Secret"
+
+	// MaxPersistentIDs is the most datasets a single notification can name
+	MaxPersistentIDs = 100
+
+	// MaxAge is how far a notification's timestamp can be from now
+	MaxAge = 5 * time.Minute
+)
+
+var (
+	// ErrStale Is returned for a notification whose timestamp is missing
+	// or more than MaxAge from now
+	ErrStale = errors.New("missing or stale " + TimestampHeader + " header")
+	// ErrReplayed Is returned for a notification that has already been
+	// received
+	ErrReplayed = errors.New("notification has already been received")
+)
+
+// Notification Defines the body a custodian sends when datasets are
+// created, changed or withdrawn
+type Notification struct {
+	Event         string   `json:"event"`
+	PersistentIDs []string `json:"persistentIds"`
+}
+
+// LookupFederation Returns the active federation a notification is for.
+// ok is false when there is no such federation
+var LookupFederation = func(ctx context.Context, id int, sessionId string) (pkg.Federation, bool, error) {
+	return gateway.FindFederation(ctx, gateway.Default, id, sessionId)
+}
+
+// LookupSecret Returns the webhook secret for a federation
+var LookupSecret = func(ctx context.Context, fed pkg.Federation) (string, error) {
+	return secrets.NewSecrets(secrets.WebhookSecretID(fed.PID), "").GetWebhookSecret(ctx)
+}
+
+// Sign Returns the SignatureHeader value for body sent at timestamp,
+// signed with secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Timestamp Returns the TimestampHeader value for a notification sent at t
+func Timestamp(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// CheckTimestamp Returns ErrStale unless timestamp is within MaxAge of
+// now, so a captured notification can't be sent again later
+func CheckTimestamp(timestamp string, now time.Time) error {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return ErrStale
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > MaxAge || age < -MaxAge {
+		return ErrStale
+	}
+	return nil
+}
+
+// Verify Returns true when either signature is a valid signature of body
+// and timestamp or sharedSecret matches secret. Comparisons are constant
+// time
+func Verify(secret string, body []byte, timestamp, signature, sharedSecret string) bool {
+	if secret == "" {
+		return false
+	}
+
+	if signature != "" {
+		expected := Sign(secret, timestamp, body)
+		return hmac.Equal([]byte(strings.ToLower(strings.TrimSpace(signature))), []byte(expected))
+	}
+
+	if sharedSecret != "" {
+		return subtle.ConstantTimeCompare([]byte(sharedSecret), []byte(secret)) == 1
+	}
+
+	return false
+}
+
+// replays Remembers the notifications received within MaxAge, so one
+// can't be sent again while its timestamp is still fresh
+var replays = struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// Remember Records a federation's notification, returning ErrReplayed if
+// the same body was already received with the same timestamp. Call it
+// only once the notification is authenticated
+func Remember(federationId int, timestamp string, body []byte, now time.Time) error {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%s", federationId, timestamp, body)))
+	k := hex.EncodeToString(sum[:])
+
+	replays.mu.Lock()
+	defer replays.mu.Unlock()
+
+	for seen, expires := range replays.expires {
+		if now.After(expires) {
+			delete(replays.expires, seen)
+		}
+	}
+	if _, ok := replays.expires[k]; ok {
+		return ErrReplayed
+	}
+	// Twice MaxAge covers a timestamp up to MaxAge in the future
+	replays.expires[k] = now.Add(2 * MaxAge)
+	return nil
+}
+
+// Validate Returns every problem with a notification
+func (n *Notification) Validate() []string {
+	problems := []string{}
+
+	switch n.Event {
+	case EventCreated, EventUpdated, EventWithdrawn:
+	default:
+		problems = append(problems, fmt.Sprintf("event must be one of %s, %s or %s", EventCreated, EventUpdated, EventWithdrawn))
+	}
+
+	if len(n.PersistentIDs) == 0 {
+		problems = append(problems, "persistentIds must name at least one dataset")
+	}
+	if len(n.PersistentIDs) > MaxPersistentIDs {
+		problems = append(problems, fmt.Sprintf("persistentIds can name at most %d datasets", MaxPersistentIDs))
+	}
+	for _, pid := range n.PersistentIDs {
+		if strings.TrimSpace(pid) == "" {
+			problems = append(problems, "persistentIds must not be empty")
+			break
+		}
+	}
+
+	return problems
+}
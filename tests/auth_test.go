@@ -0,0 +1,116 @@
+package pull
+
+import (
+	"fmt"
+	"hdruk/federated-metadata/pkg/auth"
+	"hdruk/federated-metadata/pkg/push"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthTestSuite struct {
+	suite.Suite
+	router *gin.Engine
+}
+
+func (t *AuthTestSuite) SetupTest() {
+	t.T().Setenv("JWT_SECRET", "test-secret")
+	t.T().Setenv("PUSH_API_KEYS", "service-key-1, service-key-2")
+	t.T().Setenv("JWKS_URL", "")
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "")
+
+	gin.SetMode(gin.TestMode)
+	t.router = gin.New()
+	t.router.GET("/teams/:team", auth.RequireAuth(), func(c *gin.Context) {
+		var team int
+		fmt.Sscan(c.Param("team"), &team)
+		if !auth.AuthoriseTeam(c, team) {
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+}
+
+func (t *AuthTestSuite) token(secret string, claims auth.Claims) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	t.Nil(err)
+	return signed
+}
+
+func (t *AuthTestSuite) call(path string, headers map[string]string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	t.router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func validClaims(teams []int) auth.Claims {
+	return auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "42",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Teams: teams,
+	}
+}
+
+// getAs Sends a GET for path through the push API router as a member of
+// teams, with a token signed by the JWT_SECRET callers set to
+// "test-secret"
+func getAs(path string, teams ...int) *httptest.ResponseRecorder {
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims(teams)).SignedString([]byte("test-secret"))
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func (t *AuthTestSuite) TestItRejectsRequestsWithoutCredentials() {
+	t.Equal(http.StatusUnauthorized, t.call("/teams/18", nil))
+}
+
+func (t *AuthTestSuite) TestItAcceptsServiceAPIKeys() {
+	t.Equal(http.StatusOK, t.call("/teams/18", map[string]string{"x-api-key": "service-key-2"}))
+	t.Equal(http.StatusUnauthorized, t.call("/teams/18", map[string]string{"x-api-key": "wrong"}))
+}
+
+func (t *AuthTestSuite) TestItOnlyLetsTeamMembersManageTheirTeam() {
+	bearer := "Bearer " + t.token("test-secret", validClaims([]int{18}))
+
+	t.Equal(http.StatusOK, t.call("/teams/18", map[string]string{"Authorization": bearer}))
+	t.Equal(http.StatusForbidden, t.call("/teams/19", map[string]string{"Authorization": bearer}))
+}
+
+func (t *AuthTestSuite) TestAdminsCanManageAnyTeam() {
+	claims := validClaims(nil)
+	claims.Roles = []string{"hdruk.superadmin"}
+	bearer := "Bearer " + t.token("test-secret", claims)
+
+	t.Equal(http.StatusOK, t.call("/teams/19", map[string]string{"Authorization": bearer}))
+}
+
+func (t *AuthTestSuite) TestItRejectsBadlySignedOrExpiredTokens() {
+	forged := "Bearer " + t.token("another-secret", validClaims([]int{18}))
+	t.Equal(http.StatusUnauthorized, t.call("/teams/18", map[string]string{"Authorization": forged}))
+
+	claims := validClaims([]int{18})
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	expired := "Bearer " + t.token("test-secret", claims)
+	t.Equal(http.StatusUnauthorized, t.call("/teams/18", map[string]string{"Authorization": expired}))
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
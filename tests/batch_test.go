@@ -0,0 +1,129 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// datasetFor Returns the test dataset with pid as its identifier
+func datasetFor(pid string) string {
+	return strings.Replace(jsonStringDataset, teamsPid, pid, 1)
+}
+
+type BatchTestSuite struct {
+	CustodianSuite
+
+	mu      sync.Mutex
+	single  []string
+	batches []string
+}
+
+func (t *BatchTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.single, t.batches = nil, nil
+
+	// only a and b are embedded in the list
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [
+			{"persistentId": "a", "version": "1.0.0", "dataset": ` + datasetFor("a") + `},
+			{"persistentId": "b", "version": "1.0.0", "dataset": ` + datasetFor("b") + `},
+			{"persistentId": "c", "version": "1.0.0"}
+		]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		pid := strings.TrimPrefix(r.URL.Path, "/api/datasets/")
+		t.mu.Lock()
+		t.single = append(t.single, pid)
+		t.mu.Unlock()
+		w.Write([]byte(datasetFor(pid)))
+	})
+	// the batch endpoint never knows about c
+	t.mux.HandleFunc("/api/batch", func(w http.ResponseWriter, r *http.Request) {
+		ids := r.URL.Query().Get("ids")
+		t.mu.Lock()
+		t.batches = append(t.batches, ids)
+		t.mu.Unlock()
+
+		found := map[string]json.RawMessage{}
+		for _, pid := range strings.Split(ids, ",") {
+			if pid != "c" {
+				found[pid] = json.RawMessage(datasetFor(pid))
+			}
+		}
+		json.NewEncoder(w).Encode(found)
+	})
+	t.mux.HandleFunc("/api/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+}
+
+func (t *BatchTestSuite) federation(id int, mode, batch string) *pkg.Federation {
+	fed := t.CustodianSuite.federation(id)
+	fed.EndpointBatch = batch
+	fed.DatasetMode = mode
+	fed.BatchSize = 2
+	return fed
+}
+
+func (t *BatchTestSuite) TestItUsesDatasetsEmbeddedInTheList() {
+	t.fake.Federations = []pkg.Federation{*t.federation(9310, pkg.DatasetModeEmbedded, "")}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9310)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Len(t.fake.Created, 3)
+
+	// only the dataset left out of the list is fetched on its own
+	t.Equal([]string{"c"}, t.single)
+}
+
+func (t *BatchTestSuite) TestItFetchesDatasetsInBatches() {
+	fed := t.federation(9320, "batch", "/api/batch?ids={ids}")
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"a", "b", "c", "d"}, false)
+
+	t.Len(outcomes, 4)
+	for _, outcome := range outcomes {
+		t.Equal(report.ActionCreated, outcome.Action, outcome.PersistentID)
+	}
+	t.Equal([]string{"a,b", "c,d"}, t.batches)
+	t.Equal([]string{"c"}, t.single)
+}
+
+func (t *BatchTestSuite) TestAFailedBatchFallsBackToSingleFetches() {
+	fed := t.federation(9330, pkg.DatasetModeBatch, "/api/broken?ids={ids}")
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"a", "b"}, false)
+
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.Equal(report.ActionCreated, outcomes[1].Action)
+	t.Equal([]string{"a", "b"}, t.single)
+}
+
+func (t *BatchTestSuite) TestItRejectsUnusableDatasetModes() {
+	_, err := pull.NewFederationPull(context.Background(), t.federation(9340, pkg.DatasetModeBatch, ""), "")
+	t.ErrorContains(err, "needs endpoint_batch")
+
+	_, err = pull.NewFederationPull(context.Background(), t.federation(9340, "STREAM", ""), "")
+	t.ErrorContains(err, `unknown dataset_mode "STREAM"`)
+}
+
+func TestBatchTestSuite(t *testing.T) {
+	suite.Run(t, new(BatchTestSuite))
+}
@@ -0,0 +1,102 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BudgetTestSuite struct {
+	CustodianSuite
+	stuck chan struct{}
+}
+
+func (t *BudgetTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.stuck = make(chan struct{}, 10)
+
+	// a custodian that never answers
+	t.mux.HandleFunc("/stuck/datasets", func(w http.ResponseWriter, r *http.Request) {
+		t.stuck <- struct{}{}
+		<-r.Context().Done()
+	})
+	t.mux.HandleFunc("/ok/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{"persistentId": "e96e36ba-30ca-4c25-bc55-fab02d72a51c", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/ok/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+
+	t.fake.Federations = []pkg.Federation{t.federation(8080, "stuck"), t.federation(8081, "ok")}
+
+	t.T().Setenv("GMI_FEDERATION_TIMEOUT_SECONDS", "1")
+}
+
+func (t *BudgetTestSuite) TearDownTest() {
+	pull.Resume()
+	t.CustodianSuite.TearDownTest()
+}
+
+func (t *BudgetTestSuite) federation(id int, path string) pkg.Federation {
+	fed := t.CustodianSuite.federation(id)
+	fed.PID = path
+	fed.EndpointDatasets = "/" + path + "/datasets"
+	fed.EndpointDataset = "/" + path + "/datasets/{id}"
+	return *fed
+}
+
+func (t *BudgetTestSuite) TestEachFederationGetsItsOwnBudget() {
+	pull.Run(context.Background())
+
+	stuck, ok := report.LatestFederationRun(8080)
+	t.True(ok)
+	t.Equal(report.StatusFailed, stuck.Status)
+	t.Contains(stuck.Error, pull.ErrFederationTimeout.Error())
+
+	// the stuck custodian isn't blamed for our deadline
+	t.Empty(t.fake.Disabled)
+
+	synced, ok := report.LatestFederationRun(8081)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, synced.Status)
+	t.Len(t.fake.Created, 1)
+}
+
+func (t *BudgetTestSuite) TestAbortCancelsCallsInFlight() {
+	t.T().Setenv("GMI_FEDERATION_TIMEOUT_SECONDS", "60")
+
+	done := make(chan struct{})
+	go func() {
+		pull.Run(context.Background())
+		close(done)
+	}()
+
+	<-t.stuck
+	started := time.Now()
+	pull.Abort()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.FailNow("pull cycle did not stop after abort")
+	}
+	t.Less(time.Since(started), time.Second)
+
+	run, ok := report.LatestFederationRun(8080)
+	t.True(ok)
+	t.Equal(report.StatusInterrupted, run.Status)
+
+	// the cycle stopped rather than moving on
+	t.Empty(t.fake.Created)
+}
+
+func TestBudgetTestSuite(t *testing.T) {
+	suite.Run(t, new(BudgetTestSuite))
+}
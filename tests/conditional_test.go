@@ -0,0 +1,184 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/conditional"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const lastModified = "Wed, 21 Oct 2026 07:28:00 GMT"
+
+type ConditionalTestSuite struct {
+	CustodianSuite
+
+	listBodies    atomic.Int32
+	datasetBodies atomic.Int32
+}
+
+func (t *ConditionalTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.listBodies.Store(0)
+	t.datasetBodies.Store(0)
+
+	t.mux.HandleFunc("/etag/datasets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"list-1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		t.listBodies.Add(1)
+		w.Header().Set("ETag", `"list-1"`)
+		w.Write([]byte(`{"items": [{"persistentId": "` + teamsPid + `", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/etag/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"dataset-1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		t.datasetBodies.Add(1)
+		w.Header().Set("ETag", `"dataset-1"`)
+		w.Write([]byte(jsonStringDataset))
+	})
+	t.mux.HandleFunc("/dated/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		t.datasetBodies.Add(1)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(jsonStringDataset))
+	})
+}
+
+func (t *ConditionalTestSuite) federation(id int, path string) (*pull.Pull, *pkg.Federation) {
+	fed := t.CustodianSuite.federation(id)
+	fed.EndpointDatasets = "/" + path + "/datasets"
+	fed.EndpointDataset = "/" + path + "/datasets/{id}"
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+	return p, fed
+}
+
+func (t *ConditionalTestSuite) TestTheStoreKeepsOnlyUsefulValidators() {
+	store := conditional.NewStore()
+
+	store.Set("a", conditional.Validators{ETag: `"1"`})
+	store.Set("a", conditional.Validators{})
+	_, ok := store.Get("a")
+	t.False(ok)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	conditional.Validators{ETag: `"1"`, LastModified: lastModified}.Apply(req)
+	t.Equal(`"1"`, req.Header.Get("If-None-Match"))
+	t.Equal(lastModified, req.Header.Get("If-Modified-Since"))
+}
+
+func (t *ConditionalTestSuite) TestTheStoreStaysWithinItsLimits() {
+	store := conditional.NewLimitedStore(conditional.Limits{Entries: 2, BodyBytes: 10, TTL: time.Hour})
+
+	store.Set("a", conditional.Validators{ETag: `"a"`})
+	store.Set("b", conditional.Validators{ETag: `"b"`})
+	store.Get("a")
+	store.Set("c", conditional.Validators{ETag: `"c"`})
+	_, ok := store.Get("b")
+	t.False(ok, "the least recently used is evicted")
+	_, ok = store.Get("a")
+	t.True(ok)
+
+	store.Set("big", conditional.Validators{ETag: `"big"`, Body: []byte("01234567890")})
+	_, ok = store.Get("big")
+	t.False(ok, "a body over the cap isn't kept")
+
+	store.Set("d", conditional.Validators{ETag: `"d"`, Body: []byte("012345")})
+	store.Set("e", conditional.Validators{ETag: `"e"`, Body: []byte("012345")})
+	_, ok = store.Get("d")
+	t.False(ok, "bodies are evicted to stay under the byte cap")
+	_, ok = store.Get("e")
+	t.True(ok)
+
+	expiring := conditional.NewLimitedStore(conditional.Limits{Entries: 2, BodyBytes: 10, TTL: time.Millisecond})
+	expiring.Set("a", conditional.Validators{ETag: `"a"`})
+	time.Sleep(5 * time.Millisecond)
+	_, ok = expiring.Get("a")
+	t.False(ok)
+	t.Equal(0, expiring.Len())
+}
+
+func (t *ConditionalTestSuite) TestItRefetchesAListItCannotReuse() {
+	p, _ := t.federation(9130, "etag")
+	conditional.Default.Set(p.DatasetsUri, conditional.Validators{ETag: `"list-1"`, Body: []byte(`not json`)})
+
+	list, err := p.CallForList(context.Background())
+	t.Nil(err)
+	t.Len(list.Items, 1)
+	t.Equal(int32(1), t.listBodies.Load())
+	t.Empty(t.fake.Disabled)
+
+	validators, ok := conditional.Default.Get(p.DatasetsUri)
+	t.True(ok)
+	t.Contains(string(validators.Body), teamsPid)
+}
+
+func (t *ConditionalTestSuite) TestItReusesAnUnmodifiedList() {
+	p, _ := t.federation(9110, "etag")
+
+	first, err := p.CallForList(context.Background())
+	t.Nil(err)
+
+	second, err := p.CallForList(context.Background())
+	t.Nil(err)
+	t.Equal(first, second)
+	t.Equal(int32(1), t.listBodies.Load())
+}
+
+func (t *ConditionalTestSuite) TestItSkipsUnmodifiedDatasets() {
+	for i, path := range []string{"etag", "dated"} {
+		t.datasetBodies.Store(0)
+		p, fed := t.federation(9120+i, path)
+		pid := []string{teamsPid}
+
+		outcomes := pull.SyncDatasets(context.Background(), p, fed, pid, false)
+		t.Equal(report.ActionCreated, outcomes[0].Action)
+
+		outcomes = pull.SyncDatasets(context.Background(), p, fed, pid, false)
+		t.Equal(report.ActionSkipped, outcomes[0].Action, path)
+		t.Equal("not modified", outcomes[0].Message, path)
+		t.Equal(int32(1), t.datasetBodies.Load(), path)
+		t.Len(t.fake.Created, 1)
+		t.Empty(t.fake.Updated)
+
+		// a dataset gone from the gateway is fetched in full and rewritten
+		t.fake.DeleteDataset(context.Background(), fed.ID, teamsPid, "")
+		t.fake.Created = nil
+		outcomes = pull.SyncDatasets(context.Background(), p, fed, pid, false)
+		t.Equal(report.ActionCreated, outcomes[0].Action, path)
+		t.Equal(int32(2), t.datasetBodies.Load(), path)
+		t.fake.Created = nil
+	}
+}
+
+func (t *ConditionalTestSuite) TestConditionalRequestsCanBeTurnedOff() {
+	t.T().Setenv("GMI_CONDITIONAL_REQUESTS", "false")
+	p, fed := t.federation(9130, "etag")
+	pid := []string{teamsPid}
+
+	pull.SyncDatasets(context.Background(), p, fed, pid, false)
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, pid, false)
+
+	t.Equal(report.ActionSkipped, outcomes[0].Action)
+	t.Empty(outcomes[0].Message)
+	t.Equal(int32(2), t.datasetBodies.Load())
+}
+
+func TestConditionalTestSuite(t *testing.T) {
+	suite.Run(t, new(ConditionalTestSuite))
+}
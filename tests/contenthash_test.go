@@ -0,0 +1,88 @@
+package pull
+
+import (
+	"hdruk/federated-metadata/pkg/contenthash"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ContentHashTestSuite struct {
+	suite.Suite
+}
+
+func (t *ContentHashTestSuite) TestItIgnoresKeyOrderAndWhitespace() {
+	a, err := contenthash.Hash([]byte(`{"b": [1, 2], "a": {"y": "<x>", "x": 1.50}}`))
+	t.Nil(err)
+	b, err := contenthash.Hash([]byte("{\n\t\"a\":{\"x\":1.50,\"y\":\"<x>\"},\"b\":[1,2]}\n"))
+	t.Nil(err)
+
+	t.Equal(a, b)
+	t.Regexp(`^sha256:[0-9a-f]{64}$`, a)
+
+	canonical, _ := contenthash.Canonical([]byte(`{"b": [1, 2], "a": {"y": "<x>", "x": 1.50}}`))
+	t.Equal(`{"a":{"x":1.50,"y":"<x>"},"b":[1,2]}`, string(canonical))
+}
+
+func (t *ContentHashTestSuite) TestItSeesContentChanges() {
+	a, _ := contenthash.Hash([]byte(`{"title": "Bones"}`))
+	b, _ := contenthash.Hash([]byte(`{"title": "Bones Dataset"}`))
+	t.NotEqual(a, b)
+
+	// array order is content
+	a, _ = contenthash.Hash([]byte(`[1, 2]`))
+	b, _ = contenthash.Hash([]byte(`[2, 1]`))
+	t.NotEqual(a, b)
+}
+
+func (t *ContentHashTestSuite) TestItRejectsInvalidDocuments() {
+	_, err := contenthash.Hash([]byte(`{"title": `))
+	t.NotNil(err)
+
+	_, err = contenthash.Hash([]byte(`{} {}`))
+	t.NotNil(err)
+}
+
+func (t *ContentHashTestSuite) TestTheStoreIsKeyedByTeamAndDataset() {
+	store := contenthash.NewStore()
+	store.Set(1, "a", "sha256:1")
+
+	hash, ok := store.Get(1, "a")
+	t.True(ok)
+	t.Equal("sha256:1", hash)
+
+	_, ok = store.Get(2, "a")
+	t.False(ok)
+
+	store.Forget(1, "a")
+	_, ok = store.Get(1, "a")
+	t.False(ok)
+}
+
+func (t *ContentHashTestSuite) TestTheStoreKeepsHashesAcrossRestarts() {
+	path := filepath.Join(t.T().TempDir(), "contenthash.log")
+
+	store, err := contenthash.OpenStore(path)
+	t.Nil(err)
+	store.Set(1, "a", "sha256:1")
+	store.Set(1, "b", "sha256:2")
+	store.Set(1, "a", "sha256:3")
+	store.Forget(1, "b")
+
+	restarted, err := contenthash.OpenStore(path)
+	t.Nil(err)
+	hash, ok := restarted.Get(1, "a")
+	t.True(ok)
+	t.Equal("sha256:3", hash)
+	_, ok = restarted.Get(1, "b")
+	t.False(ok)
+
+	t.T().Setenv("GMI_CONTENT_HASH_PATH", "")
+	t.T().Setenv("GMI_STATE_DIR", "/var/lib/gmi")
+	t.Equal("/var/lib/gmi/contenthash.log", contenthash.Path())
+}
+
+func TestContentHashTestSuite(t *testing.T) {
+	suite.Run(t, new(ContentHashTestSuite))
+}
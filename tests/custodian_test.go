@@ -0,0 +1,64 @@
+package pull
+
+import (
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/gateway"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+// CustodianSuite Is embedded by suites that pull from a fake custodian.
+// Each test gets a server whose mux answers /schema.json, which both
+// schema URLs point at, and a gateway.Fake standing in for
+// gateway.Default. Suites add their custodian's handlers to mux after
+// calling SetupTest. Environment set with t.T().Setenv is restored when
+// each test ends
+type CustodianSuite struct {
+	suite.Suite
+	mux     *http.ServeMux
+	server  *httptest.Server
+	fake    *gateway.Fake
+	gateway gateway.API
+}
+
+func (t *CustodianSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+
+	t.mux = http.NewServeMux()
+	t.mux.HandleFunc("/schema.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"type": "object"}`))
+	})
+	t.server = httptest.NewServer(t.mux)
+
+	t.fake = gateway.NewFake()
+	t.gateway, gateway.Default = gateway.Default, t.fake
+
+	t.T().Setenv("GMI_DEFAULT_SCHEMA_VALIDATION_URL", t.server.URL+"/schema.json")
+	t.T().Setenv("GMI_DATASET_SCHEMA_VALIDATION_URL", t.server.URL+"/schema.json")
+	t.T().Setenv("IGNORE_MINUTES", "true")
+}
+
+func (t *CustodianSuite) TearDownTest() {
+	gateway.Default = t.gateway
+	t.server.Close()
+}
+
+// federation Returns an enabled federation for team id, due to run now,
+// whose list and datasets are at /api/datasets on the custodian
+func (t *CustodianSuite) federation(id int) *pkg.Federation {
+	return &pkg.Federation{
+		ID:               id,
+		AuthType:         "NO_AUTH",
+		EndpointBaseURL:  t.server.URL,
+		EndpointDatasets: "/api/datasets",
+		EndpointDataset:  "/api/datasets/{id}",
+		RunTimeHour:      time.Now().UTC().Hour(),
+		RunTimeMinute:    "0",
+		Enabled:          true,
+		Team:             []pkg.Team{{ID: id}},
+	}
+}
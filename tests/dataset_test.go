@@ -0,0 +1,87 @@
+package pull
+
+import (
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DatasetTestSuite struct {
+	suite.Suite
+}
+
+func (t *DatasetTestSuite) TestItDecodesTheFixtureIntoTheTypedModel() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	t.Equal("e96e36ba-30ca-4c25-bc55-fab02d72a51c", dataset.Identifier)
+	t.Equal("1.0.0", dataset.Version)
+	t.Equal("Bones Dataset", dataset.Summary.Title)
+	t.Equal([]string{"bones", "Blood"}, dataset.Summary.Keywords.Values)
+	t.Equal("ALLIANCE", dataset.Summary.Publisher.MemberOf)
+	t.Equal("IRREGULAR", dataset.Provenance.Temporal.AccrualPeriodicity)
+	t.Equal([]string{"GB-NIR"}, dataset.Accessibility.Access.Jurisdiction.Values)
+	t.Len(dataset.Observations, 1)
+	t.Equal(float64(3), dataset.Observations[0].MeasuredValue)
+}
+
+func (t *DatasetTestSuite) TestItAcceptsStringsOrArrays() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	// contactPoint is a string on the summary and an array on the publisher
+	t.False(dataset.Summary.ContactPoint.Array)
+	t.Equal("test@bones.com", dataset.Summary.ContactPoint.String())
+	t.True(dataset.Summary.Publisher.ContactPoint.Array)
+	t.True(dataset.Summary.Publisher.ContactPoint.IsEmpty())
+
+	// spatial is an empty array in the fixture, but a string elsewhere
+	t.True(dataset.Coverage.Spatial.Array)
+
+	var coverage pkg.Coverage
+	err = json.Unmarshal([]byte(`{"spatial":"United Kingdom"}`), &coverage)
+	t.Nil(err)
+	t.Equal([]string{"United Kingdom"}, coverage.Spatial.Values)
+
+	// anything else in an array would change when written back
+	err = json.Unmarshal([]byte(`{"spatial":["United Kingdom", 3]}`), &coverage)
+	t.ErrorContains(err, "expected a string at index 1")
+}
+
+func (t *DatasetTestSuite) TestItRoundTripsUnknownFields() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	encoded, err := json.Marshal(dataset)
+	t.Nil(err)
+
+	var original, roundTripped map[string]interface{}
+	t.Nil(json.Unmarshal([]byte(jsonStringDataset), &original))
+	t.Nil(json.Unmarshal(encoded, &roundTripped))
+
+	t.Equal(original, roundTripped)
+}
+
+func (t *DatasetTestSuite) TestItWritesChangesMadeThroughTheModel() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	dataset.Summary.Title = "Renamed Dataset"
+	dataset.Documentation.Description = "Now documented"
+
+	encoded, err := json.Marshal(dataset)
+	t.Nil(err)
+
+	var roundTripped map[string]interface{}
+	t.Nil(json.Unmarshal(encoded, &roundTripped))
+
+	t.Equal("Renamed Dataset", roundTripped["summary"].(map[string]interface{})["title"])
+	t.Equal("Now documented", roundTripped["documentation"].(map[string]interface{})["description"])
+	t.Equal("10.1093/ajae/aaq063", roundTripped["summary"].(map[string]interface{})["doiName"])
+}
+
+func TestDatasetTestSuite(t *testing.T) {
+	suite.Run(t, new(DatasetTestSuite))
+}
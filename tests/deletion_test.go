@@ -0,0 +1,222 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/deletion"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DeletionTestSuite struct {
+	CustodianSuite
+
+	mu     sync.Mutex
+	listed []string
+}
+
+func (t *DeletionTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.listed = []string{"kept"}
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		items := []string{}
+		for _, pid := range t.listed {
+			items = append(items, `{"persistentId": "`+pid+`", "version": "1.0.0"}`)
+		}
+		w.Write([]byte(`{"items": [` + strings.Join(items, ",") + `]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(datasetFor(strings.TrimPrefix(r.URL.Path, "/api/datasets/"))))
+	})
+
+	t.T().Setenv("GMI_CONDITIONAL_REQUESTS", "false")
+}
+
+func (t *DeletionTestSuite) list(pids ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listed = pids
+}
+
+// pullOnce Runs a pull cycle for fed and returns its outcome for pid
+func (t *DeletionTestSuite) pullOnce(fed *pkg.Federation, pid string) report.DatasetOutcome {
+	t.fake.Federations = []pkg.Federation{*fed}
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(fed.ID)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	for _, outcome := range run.Datasets {
+		if outcome.PersistentID == pid {
+			return outcome
+		}
+	}
+	return report.DatasetOutcome{}
+}
+
+func (t *DeletionTestSuite) TestItResolvesThePolicy() {
+	fed := t.federation(9600)
+	t.Equal(deletion.Policy{Runs: 3}, deletion.PolicyFor(fed))
+
+	t.T().Setenv("GMI_DELETE_AFTER_RUNS", "5")
+	t.T().Setenv("GMI_DELETE_AFTER_HOURS", "24")
+	t.Equal(deletion.Policy{Runs: 5, Window: 24 * time.Hour}, deletion.PolicyFor(fed))
+
+	fed.DeleteAfterRuns = 1
+	fed.DeleteAfterHours = 2
+	policy := deletion.PolicyFor(fed)
+	t.Equal(deletion.Policy{Runs: 1, Window: 2 * time.Hour}, policy)
+
+	// both the runs and the window must have passed
+	start := time.Now()
+	s := deletion.NewStore()
+	t.False(policy.Due(s.Miss(9600, 1, "a", start)))
+	t.False(policy.Due(s.Miss(9600, 1, "a", start.Add(time.Hour))))
+	t.True(policy.Due(s.Miss(9600, 1, "a", start.Add(2*time.Hour))))
+}
+
+func (t *DeletionTestSuite) TestARestartedStoreKeepsItsCountsAndWindow() {
+	path := filepath.Join(t.T().TempDir(), "deletions.log")
+	policy := deletion.Policy{Runs: 3, Window: 2 * time.Hour}
+	start := time.Now().UTC().Truncate(time.Second)
+
+	s, err := deletion.OpenStore(path)
+	t.Nil(err)
+	s.Miss(9640, 1, "a", start)
+	s.Miss(9640, 1, "b", start)
+	s.Miss(9640, 1, "a", start.Add(time.Hour))
+	s.Forget(9640, 1, "b")
+
+	restarted, err := deletion.OpenStore(path)
+	t.Nil(err)
+	pending := restarted.List(9640)
+	t.Len(pending, 1)
+	t.Equal(2, pending[0].MissingRuns)
+	t.True(start.Equal(pending[0].FirstMissing))
+
+	// the window runs from when it first went missing, not the restart
+	t.True(policy.Due(restarted.Miss(9640, 1, "a", start.Add(2*time.Hour))))
+}
+
+func (t *DeletionTestSuite) TestItDeletesAfterConsecutiveMissedRuns() {
+	fed := t.federation(9610)
+	t.fake.Datasets[9610] = pkg.DatasetsVersions{"gone": {Versions: []string{"1.0.0"}}}
+
+	for run := 1; run <= 2; run++ {
+		outcome := t.pullOnce(fed, "gone")
+		t.Equal(report.ActionPendingDeletion, outcome.Action)
+		t.Contains(outcome.Message, "missing for")
+		t.Empty(t.fake.Deleted)
+	}
+
+	pending := deletion.Default.List(9610)
+	t.Len(pending, 1)
+	t.Equal(2, pending[0].MissingRuns)
+
+	outcome := t.pullOnce(fed, "gone")
+	t.Equal(report.ActionDeleted, outcome.Action)
+	t.Equal("missing for 3 of 3 runs", outcome.Message)
+	t.Equal([]string{"gone"}, t.fake.Deleted)
+	t.Empty(deletion.Default.List(9610))
+}
+
+func (t *DeletionTestSuite) TestADatasetThatComesBackIsKept() {
+	fed := t.federation(9620)
+	t.fake.Datasets[9620] = pkg.DatasetsVersions{"flaky": {Versions: []string{"1.0.0"}}}
+
+	t.pullOnce(fed, "flaky")
+	t.pullOnce(fed, "flaky")
+	t.Len(deletion.Default.List(9620), 1)
+
+	t.list("kept", "flaky")
+	t.pullOnce(fed, "flaky")
+	t.Empty(deletion.Default.List(9620))
+
+	// missing again starts the count from scratch
+	t.list("kept")
+	outcome := t.pullOnce(fed, "flaky")
+	t.Equal(report.ActionPendingDeletion, outcome.Action)
+	t.Equal("missing for 1 of 3 runs", outcome.Message)
+	t.Empty(t.fake.Deleted)
+}
+
+func (t *DeletionTestSuite) TestAWebhookCancelsAPendingDeletion() {
+	fed := t.federation(9630)
+	t.fake.Datasets[9630] = pkg.DatasetsVersions{"named": {Versions: []string{"1.0.0"}}}
+
+	t.pullOnce(fed, "named")
+	t.Len(deletion.Default.List(9630), 1)
+
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+	pull.SyncDatasets(context.Background(), p, fed, []string{"named"}, false)
+	t.Empty(deletion.Default.List(9630))
+}
+
+func (t *DeletionTestSuite) TestItListsPendingDeletions() {
+	fed := t.federation(9640)
+	t.fake.Datasets[9640] = pkg.DatasetsVersions{"b": {Versions: []string{"1.0.0"}}, "a": {Versions: []string{"1.0.0"}}}
+	t.pullOnce(fed, "a")
+
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "1")
+
+	req := httptest.NewRequest(http.MethodGet, "/federation/9640/deletions", nil)
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, req)
+	t.Equal(http.StatusOK, rec.Code)
+
+	var body struct {
+		FederationID int                `json:"federation_id"`
+		Pending      []deletion.Pending `json:"pending"`
+	}
+	t.Nil(json.Unmarshal(rec.Body.Bytes(), &body))
+	t.Equal(9640, body.FederationID)
+	t.Len(body.Pending, 2)
+	t.Equal("a", body.Pending[0].PersistentID)
+	t.Equal(1, body.Pending[0].MissingRuns)
+}
+
+func (t *DeletionTestSuite) TestADryRunReportsWhatItWouldDelete() {
+	t.T().Setenv("GMI_DRY_RUN", "1")
+	fed := t.federation(9660)
+	fed.DeleteAfterRuns = 1
+	t.fake.Datasets[9660] = pkg.DatasetsVersions{"gone": {Versions: []string{"1.0.0"}}}
+
+	outcome := t.pullOnce(fed, "gone")
+
+	t.Equal(report.ActionSkipped, outcome.Action)
+	t.Equal("dry run: would delete", outcome.Message)
+	t.Empty(t.fake.Deleted)
+	t.Empty(deletion.Default.List(9660))
+}
+
+func (t *DeletionTestSuite) TestOnlyTheFederationsTeamsCanSeeItsDeletions() {
+	t.T().Setenv("JWT_SECRET", "test-secret")
+	t.T().Setenv("JWKS_URL", "")
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "")
+	t.fake.Federations = []pkg.Federation{*t.federation(9650)}
+
+	t.Equal(http.StatusForbidden, getAs("/federation/9650/deletions", 9651).Code)
+	t.Equal(http.StatusForbidden, getAs("/federation/9659/deletions", 9651).Code)
+	t.Equal(http.StatusOK, getAs("/federation/9650/deletions", 9650).Code)
+}
+
+func TestDeletionTestSuite(t *testing.T) {
+	suite.Run(t, new(DeletionTestSuite))
+}
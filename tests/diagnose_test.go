@@ -0,0 +1,235 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/testjob"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DiagnoseTestSuite struct {
+	CustodianSuite
+}
+
+func (t *DiagnoseTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer letmein" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"items": [
+			{"persistentId": "e96e36ba-30ca-4c25-bc55-fab02d72a51c", "version": "1.0.0"},
+			{"persistentId": "missing", "version": "1.0.0"}
+		], "query": {"total": 2}}`))
+	})
+	t.mux.HandleFunc("/api/datasets/e96e36ba-30ca-4c25-bc55-fab02d72a51c", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+	// a custodian that never answers
+	t.mux.HandleFunc("/api/stuck", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+}
+
+func (t *DiagnoseTestSuite) newPull(token string) *pull.Pull {
+	return pull.NewPull(1, t.server.URL+"/api/datasets", t.server.URL+"/api/datasets/{id}", "", "", token, "bearer", false, "")
+}
+
+func stepStatuses(report pull.DiagnosticReport) []string {
+	statuses := []string{}
+	for _, step := range report.Steps {
+		name := step.Name
+		if step.PersistentID != "" {
+			name += ":" + step.PersistentID[:7]
+		}
+		statuses = append(statuses, name+"="+step.Status)
+	}
+	return statuses
+}
+
+func (t *DiagnoseTestSuite) TestItReportsEveryStepInOrder() {
+	report := t.newPull("letmein").Diagnose(context.Background())
+
+	t.False(report.Success)
+	t.Equal("dataset-fetch", report.FailedStep)
+	t.Equal([]string{
+		"url-parse=PASSED",
+		"dns=PASSED",
+		"tcp-connect=PASSED",
+		"tls-handshake=WARNING",
+		"auth=PASSED",
+		"list-status=PASSED",
+		"list-schema=PASSED",
+		"dataset-fetch:e96e36b=PASSED",
+		"dataset-version:e96e36b=PASSED",
+		"dataset-valid:e96e36b=PASSED",
+		"dataset-fetch:missing=FAILED",
+	}, stepStatuses(report))
+	t.True(strings.Contains(report.Errors, "404"))
+}
+
+func (t *DiagnoseTestSuite) TestItStopsAtAuthFailures() {
+	report := t.newPull("wrong").Diagnose(context.Background())
+
+	t.False(report.Success)
+	t.Equal(http.StatusUnauthorized, report.Status)
+	t.Equal("auth", report.FailedStep)
+	t.Equal(pull.StepSkipped, report.Steps[len(report.Steps)-1].Status)
+}
+
+func (t *DiagnoseTestSuite) TestItRejectsUnparseableEndpoints() {
+	p := pull.NewPull(1, "not a url", "also not", "", "", "", "NO_AUTH", false, "")
+	report := p.Diagnose(context.Background())
+
+	t.Equal("url-parse", report.FailedStep)
+	t.Equal(pull.StepFailed, report.Steps[0].Status)
+}
+
+func (t *DiagnoseTestSuite) postTest(credentials string) (int, string) {
+	return t.request(http.MethodPost, "/test", t.testBody(credentials))
+}
+
+func (t *DiagnoseTestSuite) request(method, path, body string) (int, string) {
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "1")
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func (t *DiagnoseTestSuite) testBody(credentials string) string {
+	body := `{"auth_type": "BEARER", "endpoint_baseurl": "` + t.server.URL + `", "endpoint_datasets": "/api/datasets", "endpoint_dataset": "/api/datasets/{id}"`
+	if credentials != "" {
+		body += `, "credentials": ` + credentials
+	}
+	return body + `}`
+}
+
+func (t *DiagnoseTestSuite) TestItTestsWithInlineCredentials() {
+	for _, credentials := range []string{`{"bearer_token": "letmein"}`, `"{\"bearer_token\": \"letmein\"}"`} {
+		code, body := t.postTest(credentials)
+
+		t.Equal(http.StatusOK, code)
+		t.Contains(body, `"failed_step":"dataset-fetch"`)
+		t.NotContains(body, "letmein")
+	}
+}
+
+func (t *DiagnoseTestSuite) TestItNeedsCredentialsForAuthenticatedEndpoints() {
+	code, body := t.postTest("")
+	t.Equal(http.StatusBadRequest, code)
+	t.Contains(body, "missing credentials")
+
+	code, body = t.postTest(`{"api_key": "letmein"}`)
+	t.Equal(http.StatusBadRequest, code)
+	t.Contains(body, "bearer_token")
+}
+
+func (t *DiagnoseTestSuite) TestItRunsTestsAsBackgroundJobs() {
+	code, body := t.request(http.MethodPost, "/test?async=true", t.testBody(`{"bearer_token": "letmein"}`))
+	t.Equal(http.StatusAccepted, code)
+
+	var job testjob.Job
+	t.Nil(json.Unmarshal([]byte(body), &job))
+	t.Equal(testjob.StatusRunning, job.Status)
+
+	t.Eventually(func() bool {
+		_, body := t.request(http.MethodGet, "/test/"+job.ID, "")
+		json.Unmarshal([]byte(body), &job)
+		return job.Status == testjob.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Equal(2, job.Progress.DatasetsTotal)
+	t.Equal(2, job.Progress.DatasetsDone)
+	t.Equal("dataset-fetch", job.Result.FailedStep)
+
+	code, body = t.request(http.MethodGet, "/test/"+job.ID+"/events", "")
+	t.Equal(http.StatusOK, code)
+	t.Equal(len(job.Steps), strings.Count(body, "event:step"))
+	t.True(strings.HasSuffix(strings.TrimSpace(body), "}"))
+	t.Contains(body, "event:result")
+
+	code, _ = t.request(http.MethodGet, "/test/unknown", "")
+	t.Equal(http.StatusNotFound, code)
+}
+
+func (t *DiagnoseTestSuite) TestItStopsWhenOutOfTime() {
+	p := pull.NewPull(1, t.server.URL+"/api/stuck", t.server.URL+"/api/datasets/{id}", "", "", "", "NO_AUTH", false, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report := p.Diagnose(ctx)
+
+	t.Equal("auth", report.FailedStep)
+	t.Equal(http.StatusGatewayTimeout, report.Status)
+	t.Contains(stepStatuses(report), "interrupted=FAILED")
+	t.Contains(stepStatuses(report), "list-status=SKIPPED")
+}
+
+func (t *DiagnoseTestSuite) TestItCancelsBackgroundJobs() {
+	body := `{"auth_type": "NO_AUTH", "endpoint_baseurl": "` + t.server.URL + `", "endpoint_datasets": "/api/stuck", "endpoint_dataset": "/api/datasets/{id}"}`
+	code, response := t.request(http.MethodPost, "/test?async=true", body)
+	t.Equal(http.StatusAccepted, code)
+
+	var job testjob.Job
+	t.Nil(json.Unmarshal([]byte(response), &job))
+
+	code, _ = t.request(http.MethodDelete, "/test/"+job.ID, "")
+	t.Equal(http.StatusAccepted, code)
+
+	t.Eventually(func() bool {
+		_, response := t.request(http.MethodGet, "/test/"+job.ID, "")
+		json.Unmarshal([]byte(response), &job)
+		return job.Status == testjob.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.False(job.Result.Success)
+	t.Contains(stepStatuses(*job.Result), "interrupted=FAILED")
+
+	code, _ = t.request(http.MethodDelete, "/test/"+job.ID, "")
+	t.Equal(http.StatusConflict, code)
+}
+
+func (t *DiagnoseTestSuite) TestItCapsBackgroundJobsPerPrincipal() {
+	t.T().Setenv("GMI_TEST_JOBS_PER_PRINCIPAL", "1")
+
+	body := `{"auth_type": "NO_AUTH", "endpoint_baseurl": "` + t.server.URL + `", "endpoint_datasets": "/api/stuck", "endpoint_dataset": "/api/datasets/{id}"}`
+	code, response := t.request(http.MethodPost, "/test?async=true", body)
+	t.Equal(http.StatusAccepted, code)
+
+	var job testjob.Job
+	t.Nil(json.Unmarshal([]byte(response), &job))
+
+	code, response = t.request(http.MethodPost, "/test?async=true", body)
+	t.Equal(http.StatusTooManyRequests, code)
+	t.Contains(response, "at most 1 may run at once")
+
+	// a finished job no longer counts
+	t.request(http.MethodDelete, "/test/"+job.ID, "")
+	t.Eventually(func() bool {
+		_, response := t.request(http.MethodGet, "/test/"+job.ID, "")
+		json.Unmarshal([]byte(response), &job)
+		return job.Status == testjob.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+
+	code, response = t.request(http.MethodPost, "/test?async=true", body)
+	t.Equal(http.StatusAccepted, code)
+	t.Nil(json.Unmarshal([]byte(response), &job))
+	t.request(http.MethodDelete, "/test/"+job.ID, "")
+}
+
+func TestDiagnoseTestSuite(t *testing.T) {
+	suite.Run(t, new(DiagnoseTestSuite))
+}
@@ -0,0 +1,182 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hdruk/federated-metadata/pkg/gateway"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type GatewayTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	client *gateway.Client
+
+	logins      atomic.Int32
+	token       atomic.Value
+	received    atomic.Value
+	idempotency atomic.Value
+}
+
+func (t *GatewayTestSuite) SetupTest() {
+	t.logins.Store(0)
+	t.token.Store("first")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["email"] != "svc@example.com" || login["password"] != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		t.logins.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": t.token.Load().(string)})
+	})
+	mux.HandleFunc("/api/federations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message": "boom"}`))
+		case http.MethodPost:
+			// tokens issued before a rotation are refused
+			if r.Header.Get("Authorization") != "Bearer second" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var body gateway.DatasetRequest
+			json.NewDecoder(r.Body).Decode(&body)
+			t.received.Store(body)
+			t.idempotency.Store(r.Header.Get("Idempotency-Key"))
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("team_id") {
+		case "1":
+			w.Write([]byte(`[]`))
+		case "2":
+			w.Write([]byte(`{"a": {"versions": ["1.0.0", "2.0.0"]}}`))
+		default:
+			w.Write([]byte(`not json`))
+		}
+	})
+	mux.HandleFunc("/api/datasets/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	t.server = httptest.NewServer(mux)
+
+	t.client = &gateway.Client{
+		BaseURL:  t.server.URL + "/api",
+		AuthURL:  t.server.URL + "/auth",
+		Email:    "svc@example.com",
+		Password: "pw",
+	}
+}
+
+func (t *GatewayTestSuite) TearDownTest() {
+	t.server.Close()
+}
+
+func (t *GatewayTestSuite) TestItMapsStatusesToErrors() {
+	_, err := t.client.ListFederations(context.Background(), "")
+	t.ErrorIs(err, gateway.ErrUnavailable)
+
+	var gatewayErr *gateway.Error
+	t.True(errors.As(err, &gatewayErr))
+	t.Equal(http.StatusInternalServerError, gatewayErr.StatusCode)
+	t.Contains(err.Error(), "boom")
+
+	_, err = t.client.GetDataset(context.Background(), "missing", "")
+	t.ErrorIs(err, gateway.ErrNotFound)
+	t.NotErrorIs(err, gateway.ErrUnavailable)
+}
+
+func (t *GatewayTestSuite) TestItReportsUndecodableResponses() {
+	_, err := t.client.ListTeamDatasets(context.Background(), 3, "")
+	t.ErrorIs(err, gateway.ErrInvalidResponse)
+}
+
+func (t *GatewayTestSuite) TestItListsTeamDatasets() {
+	datasets, err := t.client.ListTeamDatasets(context.Background(), 1, "")
+	t.Nil(err)
+	t.Empty(datasets)
+
+	datasets, err = t.client.ListTeamDatasets(context.Background(), 2, "")
+	t.Nil(err)
+	t.Equal([]string{"1.0.0", "2.0.0"}, datasets["a"].Versions)
+}
+
+func (t *GatewayTestSuite) TestItLogsInAgainWhenTheTokenIsRefused() {
+	// every token the gateway issues is refused, so the client logs in
+	// once more then gives up
+	err := t.client.CreateDataset(context.Background(), gateway.NewDatasetRequest(7, "pid-1", `{}`), "")
+	t.ErrorIs(err, gateway.ErrUnauthorised)
+	t.Equal(int32(2), t.logins.Load())
+
+	t.token.Store("second")
+	err = t.client.CreateDataset(context.Background(), gateway.NewDatasetRequest(7, "pid-1", `{}`), "")
+	t.Nil(err)
+	t.Equal(int32(3), t.logins.Load())
+
+	body := t.received.Load().(gateway.DatasetRequest)
+	t.Equal("7", body.TeamID)
+	t.Equal("pid-1", body.PersistentID)
+	t.Equal("GMI", body.CreateOrigin)
+
+	// the accepted token is kept for later calls
+	t.Nil(t.client.CreateDataset(context.Background(), gateway.NewDatasetRequest(7, "pid-2", `{}`), ""))
+	t.Equal(int32(3), t.logins.Load())
+}
+
+func (t *GatewayTestSuite) TestItSendsIdempotencyKeys() {
+	t.token.Store("second")
+
+	ctx := gateway.WithIdempotencyKey(context.Background(), "key-1")
+	t.Nil(t.client.CreateDataset(ctx, gateway.NewDatasetRequest(7, "pid-1", `{}`), ""))
+	t.Equal("key-1", t.idempotency.Load())
+
+	t.Nil(t.client.CreateDataset(context.Background(), gateway.NewDatasetRequest(7, "pid-1", `{}`), ""))
+	t.Equal("", t.idempotency.Load())
+}
+
+func (t *GatewayTestSuite) TestItRefusesToWriteWithoutCredentials() {
+	client := &gateway.Client{BaseURL: t.server.URL + "/api", AuthURL: t.server.URL + "/auth", Email: "svc@example.com", Password: "wrong"}
+
+	err := client.DeleteDataset(context.Background(), 1, "pid-1", "")
+	t.ErrorIs(err, gateway.ErrUnauthorised)
+}
+
+func (t *GatewayTestSuite) TestItPingsWithoutLoggingIn() {
+	t.ErrorIs(t.client.Ping(context.Background(), ""), gateway.ErrUnavailable)
+
+	// anything short of a server error means the API is serving
+	client := &gateway.Client{BaseURL: t.server.URL + "/api/datasets"}
+	t.Nil(client.Ping(context.Background(), ""))
+	t.Equal(int32(0), t.logins.Load())
+
+	t.T().Setenv("GATEWAY_API_URL", "")
+	t.ErrorContains((&gateway.Client{}).Ping(context.Background(), ""), "GATEWAY_API_URL is not set")
+}
+
+func (t *GatewayTestSuite) TestTheFakeRecordsWrites() {
+	fake := gateway.NewFake()
+	fake.Errors["DeleteDataset"] = gateway.ErrConflict
+
+	t.Nil(fake.CreateDataset(context.Background(), gateway.NewDatasetRequest(4, "a", `{"version": "1.0.0"}`), ""))
+	datasets, _ := fake.ListTeamDatasets(context.Background(), 4, "")
+	t.Equal([]string{"1.0.0"}, datasets["a"].Versions)
+
+	t.ErrorIs(fake.DeleteDataset(context.Background(), 4, "a", ""), gateway.ErrConflict)
+	t.Empty(fake.Deleted)
+}
+
+func TestGatewayTestSuite(t *testing.T) {
+	suite.Run(t, new(GatewayTestSuite))
+}
@@ -0,0 +1,84 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hdruk/federated-metadata/pkg/health"
+	"hdruk/federated-metadata/pkg/push"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+	checks []health.Check
+}
+
+func (t *HealthTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	t.checks = health.Checks
+}
+
+func (t *HealthTestSuite) TearDownTest() {
+	health.Checks = t.checks
+}
+
+func (t *HealthTestSuite) get(path string) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec.Code, body
+}
+
+func (t *HealthTestSuite) TestLivenessNeverChecksDependencies() {
+	health.Checks = []health.Check{
+		{Name: "broken", Check: func(ctx context.Context) error { return errors.New("down") }},
+	}
+
+	code, body := t.get("/healthz")
+	t.Equal(http.StatusOK, code)
+	t.Equal(health.Version, body["version"])
+}
+
+func (t *HealthTestSuite) TestReadinessReportsEachDependency() {
+	health.Checks = []health.Check{
+		{Name: "up", Check: func(ctx context.Context) error { return nil }},
+		{Name: "down", Check: func(ctx context.Context) error { return errors.New("connection refused") }},
+	}
+
+	code, body := t.get("/readyz")
+	t.Equal(http.StatusServiceUnavailable, code)
+	t.Equal(false, body["success"])
+	t.Equal("down: connection refused", body["errors"])
+
+	deps := body["dependencies"].([]interface{})
+	t.Equal("UP", deps[0].(map[string]interface{})["status"])
+	t.Equal("DOWN", deps[1].(map[string]interface{})["status"])
+}
+
+func (t *HealthTestSuite) TestReadinessTimesOutSlowDependencies() {
+	t.T().Setenv("GMI_READINESS_TIMEOUT_SECONDS", "1")
+
+	ready, statuses := health.Ready(context.Background(), []health.Check{
+		{Name: "slow", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}},
+	})
+
+	t.False(ready)
+	t.Contains(statuses[0].Error, "timed out")
+}
+
+func TestHealthTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
@@ -0,0 +1,107 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LimitsTestSuite struct {
+	CustodianSuite
+}
+
+func (t *LimitsTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"query": {"page": [1, {"of": 1}]}, "items": [
+			{"persistentId": "` + teamsPid + `", "version": "1.0.0"},
+			{"persistentId": "huge", "version": "1.0.0"}
+		]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/"+teamsPid, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+	// a dataset sent without a length, so only reading it finds the size
+	t.mux.HandleFunc("/api/datasets/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"padding": "`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("x", 1<<16) + `"}`))
+	})
+	// a list sent without a length, valid until it runs past the limit
+	t.mux.HandleFunc("/api/streamed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat(`{"persistentId": "a"},`, 64) + `{"persistentId": "a"}]}`))
+	})
+
+	t.T().Setenv("GMI_MAX_DATASET_BYTES", "32768")
+}
+
+func (t *LimitsTestSuite) TestItDecodesListsItemByItem() {
+	list, err := pkg.DecodeFederationResponse(strings.NewReader(`{"query": {"a": [1, [2]]}, "items": [{"persistentId": "a"}, {"persistentId": "b", "version": "2.0.0"}], "next": null}`))
+	t.Nil(err)
+	t.Len(list.Items, 2)
+	t.Equal("2.0.0", list.Items[1].Version)
+
+	list, err = pkg.DecodeFederationResponse(strings.NewReader(`{"items": null}`))
+	t.Nil(err)
+	t.Empty(list.Items)
+
+	_, err = pkg.DecodeFederationResponse(strings.NewReader(`{"items": {"persistentId": "a"}}`))
+	t.ErrorContains(err, "items must be an array")
+
+	_, err = pkg.DecodeFederationResponse(strings.NewReader(`{"items": [{"persistentId": 1}]}`))
+	t.ErrorContains(err, "item 0")
+
+	_, err = pkg.DecodeFederationResponse(strings.NewReader(`{"items": []} {}`))
+	t.Error(err)
+}
+
+func (t *LimitsTestSuite) TestItRefusesListsOverTheLimit() {
+	t.T().Setenv("GMI_MAX_LIST_BYTES", "64")
+	fed := t.federation(9210)
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	_, err = p.CallForList(context.Background())
+	t.ErrorIs(err, pull.ErrBodyTooLarge)
+	t.ErrorContains(err, "declared, limit is 64")
+}
+
+func (t *LimitsTestSuite) TestItStopsDecodingListsAtTheLimit() {
+	t.T().Setenv("GMI_MAX_LIST_BYTES", "256")
+	fed := t.federation(9230)
+	fed.EndpointDatasets = "/api/streamed"
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	_, err = p.CallForList(context.Background())
+	t.ErrorIs(err, pull.ErrBodyTooLarge)
+	t.ErrorContains(err, "more than 256 bytes")
+}
+
+func (t *LimitsTestSuite) TestAnOversizedDatasetDoesNotStopTheRest() {
+	t.fake.Federations = []pkg.Federation{*t.federation(9220)}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9220)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Len(run.Datasets, 2)
+	t.Equal(report.ActionCreated, run.Datasets[0].Action)
+	t.Equal(report.ActionInvalid, run.Datasets[1].Action)
+	t.Contains(run.Datasets[1].Message, pull.ErrBodyTooLarge.Error())
+	t.Len(t.fake.Created, 1)
+}
+
+func TestLimitsTestSuite(t *testing.T) {
+	suite.Run(t, new(LimitsTestSuite))
+}
@@ -0,0 +1,84 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/metrics"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+}
+
+func (t *MetricsTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	t.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gateway/datasets" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+}
+
+func (t *MetricsTestSuite) TearDownTest() {
+	t.server.Close()
+}
+
+func (t *MetricsTestSuite) TestItTimesCustodianCallsPerFederation() {
+	p := pull.NewPull(4242, t.server.URL+"/list", t.server.URL+"/{id}", "", "", "", "NO_AUTH", false, "")
+
+	_, err := p.Fetch(context.Background(), t.server.URL+"/list")
+	t.Nil(err)
+
+	t.Contains(t.scrape(), `gmi_custodian_request_duration_seconds_count{code="200",federation="4242"} 1`)
+}
+
+func (t *MetricsTestSuite) TestItCountsGatewayErrors() {
+	client := &gateway.Client{BaseURL: t.server.URL + "/gateway"}
+	before := testutil.ToFloat64(metrics.GatewayAPIErrors.WithLabelValues("GET", "datasets", "500"))
+
+	_, err := client.ListTeamDatasets(context.Background(), 1, "")
+	t.ErrorIs(err, gateway.ErrUnavailable)
+
+	t.Equal(before+1, testutil.ToFloat64(metrics.GatewayAPIErrors.WithLabelValues("GET", "datasets", "500")))
+}
+
+func (t *MetricsTestSuite) TestItRecordsCycleOutcomes() {
+	run := report.NewFederationRun(4343, "metrics-cycle")
+	run.AddDataset(report.DatasetOutcome{PersistentID: "a", Action: report.ActionCreated})
+	run.AddDataset(report.DatasetOutcome{PersistentID: "b", Action: report.ActionInvalid})
+	run.Finish(nil)
+
+	cycle := report.NewCycle("metrics-cycle")
+	cycle.Finish(nil)
+	metrics.ObserveCycle(*cycle, report.FederationRuns("metrics-cycle"))
+
+	t.Equal(1.0, testutil.ToFloat64(metrics.LastCycleSuccess))
+	t.Equal(1.0, testutil.ToFloat64(metrics.FederationSyncs.WithLabelValues("4343", report.StatusSucceeded)))
+	t.Equal(1.0, testutil.ToFloat64(metrics.Datasets.WithLabelValues("4343", "created")))
+	t.Equal(1.0, testutil.ToFloat64(metrics.ValidationFailures.WithLabelValues("4343", "dataset")))
+}
+
+func (t *MetricsTestSuite) scrape() string {
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	t.Equal(http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
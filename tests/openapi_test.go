@@ -0,0 +1,91 @@
+package pull
+
+import (
+	"encoding/json"
+	"hdruk/federated-metadata/pkg/openapi"
+	"hdruk/federated-metadata/pkg/push"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type OpenAPITestSuite struct {
+	suite.Suite
+	router *gin.Engine
+}
+
+func (t *OpenAPITestSuite) SetupTest() {
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "1")
+	gin.SetMode(gin.TestMode)
+	t.router = push.NewRouter()
+}
+
+func (t *OpenAPITestSuite) call(method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	t.router.ServeHTTP(rec, req)
+
+	var decoded map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &decoded)
+	return rec.Code, decoded
+}
+
+func (t *OpenAPITestSuite) TestEveryRouteIsDocumented() {
+	for _, route := range t.router.Routes() {
+		t.True(openapi.HasOperation(route.Method, route.Path), "%s %s is not in openapi.json", route.Method, route.Path)
+	}
+}
+
+func (t *OpenAPITestSuite) TestItServesTheDocument() {
+	code, body := t.call(http.MethodGet, "/openapi.json", "")
+
+	t.Equal(http.StatusOK, code)
+	t.Equal("3.0.3", body["openapi"])
+}
+
+func (t *OpenAPITestSuite) TestItRejectsBodiesThatDontMatchTheSpec() {
+	code, body := t.call(http.MethodPost, "/federation", `{"path": "projects/1", "secret_id": "abc", "payload": "{}", "team_id": "eighteen"}`)
+
+	t.Equal(http.StatusBadRequest, code)
+	t.Equal(false, body["success"])
+	t.Equal("request does not match the api specification", body["title"])
+	t.Len(body["details"], 1)
+	t.Contains(body["errors"], "team_id")
+}
+
+func (t *OpenAPITestSuite) TestItRejectsParametersThatDontMatchTheSpec() {
+	code, body := t.call(http.MethodGet, "/federation/abc/quality", "")
+	t.Equal(http.StatusBadRequest, code)
+	t.Contains(body["errors"], "id")
+
+	code, body = t.call(http.MethodGet, "/federation/secrets", "")
+	t.Equal(http.StatusBadRequest, code)
+	t.Contains(body["errors"], "team_id: query parameter is required")
+}
+
+func (t *OpenAPITestSuite) TestItRejectsBodiesOverTheLimit() {
+	t.T().Setenv("GMI_MAX_REQUEST_BYTES", "64")
+
+	code, body := t.call(http.MethodPost, "/validate", `{"document": {"padding": "`+strings.Repeat("x", 64)+`"}}`)
+
+	t.Equal(http.StatusRequestEntityTooLarge, code)
+	t.Equal("request body too large", body["title"])
+}
+
+func (t *OpenAPITestSuite) TestUnknownRoutesUseTheErrorEnvelope() {
+	code, body := t.call(http.MethodGet, "/nowhere", "")
+
+	t.Equal(http.StatusNotFound, code)
+	t.Equal(float64(http.StatusNotFound), body["status"])
+	t.Equal(false, body["success"])
+}
+
+func TestOpenAPITestSuite(t *testing.T) {
+	suite.Run(t, new(OpenAPITestSuite))
+}
@@ -0,0 +1,280 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/contenthash"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/outbox"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OutboxTestSuite struct {
+	CustodianSuite
+	path string
+}
+
+func (t *OutboxTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{"persistentId": "` + teamsPid + `", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/"+teamsPid, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+
+	t.path = filepath.Join(t.T().TempDir(), "outbox.json")
+
+	t.T().Setenv("GMI_OUTBOX_BACKOFF_SECONDS", "0")
+}
+
+func (t *OutboxTestSuite) store() *outbox.Store {
+	s, err := outbox.NewStore(t.path)
+	t.Nil(err)
+	return s
+}
+
+func (t *OutboxTestSuite) write(teamId int, pid string) outbox.Entry {
+	req := gateway.NewDatasetRequest(teamId, pid, `{"version": "1.0.0"}`)
+	return outbox.NewWrite(outbox.OpCreate, 1, req, "sha256:"+pid)
+}
+
+func (t *OutboxTestSuite) TestItKeysWritesByWhatTheySend() {
+	t.Equal(outbox.Key(outbox.OpCreate, 1, "a", "sha256:1"), outbox.Key(outbox.OpCreate, 1, "a", "sha256:1"))
+	t.NotEqual(outbox.Key(outbox.OpCreate, 1, "a", "sha256:1"), outbox.Key(outbox.OpCreate, 1, "a", "sha256:2"))
+	t.NotEqual(outbox.Key(outbox.OpCreate, 1, "a", ""), outbox.Key(outbox.OpDelete, 1, "a", ""))
+
+	t.T().Setenv("GMI_OUTBOX_BACKOFF_SECONDS", "")
+	t.Equal(30*time.Second, outbox.Backoff(1))
+	t.T().Setenv("GMI_OUTBOX_BACKOFF_SECONDS", "10")
+	t.Equal(40*time.Second, outbox.Backoff(3))
+	t.Equal(time.Hour, outbox.Backoff(30))
+}
+
+func (t *OutboxTestSuite) TestItKeepsFailedWritesAcrossRestarts() {
+	t.fake.Errors["CreateDataset"] = gateway.ErrUnavailable
+
+	s := t.store()
+	err := s.Deliver(context.Background(), t.write(9510, "a"), "")
+	t.ErrorIs(err, gateway.ErrUnavailable)
+	t.ErrorContains(err, "queued for retry")
+	t.Len(s.List(outbox.StatusPending), 1)
+
+	// a new process picks up where the last one stopped
+	delete(t.fake.Errors, "CreateDataset")
+	restarted := t.store()
+	t.Len(restarted.List(outbox.StatusPending), 1)
+
+	t.Equal(1, restarted.RetryDue(context.Background(), ""))
+	t.Len(t.fake.Created, 1)
+	t.Empty(restarted.List(""))
+	t.Empty(t.store().List(""))
+
+	hash, ok := contenthash.Default.Get(9510, "a")
+	t.True(ok)
+	t.Equal("sha256:a", hash)
+}
+
+func (t *OutboxTestSuite) TestItMovesRepeatedFailuresToDeadLetters() {
+	t.T().Setenv("GMI_OUTBOX_MAX_ATTEMPTS", "2")
+	t.fake.Errors["DeleteDataset"] = gateway.ErrUnauthorised
+
+	s := t.store()
+	err := s.Deliver(context.Background(), outbox.NewDelete(1, 9520, "a"), "")
+	t.ErrorContains(err, "queued for retry")
+
+	t.Equal(0, s.RetryDue(context.Background(), ""))
+	dead := s.List(outbox.StatusDead)
+	t.Len(dead, 1)
+	t.Equal(2, dead[0].Attempts)
+	t.Contains(dead[0].LastError, gateway.ErrUnauthorised.Error())
+
+	// dead letters wait for an operator
+	t.Equal(0, s.RetryDue(context.Background(), ""))
+
+	delete(t.fake.Errors, "DeleteDataset")
+	entry, err := s.Replay(context.Background(), dead[0].ID, "")
+	t.Nil(err)
+	t.Equal(outbox.StatusDelivered, entry.Status)
+	t.Equal([]string{"a"}, t.fake.Deleted)
+	t.Empty(s.List(""))
+
+	_, err = s.Replay(context.Background(), dead[0].ID, "")
+	t.ErrorIs(err, outbox.ErrNotFound)
+}
+
+func (t *OutboxTestSuite) TestItDoesNotRetryRejectedWrites() {
+	t.fake.Errors["CreateDataset"] = gateway.ErrRejected
+
+	s := t.store()
+	err := s.Deliver(context.Background(), t.write(9530, "a"), "")
+	t.ErrorContains(err, "dead letters")
+	t.Len(s.List(outbox.StatusDead), 1)
+
+	_, err = s.Replay(context.Background(), "unknown", "")
+	t.ErrorIs(err, outbox.ErrNotFound)
+}
+
+func (t *OutboxTestSuite) TestRepeatingALandedWriteIsSafe() {
+	s := t.store()
+
+	// the create reached the gateway but its response was lost
+	t.fake.Errors["CreateDataset"] = gateway.ErrConflict
+	t.Nil(s.Deliver(context.Background(), t.write(9540, "a"), ""))
+	t.Len(t.fake.Updated, 1)
+
+	t.fake.Errors["DeleteDataset"] = gateway.ErrNotFound
+	t.Nil(s.Deliver(context.Background(), outbox.NewDelete(1, 9540, "a"), ""))
+	t.Empty(s.List(""))
+}
+
+func (t *OutboxTestSuite) TestANewerWriteReplacesOneWaiting() {
+	t.fake.Errors["CreateDataset"] = gateway.ErrUnavailable
+	t.fake.Errors["DeleteDataset"] = gateway.ErrUnavailable
+
+	s := t.store()
+	s.Deliver(context.Background(), t.write(9550, "a"), "")
+	s.Deliver(context.Background(), t.write(9550, "b"), "")
+	s.Deliver(context.Background(), outbox.NewDelete(1, 9550, "a"), "")
+
+	entries := s.List("")
+	t.Len(entries, 2)
+	t.Equal(outbox.OpCreate, entries[0].Op)
+	t.Equal("b", entries[0].PersistentID)
+	t.Nil(entries[0].Request)
+	t.Equal(outbox.OpDelete, entries[1].Op)
+
+	full, ok := s.Get(entries[0].ID)
+	t.True(ok)
+	t.Equal("b", full.Request.PersistentID)
+}
+
+func (t *OutboxTestSuite) TestItJournalsChangesAndSurvivesATornWrite() {
+	t.fake.Errors["CreateDataset"] = gateway.ErrUnavailable
+
+	s := t.store()
+	for i := 0; i < 3; i++ {
+		s.Deliver(context.Background(), t.write(9540, "a"), "")
+		s.RetryDue(context.Background(), "")
+	}
+	s.Deliver(context.Background(), t.write(9540, "b"), "")
+
+	// each change is a line of its own, the last left half written
+	data, err := os.ReadFile(t.path)
+	t.Nil(err)
+	t.Greater(strings.Count(string(data), "\n"), 2)
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	t.Nil(err)
+	file.Write([]byte(`{"key": "torn`))
+	file.Close()
+
+	restarted := t.store()
+	t.Len(restarted.List(outbox.StatusPending), 2)
+
+	// opening compacts it to the entries still held
+	data, err = os.ReadFile(t.path)
+	t.Nil(err)
+	t.Equal(2, strings.Count(string(data), "\n"))
+	t.NotContains(string(data), "torn")
+}
+
+func (t *OutboxTestSuite) TestItKeepsTheOutboxInTheStateDirectory() {
+	t.T().Setenv("GMI_OUTBOX_PATH", "")
+	t.T().Setenv("GMI_STATE_DIR", "")
+	t.Equal("", outbox.Path())
+
+	dir := t.T().TempDir()
+	t.T().Setenv("GMI_STATE_DIR", dir)
+	t.Equal(filepath.Join(dir, "outbox.log"), outbox.Path())
+
+	t.T().Setenv("GMI_OUTBOX_PATH", t.path)
+	t.Equal(t.path, outbox.Path())
+}
+
+func (t *OutboxTestSuite) TestAPullCycleQueuesWritesTheGatewayMissed() {
+	t.fake.Errors["CreateDataset"] = gateway.ErrUnavailable
+	t.fake.Federations = []pkg.Federation{{
+		ID:               9560,
+		AuthType:         "NO_AUTH",
+		EndpointBaseURL:  t.server.URL,
+		EndpointDatasets: "/api/datasets",
+		EndpointDataset:  "/api/datasets/{id}",
+		RunTimeHour:      time.Now().UTC().Hour(),
+		RunTimeMinute:    "0",
+		Enabled:          true,
+		Team:             []pkg.Team{{ID: 9560}},
+	}}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9560)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Equal(report.ActionQueued, run.Datasets[0].Action)
+	t.Contains(run.Datasets[0].Message, "queued for retry")
+	_, ok = contenthash.Default.Get(9560, teamsPid)
+	t.False(ok)
+
+	delete(t.fake.Errors, "CreateDataset")
+	outbox.Default.RetryDue(context.Background(), "")
+	t.Len(t.fake.Created, 1)
+	_, ok = contenthash.Default.Get(9560, teamsPid)
+	t.True(ok)
+}
+
+func (t *OutboxTestSuite) TestOperatorsCanReplayDeadLetters() {
+	t.fake.Errors["DeleteDataset"] = gateway.ErrRejected
+	outbox.Default.Deliver(context.Background(), outbox.NewDelete(1, 9570, "a"), "")
+	id := outbox.NewDelete(1, 9570, "a").ID
+
+	code, body := t.request(http.MethodGet, "/outbox?status=dead")
+	t.Equal(http.StatusOK, code)
+	var listed struct {
+		Entries []outbox.Entry `json:"entries"`
+	}
+	t.Nil(json.Unmarshal([]byte(body), &listed))
+	t.Len(listed.Entries, 1)
+	t.Equal(id, listed.Entries[0].ID)
+
+	code, _ = t.request(http.MethodGet, "/outbox/"+id)
+	t.Equal(http.StatusOK, code)
+
+	code, body = t.request(http.MethodPost, "/outbox/"+id+"/replay")
+	t.Equal(http.StatusOK, code)
+	t.Contains(body, `"status":"DEAD"`)
+
+	delete(t.fake.Errors, "DeleteDataset")
+	code, body = t.request(http.MethodPost, "/outbox/"+id+"/replay")
+	t.Equal(http.StatusOK, code)
+	t.Contains(body, `"status":"DELIVERED"`)
+
+	code, _ = t.request(http.MethodPost, "/outbox/"+id+"/replay")
+	t.Equal(http.StatusNotFound, code)
+}
+
+func (t *OutboxTestSuite) request(method, path string) (int, string) {
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "1")
+
+	req := httptest.NewRequest(method, path, strings.NewReader(""))
+	rec := httptest.NewRecorder()
+	push.NewRouter().ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestOutboxTestSuite(t *testing.T) {
+	suite.Run(t, new(OutboxTestSuite))
+}
@@ -221,7 +221,7 @@ func (t *PullTestSuite) TestCallForList() {
 }
 
 func (t *PullTestSuite) TestItCanValidateAgainstOurSchema() {
-	verdict, err := validator.ValidateSchema(jsonStringList, "")
+	verdict, err := validator.ValidateSchema([]byte(jsonStringList), "")
 	t.Nil(err)
 
 	t.Equal(true, verdict)
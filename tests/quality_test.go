@@ -0,0 +1,95 @@
+package pull
+
+import (
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/quality"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type QualityTestSuite struct {
+	suite.Suite
+}
+
+func (t *QualityTestSuite) TestItScoresTheFixture() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	score := quality.ScoreDataset(&dataset)
+
+	t.Equal("e96e36ba-30ca-4c25-bc55-fab02d72a51c", score.PersistentID)
+	t.Equal(90.91, score.Completeness)
+	t.Equal(31.6, score.Richness)
+	t.Equal([]string{"coverage.spatial", "documentation.description", "structuralMetadata"}, score.Missing)
+}
+
+func (t *QualityTestSuite) TestItRewardsDescribedStructuralMetadata() {
+	description := "Patient identifier"
+	dataset := pkg.FederationDataset{
+		StructuralMetadata: []pkg.StructuralMetadata{
+			{
+				Name: "patients",
+				Elements: []pkg.DataElement{
+					{Name: "id", Description: &description},
+					{Name: "dob"},
+				},
+			},
+		},
+	}
+
+	score := quality.ScoreDataset(&dataset)
+
+	for _, c := range score.Criteria {
+		if c.Name == "structural-metadata" {
+			t.Equal(0.75, c.Score)
+		}
+	}
+	t.NotContains(score.Missing, "structuralMetadata")
+}
+
+func (t *QualityTestSuite) TestAFullyDescribedDatasetScoresHighly() {
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	description := "Patient identifier"
+	dataset.Summary.Abstract = strings.Repeat("A long and useful abstract. ", 10)
+	dataset.Summary.Keywords = pkg.MultiString{Values: []string{"a", "b", "c", "d", "e"}, Array: true}
+	dataset.Coverage.Spatial = pkg.NewMultiString("United Kingdom")
+	dataset.Documentation.Description = "Documented"
+	dataset.StructuralMetadata = []pkg.StructuralMetadata{
+		{Name: "patients", Elements: []pkg.DataElement{{Name: "id", Description: &description}}},
+	}
+
+	score := quality.ScoreDataset(&dataset)
+
+	t.Equal(float64(100), score.Overall)
+	t.Empty(score.Missing)
+}
+
+func (t *QualityTestSuite) TestOnlyTheFederationsTeamsCanSeeItsScores() {
+	t.T().Setenv("JWT_SECRET", "test-secret")
+	t.T().Setenv("JWKS_URL", "")
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "")
+	gin.SetMode(gin.TestMode)
+
+	fake := gateway.NewFake()
+	fake.Federations = []pkg.Federation{{ID: 9720, Team: []pkg.Team{{ID: 9721}}}}
+	api := gateway.Default
+	gateway.Default = fake
+	defer func() { gateway.Default = api }()
+
+	t.Equal(http.StatusForbidden, getAs("/federation/9720/quality", 9722).Code)
+	t.Equal(http.StatusForbidden, getAs("/federation/9729/quality", 9722).Code)
+
+	// a member gets past authorisation to find nothing has run yet
+	t.Equal(http.StatusNotFound, getAs("/federation/9720/quality", 9721).Code)
+}
+
+func TestQualityTestSuite(t *testing.T) {
+	suite.Run(t, new(QualityTestSuite))
+}
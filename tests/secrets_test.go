@@ -0,0 +1,67 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg/routes"
+	"hdruk/federated-metadata/pkg/secrets"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type SecretsTestSuite struct {
+	suite.Suite
+}
+
+func (t *SecretsTestSuite) TestItListsOnlyPopulatedPayloadFields() {
+	fields := secrets.PayloadFields([]byte(`{"client_secret":"s3cret","client_id":"abc","api_key":""}`))
+
+	t.Equal([]string{"client_id", "client_secret"}, fields)
+	t.Equal("API_KEY", secrets.InferAuthType(fields))
+}
+
+func (t *SecretsTestSuite) TestItInfersAuthTypeFromFields() {
+	t.Equal("BEARER", secrets.InferAuthType(secrets.PayloadFields([]byte(`{"bearer_token":"xyz"}`))))
+	t.Equal("NO_AUTH", secrets.InferAuthType(secrets.PayloadFields([]byte(`{}`))))
+	t.Equal("UNKNOWN", secrets.InferAuthType([]string{"password"}))
+}
+
+func (t *SecretsTestSuite) TestItAnnotatesWhatAPayloadHolds() {
+	annotations := secrets.PayloadAnnotations([]byte(`{"client_secret":"s3cret","client_id":"abc"}`))
+
+	t.Equal(map[string]string{
+		"gmi-auth-type": "API_KEY",
+		"gmi-fields":    "client_id,client_secret",
+	}, annotations)
+	t.NotContains(annotations["gmi-fields"], "s3cret")
+}
+
+func (t *SecretsTestSuite) TestOtherTeamsCantTellTheirSecretsFromMissingOnes() {
+	t.T().Setenv("JWT_SECRET", "test-secret")
+	t.T().Setenv("JWKS_URL", "")
+	t.T().Setenv("PUSH_API_AUTH_DISABLED", "")
+	gin.SetMode(gin.TestMode)
+
+	lookup := routes.LookupSecretMetadata
+	defer func() { routes.LookupSecretMetadata = lookup }()
+	routes.LookupSecretMetadata = func(ctx context.Context, secretID string) (secrets.SecretMetadata, error) {
+		if secretID == "theirs" {
+			return secrets.SecretMetadata{SecretID: secretID, Exists: true, TeamID: "9710", Fields: []string{}}, nil
+		}
+		return secrets.SecretMetadata{SecretID: secretID, Fields: []string{}}, nil
+	}
+
+	theirs := getAs("/federation/secrets/theirs", 9700)
+	missing := getAs("/federation/secrets/missing", 9700)
+	t.Equal(http.StatusNotFound, theirs.Code)
+	t.Equal(missing.Code, theirs.Code)
+	t.JSONEq(missing.Body.String(), theirs.Body.String())
+
+	t.Equal(http.StatusOK, getAs("/federation/secrets/theirs", 9710).Code)
+}
+
+func TestSecretsTestSuite(t *testing.T) {
+	suite.Run(t, new(SecretsTestSuite))
+}
@@ -0,0 +1,174 @@
+package pull
+
+import (
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/validator"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SemanticTestSuite struct {
+	suite.Suite
+}
+
+func (t *SemanticTestSuite) testInput() *validator.SemanticInput {
+	var list pkg.FederationResponse
+	err := json.Unmarshal([]byte(jsonStringList), &list)
+	t.Nil(err)
+
+	dataset, err := pkg.DecodeFederationDataset([]byte(jsonStringDataset))
+	t.Nil(err)
+
+	return &validator.SemanticInput{
+		Item:       list.Items[0],
+		Dataset:    &dataset,
+		DatasetUri: "http://example-url.com/api/datasets/{id}",
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func findingsFor(findings []validator.SemanticFinding, rule string) []validator.SemanticFinding {
+	var ret []validator.SemanticFinding
+	for _, f := range findings {
+		if f.Rule == rule {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+func (t *SemanticTestSuite) TestItPassesAConsistentDataset() {
+	in := t.testInput()
+	in.Item.Version = "1.0.0"
+
+	findings := validator.ValidateSemantics(in, "")
+
+	t.Empty(findings)
+	t.False(validator.HasSemanticErrors(findings))
+}
+
+func (t *SemanticTestSuite) TestItReportsVersionMismatchAsError() {
+	findings := validator.ValidateSemantics(t.testInput(), "")
+
+	mismatch := findingsFor(findings, "version-matches-list")
+	t.Len(mismatch, 1)
+	t.Equal(validator.SeverityError, mismatch[0].Severity)
+	t.True(validator.HasSemanticErrors(findings))
+}
+
+func (t *SemanticTestSuite) TestItReportsIdentifierMismatch() {
+	in := t.testInput()
+	in.Item.Version = "1.0.0"
+	in.Item.PersistentID = "another-pid"
+	in.Item.Self = ""
+
+	findings := validator.ValidateSemantics(in, "")
+
+	t.Len(findingsFor(findings, "identifier-matches-list"), 1)
+}
+
+func (t *SemanticTestSuite) TestItWarnsOnNonSemverVersions() {
+	in := t.testInput()
+	in.Item.Version = "v1.0"
+	in.Dataset.Version = "v1.0"
+
+	findings := validator.ValidateSemantics(in, "")
+
+	semver := findingsFor(findings, "version-is-semver")
+	t.Len(semver, 1)
+	t.Equal(validator.SeverityWarning, semver[0].Severity)
+	t.Empty(findingsFor(findings, "version-matches-list"))
+	t.False(validator.HasSemanticErrors(findings))
+}
+
+func (t *SemanticTestSuite) TestItWarnsWhenModifiedIsBeforeIssued() {
+	in := t.testInput()
+	in.Item.Version = "1.0.0"
+	in.Dataset.Modified = "2020-01-01T00:00:00+00:00"
+
+	findings := validator.ValidateSemantics(in, "")
+
+	modified := findingsFor(findings, "modified-after-issued")
+	t.Len(modified, 1)
+	t.Equal(validator.SeverityWarning, modified[0].Severity)
+	t.False(validator.HasSemanticErrors(findings))
+}
+
+func (t *SemanticTestSuite) TestItWarnsOnUnknownRevisionVersions() {
+	in := t.testInput()
+	in.Item.Version = "1.0.0"
+	in.Dataset.Revisions = []pkg.Revisions{
+		{Version: stringPtr("0.9.0")},
+		{Version: stringPtr("latest")},
+		{Version: stringPtr("2.0.0")},
+	}
+
+	findings := validator.ValidateSemantics(in, "")
+
+	t.Len(findingsFor(findings, "revisions-known-versions"), 2)
+}
+
+func (t *SemanticTestSuite) TestItWarnsWhenSelfDoesNotResolve() {
+	in := t.testInput()
+	in.Item.Version = "1.0.0"
+	in.DatasetUri = "http://example-url.com/api/v1/datasets/{id}"
+
+	findings := validator.ValidateSemantics(in, "")
+
+	t.Len(findingsFor(findings, "self-resolves-to-dataset"), 1)
+}
+
+func (t *SemanticTestSuite) TestItRejectsSchemasOutsideTheAllowedPrefixes() {
+	fetched := 0
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte(`{"type": "object"}`))
+	}))
+	defer internal.Close()
+
+	t.T().Setenv("GMI_DATASET_SCHEMA_VALIDATION_URL", "")
+
+	for _, schemaUrl := range []string{
+		"file:///etc/passwd",
+		"http://169.254.169.254/latest/meta-data/",
+		internal.URL + "/schema.json",
+		"https://raw.githubusercontent.com/HDRUK/../someone-else/schema.json",
+		"https://example.com/HDRUK/schema.json",
+	} {
+		var document map[string]interface{}
+		t.Nil(json.Unmarshal([]byte(jsonStringDataset), &document))
+		document["@schema"] = schemaUrl
+		body, err := json.Marshal(document)
+		t.Nil(err)
+
+		report := validator.ValidateDatasetDocument(body, nil, "", "")
+
+		t.False(report.Valid, schemaUrl)
+		t.False(report.Schema.Valid, schemaUrl)
+		t.False(report.Schema.Skipped, schemaUrl)
+		t.Len(report.Schema.Errors, 1, schemaUrl)
+		t.Contains(report.Schema.Errors[0], validator.ErrSchemaNotAllowed.Error(), schemaUrl)
+	}
+	t.Equal(0, fetched)
+}
+
+func (t *SemanticTestSuite) TestItAllowsSchemasUnderTheConfiguredPrefixes() {
+	t.T().Setenv("GMI_SCHEMA_ALLOWED_PREFIXES", "https://schemas.example.com/gmi/, https://raw.githubusercontent.com/HDRUK/")
+
+	t.Nil(validator.SchemaUrlAllowed("https://schemas.example.com/gmi/dataset.schema.json"))
+	t.Nil(validator.SchemaUrlAllowed("https://raw.githubusercontent.com/HDRUK/schemata-2/master/schema.json"))
+	t.ErrorIs(validator.SchemaUrlAllowed("https://schemas.example.com/other/dataset.schema.json"), validator.ErrSchemaNotAllowed)
+	t.ErrorIs(validator.SchemaUrlAllowed("http://schemas.example.com/gmi/dataset.schema.json"), validator.ErrSchemaNotAllowed)
+	t.ErrorIs(validator.SchemaUrlAllowed("https://user@schemas.example.com/gmi/dataset.schema.json"), validator.ErrSchemaNotAllowed)
+}
+
+func TestSemanticTestSuite(t *testing.T) {
+	suite.Run(t, new(SemanticTestSuite))
+}
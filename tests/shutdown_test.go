@@ -0,0 +1,115 @@
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hdruk/federated-metadata/pkg/gateway"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ShutdownTestSuite struct {
+	CustodianSuite
+	gatewayCalls atomic.Int32
+	datasetCalls atomic.Int32
+}
+
+func (t *ShutdownTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.gatewayCalls.Store(0)
+	t.datasetCalls.Store(0)
+
+	t.mux.HandleFunc("/gateway/federations", func(w http.ResponseWriter, r *http.Request) {
+		t.gatewayCalls.Add(1)
+		fmt.Fprintf(w, `[{
+			"id": 7070,
+			"pid": "shutdown",
+			"auth_type": "NO_AUTH",
+			"endpoint_baseurl": "%s",
+			"endpoint_datasets": "/api/datasets",
+			"endpoint_dataset": "/api/datasets/{id}",
+			"run_time_hour": %d,
+			"run_time_minute": "0",
+			"enabled": true,
+			"team": [{"id": 1}]
+		}]`, "http://"+r.Host, time.Now().UTC().Hour())
+	})
+	t.mux.HandleFunc("/gateway/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		// the shutdown deadline passes while the list is being fetched
+		pull.Abort()
+		w.Write([]byte(`{"items": [{"persistentId": "e96e36ba-30ca-4c25-bc55-fab02d72a51c", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		t.datasetCalls.Add(1)
+		w.Write([]byte(jsonStringDataset))
+	})
+
+	// this suite drives the real client against the server's gateway
+	t.T().Setenv("GATEWAY_API_URL", t.server.URL+"/gateway")
+	gateway.Default = t.gateway
+}
+
+func (t *ShutdownTestSuite) TearDownTest() {
+	pull.Resume()
+	t.CustodianSuite.TearDownTest()
+}
+
+func (t *ShutdownTestSuite) TestItRecordsInterruptedRuns() {
+	run := report.NewFederationRun(7071, "shutdown-report")
+	run.Finish(fmt.Errorf("stopping: %w", report.ErrInterrupted))
+
+	latest, ok := report.LatestFederationRun(7071)
+	t.True(ok)
+	t.Equal(report.StatusInterrupted, latest.Status)
+
+	run = report.NewFederationRun(7071, "shutdown-report")
+	run.Finish(errors.New("boom"))
+
+	latest, _ = report.LatestFederationRun(7071)
+	t.Equal(report.StatusFailed, latest.Status)
+}
+
+func (t *ShutdownTestSuite) TestItDoesNotStartCyclesWhileDraining() {
+	pull.Drain()
+	pull.Run(context.Background())
+
+	t.Equal(int32(0), t.gatewayCalls.Load())
+	t.True(pull.Wait(context.Background()))
+}
+
+func (t *ShutdownTestSuite) TestItInterruptsTheRunningFederationOnAbort() {
+	pull.Run(context.Background())
+
+	t.Equal(int32(1), t.gatewayCalls.Load())
+	t.Equal(int32(0), t.datasetCalls.Load())
+
+	run, ok := report.LatestFederationRun(7070)
+	t.True(ok)
+	t.Equal(report.StatusInterrupted, run.Status)
+
+	cycle, ok := report.LatestCycle()
+	t.True(ok)
+	t.Equal(report.StatusInterrupted, cycle.Status)
+}
+
+func (t *ShutdownTestSuite) TestShutdownTimeoutDefault() {
+	t.Equal(25*time.Second, pull.ShutdownTimeout())
+
+	t.T().Setenv("GMI_SHUTDOWN_TIMEOUT_SECONDS", "5")
+	t.Equal(5*time.Second, pull.ShutdownTimeout())
+}
+
+func TestShutdownTestSuite(t *testing.T) {
+	suite.Run(t, new(ShutdownTestSuite))
+}
@@ -0,0 +1,208 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/validator"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const teamsPid = "e96e36ba-30ca-4c25-bc55-fab02d72a51c"
+
+// ourDatasetSchema is the @schema jsonStringDataset names
+const ourDatasetSchema = "https://raw.githubusercontent.com/HDRUK/schemata/master/schema/dataset/2.1.0/dataset.schema.json"
+
+type TeamsTestSuite struct {
+	CustodianSuite
+}
+
+func (t *TeamsTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.mux.HandleFunc("/strict-schema.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"type": "object", "required": ["notInTheFixture"]}`))
+	})
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{"persistentId": "` + teamsPid + `", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+}
+
+func (t *TeamsTestSuite) federation(id int, teams []int, rules ...pkg.TeamRule) *pkg.Federation {
+	fed := t.CustodianSuite.federation(id)
+	fed.TeamRules = rules
+	fed.Team = nil
+	for _, team := range teams {
+		fed.Team = append(fed.Team, pkg.Team{ID: team})
+	}
+	return fed
+}
+
+func (t *TeamsTestSuite) sync(fed *pkg.Federation) []report.DatasetOutcome {
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+	return pull.SyncDatasets(context.Background(), p, fed, []string{teamsPid}, false)
+}
+
+func (t *TeamsTestSuite) TestItChecksTheTeamConfig() {
+	_, err := pull.TeamIDs(t.federation(9000, nil))
+	t.ErrorIs(err, pull.ErrNoTeams)
+
+	_, err = pull.TeamIDs(t.federation(9000, []int{1}, pkg.TeamRule{TeamID: 2, Publisher: "Bones"}))
+	t.ErrorIs(err, pull.ErrInvalidTeamRules)
+
+	_, err = pull.TeamIDs(t.federation(9000, []int{1}, pkg.TeamRule{TeamID: 1}))
+	t.ErrorIs(err, pull.ErrInvalidTeamRules)
+
+	ids, err := pull.TeamIDs(t.federation(9000, []int{3, 1}, pkg.TeamRule{TeamID: 1, MemberOf: "ALLIANCE"}))
+	t.Nil(err)
+	t.Equal([]int{3, 1}, ids)
+}
+
+func (t *TeamsTestSuite) TestItReportsFederationsWithoutTeams() {
+	t.fake.Federations = []pkg.Federation{*t.federation(9010, nil), *t.federation(9011, []int{9011})}
+
+	pull.Run(context.Background())
+
+	broken, ok := report.LatestFederationRun(9010)
+	t.True(ok)
+	t.Equal(report.StatusFailed, broken.Status)
+	t.Contains(broken.Error, "invalid federation config: federation has no team")
+	t.Empty(t.fake.Disabled)
+
+	// the misconfigured federation doesn't hold up the others
+	synced, ok := report.LatestFederationRun(9011)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, synced.Status)
+	t.Len(t.fake.Created, 1)
+}
+
+func (t *TeamsTestSuite) TestItMapsDatasetsToTeamsByPublisher() {
+	fed := t.federation(9020, []int{9021, 9022}, pkg.TeamRule{TeamID: 9022, Publisher: " bones ", MemberOf: "alliance"})
+
+	outcomes := t.sync(fed)
+
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.Equal(9022, outcomes[0].TeamID)
+	t.Equal("9022", t.fake.Created[0].TeamID)
+}
+
+func (t *TeamsTestSuite) TestPidRulesComeBeforeThePayload() {
+	fed := t.federation(9030, []int{9031, 9032, 9033},
+		pkg.TeamRule{TeamID: 9032, MemberOf: "ALLIANCE"},
+		pkg.TeamRule{TeamID: 9033, PersistentIDs: []string{teamsPid}},
+	)
+
+	outcomes := t.sync(fed)
+
+	t.Equal(9033, outcomes[0].TeamID)
+	t.Equal("9033", t.fake.Created[0].TeamID)
+}
+
+func (t *TeamsTestSuite) TestUnmatchedDatasetsGoToTheFirstTeam() {
+	fed := t.federation(9040, []int{9041, 9042}, pkg.TeamRule{TeamID: 9042, Publisher: "Someone else"})
+
+	outcomes := t.sync(fed)
+
+	t.Equal(9041, outcomes[0].TeamID)
+}
+
+func (t *TeamsTestSuite) TestItReconcilesEachTeam() {
+	t.fake.Datasets[9051] = pkg.DatasetsVersions{
+		teamsPid: {Versions: []string{"1.0.0"}},
+		"gone-a": {Versions: []string{"1.0.0"}},
+	}
+	t.fake.Datasets[9052] = pkg.DatasetsVersions{"gone-b": {Versions: []string{"1.0.0"}}}
+	fed := t.federation(9050, []int{9051, 9052}, pkg.TeamRule{TeamID: 9052, MemberOf: "ALLIANCE"})
+	fed.DeleteAfterRuns = 1
+	t.fake.Federations = []pkg.Federation{*fed}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9050)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+
+	// each team loses what the federation no longer lists, and the
+	// dataset now belonging to the second team moves there
+	t.ElementsMatch([]string{"gone-a", "gone-b", teamsPid}, t.fake.Deleted)
+	t.Len(t.fake.Created, 1)
+	t.Equal("9052", t.fake.Created[0].TeamID)
+	t.Empty(t.fake.Datasets[9051])
+	t.Contains(t.fake.Datasets[9052], teamsPid)
+
+	moved := run.Datasets[len(run.Datasets)-1]
+	t.Equal(report.ActionDeleted, moved.Action)
+	t.Equal(9051, moved.TeamID)
+	t.Equal("moved to team 9052", moved.Message)
+}
+
+func (t *TeamsTestSuite) TestWithdrawalsReachEveryTeam() {
+	t.fake.Datasets[9061] = pkg.DatasetsVersions{"withdrawn": {Versions: []string{"1.0.0"}}}
+	t.fake.Datasets[9062] = pkg.DatasetsVersions{"withdrawn": {Versions: []string{"1.0.0"}}}
+	fed := t.federation(9060, []int{9061, 9062})
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"withdrawn"}, true)
+
+	t.Len(outcomes, 2)
+	t.Equal(9061, outcomes[0].TeamID)
+	t.Equal(9062, outcomes[1].TeamID)
+	t.Len(t.fake.Deleted, 2)
+}
+
+func (t *TeamsTestSuite) TestItSkipsDatasetsFailingTheSchema() {
+	t.T().Setenv("GMI_DATASET_SCHEMA_VALIDATION_URL", t.server.URL+"/strict-schema.json")
+
+	outcomes := t.sync(t.federation(9070, []int{9070}))
+
+	t.Equal(report.ActionInvalid, outcomes[0].Action)
+	t.Contains(outcomes[0].Message, "failed schema validation")
+	t.Contains(outcomes[0].Message, "notInTheFixture")
+	t.Empty(t.fake.Created)
+}
+
+func (t *TeamsTestSuite) TestItNeverFetchesTheSchemaADatasetNames() {
+	fetched := 0
+	t.mux.HandleFunc("/own-schema.json", func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte(`{"type": "object", "required": ["notInTheFixture"]}`))
+	})
+	t.mux.HandleFunc("/own/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Replace(jsonStringDataset, ourDatasetSchema, t.server.URL+"/own-schema.json", 1)))
+	})
+	t.T().Setenv("GMI_DATASET_SCHEMA_VALIDATION_URL", "")
+	fed := t.federation(9080, []int{9080})
+	fed.EndpointDataset = "/own/{id}"
+
+	outcomes := t.sync(fed)
+
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.Equal(0, fetched)
+}
+
+func (t *TeamsTestSuite) TestItChecksThePinnedSchema() {
+	t.T().Setenv("GMI_SCHEMA_ALLOWED_PREFIXES", "https://schemas.example.com/")
+
+	fed := t.federation(9090, []int{9090})
+	fed.DatasetSchemaURL = t.server.URL + "/strict-schema.json"
+
+	outcomes := t.sync(fed)
+
+	t.Equal(report.ActionInvalid, outcomes[0].Action)
+	t.Contains(outcomes[0].Message, validator.ErrSchemaNotAllowed.Error())
+	t.Empty(t.fake.Created)
+}
+
+func TestTeamsTestSuite(t *testing.T) {
+	suite.Run(t, new(TeamsTestSuite))
+}
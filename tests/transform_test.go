@@ -0,0 +1,109 @@
+package pull
+
+import (
+	"encoding/json"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/transform"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TransformTestSuite struct {
+	suite.Suite
+}
+
+var jsonStringAlmostCompliant = `{
+	"identifier":"e96e36ba-30ca-4c25-bc55-fab02d72a51c",
+	"version":"1.0.0",
+	"summary":{
+		"name":"Bones Dataset",
+		"keywords":"bones, Blood,, skeleton",
+		"publisher":"Bones"
+	}
+}`
+
+func (t *TransformTestSuite) apply(rules []pkg.TransformRule) (map[string]interface{}, transform.Result) {
+	result, err := transform.Apply([]byte(jsonStringAlmostCompliant), rules)
+	t.Nil(err)
+
+	var doc map[string]interface{}
+	t.Nil(json.Unmarshal(result.After, &doc))
+	return doc, result
+}
+
+func (t *TransformTestSuite) TestItRenamesKeysInPlace() {
+	doc, _ := t.apply([]pkg.TransformRule{
+		{Op: transform.OpRename, From: "summary.name", To: "title"},
+	})
+
+	summary := doc["summary"].(map[string]interface{})
+	t.Equal("Bones Dataset", summary["title"])
+	t.NotContains(summary, "name")
+}
+
+func (t *TransformTestSuite) TestItMovesValuesBeneathTheirOwnPath() {
+	doc, _ := t.apply([]pkg.TransformRule{
+		{Op: transform.OpMove, From: "summary.publisher", To: "summary.publisher.name"},
+	})
+
+	publisher := doc["summary"].(map[string]interface{})["publisher"].(map[string]interface{})
+	t.Equal("Bones", publisher["name"])
+}
+
+func (t *TransformTestSuite) TestItSplitsCommaSeparatedStrings() {
+	doc, _ := t.apply([]pkg.TransformRule{
+		{Op: transform.OpSplit, From: "summary.keywords"},
+	})
+
+	t.Equal([]interface{}{"bones", "Blood", "skeleton"}, doc["summary"].(map[string]interface{})["keywords"])
+}
+
+func (t *TransformTestSuite) TestItOnlyDefaultsMissingValues() {
+	doc, result := t.apply([]pkg.TransformRule{
+		{Op: transform.OpDefault, To: "version", Value: "9.9.9"},
+		{Op: transform.OpDefault, To: "accessibility.access.jurisdiction", Value: "GB-ENG"},
+		{Op: transform.OpConstant, To: "summary.publisher", Value: "HDR UK"},
+	})
+
+	t.Equal("1.0.0", doc["version"])
+	t.Equal("GB-ENG", doc["accessibility"].(map[string]interface{})["access"].(map[string]interface{})["jurisdiction"])
+	t.Equal("HDR UK", doc["summary"].(map[string]interface{})["publisher"])
+
+	t.False(result.Changes[0].Applied)
+	t.True(result.Changes[1].Applied)
+	t.True(result.Changes[2].Applied)
+}
+
+func (t *TransformTestSuite) TestItRecordsMissingSourcesAsNotApplied() {
+	_, result := t.apply([]pkg.TransformRule{
+		{Op: transform.OpRename, From: "summary.missing", To: "title"},
+	})
+
+	t.False(result.Changes[0].Applied)
+	t.Equal("summary.missing not found", result.Changes[0].Reason)
+}
+
+func (t *TransformTestSuite) TestItRejectsInvalidRules() {
+	t.NotNil(transform.ValidateRules([]pkg.TransformRule{{Op: "explode", From: "summary"}}))
+	t.NotNil(transform.ValidateRules([]pkg.TransformRule{{Op: transform.OpRename, From: "summary.name", To: "summary.title"}}))
+	t.NotNil(transform.ValidateRules([]pkg.TransformRule{{Op: transform.OpConstant, To: "version"}}))
+}
+
+func (t *TransformTestSuite) TestTransformedDocumentsDecodeIntoTheTypedModel() {
+	_, result := t.apply([]pkg.TransformRule{
+		{Op: transform.OpRename, From: "summary.name", To: "title"},
+		{Op: transform.OpMove, From: "summary.publisher", To: "summary.publisher.name"},
+		{Op: transform.OpSplit, From: "summary.keywords"},
+	})
+
+	dataset, err := pkg.DecodeFederationDataset(result.After)
+	t.Nil(err)
+	t.Equal("Bones Dataset", dataset.Summary.Title)
+	t.Equal("Bones", dataset.Summary.Publisher.Name)
+	t.Equal([]string{"bones", "Blood", "skeleton"}, dataset.Summary.Keywords.Values)
+}
+
+func TestTransformTestSuite(t *testing.T) {
+	suite.Run(t, new(TransformTestSuite))
+}
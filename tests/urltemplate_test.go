@@ -0,0 +1,193 @@
+package pull
+
+import (
+	"context"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/urltemplate"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type URLTemplateTestSuite struct {
+	CustodianSuite
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (t *URLTemplateTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.requested = nil
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [
+			{"persistentId": "` + teamsPid + `", "version": "1.0.0", "self": "/api/records/` + teamsPid + `"}
+		]}`))
+	})
+	t.mux.HandleFunc("/api/foreign", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [
+			{"persistentId": "` + teamsPid + `", "version": "1.0.0", "self": "https://elsewhere.example/api/records/` + teamsPid + `"}
+		]}`))
+	})
+	// records every dataset url as the custodian sees it
+	t.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			uri += "?" + r.URL.RawQuery
+		}
+		t.mu.Lock()
+		t.requested = append(t.requested, uri)
+		t.mu.Unlock()
+		w.Write([]byte(jsonStringDataset))
+	})
+}
+
+func (t *URLTemplateTestSuite) federation(id int, endpoint string) *pkg.Federation {
+	fed := t.CustodianSuite.federation(id)
+	fed.EndpointDataset = endpoint
+	return fed
+}
+
+func (t *URLTemplateTestSuite) TestItExpandsEveryOperator() {
+	values := map[string]string{
+		"id":      "a b/c",
+		"version": "1.0.0",
+		"self":    "https://example.org/d?x=1&y=%20",
+	}
+
+	for template, expected := range map[string]string{
+		"/datasets/{id}":        "/datasets/a%20b%2Fc",
+		"{+self}":               "https://example.org/d?x=1&y=%20",
+		"/d{#id}":               "/d#a%20b/c",
+		"/d/file{.version}":     "/d/file.1.0.0",
+		"/d{/id,version}":       "/d/a%20b%2Fc/1.0.0",
+		"/d{;version}":          "/d;version=1.0.0",
+		"/d{?id,version}":       "/d?id=a%20b%2Fc&version=1.0.0",
+		"/d?all=1{&version}":    "/d?all=1&version=1.0.0",
+		"/d/{id}/v/{version}":   "/d/a%20b%2Fc/v/1.0.0",
+		"/d/{missing}{?absent}": "/d/",
+	} {
+		tmpl, err := urltemplate.Parse(template, "id", "version", "self", "missing", "absent")
+		t.Nil(err, template)
+		t.Equal(expected, tmpl.Expand(values), template)
+	}
+}
+
+func (t *URLTemplateTestSuite) TestItRejectsBadTemplates() {
+	for template, problem := range map[string]string{
+		"/d/{id":      "unclosed expression",
+		"/d/id}":      "unexpected }",
+		"/d/{}":       "empty expression",
+		"/d/{=id}":    "operator = is reserved",
+		"/d/{id:3}":   "modifiers are not supported",
+		"/d/{ids}":    `unknown variable "ids"`,
+		"/d/{{id}}":   "unclosed expression",
+		"/d/{id,pid}": `unknown variable "pid"`,
+	} {
+		_, err := pull.ParseDatasetTemplate(template)
+		t.ErrorContains(err, problem, template)
+	}
+
+	tmpl, err := pull.ParseDatasetTemplate("/d/{version}{?id}")
+	t.Nil(err)
+	t.Equal([]string{"version"}, tmpl.Required())
+	t.False(tmpl.Uses("self"))
+}
+
+func (t *URLTemplateTestSuite) TestItEscapesIdsInDatasetUrls() {
+	fed := t.federation(9410, "/api/datasets/{id}{?version}")
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	// a webhook knows no version, so it is left out of the query
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"doi:10.1/a b"}, false)
+
+	t.Len(outcomes, 1)
+	t.Equal([]string{"/api/datasets/doi%3A10.1%2Fa%20b"}, t.requested)
+}
+
+func (t *URLTemplateTestSuite) TestItFollowsSelfLinks() {
+	t.fake.Federations = []pkg.Federation{*t.federation(9420, "{+self}?format=json")}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9420)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Len(t.fake.Created, 1)
+	t.Equal([]string{"/api/records/" + teamsPid + "?format=json"}, t.requested)
+}
+
+func (t *URLTemplateTestSuite) TestItFetchesVersionedDatasetsFromTheList() {
+	t.fake.Federations = []pkg.Federation{*t.federation(9430, "/api/datasets/{id}/versions/{version}")}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9430)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Equal([]string{"/api/datasets/" + teamsPid + "/versions/1.0.0"}, t.requested)
+}
+
+func (t *URLTemplateTestSuite) TestAWebhookTakesTheVersionFromTheList() {
+	fed := t.federation(9440, "/api/datasets/{id}/versions/{version}")
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{teamsPid}, false)
+
+	t.Len(outcomes, 1)
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.Equal([]string{"/api/datasets/" + teamsPid + "/versions/1.0.0"}, t.requested)
+}
+
+func (t *URLTemplateTestSuite) TestAWebhookCannotFillAVersionedEndpointForAnUnlistedDataset() {
+	fed := t.federation(9460, "/api/datasets/{id}/versions/{version}")
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"unlisted"}, false)
+
+	t.Len(outcomes, 1)
+	t.Equal(report.ActionInvalid, outcomes[0].Action)
+	t.Contains(outcomes[0].Message, "{version}")
+	t.Contains(outcomes[0].Message, "isn't in the custodian's list")
+	t.Empty(t.requested)
+	t.Empty(t.fake.Created)
+}
+
+func (t *URLTemplateTestSuite) TestItOnlyFollowsSelfLinksOnTheFederationsHost() {
+	fed := t.federation(9470, "{+self}")
+	fed.EndpointDatasets = "/api/foreign"
+	t.fake.Federations = []pkg.Federation{*fed}
+
+	pull.Run(context.Background())
+
+	run, ok := report.LatestFederationRun(9470)
+	t.True(ok)
+	t.Equal(report.StatusSucceeded, run.Status)
+	t.Equal(report.ActionInvalid, run.Datasets[0].Action)
+	t.Contains(run.Datasets[0].Message, pull.ErrUntrustedSelf.Error())
+	t.Empty(t.requested)
+	t.Empty(t.fake.Created)
+}
+
+func (t *URLTemplateTestSuite) TestItRejectsBadTemplatesBeforePulling() {
+	_, err := pull.NewFederationPull(context.Background(), t.federation(9450, "/api/datasets/{pid}"), "")
+	t.ErrorContains(err, "invalid federation config")
+
+	p := pull.NewPull(9450, t.server.URL+"/api/datasets", t.server.URL+"/api/datasets/{pid}", "", "", "", "NO_AUTH", false, "")
+	diagnosis := p.Diagnose(context.Background())
+	t.Equal("url-parse", diagnosis.FailedStep)
+	t.Contains(diagnosis.Steps[0].Message, `unknown variable "pid"`)
+}
+
+func TestURLTemplateTestSuite(t *testing.T) {
+	suite.Run(t, new(URLTemplateTestSuite))
+}
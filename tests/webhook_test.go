@@ -0,0 +1,364 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hdruk/federated-metadata/pkg"
+	"hdruk/federated-metadata/pkg/pull"
+	"hdruk/federated-metadata/pkg/push"
+	"hdruk/federated-metadata/pkg/report"
+	"hdruk/federated-metadata/pkg/webhook"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+const webhookSecret = "s3cret"
+
+type WebhookTestSuite struct {
+	suite.Suite
+	router  *gin.Engine
+	synced  chan webhook.Task
+	release chan struct{}
+
+	lookupFederation func(context.Context, int, string) (pkg.Federation, bool, error)
+	lookupSecret     func(context.Context, pkg.Federation) (string, error)
+	queue            *webhook.Queue
+	limits           *webhook.Limiter
+	lookups          int
+}
+
+// webhooksStarted and webhooksSent give every notification the tests
+// send its own timestamp, as the replay guard outlives each test
+var (
+	webhooksStarted = time.Now()
+	webhooksSent    int
+)
+
+func (t *WebhookTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	t.router = push.NewRouter()
+	t.synced = make(chan webhook.Task, 10)
+	t.release = make(chan struct{})
+
+	t.lookupFederation, t.lookupSecret, t.queue, t.limits = webhook.LookupFederation, webhook.LookupSecret, webhook.Default, webhook.Limits
+	t.lookups = 0
+
+	webhook.LookupFederation = func(ctx context.Context, id int, sessionId string) (pkg.Federation, bool, error) {
+		t.lookups++
+		if id != 5151 {
+			return pkg.Federation{}, false, nil
+		}
+		return pkg.Federation{ID: id, PID: "webhook-fed", Team: []pkg.Team{{ID: 1}}}, true, nil
+	}
+	webhook.LookupSecret = func(ctx context.Context, fed pkg.Federation) (string, error) {
+		return webhookSecret, nil
+	}
+	synced, release := t.synced, t.release
+	webhook.Limits = webhook.NewLimiter(100)
+	webhook.Default = webhook.NewQueue(10, func(ctx context.Context, task webhook.Task) []report.DatasetOutcome {
+		synced <- task
+		<-release
+		return []report.DatasetOutcome{}
+	})
+}
+
+func (t *WebhookTestSuite) TearDownTest() {
+	close(t.release)
+	webhook.LookupFederation, webhook.LookupSecret, webhook.Default, webhook.Limits = t.lookupFederation, t.lookupSecret, t.queue, t.limits
+}
+
+func (t *WebhookTestSuite) notify(id string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/federation/"+id+"/webhook", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	t.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// timestamp Returns a different timestamp for each notification sent, so
+// those with the same body aren't taken for replays
+func (t *WebhookTestSuite) timestamp() string {
+	webhooksSent++
+	return webhook.Timestamp(webhooksStarted.Add(-time.Duration(webhooksSent) * time.Second))
+}
+
+func (t *WebhookTestSuite) signed(body string) map[string]string {
+	timestamp := t.timestamp()
+	return map[string]string{
+		webhook.TimestampHeader: timestamp,
+		webhook.SignatureHeader: webhook.Sign(webhookSecret, timestamp, []byte(body)),
+	}
+}
+
+func (t *WebhookTestSuite) TestItQueuesSignedNotifications() {
+	body := `{"event": "updated", "persistentIds": ["a", "b", "a"]}`
+	rec := t.notify("5151", body, t.signed(body))
+
+	t.Equal(http.StatusAccepted, rec.Code)
+
+	var res map[string]interface{}
+	t.Nil(json.Unmarshal(rec.Body.Bytes(), &res))
+	t.Equal(true, res["success"])
+	t.Equal([]interface{}{"a", "b"}, res["queued"])
+	t.Equal([]interface{}{"a"}, res["duplicates"])
+
+	select {
+	case task := <-t.synced:
+		t.Equal(5151, task.Federation.ID)
+		t.False(task.Withdrawn)
+		t.Equal([]string{"a", "b"}, task.PersistentIDs)
+	case <-time.After(2 * time.Second):
+		t.Fail("sync was never run")
+	}
+}
+
+func (t *WebhookTestSuite) TestItAcceptsTheSharedSecret() {
+	rec := t.notify("5151", `{"event": "withdrawn", "persistentIds": ["a"]}`, map[string]string{
+		webhook.TimestampHeader: t.timestamp(),
+		webhook.SecretHeader:    webhookSecret,
+	})
+	t.Equal(http.StatusAccepted, rec.Code)
+
+	task := <-t.synced
+	t.True(task.Withdrawn)
+}
+
+func (t *WebhookTestSuite) TestItRejectsBadSignatures() {
+	body := `{"event": "created", "persistentIds": ["a"]}`
+
+	timestamp := t.timestamp()
+	rec := t.notify("5151", body, map[string]string{
+		webhook.TimestampHeader: timestamp,
+		webhook.SignatureHeader: webhook.Sign("wrong", timestamp, []byte(body)),
+	})
+	t.Equal(http.StatusUnauthorized, rec.Code)
+
+	// the signature covers the timestamp
+	headers := t.signed(body)
+	headers[webhook.TimestampHeader] = t.timestamp()
+	rec = t.notify("5151", body, headers)
+	t.Equal(http.StatusUnauthorized, rec.Code)
+
+	rec = t.notify("5151", body, map[string]string{webhook.TimestampHeader: t.timestamp(), webhook.SecretHeader: "wrong"})
+	t.Equal(http.StatusUnauthorized, rec.Code)
+
+	rec = t.notify("5151", body, nil)
+	t.Equal(http.StatusUnauthorized, rec.Code)
+
+	webhook.LookupSecret = func(ctx context.Context, fed pkg.Federation) (string, error) {
+		return "", errors.New("not found")
+	}
+	rec = t.notify("5151", body, t.signed(body))
+	t.Equal(http.StatusUnauthorized, rec.Code)
+
+	t.Len(t.synced, 0)
+}
+
+func (t *WebhookTestSuite) TestItRejectsStaleAndReplayedNotifications() {
+	body := `{"event": "withdrawn", "persistentIds": ["a"]}`
+
+	stale := webhook.Timestamp(time.Now().Add(-webhook.MaxAge - time.Minute))
+	rec := t.notify("5151", body, map[string]string{
+		webhook.TimestampHeader: stale,
+		webhook.SignatureHeader: webhook.Sign(webhookSecret, stale, []byte(body)),
+	})
+	t.Equal(http.StatusUnauthorized, rec.Code)
+	t.Contains(rec.Body.String(), webhook.TimestampHeader)
+
+	headers := t.signed(body)
+	t.Equal(http.StatusAccepted, t.notify("5151", body, headers).Code)
+	<-t.synced
+
+	rec = t.notify("5151", body, headers)
+	t.Equal(http.StatusConflict, rec.Code)
+	t.Len(t.synced, 0)
+}
+
+func (t *WebhookTestSuite) TestItDeduplicatesQueuedDatasets() {
+	first := `{"event": "updated", "persistentIds": ["a"]}`
+	t.Equal(http.StatusAccepted, t.notify("5151", first, t.signed(first)).Code)
+	<-t.synced // the worker is now busy syncing "a"
+
+	second := `{"event": "updated", "persistentIds": ["a", "b"]}`
+	rec := t.notify("5151", second, t.signed(second))
+	t.Equal(http.StatusAccepted, rec.Code)
+	t.Contains(rec.Body.String(), `"queued":["a","b"]`)
+
+	rec = t.notify("5151", second, t.signed(second))
+	t.Equal(http.StatusAccepted, rec.Code)
+	t.Contains(rec.Body.String(), `"queued":[]`)
+	t.Contains(rec.Body.String(), `"duplicates":["a","b"]`)
+}
+
+func (t *WebhookTestSuite) TestItRateLimitsEachFederation() {
+	webhook.Limits = webhook.NewLimiter(3)
+	body := `{"event": "updated", "persistentIds": ["a"]}`
+	for i := 0; i < 3; i++ {
+		t.Equal(http.StatusAccepted, t.notify("5151", body, t.signed(body)).Code)
+	}
+
+	rec := t.notify("5151", body, t.signed(body))
+	t.Equal(http.StatusTooManyRequests, rec.Code)
+	t.NotEmpty(rec.Header().Get("Retry-After"))
+}
+
+func (t *WebhookTestSuite) TestItRateLimitsBeforeLookingAnythingUp() {
+	webhook.Limits = webhook.NewLimiter(3)
+	body := `{"event": "updated", "persistentIds": ["a"]}`
+	for i := 0; i < 3; i++ {
+		t.Equal(http.StatusUnauthorized, t.notify("5151", body, map[string]string{webhook.TimestampHeader: t.timestamp()}).Code)
+	}
+	t.Equal(3, t.lookups)
+
+	rec := t.notify("5151", body, t.signed(body))
+	t.Equal(http.StatusTooManyRequests, rec.Code)
+	t.Equal(3, t.lookups)
+
+	// each federation is limited separately
+	t.Equal(http.StatusNotFound, t.notify("4040", body, t.signed(body)).Code)
+}
+
+func (t *WebhookTestSuite) TestItValidatesNotifications() {
+	body := `{"event": "renamed", "persistentIds": []}`
+	rec := t.notify("5151", body, t.signed(body))
+	t.Equal(http.StatusBadRequest, rec.Code)
+
+	body = `{"event": "created", "persistentIds": ["a"]}`
+	rec = t.notify("4040", body, t.signed(body))
+	t.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
+
+// SyncDatasetsTestSuite Drives a targeted sync against a fake custodian
+// and gateway
+type SyncDatasetsTestSuite struct {
+	CustodianSuite
+	title atomic.Value
+}
+
+func (t *SyncDatasetsTestSuite) SetupTest() {
+	t.CustodianSuite.SetupTest()
+
+	t.mux.HandleFunc("/api/datasets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{"persistentId": "e96e36ba-30ca-4c25-bc55-fab02d72a51c", "version": "1.0.0"}]}`))
+	})
+	t.mux.HandleFunc("/api/datasets/e96e36ba-30ca-4c25-bc55-fab02d72a51c", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonStringDataset))
+	})
+	// the same version of a dataset, whose title can be edited
+	t.title.Store("Bones Dataset")
+	t.mux.HandleFunc("/api/edited/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Replace(jsonStringDataset, `"title":"Bones Dataset"`, `"title":"`+t.title.Load().(string)+`"`, 1)))
+	})
+
+	t.fake.Datasets[1] = pkg.DatasetsVersions{"gone": {Versions: []string{"1.0.0"}}}
+}
+
+func (t *SyncDatasetsTestSuite) federation() (*pull.Pull, *pkg.Federation) {
+	fed := t.CustodianSuite.federation(5252)
+	fed.Team = []pkg.Team{{ID: 1}}
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+	return p, fed
+}
+
+func (t *SyncDatasetsTestSuite) TestItWritesJustTheNamedDatasets() {
+	p, fed := t.federation()
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"e96e36ba-30ca-4c25-bc55-fab02d72a51c", "missing"}, false)
+
+	t.Len(outcomes, 2)
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.Equal(report.ActionInvalid, outcomes[1].Action)
+	t.Len(t.fake.Created, 1)
+	t.Equal("1", t.fake.Created[0].TeamID)
+	t.Empty(t.fake.Deleted)
+}
+
+func (t *SyncDatasetsTestSuite) TestItOnlyDeletesDatasetsWeCreated() {
+	p, fed := t.federation()
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{"gone", "never-synced"}, true)
+
+	t.Len(outcomes, 2)
+	t.Equal(report.ActionDeleted, outcomes[0].Action)
+	t.Equal(report.ActionSkipped, outcomes[1].Action)
+	t.Equal([]string{"gone"}, t.fake.Deleted)
+	t.Empty(t.fake.Created)
+}
+
+func (t *SyncDatasetsTestSuite) TestItOnlyWithdrawsDatasetsGoneFromTheList() {
+	p, fed := t.federation()
+	t.fake.Datasets[1][teamsPid] = pkg.DatasetVersions{Versions: []string{"1.0.0"}}
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, []string{teamsPid}, true)
+
+	t.Len(outcomes, 1)
+	t.Equal(report.ActionSkipped, outcomes[0].Action)
+	t.Contains(outcomes[0].Message, "still in the custodian's list")
+	t.Empty(t.fake.Deleted)
+}
+
+func (t *SyncDatasetsTestSuite) editedFederation(teamId int, sameVersionEdits string) (*pull.Pull, *pkg.Federation) {
+	fed := t.CustodianSuite.federation(teamId)
+	fed.EndpointDataset = "/api/edited/{id}"
+	fed.SameVersionEdits = sameVersionEdits
+	p, err := pull.NewFederationPull(context.Background(), fed, "")
+	t.Nil(err)
+	return p, fed
+}
+
+func (t *SyncDatasetsTestSuite) TestItUpdatesEditsWithinTheSameVersion() {
+	p, fed := t.editedFederation(5353, "")
+	pid := []string{"e96e36ba-30ca-4c25-bc55-fab02d72a51c"}
+
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, pid, false)
+	t.Equal(report.ActionCreated, outcomes[0].Action)
+	t.NotEmpty(outcomes[0].ContentHash)
+	first := outcomes[0].ContentHash
+
+	// nothing changed, so nothing is written
+	outcomes = pull.SyncDatasets(context.Background(), p, fed, pid, false)
+	t.Equal(report.ActionSkipped, outcomes[0].Action)
+	t.Equal(first, outcomes[0].ContentHash)
+
+	t.title.Store("Bones Dataset, revised")
+	outcomes = pull.SyncDatasets(context.Background(), p, fed, pid, false)
+	t.Equal(report.ActionUpdated, outcomes[0].Action)
+	t.NotEqual(first, outcomes[0].ContentHash)
+	t.Contains(outcomes[0].Message, "warning: content of pid=e96e36ba-30ca-4c25-bc55-fab02d72a51c changed without a version bump from 1.0.0")
+	t.Len(t.fake.Updated, 1)
+	t.Contains(t.fake.Updated[0].Metadata, "Bones Dataset, revised")
+}
+
+func (t *SyncDatasetsTestSuite) TestFederationsCanAcceptSameVersionEdits() {
+	p, fed := t.editedFederation(5454, pkg.SameVersionEditsAccept)
+	pid := []string{"e96e36ba-30ca-4c25-bc55-fab02d72a51c"}
+
+	pull.SyncDatasets(context.Background(), p, fed, pid, false)
+
+	t.title.Store("Bones Dataset, revised")
+	outcomes := pull.SyncDatasets(context.Background(), p, fed, pid, false)
+	t.Equal(report.ActionUpdated, outcomes[0].Action)
+	t.NotContains(outcomes[0].Message, "warning")
+}
+
+func TestSyncDatasetsTestSuite(t *testing.T) {
+	suite.Run(t, new(SyncDatasetsTestSuite))
+}